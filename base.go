@@ -56,6 +56,7 @@ type Request struct {
 	id     json.RawMessage // the request ID, nil for notifications
 	method string          // the name of the method being requested
 	params json.RawMessage // method parameters
+	strict bool            // reject unknown fields in params
 }
 
 // IsNotification reports whether the request is a notification, and thus does
@@ -79,7 +80,8 @@ func (r *Request) HasParams() bool { return len(r.params) != 0 }
 // struct type. This can be overridden either by giving the type of v a custom
 // implementation of json.Unmarshaler, or implementing a DisallowUnknownFields
 // method. The jrpc2.StrictFields helper function adapts existing values to
-// this interface.
+// this interface. If the request was received by a server with the
+// StrictParams option set, unknown keys are rejected for all values of v.
 //
 // If v has type *json.RawMessage, decoding cannot fail.
 func (r *Request) UnmarshalParams(v interface{}) error {
@@ -91,20 +93,86 @@ func (r *Request) UnmarshalParams(v interface{}) error {
 		*t = json.RawMessage(string(r.params)) // copy
 		return nil
 	case strictFielder:
-		dec := json.NewDecoder(bytes.NewReader(r.params))
-		dec.DisallowUnknownFields()
-		if err := dec.Decode(v); err != nil {
-			return Errorf(code.InvalidParams, "invalid parameters: %v", err.Error())
-		}
-		return nil
+		return r.decodeStrict(v)
+	}
+	if r.strict {
+		return r.decodeStrict(v)
 	}
 	return json.Unmarshal(r.params, v)
 }
 
+// decodeStrict decodes the parameters of r into v, rejecting unknown fields.
+func (r *Request) decodeStrict(v interface{}) error {
+	if err := decodeStrict(r.params, v); err != nil {
+		return Errorf(code.InvalidParams, "invalid parameters: %v", err.Error())
+	}
+	return nil
+}
+
 // ParamString returns the encoded request parameters of r as a string.
 // If r has no parameters, it returns "".
 func (r *Request) ParamString() string { return string(r.params) }
 
+// Snapshot returns a plain representation of r, for logging and testing. The
+// parameters are decoded into generic values, as by json.Unmarshal into an
+// empty interface, except that numbers are decoded as json.Number so that
+// their values are preserved exactly. The result does not share storage with
+// r.
+func (r *Request) Snapshot() RequestInfo {
+	info := RequestInfo{ID: r.ID(), Method: r.method}
+	if len(r.params) != 0 {
+		dec := json.NewDecoder(bytes.NewReader(r.params))
+		dec.UseNumber()
+		if err := dec.Decode(&info.Params); err != nil {
+			info.Params = json.RawMessage(string(r.params)) // copy
+		}
+	}
+	return info
+}
+
+// RequestInfo is a plain representation of a Request. See Request.Snapshot.
+type RequestInfo struct {
+	ID     string      // the request ID, as reported by Request.ID
+	Method string      // the name of the method
+	Params interface{} // the parameters, or nil if there are none
+}
+
+// Request constructs a new *Request from the contents of r. It reports an
+// error if the ID is not a valid JSON string or number, or if the parameters
+// do not encode as a JSON object or array.
+func (r RequestInfo) Request() (*Request, error) {
+	req, err := NewRequest(r.Method, r.Params)
+	if err != nil {
+		return nil, err
+	}
+	if r.ID != "" {
+		id, err := checkID(json.RawMessage(r.ID))
+		if err != nil {
+			return nil, err
+		}
+		req.id = id
+	}
+	return req, nil
+}
+
+// NewRequest constructs a new notification *Request for the specified method
+// and parameters, for use in tests and proxies. The parameters are marshaled
+// as they would be by a client; if params is nil, or encodes as null, the
+// request has no parameters. To construct a request with an ID, use the
+// Request method of RequestInfo.
+func NewRequest(method string, params interface{}) (*Request, error) {
+	req := &Request{method: method}
+	if params != nil {
+		bits, err := encodeParams(params)
+		if err != nil {
+			return nil, err
+		} else if !isNull(bits) {
+			req.params = bits
+		}
+	}
+	return req, nil
+}
+
 // ErrInvalidVersion is returned by ParseRequests if one or more of the
 // requests in the input has a missing or invalid version marker.
 var ErrInvalidVersion = Errorf(code.InvalidRequest, "incorrect version marker")
@@ -176,9 +244,7 @@ func (r *Response) UnmarshalResult(v interface{}) error {
 		*t = json.RawMessage(string(r.result)) // copy
 		return nil
 	case strictFielder:
-		dec := json.NewDecoder(bytes.NewReader(r.result))
-		dec.DisallowUnknownFields()
-		return dec.Decode(v)
+		return decodeStrict(r.result, v)
 	}
 	return json.Unmarshal(r.result, v)
 }
@@ -187,14 +253,35 @@ func (r *Response) UnmarshalResult(v interface{}) error {
 // If r has no result, for example if r is an error response, it returns "".
 func (r *Response) ResultString() string { return string(r.result) }
 
-// MarshalJSON converts the response to equivalent JSON.
-func (r *Response) MarshalJSON() ([]byte, error) {
-	return json.Marshal(&jmessage{
+// MarshalJSON converts the response to equivalent JSON. If r is a successful
+// response with no result, the "result" field is omitted; use ExplicitNull to
+// encode it as null instead.
+func (r *Response) MarshalJSON() ([]byte, error) { return json.Marshal(r.toMessage()) }
+
+// ExplicitNull returns a value that marshals to JSON as r does, except that
+// if r is a successful response with no result, it is encoded with an explicit
+// "result":null field. This is for interoperation with peers that require
+// every successful response to have a result.
+func (r *Response) ExplicitNull() json.Marshaler { return explicitNull{r} }
+
+type explicitNull struct{ r *Response }
+
+func (e explicitNull) MarshalJSON() ([]byte, error) {
+	msg := e.r.toMessage()
+	if msg.E == nil && len(msg.R) == 0 {
+		msg.R = json.RawMessage("null")
+	}
+	return json.Marshal(msg)
+}
+
+// toMessage returns the transmission format of r.
+func (r *Response) toMessage() *jmessage {
+	return &jmessage{
 		V:  Version,
 		ID: json.RawMessage(r.id),
 		R:  r.result,
 		E:  r.err,
-	})
+	}
 }
 
 // wait blocks until r is complete. It is safe to call this multiple times and
@@ -243,6 +330,7 @@ func (j *jmessages) parseJSON(data []byte) error {
 	// or array.
 	var msgs []json.RawMessage
 	var batch bool
+	data = bytes.TrimLeft(data, " \t\r\n")
 	if len(data) == 0 || data[0] != '[' {
 		msgs = append(msgs, nil)
 		if err := json.Unmarshal(data, &msgs[0]); err != nil {
@@ -260,6 +348,7 @@ func (j *jmessages) parseJSON(data []byte) error {
 		req := new(jmessage)
 		req.parseJSON(raw)
 		req.batch = batch
+		req.raw = raw
 		*j = append(*j, req)
 	}
 	return nil
@@ -282,8 +371,10 @@ type jmessage struct {
 	// and R. Specifically, if M != "" then E and R must both be unset. This is
 	// checked during parsing.
 
-	batch bool  // this message was part of a batch
-	err   error // if not nil, this message is invalid and err is why
+	batch bool            // this message was part of a batch
+	raw   json.RawMessage // the encoding of this message as received
+	vraw  json.RawMessage // the encoding of the version marker, nil if absent
+	err   error           // if not nil, this message is invalid and err is why
 }
 
 func (j *jmessage) fail(code code.Code, msg string) error {
@@ -308,6 +399,7 @@ func (j *jmessage) parseJSON(data []byte) error {
 	for key, val := range obj {
 		switch key {
 		case "jsonrpc":
+			j.vraw = val
 			if json.Unmarshal(val, &j.V) != nil {
 				j.fail(code.ParseError, "invalid version key")
 			}
@@ -377,7 +469,15 @@ func encode(ch channel.Sender, rsps jmessages) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	return len(bits), ch.Send(bits)
+	return len(bits), send(ch, bits)
+}
+
+// send transmits msg on ch, and flushes ch if it buffers its output.
+func send(ch channel.Sender, msg []byte) error {
+	if err := ch.Send(msg); err != nil {
+		return err
+	}
+	return channel.Flush(ch)
 }
 
 // Network guesses a network type for the specified address.  The assignment of
@@ -454,3 +554,14 @@ func StrictFields(v interface{}) interface{} { return &strict{v: v} }
 type strict struct{ v interface{} }
 
 func (strict) DisallowUnknownFields() {}
+
+// decodeStrict decodes data into v, rejecting unknown fields. If v was wrapped
+// by StrictFields, it decodes into the wrapped value.
+func decodeStrict(data []byte, v interface{}) error {
+	if s, ok := v.(*strict); ok {
+		v = s.v
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
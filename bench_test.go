@@ -103,3 +103,37 @@ func BenchmarkParseRequests(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkWorkerPool(b *testing.B) {
+	// Compare per-request goroutines with a fixed worker pool, for a method
+	// that does no useful work, with many calls in flight at once.
+	voidService := handler.Map{
+		"void": handler.Func(func(context.Context, *jrpc2.Request) (interface{}, error) {
+			return nil, nil
+		}),
+	}
+	tests := []struct {
+		desc string
+		srv  *jrpc2.ServerOptions
+	}{
+		{"PerRequest", &jrpc2.ServerOptions{Concurrency: 8}},
+		{"Pool", &jrpc2.ServerOptions{Concurrency: 8, WorkerPool: 8}},
+	}
+	for _, test := range tests {
+		b.Run(test.desc, func(b *testing.B) {
+			loc := server.NewLocal(voidService, &server.LocalOptions{Server: test.srv})
+			defer loc.Close()
+			ctx := context.Background()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := loc.Client.Call(ctx, "void", nil); err != nil {
+						b.Errorf("Call void failed: %v", err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package jrpc2
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/yinfei8/jrpc2/code"
+)
+
+// A memBudget limits the total size of the parameters of the requests in
+// flight on a server, for the MemoryBudget option of the server. A nil
+// *memBudget imposes no limit.
+type memBudget struct {
+	max int // the maximum total size in bytes
+
+	mu   sync.Mutex
+	used int // the total size of the requests admitted and not yet released
+}
+
+func newMemBudget(max int) *memBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &memBudget{max: max}
+}
+
+// acquire reserves n bytes of the budget. It reports an error with code
+// code.Overloaded if the reservation would exceed the budget.
+func (b *memBudget) acquire(n int) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.max {
+		return Errorf(code.Overloaded, "request size %d exceeds memory budget (%d of %d bytes in use)", n, b.used, b.max)
+	}
+	b.used += n
+	return nil
+}
+
+// release returns n bytes reserved by acquire to the budget.
+func (b *memBudget) release(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	if b.used < 0 {
+		panic(fmt.Sprintf("memory budget released %d bytes more than acquired", -b.used))
+	}
+}
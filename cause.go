@@ -0,0 +1,65 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// WithCancelReason returns a context derived from ctx that records reason as
+// the reason to give the server if a call made with the context is cancelled.
+//
+// When the context governing a call ends before the call completes, the client
+// sends the reason along with the rpc.cancel notification for the call. If no
+// reason is recorded, the client uses the cause of the context as reported by
+// context.Cause, if the cause is not simply the error from ctx.Err.
+func WithCancelReason(ctx context.Context, reason string) context.Context {
+	return context.WithValue(ctx, cancelReasonKey{}, reason)
+}
+
+type cancelReasonKey struct{}
+
+// cancelReason returns the reason to send with the cancellation of a call
+// governed by ctx, or "" if there is none.
+func cancelReason(ctx context.Context) string {
+	if reason, ok := ctx.Value(cancelReasonKey{}).(string); ok && reason != "" {
+		return reason
+	}
+	if cause := contextCause(ctx); cause != nil && cause != ctx.Err() {
+		return cause.Error()
+	}
+	return ""
+}
+
+// A CancelError is the cause of the cancellation of a request that the client
+// cancelled with a reason. See CancelCause.
+type CancelError struct {
+	Reason string // the reason given by the client
+}
+
+// Error satisfies the error interface.
+func (e *CancelError) Error() string { return "cancelled by client: " + e.Reason }
+
+// CancelCause returns the cause of the cancellation of ctx, as reported by
+// context.Cause. If the client cancelled the request whose handler received
+// ctx and gave a reason, the cause has concrete type *CancelError. If the Go
+// version does not support cancellation causes (before Go 1.21), CancelCause
+// returns ctx.Err().
+func CancelCause(ctx context.Context) error { return contextCause(ctx) }
+
+// cancelInfo is the encoding of the additional member of the parameters of
+// rpc.cancel that carries the reason for the cancellation. Since this member
+// is an object, a server that does not understand it treats it as the ID of a
+// request that does not exist, and ignores it.
+type cancelInfo struct {
+	Reason string `json:"reason"`
+}
+
+// cancelParams returns the parameters of an rpc.cancel notification for the
+// given ID and reason.
+func cancelParams(id, reason string) []interface{} {
+	params := []interface{}{json.RawMessage(id)}
+	if reason != "" {
+		params = append(params, cancelInfo{Reason: reason})
+	}
+	return params
+}
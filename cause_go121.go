@@ -0,0 +1,12 @@
+//go:build go1.21
+// +build go1.21
+
+package jrpc2
+
+import "context"
+
+func withCancelCause(ctx context.Context) (context.Context, func(error)) {
+	return context.WithCancelCause(ctx)
+}
+
+func contextCause(ctx context.Context) error { return context.Cause(ctx) }
@@ -0,0 +1,15 @@
+//go:build !go1.21
+// +build !go1.21
+
+package jrpc2
+
+import "context"
+
+// withCancelCause is a substitute for context.WithCancelCause, which discards
+// the cause.
+func withCancelCause(ctx context.Context) (context.Context, func(error)) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, func(error) { cancel() }
+}
+
+func contextCause(ctx context.Context) error { return ctx.Err() }
@@ -0,0 +1,79 @@
+package channel
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// A Flusher is a channel that may buffer records passed to Send rather than
+// transmitting them immediately. Flush transmits any buffered records.
+//
+// The jrpc2 client and server flush a channel that implements Flusher after
+// each message they send. Wrappers defined by this package, such as
+// Concurrent and Checksum, forward Flush to the channel they wrap.
+type Flusher interface {
+	Flush() error
+}
+
+// Flush transmits any records buffered by ch. If ch does not implement
+// Flusher, its records are not buffered, and Flush returns nil.
+func Flush(ch Sender) error {
+	if f, ok := ch.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// Buffered returns a Framing that applies f to a buffered writer of the given
+// size in bytes, so that the writes made by f for each record are coalesced.
+// If size <= 0, a default size is used.
+//
+// Records sent on a channel constructed by the resulting framing are written
+// to the underlying writer only when the buffer fills, when the channel is
+// flushed (see Flusher), or when the channel is closed.
+func Buffered(f Framing, size int) Framing {
+	return func(r io.Reader, wc io.WriteCloser) Channel {
+		bw := &bufferedWriter{wc: wc, buf: bufio.NewWriterSize(wc, size)}
+		return buffered{Channel: f(r, bw), bw: bw}
+	}
+}
+
+type buffered struct {
+	Channel
+	bw *bufferedWriter
+}
+
+// Flush implements the Flusher interface.
+func (b buffered) Flush() error { return b.bw.Flush() }
+
+// A bufferedWriter is a buffered io.WriteCloser whose Close flushes the buffer
+// before closing the underlying writer. It is safe for concurrent use, so that
+// Close may be called while a Send is in progress.
+type bufferedWriter struct {
+	mu  sync.Mutex
+	wc  io.WriteCloser
+	buf *bufio.Writer
+}
+
+func (w *bufferedWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(data)
+}
+
+func (w *bufferedWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Flush()
+}
+
+func (w *bufferedWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ferr := w.buf.Flush()
+	if err := w.wc.Close(); err != nil {
+		return err
+	}
+	return ferr
+}
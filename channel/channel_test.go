@@ -1,12 +1,21 @@
 package channel
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/yinfei8/jrpc2/code"
 )
 
 // newPipe creates a pair of connected in-memory channels using the specified
@@ -244,3 +253,407 @@ func TestWithTrigger(t *testing.T) {
 		})
 	}
 }
+
+func TestChecksum(t *testing.T) {
+	// The checksum framing composes with length-prefixed framings.
+	for _, f := range []Framing{Varint, LSP} {
+		lhs, rhs := newPipe(Checksum(f))
+		testSendRecv(t, lhs, rhs, message1)
+		testSendRecv(t, rhs, lhs, message2)
+		testSendRecv(t, lhs, rhs, "")
+		lhs.Close()
+		rhs.Close()
+	}
+}
+
+// checksumFrame returns the complete encoding of msg in the checksum framing
+// over Varint.
+func checksumFrame(t *testing.T, msg string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	ch := Checksum(Varint)(nil, nopCloser{&buf})
+	if err := ch.Send([]byte(msg)); err != nil {
+		t.Fatalf("Send %q: unexpected error: %v", msg, err)
+	}
+	return buf.Bytes()
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// Verify that no corrupted record is delivered by the checksum framing.
+func TestChecksumCorruption(t *testing.T) {
+	frame := checksumFrame(t, message2)
+
+	// Check that an uncorrupted frame is received correctly.
+	recv := func(data []byte) ([]byte, error) {
+		return Checksum(Varint)(bytes.NewReader(data), nopCloser{ioutil.Discard}).Recv()
+	}
+	if got, err := recv(frame); err != nil || string(got) != message2 {
+		t.Fatalf("Recv: got %q, %v; want %q, nil", got, err, message2)
+	}
+
+	// Flip each bit of the frame in turn. Corruption of the payload or the
+	// checksum must be reported as ErrChecksum; corruption of the length
+	// prefix may instead cause a read error. No flip may deliver a record.
+	for i := 0; i < 8*len(frame); i++ {
+		bad := append([]byte(nil), frame...)
+		bad[i/8] ^= 1 << uint(i%8)
+		got, err := recv(bad)
+		if err == nil {
+			t.Errorf("Recv with bit %d flipped: got %q, wanted error", i, got)
+		} else if i/8 >= 1 && err != ErrChecksum {
+			t.Errorf("Recv with bit %d flipped: got error %v, want %v", i, err, ErrChecksum)
+		}
+	}
+
+	// Scribble random bytes over the payload and checksum.
+	rng := rand.New(rand.NewSource(20201207))
+	for i := 0; i < 5000; i++ {
+		bad := append([]byte(nil), frame...)
+		for n := rng.Intn(8) + 1; n > 0; n-- {
+			pos := 1 + rng.Intn(len(bad)-1)
+			old := bad[pos]
+			for bad[pos] == old {
+				bad[pos] = byte(rng.Intn(256))
+			}
+		}
+		if got, err := recv(bad); err != ErrChecksum {
+			t.Fatalf("Recv corrupted %q: got %q, %v; want %v", bad, got, err, ErrChecksum)
+		}
+	}
+
+	// A record too short to hold a checksum is reported as corrupt.
+	short := Varint(bytes.NewReader([]byte{2, 'x', 'y'}), nopCloser{ioutil.Discard})
+	if got, err := (crcChannel{short}).Recv(); err != ErrChecksum {
+		t.Errorf("Recv short: got %q, %v; want %v", got, err, ErrChecksum)
+	}
+}
+
+func TestLineEmbeddedNewlines(t *testing.T) {
+	lhs, rhs := newPipe(Line)
+	defer lhs.Close()
+	defer rhs.Close()
+
+	// Raw newlines between JSON tokens, as from a json.RawMessage that was
+	// encoded elsewhere, are removed by compaction.
+	raw := json.RawMessage("{\n  \"jsonrpc\": \"2.0\",\n  \"id\": 1,\n  \"result\": [\n    \"a\\nb\"\n  ]\n}\n")
+	var buf bytes.Buffer
+	var recvErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var got []byte
+		got, recvErr = rhs.Recv()
+		buf.Write(got)
+	}()
+	if err := lhs.Send(raw); err != nil {
+		t.Fatalf("Send(%q): unexpected error: %v", raw, err)
+	}
+	<-done
+	if recvErr != nil {
+		t.Errorf("Recv: unexpected error: %v", recvErr)
+	}
+	const want = `{"jsonrpc":"2.0","id":1,"result":["a\nb"]}`
+	if got := buf.String(); got != want {
+		t.Errorf("Recv: got %#q, want %#q", got, want)
+	}
+
+	// A raw newline inside a JSON string, or in a record that is not JSON,
+	// cannot be compacted and must not be sent.
+	for _, bad := range []string{"\"a\nb\"", "not\njson", "{\"a\":\n"} {
+		if err := lhs.Send([]byte(bad)); err == nil {
+			t.Errorf("Send(%q): got nil, want error", bad)
+		} else {
+			t.Logf("Send(%q) correctly failed: %v", bad, err)
+		}
+	}
+}
+
+func TestLineCRLF(t *testing.T) {
+	const input = "{\"id\":1}\r\n{\"id\":2}\n\r\n[]\r\n"
+	ch := Line(strings.NewReader(input), nopCloser{ioutil.Discard})
+	for _, want := range []string{`{"id":1}`, `{"id":2}`, ``, `[]`} {
+		got, err := ch.Recv()
+		if err != nil {
+			t.Fatalf("Recv: unexpected error: %v", err)
+		} else if string(got) != want {
+			t.Errorf("Recv: got %#q, want %#q", got, want)
+		}
+	}
+	if got, err := ch.Recv(); err != io.EOF {
+		t.Errorf("Recv at end: got %#q, %v; want %v", got, err, io.EOF)
+	}
+}
+
+// Verify that a Concurrent channel delivers each record intact when there are
+// multiple concurrent senders and receivers.
+func TestConcurrent(t *testing.T) {
+	const numSenders = 8
+	const numReceivers = 4
+	const perSender = 200
+
+	// The Header framing writes the header and body separately, so records
+	// from unsynchronized senders could be interleaved.
+	lhs, rhs := newPipe(Header("text/plain"))
+	cl, cr := Concurrent(lhs), Concurrent(rhs)
+
+	var sendWG sync.WaitGroup
+	for i := 0; i < numSenders; i++ {
+		i := i
+		sendWG.Add(1)
+		go func() {
+			defer sendWG.Done()
+			for j := 0; j < perSender; j++ {
+				msg := fmt.Sprintf("sender %d message %d %s", i, j, strings.Repeat("x", j))
+				if err := cl.Send([]byte(msg)); err != nil {
+					t.Errorf("Send(%d, %d): unexpected error: %v", i, j, err)
+					return
+				}
+			}
+		}()
+	}
+	go func() { sendWG.Wait(); cl.Close() }()
+
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	var recvWG sync.WaitGroup
+	for i := 0; i < numReceivers; i++ {
+		recvWG.Add(1)
+		go func() {
+			defer recvWG.Done()
+			for {
+				msg, err := cr.Recv()
+				if err == io.EOF {
+					return
+				} else if err != nil {
+					t.Errorf("Recv: unexpected error: %v", err)
+					return
+				}
+				mu.Lock()
+				seen[string(msg)] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	recvWG.Wait()
+	cr.Close()
+
+	if len(seen) != numSenders*perSender {
+		t.Errorf("Received %d distinct records, want %d", len(seen), numSenders*perSender)
+	}
+	for i := 0; i < numSenders; i++ {
+		for j := 0; j < perSender; j++ {
+			msg := fmt.Sprintf("sender %d message %d %s", i, j, strings.Repeat("x", j))
+			if !seen[msg] {
+				t.Errorf("Missing record %q", msg)
+			}
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	recv := func(data []byte) ([]byte, error) {
+		return Strict(Varint(bytes.NewReader(data), nopCloser{ioutil.Discard})).Recv()
+	}
+	frame := func(msg string) []byte {
+		var buf bytes.Buffer
+		if err := Varint(nil, nopCloser{&buf}).Send([]byte(msg)); err != nil {
+			t.Fatalf("Send %q: %v", msg, err)
+		}
+		return buf.Bytes()
+	}
+
+	// Valid records are delivered unmodified.
+	for _, msg := range []string{message1, message2, `null`, ` 17 `, `"été été"`} {
+		if got, err := recv(frame(msg)); err != nil || string(got) != msg {
+			t.Errorf("Recv %q: got %q, %v; want %q, nil", msg, got, err, msg)
+		}
+	}
+
+	// Invalid records are rejected with a parse error.
+	tests := []struct {
+		msg    string
+		offset int
+	}{
+		{"", 0},
+		{"{", 1},
+		{`{"a":1}}`, 8},
+		{`{"a":1} {"b":2}`, 9},
+		{`[1, 2,]`, 7},
+		{`{'a': 1}`, 2},
+		{"\"bad\xffbyte\"", 4},
+		{"{\"a\":\"\xc3\"}", 6},
+		{"\xed\xa0\x80", 0}, // encoded surrogate
+	}
+	for _, test := range tests {
+		got, err := recv(frame(test.msg))
+		perr, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("Recv %q: got %q, %v; want *ParseError", test.msg, got, err)
+			continue
+		} else if got != nil {
+			t.Errorf("Recv %q: got record %q, want nil", test.msg, got)
+		}
+		if perr.Offset != test.offset {
+			t.Errorf("Recv %q: got offset %d, want %d (%v)", test.msg, perr.Offset, test.offset, perr)
+		}
+		if c := perr.Code(); c != code.ParseError {
+			t.Errorf("Recv %q: got code %v, want %v", test.msg, c, code.ParseError)
+		}
+	}
+
+	// Errors from the inner channel are passed through.
+	if got, err := recv(nil); err != io.EOF {
+		t.Errorf("Recv empty: got %q, %v; want %v", got, err, io.EOF)
+	}
+}
+
+// Verify that a buffered channel holds records until it is flushed or closed,
+// and that wrappers forward Flush to the channel they wrap.
+func TestBuffered(t *testing.T) {
+	var want bytes.Buffer
+	LSP(nil, nopCloser{&want}).Send([]byte(message1))
+
+	var buf bytes.Buffer
+	ch := Buffered(LSP, 0)(nil, nopCloser{&buf})
+	if err := ch.Send([]byte(message1)); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Before Flush: got %#q, want no output", buf.String())
+	}
+	if err := Flush(ch); err != nil {
+		t.Fatalf("Flush: unexpected error: %v", err)
+	}
+	if got := buf.String(); got != want.String() {
+		t.Errorf("After Flush: got %#q, want %#q", got, want.String())
+	}
+
+	// Close flushes any remaining output.
+	buf.Reset()
+	if err := ch.Send([]byte(message1)); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if err := ch.Close(); err != nil {
+		t.Fatalf("Close: unexpected error: %v", err)
+	}
+	if got := buf.String(); got != want.String() {
+		t.Errorf("After Close: got %#q, want %#q", got, want.String())
+	}
+
+	// Flushing a channel that does not buffer is a no-op.
+	lhs, rhs := Direct()
+	defer rhs.Close()
+	if err := Flush(lhs); err != nil {
+		t.Errorf("Flush(Direct): unexpected error: %v", err)
+	}
+	lhs.Close()
+
+	wrappers := map[string]func(Channel) Channel{
+		"Concurrent":  Concurrent,
+		"Strict":      Strict,
+		"WithTrigger": func(ch Channel) Channel { return WithTrigger(ch, func() {}) },
+		"Tee":         func(ch Channel) Channel { return Tee(ch, ioutil.Discard, nil) },
+		"Chunked":     func(ch Channel) Channel { return Chunked(ch, nil) },
+		"Checksum": func(ch Channel) Channel {
+			return Checksum(func(io.Reader, io.WriteCloser) Channel { return ch })(nil, nil)
+		},
+	}
+	for name, wrap := range wrappers {
+		buf.Reset()
+		ch := wrap(Buffered(Varint, 0)(nil, nopCloser{&buf}))
+		if err := ch.Send([]byte(message2)); err != nil {
+			t.Errorf("%s: Send: unexpected error: %v", name, err)
+			continue
+		} else if buf.Len() != 0 {
+			t.Errorf("%s: before Flush: got %#q, want no output", name, buf.String())
+		}
+		if err := Flush(ch); err != nil {
+			t.Errorf("%s: Flush: unexpected error: %v", name, err)
+		} else if buf.Len() == 0 {
+			t.Errorf("%s: after Flush: got no output", name)
+		}
+	}
+}
+
+// Verify that a channel constructed by FromConn reports a timeout when its
+// peer stalls, and that its deadlines are renewed for each record.
+func TestFromConn(t *testing.T) {
+	lst, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Loopback TCP is not available: %v", err)
+	}
+	defer lst.Close()
+	dial := func(t *testing.T) (net.Conn, net.Conn) {
+		t.Helper()
+		cc, err := net.Dial("tcp", lst.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		sc, err := lst.Accept()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		return cc, sc
+	}
+	const timeout = 200 * time.Millisecond
+
+	t.Run("Renew", func(t *testing.T) {
+		cc, sc := dial(t)
+		ch := FromConn(sc, Line, timeout, timeout)
+		defer ch.Close()
+		peer := Line(cc, cc)
+		defer peer.Close()
+
+		// Each record arrives within the timeout, but all of them together
+		// take longer than that.
+		go func() {
+			for i := 0; i < 4; i++ {
+				time.Sleep(timeout / 2)
+				peer.Send([]byte(strconv.Itoa(i)))
+			}
+		}()
+		for i := 0; i < 4; i++ {
+			got, err := ch.Recv()
+			if err != nil {
+				t.Fatalf("Recv %d: unexpected error: %v", i, err)
+			} else if want := strconv.Itoa(i); string(got) != want {
+				t.Errorf("Recv %d: got %q, want %q", i, got, want)
+			}
+		}
+	})
+
+	t.Run("StalledReader", func(t *testing.T) {
+		cc, sc := dial(t)
+		defer cc.Close() // the peer never sends
+		ch := FromConn(sc, Line, timeout, 0)
+		defer ch.Close()
+
+		start := time.Now()
+		if got, err := ch.Recv(); !os.IsTimeout(err) {
+			t.Errorf("Recv: got %q, %v; want timeout", got, err)
+		} else if elapsed := time.Since(start); elapsed < timeout {
+			t.Errorf("Recv: timed out after %v, want at least %v", elapsed, timeout)
+		}
+	})
+
+	t.Run("StalledWriter", func(t *testing.T) {
+		cc, sc := dial(t)
+		defer cc.Close() // the peer never receives
+		ch := FromConn(sc, Line, 0, timeout)
+		defer ch.Close()
+
+		// Send until the socket buffers fill and a send times out.
+		msg := bytes.Repeat([]byte("x"), 1<<16)
+		for i := 0; i < 10000; i++ {
+			if err := ch.Send(msg); os.IsTimeout(err) {
+				return
+			} else if err != nil {
+				t.Fatalf("Send %d: got %v, want timeout", i, err)
+			}
+		}
+		t.Error("Send did not time out")
+	})
+}
@@ -0,0 +1,68 @@
+package channel
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// ErrChecksum is reported by the Recv method of a channel constructed by a
+// Checksum framing when the checksum of a received record does not match its
+// contents. The corrupted record is discarded.
+var ErrChecksum = errors.New("record checksum mismatch")
+
+// crcSize is the number of bytes added to each record by a Checksum framing.
+const crcSize = crc32.Size
+
+// Checksum returns a framing that behaves as f, but appends a CRC-32 (IEEE)
+// checksum of each record before sending it, and verifies and removes the
+// checksum from each record received. The overhead is 4 bytes per record, in
+// addition to the overhead of f.
+//
+// If the checksum of a received record does not match, Recv reports a nil
+// record and ErrChecksum. A record that is too short to contain a checksum
+// is also reported as ErrChecksum. Records are not otherwise interpreted.
+//
+// Because the checksum is binary, f should use length-prefixed records, such
+// as Varint or Header; framings that depend on the syntax of the record, such
+// as Line or RawJSON, are not suitable.
+func Checksum(f Framing) Framing {
+	return func(r io.Reader, wc io.WriteCloser) Channel {
+		return crcChannel{ch: f(r, wc)}
+	}
+}
+
+type crcChannel struct{ ch Channel }
+
+// Send implements part of the Channel interface.
+func (c crcChannel) Send(msg []byte) error {
+	buf := make([]byte, len(msg)+crcSize)
+	copy(buf, msg)
+	binary.BigEndian.PutUint32(buf[len(msg):], crc32.ChecksumIEEE(msg))
+	return c.ch.Send(buf)
+}
+
+// Recv implements part of the Channel interface. It reports ErrChecksum if a
+// record is received whose contents do not match its checksum.
+func (c crcChannel) Recv() ([]byte, error) {
+	msg, err := c.ch.Recv()
+	if err != nil {
+		// A content-type mismatch still delivers a complete record, which we
+		// must verify; any other error is reported as-is.
+		if _, ok := err.(*ContentTypeMismatchError); !ok {
+			return nil, err
+		}
+	}
+	n := len(msg) - crcSize
+	if n < 0 || crc32.ChecksumIEEE(msg[:n]) != binary.BigEndian.Uint32(msg[n:]) {
+		return nil, ErrChecksum
+	}
+	return msg[:n], err
+}
+
+// Close implements part of the Channel interface.
+func (c crcChannel) Close() error { return c.ch.Close() }
+
+// Flush implements the Flusher interface.
+func (c crcChannel) Flush() error { return Flush(c.ch) }
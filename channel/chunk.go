@@ -0,0 +1,308 @@
+package channel
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ChunkOptions control the behaviour of a channel constructed by Chunked.  A
+// nil *ChunkOptions provides default values as described.
+type ChunkOptions struct {
+	// The maximum size in bytes of a single chunk sent on the inner channel,
+	// including its header. If zero, 16KiB is used. A value below the size of
+	// the largest possible chunk header is rounded up.
+	ChunkSize int
+
+	// The maximum size in bytes of a reassembled message. Chunks that would
+	// cause a message to exceed this size cause the message to be discarded.
+	// If zero, 16MiB is used.
+	MaxSize int
+
+	// How long to wait for the remaining chunks of a message after its first
+	// chunk arrives. Messages that are not complete within this time are
+	// discarded. If zero, 30 seconds is used.
+	Timeout time.Duration
+
+	// How far ahead of the first missing chunk of a message an arriving chunk
+	// may be before the message is discarded. If zero, 8 is used.
+	Window int
+
+	// If set, this function is called with the ID of each message discarded
+	// by the receiver, and the reason it was discarded.
+	OnDrop func(id uint64, err error)
+}
+
+func (o *ChunkOptions) chunkSize() int {
+	if o == nil || o.ChunkSize == 0 {
+		return 16 << 10
+	} else if o.ChunkSize <= maxChunkHeader {
+		return maxChunkHeader + 1
+	}
+	return o.ChunkSize
+}
+
+func (o *ChunkOptions) maxSize() int {
+	if o == nil || o.MaxSize <= 0 {
+		return 16 << 20
+	}
+	return o.MaxSize
+}
+
+func (o *ChunkOptions) timeout() time.Duration {
+	if o == nil || o.Timeout <= 0 {
+		return 30 * time.Second
+	}
+	return o.Timeout
+}
+
+func (o *ChunkOptions) window() uint64 {
+	if o == nil || o.Window <= 0 {
+		return 8
+	}
+	return uint64(o.Window)
+}
+
+func (o *ChunkOptions) onDrop() func(uint64, error) {
+	if o == nil || o.OnDrop == nil {
+		return func(uint64, error) {}
+	}
+	return o.OnDrop
+}
+
+// Errors reported to the OnDrop hook of a chunked channel.
+var (
+	ErrChunkTimeout  = errors.New("message reassembly timed out")
+	ErrChunkTooLarge = errors.New("reassembled message is too large")
+	ErrChunkWindow   = errors.New("chunk is outside the reassembly window")
+)
+
+// Each chunk begins with a header comprising the message ID and the chunk
+// sequence number, both encoded as varints, followed by a single flag byte.
+const maxChunkHeader = 2*binary.MaxVarintLen64 + 1
+
+const chunkFinal = 1 // flag: this is the last chunk of its message
+
+// Chunked returns a Channel that delegates to inner, splitting each outbound
+// message into a sequence of chunks no larger than the configured chunk size,
+// and reassembling inbound chunks into complete messages.
+//
+// Each chunk is sent as a separate record on inner, and carries a header of
+// at most 21 bytes giving the message ID, the position of the chunk in its
+// message, and whether it is the final chunk. Chunks of a message may arrive
+// out of order, within the limits of the reassembly window. A message that is
+// incomplete after the reassembly timeout, that exceeds the maximum size, or
+// that receives a chunk too far beyond the window is discarded, and any
+// further chunks for that message are ignored.
+//
+// Recv reports an error only if a Recv on inner fails or delivers a malformed
+// chunk; discarded messages do not cause errors. Stale partial messages are
+// evicted as new chunks arrive. A message is forgotten as soon as it has been
+// reassembled, so inner must not deliver a chunk more than once after its
+// message is complete, as a reliable stream does not.
+func Chunked(inner Channel, opts *ChunkOptions) Channel {
+	return &chunked{
+		inner:   inner,
+		size:    opts.chunkSize(),
+		maxSize: opts.maxSize(),
+		timeout: opts.timeout(),
+		window:  opts.window(),
+		onDrop:  opts.onDrop(),
+		partial: make(map[uint64]*partial),
+		queue:   list.New(),
+		now:     time.Now,
+	}
+}
+
+type chunked struct {
+	inner   Channel
+	size    int
+	maxSize int
+	timeout time.Duration
+	window  uint64
+	onDrop  func(uint64, error)
+	now     func() time.Time
+
+	nextID  uint64              // the ID of the next outbound message
+	partial map[uint64]*partial // inbound messages awaiting reassembly
+	queue   *list.List          // the partial messages, in order of arrival
+}
+
+// A partial is an inbound message awaiting reassembly.
+type partial struct {
+	id     uint64            // the message ID
+	elt    *list.Element     // the location of the message in the queue
+	start  time.Time         // when the first chunk arrived
+	chunks map[uint64][]byte // chunks not yet reassembled, by sequence
+	next   uint64            // sequence number of the first missing chunk
+	last   uint64            // sequence number of the final chunk, if known
+	final  bool              // whether the final chunk has arrived
+	size   int               // total size of the chunks received
+	done   bool              // complete or discarded; ignore further chunks
+}
+
+// Send implements part of the Channel interface. It splits msg into chunks
+// and sends each in order on the underlying channel.
+func (c *chunked) Send(msg []byte) error {
+	id := c.nextID
+	c.nextID++
+
+	limit := c.size - maxChunkHeader
+	buf := make([]byte, 0, c.size)
+	for seq := uint64(0); ; seq++ {
+		n := len(msg)
+		if n > limit {
+			n = limit
+		}
+		buf = buf[:0]
+		buf = appendUvarint(buf, id)
+		buf = appendUvarint(buf, seq)
+		if n == len(msg) {
+			buf = append(buf, chunkFinal)
+		} else {
+			buf = append(buf, 0)
+		}
+		buf = append(buf, msg[:n]...)
+		if err := c.inner.Send(buf); err != nil {
+			return err
+		}
+		msg = msg[n:]
+		if len(msg) == 0 {
+			return nil
+		}
+	}
+}
+
+// Recv implements part of the Channel interface. It blocks until a complete
+// message has been reassembled from the underlying channel.
+func (c *chunked) Recv() ([]byte, error) {
+	for {
+		raw, err := c.inner.Recv()
+		if err != nil {
+			return nil, err
+		}
+		id, seq, final, data, err := parseChunk(raw)
+		if err != nil {
+			return nil, err
+		}
+		now := c.now()
+		c.expire(now)
+
+		p, ok := c.partial[id]
+		if !ok {
+			p = &partial{id: id, start: now, chunks: make(map[uint64][]byte)}
+			p.elt = c.queue.PushBack(p)
+			c.partial[id] = p
+		}
+		if p.done {
+			continue // a straggler for a discarded message
+		} else if _, dup := p.chunks[seq]; dup || seq < p.next {
+			continue // a duplicate chunk
+		} else if seq >= p.next+c.window {
+			c.drop(id, p, ErrChunkWindow)
+			continue
+		} else if p.size+len(data) > c.maxSize {
+			c.drop(id, p, ErrChunkTooLarge)
+			continue
+		} else if final {
+			if p.final || hasAfter(p.chunks, seq) {
+				c.drop(id, p, errors.New("conflicting final chunk"))
+				continue
+			}
+			p.final = true
+			p.last = seq
+		} else if p.final && seq > p.last {
+			c.drop(id, p, errors.New("chunk follows final chunk"))
+			continue
+		}
+
+		// The raw buffer may be reused by the inner channel, so copy the data.
+		p.chunks[seq] = append([]byte(nil), data...)
+		p.size += len(data)
+		for {
+			if _, ok := p.chunks[p.next]; !ok {
+				break
+			}
+			p.next++
+		}
+		if p.final && p.next > p.last {
+			msg := make([]byte, 0, p.size)
+			for i := uint64(0); i <= p.last; i++ {
+				msg = append(msg, p.chunks[i]...)
+			}
+			c.forget(p)
+			return msg, nil
+		}
+	}
+}
+
+// Close implements part of the Channel interface.
+func (c *chunked) Close() error { return c.inner.Close() }
+
+// Flush implements the Flusher interface.
+func (c *chunked) Flush() error { return Flush(c.inner) }
+
+// expire discards all partial messages whose reassembly timeout has elapsed
+// as of now. Discarded messages are forgotten at the same point. Since the
+// queue is in order of arrival, and hence of expiry, only its expired prefix
+// is examined.
+func (c *chunked) expire(now time.Time) {
+	for elt := c.queue.Front(); elt != nil; elt = c.queue.Front() {
+		p := elt.Value.(*partial)
+		if now.Sub(p.start) < c.timeout {
+			break
+		} else if !p.done {
+			c.onDrop(p.id, ErrChunkTimeout)
+		}
+		c.forget(p)
+	}
+}
+
+// forget removes p from the partial messages of c.
+func (c *chunked) forget(p *partial) {
+	c.queue.Remove(p.elt)
+	delete(c.partial, p.id)
+}
+
+func (c *chunked) drop(id uint64, p *partial, err error) {
+	p.settle()
+	c.onDrop(id, err)
+}
+
+// settle marks p as discarded and releases its buffered data. The message is
+// remembered until it expires, so that further chunks for it are ignored.
+func (p *partial) settle() { p.done = true; p.chunks = nil; p.size = 0 }
+
+// hasAfter reports whether chunks contains a sequence number greater than seq.
+func hasAfter(chunks map[uint64][]byte, seq uint64) bool {
+	for s := range chunks {
+		if s > seq {
+			return true
+		}
+	}
+	return false
+}
+
+func parseChunk(raw []byte) (id, seq uint64, final bool, data []byte, err error) {
+	id, n := binary.Uvarint(raw)
+	if n <= 0 {
+		return 0, 0, false, nil, errors.New("invalid chunk message ID")
+	}
+	raw = raw[n:]
+	seq, n = binary.Uvarint(raw)
+	if n <= 0 {
+		return 0, 0, false, nil, errors.New("invalid chunk sequence number")
+	}
+	raw = raw[n:]
+	if len(raw) == 0 {
+		return 0, 0, false, nil, errors.New("missing chunk flags")
+	}
+	return id, seq, raw[0]&chunkFinal != 0, raw[1:], nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
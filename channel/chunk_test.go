@@ -0,0 +1,238 @@
+package channel
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A recorder is a Channel that records the messages sent to it, and delivers
+// a caller-controlled sequence of messages to Recv.
+type recorder struct {
+	sent  [][]byte // messages passed to Send
+	queue [][]byte // messages remaining for Recv
+}
+
+func (r *recorder) Send(msg []byte) error {
+	r.sent = append(r.sent, append([]byte(nil), msg...))
+	return nil
+}
+
+func (r *recorder) Recv() ([]byte, error) {
+	if len(r.queue) == 0 {
+		return nil, io.EOF
+	}
+	next := r.queue[0]
+	r.queue = r.queue[1:]
+	return next, nil
+}
+
+func (r *recorder) Close() error { return nil }
+
+// A fakeClock is a manually-advanced clock for testing timeouts.
+type fakeClock struct{ now time.Time }
+
+func (f *fakeClock) Now() time.Time          { return f.now }
+func (f *fakeClock) Advance(d time.Duration) { f.now = f.now.Add(d) }
+
+// newChunked constructs a chunked channel over a recorder, with a fake clock.
+func newChunked(opts *ChunkOptions) (*chunked, *recorder, *fakeClock) {
+	rec := new(recorder)
+	clock := &fakeClock{now: time.Unix(1600000000, 0)}
+	ch := Chunked(rec, opts).(*chunked)
+	ch.now = clock.Now
+	return ch, rec, clock
+}
+
+// chunkSize is small enough that a short message requires multiple chunks.
+const chunkSize = maxChunkHeader + 4
+
+func TestChunkedRoundTrip(t *testing.T) {
+	ch, rec, _ := newChunked(&ChunkOptions{ChunkSize: chunkSize})
+	tests := []string{
+		"",
+		"a",
+		"abcd",
+		"abcde",
+		message1,
+		message2,
+		strings.Repeat("0123456789", 100),
+	}
+	for _, test := range tests {
+		rec.sent = nil
+		if err := ch.Send([]byte(test)); err != nil {
+			t.Fatalf("Send %q: unexpected error: %v", clip(test), err)
+		}
+		for _, c := range rec.sent {
+			if len(c) > chunkSize {
+				t.Errorf("Send %q: chunk of size %d exceeds limit %d", clip(test), len(c), chunkSize)
+			}
+		}
+		rec.queue = rec.sent
+		got, err := ch.Recv()
+		if err != nil {
+			t.Errorf("Recv %q: unexpected error: %v", clip(test), err)
+		} else if string(got) != test {
+			t.Errorf("Recv: got %q, want %q", clip(string(got)), clip(test))
+		}
+
+		// A reassembled message is forgotten at once.
+		if len(ch.partial) != 0 || ch.queue.Len() != 0 {
+			t.Errorf("Recv %q: %d partial messages (%d queued) remain", clip(test), len(ch.partial), ch.queue.Len())
+		}
+	}
+}
+
+func TestChunkedReorder(t *testing.T) {
+	ch, rec, _ := newChunked(&ChunkOptions{ChunkSize: chunkSize, Window: 4})
+	const msg = "abcdefghijkl" // 3 chunks
+	if err := ch.Send([]byte(msg)); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	if len(rec.sent) != 3 {
+		t.Fatalf("Send: got %d chunks, want 3", len(rec.sent))
+	}
+
+	// Deliver the chunks in reverse order, with a duplicate.
+	rec.queue = [][]byte{rec.sent[2], rec.sent[1], rec.sent[1], rec.sent[0]}
+	got, err := ch.Recv()
+	if err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	} else if string(got) != msg {
+		t.Errorf("Recv: got %q, want %q", got, msg)
+	}
+}
+
+func TestChunkedLoss(t *testing.T) {
+	var drops []uint64
+	var dropErr error
+	ch, rec, clock := newChunked(&ChunkOptions{
+		ChunkSize: chunkSize,
+		Timeout:   10 * time.Second,
+		OnDrop: func(id uint64, err error) {
+			drops = append(drops, id)
+			dropErr = err
+		},
+	})
+	const lost, kept = "this message has a lost chunk", "this one arrives"
+	ch.Send([]byte(lost))
+	n := len(rec.sent)
+	ch.Send([]byte(kept))
+
+	// Drop the second chunk of the first message, and deliver the rest.
+	rec.queue = append([][]byte{rec.sent[0]}, rec.sent[2:n]...)
+	for len(rec.queue) != 0 {
+		if got, err := ch.Recv(); err != io.EOF {
+			t.Fatalf("Recv: got %q, %v; want EOF", got, err)
+		}
+	}
+
+	// Deliver all but the last chunk of the second message before the timeout
+	// for the first message has elapsed.
+	clock.Advance(5 * time.Second)
+	rec.queue = rec.sent[n : len(rec.sent)-1]
+	for len(rec.queue) != 0 {
+		if got, err := ch.Recv(); err != io.EOF {
+			t.Fatalf("Recv: got %q, %v; want EOF", got, err)
+		}
+	}
+	if len(drops) != 0 {
+		t.Errorf("Dropped messages %v before the timeout", drops)
+	}
+
+	// Once the timeout has elapsed for the first message, it is dropped and
+	// the second message completes.
+	clock.Advance(6 * time.Second)
+	rec.queue = rec.sent[len(rec.sent)-1:]
+	got, err := ch.Recv()
+	if err != nil {
+		t.Fatalf("Recv: unexpected error: %v", err)
+	} else if string(got) != kept {
+		t.Errorf("Recv: got %q, want %q", got, kept)
+	}
+	if len(drops) != 1 || drops[0] != 0 || dropErr != ErrChunkTimeout {
+		t.Errorf("Drops: got %v (%v), want [0] (%v)", drops, dropErr, ErrChunkTimeout)
+	}
+	if len(ch.partial) != 0 || ch.queue.Len() != 0 {
+		t.Errorf("Partial messages: got %d (%d queued), want 0", len(ch.partial), ch.queue.Len())
+	}
+
+	// A straggler from the dropped message is ignored.
+	clock.Advance(11 * time.Second)
+	rec.queue = rec.sent[1:2]
+	if got, err := ch.Recv(); err != io.EOF {
+		t.Errorf("Recv: got %q, %v; want EOF", got, err)
+	}
+}
+
+func TestChunkedLimits(t *testing.T) {
+	var dropErr error
+	opts := &ChunkOptions{
+		ChunkSize: chunkSize,
+		MaxSize:   10,
+		Window:    2,
+		OnDrop:    func(_ uint64, err error) { dropErr = err },
+	}
+	const ok = "short"
+	tests := []struct {
+		msg     string
+		reorder func([][]byte) [][]byte
+		want    error
+	}{
+		{strings.Repeat("x", 11), nil, ErrChunkTooLarge},
+		{"abcdefghij", func(cs [][]byte) [][]byte {
+			return [][]byte{cs[2], cs[0], cs[1]} // 2 is outside the window
+		}, ErrChunkWindow},
+	}
+	for _, test := range tests {
+		ch, rec, _ := newChunked(opts)
+		dropErr = nil
+		ch.Send([]byte(test.msg))
+		n := len(rec.sent)
+		ch.Send([]byte(ok))
+		rec.queue = rec.sent
+		if test.reorder != nil {
+			rec.queue = append(test.reorder(rec.sent[:n]), rec.sent[n:]...)
+		}
+
+		// The bad message should be dropped, but the following one delivered.
+		got, err := ch.Recv()
+		if err != nil {
+			t.Errorf("Recv %q: unexpected error: %v", test.msg, err)
+		} else if string(got) != ok {
+			t.Errorf("Recv %q: got %q, want %q", test.msg, got, ok)
+		}
+		if dropErr != test.want {
+			t.Errorf("Recv %q: got drop error %v, want %v", test.msg, dropErr, test.want)
+		}
+
+		// Only the discarded message is remembered, to ignore its stragglers.
+		if len(ch.partial) != 1 || ch.queue.Len() != 1 {
+			t.Errorf("Recv %q: got %d partial messages (%d queued), want 1", test.msg, len(ch.partial), ch.queue.Len())
+		}
+	}
+}
+
+func TestChunkedMalformed(t *testing.T) {
+	ch, rec, _ := newChunked(nil)
+	for _, bad := range [][]byte{
+		nil,          // no header
+		{0x80},       // truncated ID
+		{0x01},       // missing sequence
+		{0x01, 0x00}, // missing flags
+	} {
+		rec.queue = [][]byte{bad}
+		if got, err := ch.Recv(); err == nil {
+			t.Errorf("Recv %q: got %q, wanted error", bad, got)
+		}
+	}
+
+	// Verify that a channel with default options works over a real pipe.
+	lhs, rhs := Direct()
+	defer lhs.Close()
+	defer rhs.Close()
+	big := bytes.Repeat([]byte("*"), 40000)
+	testSendRecv(t, Chunked(lhs, nil), Chunked(rhs, nil), string(big))
+}
@@ -0,0 +1,67 @@
+package channel
+
+import (
+	"net"
+	"time"
+)
+
+// FromConn returns a Channel that exchanges records over conn using the given
+// framing, and sets deadlines on conn so that a stalled peer is detected.
+//
+// If readTimeout > 0, each Recv must receive a complete record within that
+// duration, otherwise it reports an error that satisfies os.IsTimeout. Since
+// the deadline is set afresh for each record, a readTimeout on a connection
+// used by a server closes idle connections: a client that sends nothing for
+// that long is disconnected. Likewise, if writeTimeout > 0, each Send (and
+// each Flush, if the framing buffers records) must complete within that
+// duration. A timeout of zero or less sets no deadline.
+//
+// After a timeout, the state of the connection is unknown, and the channel
+// should be closed.
+func FromConn(conn net.Conn, framing Framing, readTimeout, writeTimeout time.Duration) Channel {
+	return connChannel{
+		Channel: framing(conn, conn),
+		conn:    conn,
+		rt:      readTimeout,
+		wt:      writeTimeout,
+	}
+}
+
+type connChannel struct {
+	Channel
+	conn   net.Conn
+	rt, wt time.Duration
+}
+
+// Recv implements part of the Channel interface.
+func (c connChannel) Recv() ([]byte, error) {
+	if c.rt > 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(c.rt)); err != nil {
+			return nil, err
+		}
+	}
+	return c.Channel.Recv()
+}
+
+// Send implements part of the Channel interface.
+func (c connChannel) Send(msg []byte) error {
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	return c.Channel.Send(msg)
+}
+
+// Flush implements the Flusher interface.
+func (c connChannel) Flush() error {
+	if err := c.setWriteDeadline(); err != nil {
+		return err
+	}
+	return Flush(c.Channel)
+}
+
+func (c connChannel) setWriteDeadline() error {
+	if c.wt <= 0 {
+		return nil
+	}
+	return c.conn.SetWriteDeadline(time.Now().Add(c.wt))
+}
@@ -15,7 +15,8 @@
 // interpreted (except as noted below), and it is up to the implementation to
 // decide how records are framed for transport.  A channel must support use by
 // one sender and one receiver concurrently, but is not otherwise required to
-// be safe for concurrent use.
+// be safe for concurrent use. To share a channel among multiple senders or
+// multiple receivers, wrap it with Concurrent.
 //
 // Framing
 //
@@ -3,13 +3,49 @@ package channel
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 )
 
-// Line is a framing discipline for messages terminated by a Unicode LF
-// (10). This framing has the constraint that records may not contain LF.
-var Line = Split('\n')
+// Line is a framing discipline for newline-delimited JSON (NDJSON), in which
+// each message is terminated by a Unicode LF (10).
+//
+// Outbound records may not contain LF. If a record does contain LF, as may
+// happen with pre-encoded JSON passed through verbatim, it is re-encoded in
+// compact form before sending; if that is not possible because the record is
+// not valid JSON, Send reports an error and nothing is sent. Note that an LF
+// escaped within a JSON string ("\n") is not affected.
+//
+// On input, a CR (13) immediately before the terminating LF is discarded, so
+// that CRLF-terminated input is accepted.
+var Line Framing = func(r io.Reader, wc io.WriteCloser) Channel {
+	return line{split{split: '\n', wc: wc, buf: bufio.NewReader(r)}}
+}
+
+// line implements the NDJSON framing for the Line framing discipline.
+type line struct{ split }
+
+// Send implements part of the Channel interface. If msg contains LF, it is
+// compacted before sending, and an error is reported if that fails.
+func (c line) Send(msg []byte) error {
+	if bytes.IndexByte(msg, '\n') >= 0 {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, msg); err != nil {
+			return fmt.Errorf("message contains a newline and cannot be compacted: %v", err)
+		}
+		msg = buf.Bytes()
+	}
+	return c.split.Send(msg)
+}
+
+// Recv implements part of the Channel interface. A trailing CR is removed
+// from the record.
+func (c line) Recv() ([]byte, error) {
+	msg, err := c.split.Recv()
+	return bytes.TrimSuffix(msg, []byte("\r")), err
+}
 
 // Split returns a framing in which each message is terminated by the specified
 // byte value. The framing has the constraint that outbound records may not
@@ -0,0 +1,71 @@
+package channel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"unicode/utf8"
+
+	"github.com/yinfei8/jrpc2/code"
+)
+
+// A ParseError is reported by the Recv method of a channel constructed by
+// Strict when a received record is not valid UTF-8 or is not a syntactically
+// valid JSON value. It satisfies code.Coder with code.ParseError.
+type ParseError struct {
+	Offset int    // the byte offset in the record at which the error was detected
+	Reason string // a description of the problem
+}
+
+func (p *ParseError) Error() string {
+	return fmt.Sprintf("invalid record at offset %d: %s", p.Offset, p.Reason)
+}
+
+// Code satisfies the code.Coder interface.
+func (*ParseError) Code() code.Code { return code.ParseError }
+
+// Strict returns a Channel that delegates to inner, but verifies that each
+// record received is valid UTF-8 and a syntactically valid JSON value before
+// delivering it. A record that fails either check is discarded, and Recv
+// reports a nil record and an error of concrete type *ParseError. Records
+// sent on the channel are not checked.
+//
+// Errors reported by inner are returned as-is, along with any record.
+func Strict(inner Channel) Channel { return strict{inner} }
+
+type strict struct{ Channel }
+
+// Recv implements part of the Channel interface.
+func (s strict) Recv() ([]byte, error) {
+	msg, err := s.Channel.Recv()
+	if err != nil && !(err == io.EOF && len(msg) != 0) {
+		return msg, err
+	}
+	if perr := checkRecord(msg); perr != nil {
+		return nil, perr
+	}
+	return msg, err
+}
+
+// Flush implements the Flusher interface.
+func (s strict) Flush() error { return Flush(s.Channel) }
+
+// checkRecord reports whether msg is valid UTF-8 containing a single valid
+// JSON value. It returns nil if so, or otherwise a *ParseError.
+func checkRecord(msg []byte) error {
+	for i := 0; i < len(msg); {
+		r, n := utf8.DecodeRune(msg[i:])
+		if r == utf8.RuneError && n <= 1 {
+			return &ParseError{Offset: i, Reason: "invalid UTF-8"}
+		}
+		i += n
+	}
+	if json.Valid(msg) {
+		return nil
+	}
+	var v json.RawMessage
+	if serr, ok := json.Unmarshal(msg, &v).(*json.SyntaxError); ok {
+		return &ParseError{Offset: int(serr.Offset), Reason: serr.Error()}
+	}
+	return &ParseError{Offset: len(msg), Reason: "invalid JSON"}
+}
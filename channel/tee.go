@@ -0,0 +1,216 @@
+package channel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// TeeOptions control the output of a channel constructed by Tee. A nil
+// *TeeOptions provides default values as described.
+type TeeOptions struct {
+	// If true, frames that are valid JSON are written with indentation.
+	// Otherwise frames are written as received.
+	Indent bool
+
+	// The values of object fields with these names, at any depth, are replaced
+	// by the string "[redacted]" in the output. When redaction applies, the
+	// fields of each object in the frame are written in sorted order.
+	Redact []string
+
+	// If positive, output for frames longer than this many bytes (after
+	// formatting) is truncated to this length, and the number of bytes
+	// elided is noted.
+	MaxBytes int
+
+	// If non-empty, only requests and notifications for these methods are
+	// written, along with the responses to those requests. A batch is written
+	// if any of its elements match. Frames that are not valid JSON-RPC
+	// messages are always written.
+	Methods []string
+}
+
+func (o *TeeOptions) indent() bool { return o != nil && o.Indent }
+
+func (o *TeeOptions) maxBytes() int {
+	if o == nil || o.MaxBytes < 0 {
+		return 0
+	}
+	return o.MaxBytes
+}
+
+func (o *TeeOptions) redact() map[string]bool {
+	if o == nil {
+		return nil
+	}
+	return stringSet(o.Redact)
+}
+
+func (o *TeeOptions) methods() map[string]bool {
+	if o == nil {
+		return nil
+	}
+	return stringSet(o.Methods)
+}
+
+// stringSet returns a set of the given strings, or nil if there are none.
+func stringSet(ss []string) map[string]bool {
+	if len(ss) == 0 {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, s := range ss {
+		set[s] = true
+	}
+	return set
+}
+
+// Tee returns a Channel that delegates to ch, and writes a description of
+// each message sent or received to w. The messages themselves are passed
+// through unchanged. This is intended for debugging.
+//
+// Each message is written as a single entry giving a timestamp, a direction
+// arrow ("->" for Send, "<-" for Recv), and the content of the message as
+// formatted according to opts. Entries for concurrent calls to Send and Recv
+// are not interleaved. Errors writing to w are ignored.
+func Tee(ch Channel, w io.Writer, opts *TeeOptions) Channel {
+	return &tee{
+		ch:       ch,
+		w:        w,
+		indent:   opts.indent(),
+		maxBytes: opts.maxBytes(),
+		redact:   opts.redact(),
+		methods:  opts.methods(),
+		ids:      make(map[string]bool),
+		now:      time.Now,
+	}
+}
+
+type tee struct {
+	ch       Channel
+	indent   bool
+	maxBytes int
+	redact   map[string]bool
+	methods  map[string]bool
+	now      func() time.Time
+
+	mu  sync.Mutex
+	w   io.Writer
+	ids map[string]bool // IDs of requests passed by the method filter
+}
+
+// Send implements part of the Channel interface.
+func (t *tee) Send(msg []byte) error {
+	t.log("->", msg)
+	return t.ch.Send(msg)
+}
+
+// Recv implements part of the Channel interface.
+func (t *tee) Recv() ([]byte, error) {
+	msg, err := t.ch.Recv()
+	if err == nil || len(msg) != 0 {
+		t.log("<-", msg)
+	}
+	return msg, err
+}
+
+// Close implements part of the Channel interface.
+func (t *tee) Close() error { return t.ch.Close() }
+
+// Flush implements the Flusher interface.
+func (t *tee) Flush() error { return Flush(t.ch) }
+
+func (t *tee) log(dir string, msg []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(msg))
+	dec.UseNumber()
+	parsed := dec.Decode(&v) == nil
+	if parsed && !t.wanted(v) {
+		return
+	}
+
+	out := msg
+	if parsed && t.redact != nil {
+		t.redactValue(v)
+		if t.indent {
+			out, _ = json.MarshalIndent(v, "", "  ")
+		} else {
+			out, _ = json.Marshal(v)
+		}
+	} else if t.indent {
+		var buf bytes.Buffer
+		if json.Indent(&buf, msg, "", "  ") == nil {
+			out = buf.Bytes()
+		}
+	}
+
+	var note string
+	if t.maxBytes > 0 && len(out) > t.maxBytes {
+		note = fmt.Sprintf(" ... [%d bytes truncated]", len(out)-t.maxBytes)
+		out = out[:t.maxBytes]
+	}
+	fmt.Fprintf(t.w, "%s %s %s%s\n", t.now().Format("15:04:05.000000"), dir, out, note)
+}
+
+// wanted reports whether the decoded message v passes the method filter.  The
+// caller must hold t.mu.
+func (t *tee) wanted(v interface{}) bool {
+	if t.methods == nil {
+		return true
+	}
+	msgs, ok := v.([]interface{})
+	if !ok {
+		msgs = []interface{}{v}
+	}
+	var valid, match bool
+	for _, elt := range msgs {
+		obj, ok := elt.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, hasID := obj["id"]
+		bits, _ := json.Marshal(id)
+		key := string(bits)
+		if m, ok := obj["method"].(string); ok {
+			valid = true
+			if t.methods[m] {
+				match = true
+				if hasID {
+					t.ids[key] = true
+				}
+			}
+		} else if hasID {
+			valid = true
+			if t.ids[key] {
+				match = true
+				delete(t.ids, key)
+			}
+		}
+	}
+	return match || !valid
+}
+
+// redactValue replaces, in place, the values of object fields in v whose names
+// are in the redaction set.
+func (t *tee) redactValue(v interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for key, val := range x {
+			if t.redact[key] {
+				x[key] = "[redacted]"
+			} else {
+				t.redactValue(val)
+			}
+		}
+	case []interface{}:
+		for _, val := range x {
+			t.redactValue(val)
+		}
+	}
+}
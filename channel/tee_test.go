@@ -0,0 +1,107 @@
+package channel
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// teePipe returns a connected pair of channels, in which lhs is wrapped by a
+// tee writing to the returned buffer with a fixed clock.
+func teePipe(opts *TeeOptions) (lhs, rhs Channel, buf *bytes.Buffer) {
+	buf = new(bytes.Buffer)
+	cli, srv := Direct()
+	lhs = Tee(cli, buf, opts)
+	lhs.(*tee).now = func() time.Time {
+		return time.Date(2020, 12, 7, 10, 11, 12, 345678000, time.UTC)
+	}
+	return lhs, srv, buf
+}
+
+func TestTee(t *testing.T) {
+	const stamp = "10:11:12.345678 "
+	tests := []struct {
+		desc string
+		opts *TeeOptions
+		send []string // sent from lhs to rhs
+		recv []string // sent from rhs to lhs
+		want string
+	}{
+		{"Passthrough", nil,
+			[]string{`{"id":1,"method":"A"}`, `not json`},
+			[]string{`{"id":1,"result":true}`},
+			stamp + `-> {"id":1,"method":"A"}` + "\n" +
+				stamp + `-> not json` + "\n" +
+				stamp + `<- {"id":1,"result":true}` + "\n",
+		},
+		{"Indent", &TeeOptions{Indent: true},
+			[]string{`{"id":1,"method":"A","params":[1]}`}, nil,
+			stamp + "-> {\n  \"id\": 1,\n  \"method\": \"A\",\n  \"params\": [\n    1\n  ]\n}\n",
+		},
+		{"Redact", &TeeOptions{Redact: []string{"password", "token"}},
+			[]string{
+				`{"method":"Login","params":{"user":"x","password":"hunter2"}}`,
+				`[{"method":"A","params":[{"token":{"v":1}}]}]`,
+			}, nil,
+			stamp + `-> {"method":"Login","params":{"password":"[redacted]","user":"x"}}` + "\n" +
+				stamp + `-> [{"method":"A","params":[{"token":"[redacted]"}]}]` + "\n",
+		},
+		{"Truncate", &TeeOptions{MaxBytes: 10},
+			[]string{`{"method":"Long"}`, `{}`}, nil,
+			stamp + `-> {"method":` + " ... [7 bytes truncated]\n" +
+				stamp + "-> {}\n",
+		},
+		{"Methods", &TeeOptions{Methods: []string{"Keep"}},
+			[]string{
+				`{"id":1,"method":"Keep"}`,
+				`{"id":2,"method":"Drop"}`,
+				`{"method":"Keep"}`,
+				`[{"id":3,"method":"Drop"},{"id":"1","method":"Keep"}]`,
+				`bogus`,
+			},
+			[]string{
+				`{"id":2,"result":"drop"}`,
+				`{"id":1,"result":"keep"}`,
+				`{"id":1,"result":"again"}`, // the ID is no longer pending
+				`[{"id":3,"result":0},{"id":"1","result":1}]`,
+			},
+			stamp + `-> {"id":1,"method":"Keep"}` + "\n" +
+				stamp + `-> {"method":"Keep"}` + "\n" +
+				stamp + `-> [{"id":3,"method":"Drop"},{"id":"1","method":"Keep"}]` + "\n" +
+				stamp + "-> bogus\n" +
+				stamp + `<- {"id":1,"result":"keep"}` + "\n" +
+				stamp + `<- [{"id":3,"result":0},{"id":"1","result":1}]` + "\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			lhs, rhs, buf := teePipe(test.opts)
+			defer lhs.Close()
+			defer rhs.Close()
+			for _, msg := range test.send {
+				testSendRecv(t, lhs, rhs, msg)
+			}
+			for _, msg := range test.recv {
+				testSendRecv(t, rhs, lhs, msg)
+			}
+			if got := buf.String(); got != test.want {
+				t.Errorf("Tee output:\n got: %s\nwant: %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestTeeUnchanged(t *testing.T) {
+	lhs, rhs, buf := teePipe(&TeeOptions{Indent: true, Redact: []string{"x"}, MaxBytes: 5})
+	defer rhs.Close()
+	const msg = `{"x":  "secret", "y":1}`
+	testSendRecv(t, lhs, rhs, msg)
+	testSendRecv(t, rhs, lhs, msg)
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("Tee output contains a redacted value:\n%s", buf.String())
+	}
+	if err := lhs.Close(); err != nil {
+		t.Errorf("Close: unexpected error: %v", err)
+	}
+}
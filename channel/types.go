@@ -3,6 +3,7 @@ package channel
 import (
 	"errors"
 	"io"
+	"sync"
 )
 
 // A Framing converts a reader and a writer into a Channel with a particular
@@ -31,8 +32,55 @@ func (c triggered) Recv() ([]byte, error) {
 }
 
 func (c triggered) Send(msg []byte) error { return c.ch.Send(msg) }
+func (c triggered) Flush() error          { return Flush(c.ch) }
 func (c triggered) Close() error          { return c.ch.Close() }
 
+// Concurrent returns a Channel that delegates to ch, and serializes calls to
+// its Send and Recv methods so that the result is safe for use by multiple
+// concurrent senders and multiple concurrent receivers. Sends and receives
+// use independent locks, so a Send does not wait for a Recv in progress, nor
+// vice versa. Each record is sent or received as a unit.
+//
+// Close is not serialized, so that it may be used to interrupt a Send or Recv
+// that is blocked in ch.
+func Concurrent(ch Channel) Channel { return &concurrent{ch: ch} }
+
+type concurrent struct {
+	ch     Channel
+	sendMu sync.Mutex
+	recvMu sync.Mutex
+}
+
+// Send implements part of the Channel interface.
+func (c *concurrent) Send(msg []byte) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return c.ch.Send(msg)
+}
+
+// Flush implements the Flusher interface. It is serialized with Send.
+func (c *concurrent) Flush() error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	return Flush(c.ch)
+}
+
+// Recv implements part of the Channel interface. The record is copied before
+// returning, since the underlying channel may reuse its buffer on the next
+// call to Recv, which may occur concurrently.
+func (c *concurrent) Recv() ([]byte, error) {
+	c.recvMu.Lock()
+	defer c.recvMu.Unlock()
+	msg, err := c.ch.Recv()
+	if msg != nil {
+		msg = append([]byte(nil), msg...)
+	}
+	return msg, err
+}
+
+// Close implements part of the Channel interface.
+func (c *concurrent) Close() error { return c.ch.Close() }
+
 type direct struct {
 	send chan<- []byte
 	recv <-chan []byte
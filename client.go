@@ -1,6 +1,7 @@
 package jrpc2
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -16,16 +17,24 @@ import (
 // A Client is a JSON-RPC 2.0 client. The client sends requests and receives
 // responses on a channel.Channel provided by the caller.
 type Client struct {
-	done chan struct{} // closed when the reader is done at shutdown time
+	done chan struct{}  // closed when the reader is done at shutdown time
+	dwg  sync.WaitGroup // responses received and not yet delivered
 
 	log   func(string, ...interface{}) // write debug logs here
 	enctx encoder
 	snote func(*jmessage)
 	scall func(*jmessage) []byte
 	chook func(*Client, *Response)
+	orph  func(*jmessage)
+	newID func() json.RawMessage // if set, mints request IDs
 
-	allow1 bool // tolerate v1 replies with no version marker
-	allowC bool // send rpc.cancel when a request context ends
+	allow1 bool   // tolerate v1 replies with no version marker
+	allowC bool   // send rpc.cancel when a request context ends
+	objP   bool   // require parameters to be an object
+	cancel string // the name of the built-in cancel method
+	info   string // the name of the built-in serverInfo method
+	mods   string // the name of the built-in modules method
+	maxP   int    // maximum number of pending requests (0 means no limit)
 
 	mu      sync.Mutex           // protects the fields below
 	ch      channel.Channel      // channel to the server
@@ -41,10 +50,17 @@ func NewClient(ch channel.Channel, opts *ClientOptions) *Client {
 		log:    opts.logger(),
 		allow1: opts.allowV1(),
 		allowC: opts.allowCancel(),
+		objP:   opts.objectParams(),
+		cancel: opts.builtinPrefix() + cancelMethod,
+		info:   opts.builtinPrefix() + serverInfoMethod,
+		mods:   opts.builtinPrefix() + modulesMethod,
+		maxP:   opts.maxPending(),
 		enctx:  opts.encodeContext(),
 		snote:  opts.handleNotification(),
 		scall:  opts.handleCallback(),
 		chook:  opts.handleCancel(),
+		orph:   opts.handleOrphan(),
+		newID:  opts.newID(),
 
 		// Lock-protected fields
 		ch:      ch,
@@ -67,6 +83,27 @@ func NewClient(ch channel.Channel, opts *ClientOptions) *Client {
 	return c
 }
 
+// NewChildClient returns a new client that communicates with the server via ch
+// as NewClient does, but whose lifetime is bound to ctx: When ctx ends, the
+// client is closed and any requests still pending are abandoned, as if by a
+// call to Close. The caller should still close the client when it is done.
+//
+// This is intended for use by a handler that makes calls to another server
+// on behalf of an inbound request, using the handler's context, so that
+// cancellation of the inbound request cancels its downstream calls.
+func NewChildClient(ctx context.Context, ch channel.Channel, opts *ClientOptions) *Client {
+	c := NewClient(ch, opts)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.log("Parent context ended: %v", ctx.Err())
+			c.Close()
+		case <-c.done:
+		}
+	}()
+	return c
+}
+
 // accept receives the next batch of responses from the server.  This may
 // either be a list or a single object, the decoder for jmessages knows how to
 // handle both. The caller must not hold c.mu.
@@ -80,6 +117,10 @@ func (c *Client) accept(ch channel.Receiver) error {
 		if !isUninteresting(err) {
 			c.log("Decoding error: %v", err)
 		}
+		// Deliver the responses already received before failing the
+		// requests still pending, since the server may close the connection
+		// as soon as it has replied.
+		c.dwg.Wait()
 		c.mu.Lock()
 		c.stop(err)
 		c.mu.Unlock()
@@ -87,11 +128,22 @@ func (c *Client) accept(ch channel.Receiver) error {
 	}
 
 	c.log("Received %d responses", len(in))
+	c.dwg.Add(1)
 	go func() {
+		var orphans jmessages
 		c.mu.Lock()
-		defer c.mu.Unlock()
 		for _, rsp := range in {
-			c.deliver(rsp)
+			if c.deliver(rsp) {
+				orphans = append(orphans, rsp)
+			}
+		}
+		c.mu.Unlock()
+		c.dwg.Done()
+
+		// Call the orphan hook only after delivery is complete, and without
+		// the lock, so that the hook may use the client, even to close it.
+		for _, rsp := range orphans {
+			c.orph(rsp)
 		}
 	}()
 	return nil
@@ -111,33 +163,43 @@ func (c *Client) handleRequest(msg *jmessage) {
 		c.log("Discarding callback request: %v", msg)
 	} else {
 		bits := c.scall(msg)
-		if err := c.ch.Send(bits); err != nil {
+		if err := send(c.ch, bits); err != nil {
 			c.log("Sending reply for callback %v failed: %v", msg, err)
 		}
 	}
 }
 
 // For each response, find the request pending on its ID and deliver it.  The
-// caller must hold c.mu.  Unknown response IDs are logged and discarded.  As
+// caller must hold c.mu.  Responses with unknown IDs are logged and discarded,
+// unless the client has an orphan hook, in which case deliver reports true and
+// the caller must pass rsp to the hook after releasing c.mu.  As
 // we are under the lock, we do not wait for the pending receiver to pick up
 // the response; we just drop it in their channel.  The channel is buffered so
 // we don't need to rendezvous.
-func (c *Client) deliver(rsp *jmessage) {
+func (c *Client) deliver(rsp *jmessage) bool {
 	if rsp.isRequestOrNotification() {
 		c.handleRequest(rsp)
-		return
+		return false
 	}
 
 	id := string(fixID(rsp.ID))
 	if p := c.pending[id]; p == nil {
+		if c.orph != nil {
+			c.log("Received response for unknown ID %q", id)
+			return true
+		}
 		c.log("Discarding response for unknown ID %q", id)
-	} else if !c.versionOK(rsp.V) {
+	} else if !c.versionOK(rsp) {
+		marker := "missing version marker"
+		if rsp.vraw != nil {
+			marker = "incorrect version marker " + string(rsp.vraw)
+		}
 		delete(c.pending, id)
 		p.ch <- &jmessage{
 			ID: rsp.ID,
 			E: &Error{
 				code:    code.InvalidRequest,
-				message: fmt.Sprintf("incorrect version marker %q", rsp.V),
+				message: marker,
 			},
 		}
 		c.log("Invalid response for ID %q", id)
@@ -148,6 +210,7 @@ func (c *Client) deliver(rsp *jmessage) {
 		p.ch <- rsp
 		c.log("Completed request for ID %q", id)
 	}
+	return false
 }
 
 // req constructs a fresh request for the specified method and parameters.
@@ -158,10 +221,10 @@ func (c *Client) req(ctx context.Context, method string, params interface{}) (*j
 		return nil, err
 	}
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	id := json.RawMessage(strconv.FormatInt(c.nextID, 10))
-	c.nextID++
+	id, err := c.newRequestID()
+	if err != nil {
+		return nil, err
+	}
 	return &jmessage{
 		V:  Version,
 		ID: id,
@@ -170,6 +233,19 @@ func (c *Client) req(ctx context.Context, method string, params interface{}) (*j
 	}, nil
 }
 
+// newRequestID returns a fresh ID for a request, from the NewID option of the
+// client if it was set, or otherwise from its counter.
+func (c *Client) newRequestID() (json.RawMessage, error) {
+	if c.newID != nil {
+		return checkID(c.newID())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := json.RawMessage(strconv.FormatInt(c.nextID, 10))
+	c.nextID++
+	return id, nil
+}
+
 // note constructs a notification request for the specified method and parameters.
 func (c *Client) note(ctx context.Context, method string, params interface{}) (*jmessage, error) {
 	bits, err := c.marshalParams(ctx, method, params)
@@ -199,24 +275,44 @@ func (c *Client) send(ctx context.Context, reqs jmessages) ([]*Response, error)
 	if err != nil {
 		return nil, Errorf(code.InternalError, "marshaling request failed: %v", err)
 	}
-
-	var pends []*Response
-	var pctxs []context.Context
+	var ids []string
 	for _, req := range reqs {
 		if id := string(req.ID); id != "" {
-			pctx, p := newPending(ctx, id)
-			pends = append(pends, p)
-			pctxs = append(pctxs, pctx)
+			ids = append(ids, id)
 		}
 	}
+	return c.transmit(ctx, b, ids)
+}
+
+// transmit sends the encoded request or batch b to the server, and returns
+// pending responses for the requests in b having the given IDs, which must be
+// in compact form. This method blocks until b has been transmitted.
+func (c *Client) transmit(ctx context.Context, b []byte, ids []string) ([]*Response, error) {
+	var pends []*Response
+	var pctxs []context.Context
+	for _, id := range ids {
+		pctx, p := newPending(ctx, id)
+		pends = append(pends, p)
+		pctxs = append(pctxs, pctx)
+	}
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.err != nil {
 		return nil, c.err
+	} else if c.maxP > 0 && len(c.pending)+len(pends) > c.maxP {
+		for _, p := range pends {
+			p.cancel() // release the unused pending contexts
+		}
+		return nil, ErrTooManyPending
+	} else if err := c.checkUnused(pends); err != nil {
+		for _, p := range pends {
+			p.cancel()
+		}
+		return nil, err
 	}
 	c.log("Outgoing batch: %s", string(b))
-	if err := c.ch.Send(b); err != nil {
+	if err := send(c.ch, b); err != nil {
 		return nil, err
 	}
 
@@ -230,6 +326,34 @@ func (c *Client) send(ctx context.Context, reqs jmessages) ([]*Response, error)
 	return pends, nil
 }
 
+// checkUnused reports an error if the ID of any of pends is already in use by
+// a pending request, or by another element of pends. The caller must hold c.mu.
+func (c *Client) checkUnused(pends []*Response) error {
+	seen := make(map[string]bool)
+	for _, p := range pends {
+		if c.pending[p.id] != nil || seen[p.id] {
+			c.log("Request ID %q is already in use", p.id)
+			return ErrDuplicateID
+		}
+		seen[p.id] = true
+	}
+	return nil
+}
+
+// checkID reports whether id is a valid request ID, a JSON string or number,
+// and returns it in compact form. The ID is not decoded, so numeric IDs are
+// preserved exactly even if they cannot be represented as a float64.
+func checkID(id json.RawMessage) (json.RawMessage, error) {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, id); err != nil {
+		return nil, fmt.Errorf("invalid request ID: %v", err)
+	}
+	if b := buf.Bytes(); len(b) != 0 && (b[0] == '"' || b[0] == '-' || (b[0] >= '0' && b[0] <= '9')) {
+		return b, nil
+	}
+	return nil, fmt.Errorf("invalid request ID %s", string(id))
+}
+
 // waitComplete waits for completion of the context governing p. When the
 // context ends, check whether the request is still in the pending set for the
 // client: If so, a reply has not yet been delivered.  Otherwise, the
@@ -243,7 +367,9 @@ func (c *Client) waitComplete(pctx context.Context, id string, p *Response) {
 		cleanup() // N.B. outside the lock
 	}()
 
-	if _, ok := c.pending[id]; !ok {
+	// N.B. Check that the pending request is p and not merely one with the
+	// same ID, since an ID may be reused once its response has been delivered.
+	if c.pending[id] != p {
 		return
 	}
 
@@ -272,9 +398,10 @@ func (c *Client) waitComplete(pctx context.Context, id string, p *Response) {
 			c.chook(c, p)
 		}
 	} else if c.allowC {
+		reason := cancelReason(pctx)
 		cleanup = func() {
-			c.log("Sending rpc.cancel for id %q to the server", id)
-			c.Notify(context.Background(), rpcCancel, []json.RawMessage{json.RawMessage(id)})
+			c.log("Sending %s for id %q to the server", c.cancel, id)
+			c.Notify(context.Background(), c.cancel, cancelParams(id, reason))
 		}
 	}
 }
@@ -307,6 +434,114 @@ func (c *Client) Call(ctx context.Context, method string, params interface{}) (*
 	return rsp[0], nil
 }
 
+// CallRaw sends raw to the server verbatim as a single request, and blocks
+// until the response returns. This allows a caller to send requests that
+// Call cannot produce, for example to test how a server handles unusual or
+// malformed requests. As for Call, a successful call reports a nil error and
+// a non-nil response, and errors from the server have concrete type
+// *jrpc2.Error.
+//
+// The request must be a JSON object, but its members are not otherwise
+// checked, and the client does not encode its context or parameters. If the
+// object has an "id" member, it must be a valid request ID (a string or a
+// number), and must not be in use by another pending request. Otherwise, the
+// client assigns a fresh ID, which is added as the first member of the object.
+//
+//    rsp, err := c.CallRaw(ctx, json.RawMessage(`{"jsonrpc":"2.0","method":"Add","params":[1,2]}`))
+//
+func (c *Client) CallRaw(ctx context.Context, raw json.RawMessage) (*Response, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil || obj == nil {
+		return nil, errors.New("raw request is not a JSON object")
+	}
+	id, ok := obj["id"]
+	if ok {
+		cid, err := checkID(id)
+		if err != nil {
+			return nil, err
+		}
+		id = cid
+	} else {
+		nid, err := c.newRequestID()
+		if err != nil {
+			return nil, err
+		}
+		id = nid
+		body := bytes.TrimSpace(raw)[1:] // after the opening brace
+		sep := ","
+		if len(obj) == 0 {
+			sep, body = "", []byte("}")
+		}
+		raw = json.RawMessage(`{"id":` + string(id) + sep + string(body))
+	}
+	rsps, err := c.transmit(ctx, raw, []string{string(id)})
+	if err != nil {
+		return nil, err
+	}
+	rsps[0].wait()
+	if err := rsps[0].Error(); err != nil {
+		return nil, filterError(err)
+	}
+	return rsps[0], nil
+}
+
+// CallAsync initiates a single request and returns without waiting for the
+// response. Use the Await method of the result to obtain the response. The
+// request is sent before CallAsync returns, so that several calls started in
+// sequence reach the server in that order.
+//
+// The request is governed by ctx: If ctx ends before the response arrives,
+// the request is cancelled as it would be for Call.
+//
+//    p := c.CallAsync(ctx, method, params)
+//    // ... do other work ...
+//    rsp, err := p.Await(ctx)
+//
+func (c *Client) CallAsync(ctx context.Context, method string, params interface{}) *Pending {
+	req, err := c.req(ctx, method, params)
+	if err != nil {
+		return &Pending{err: err}
+	}
+	rsps, err := c.send(ctx, jmessages{req})
+	if err != nil {
+		return &Pending{err: err}
+	}
+	p := &Pending{rsp: rsps[0], done: make(chan struct{})}
+	go func() { defer close(p.done); p.rsp.wait() }()
+	return p
+}
+
+// A Pending is a call in progress, started by Client.CallAsync.
+type Pending struct {
+	rsp  *Response
+	err  error         // error from sending the request
+	done chan struct{} // closed when rsp is complete
+}
+
+// Await blocks until the response to p is available, or until ctx ends, and
+// returns the result as Call would. If ctx ends first, the request is
+// cancelled and Await reports the error from ctx, unless the response arrived
+// in the meantime. It is safe to call Await multiple times and from
+// concurrent goroutines; each call reports the same response.
+func (p *Pending) Await(ctx context.Context) (*Response, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		p.rsp.cancel()
+		<-p.done
+		if e := p.rsp.Error(); e != nil && e.code == code.Cancelled {
+			return nil, ctx.Err()
+		}
+	}
+	if err := p.rsp.Error(); err != nil {
+		return nil, filterError(err)
+	}
+	return p.rsp, nil
+}
+
 // CallResult invokes Call with the given method and params. If it succeeds,
 // the result is decoded into result. This is a convenient shorthand for Call
 // followed by UnmarshalResult. It will panic if result == nil.
@@ -370,15 +605,29 @@ func (c *Client) Notify(ctx context.Context, method string, params interface{})
 
 // Close shuts down the client, abandoning any pending in-flight requests.
 func (c *Client) Close() error {
+	_, err := c.CloseWait()
+	return err
+}
+
+// CloseWait shuts down the client as Close does, and also reports the number
+// of requests that were still awaiting a reply from the server, and were thus
+// abandoned, when the client shut down. Callers waiting on the abandoned
+// requests receive errors as for Close. If the client had already stopped,
+// for example because the server closed the channel, CloseWait reports 0.
+func (c *Client) CloseWait() (int, error) {
 	c.mu.Lock()
+	var n int
+	if c.ch != nil {
+		n = len(c.pending)
+	}
 	c.stop(errClientStopped)
 	c.mu.Unlock()
 	<-c.done
 	// Don't remark on a closed channel or EOF as a noteworthy failure.
 	if isUninteresting(c.err) {
-		return nil
+		return n, nil
 	}
-	return c.err
+	return n, c.err
 }
 
 func isUninteresting(err error) bool {
@@ -402,11 +651,14 @@ func (c *Client) stop(err error) {
 	c.ch = nil
 }
 
-func (c *Client) versionOK(v string) bool {
-	if v == "" {
+// versionOK reports whether the version marker of rsp is acceptable. A marker
+// that is present must be exactly the string Version, even if the client
+// allows the marker to be omitted.
+func (c *Client) versionOK(rsp *jmessage) bool {
+	if rsp.vraw == nil {
 		return c.allow1
 	}
-	return v == Version
+	return rsp.V == Version
 }
 
 // marshalParams validates and marshals params to JSON for a request.  The
@@ -415,6 +667,22 @@ func (c *Client) marshalParams(ctx context.Context, method string, params interf
 	if params == nil {
 		return c.enctx(ctx, method, nil) // no parameters, that is OK
 	}
+	pbits, err := encodeParams(params)
+	if err != nil {
+		return nil, err
+	} else if c.objP && pbits[0] == '[' {
+		return nil, Errorf(code.InvalidRequest, "invalid parameters: object required")
+	}
+	bits, err := c.enctx(ctx, method, pbits)
+	if err != nil {
+		return nil, err
+	}
+	return bits, err
+}
+
+// encodeParams marshals params to JSON for a request. The value of params must
+// be encodable as a JSON object, array, or null.
+func encodeParams(params interface{}) (json.RawMessage, error) {
 	pbits, err := json.Marshal(params)
 	if err != nil {
 		return nil, err
@@ -424,11 +692,7 @@ func (c *Client) marshalParams(ctx context.Context, method string, params interf
 		// an array or an object.
 		return nil, Errorf(code.InvalidRequest, "invalid parameters: array or object required")
 	}
-	bits, err := c.enctx(ctx, method, pbits)
-	if err != nil {
-		return nil, err
-	}
-	return bits, err
+	return pbits, nil
 }
 
 func newPending(ctx context.Context, id string) (context.Context, *Response) {
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 )
 
 // A Code is an error response code.
@@ -17,7 +18,11 @@ import (
 // See also: https://www.jsonrpc.org/specification#error_object
 type Code int32
 
+// String returns the message registered for c, if there is one, or else a
+// placeholder that describes the value.
 func (c Code) String() string {
+	stdMu.RLock()
+	defer stdMu.RUnlock()
 	if s, ok := stdError[c]; ok {
 		return s
 	}
@@ -73,8 +78,13 @@ const (
 	SystemError      Code = -32098 // Errors from the operating environment
 	Cancelled        Code = -32097 // Request cancelled (context.Canceled)
 	DeadlineExceeded Code = -32096 // Request deadline exceeded (context.DeadlineExceeded)
+	Unauthorized     Code = -32095 // Request not authorized
+	Overloaded       Code = -32094 // Server resource limit exceeded
 )
 
+// stdMu protects stdError, which may be updated by Register.
+var stdMu sync.RWMutex
+
 var stdError = map[Code]string{
 	ParseError:     "parse error",
 	InvalidRequest: "invalid request",
@@ -86,13 +96,50 @@ var stdError = map[Code]string{
 	SystemError:      "system error",
 	Cancelled:        "request cancelled",
 	DeadlineExceeded: "deadline exceeded",
+	Unauthorized:     "request not authorized",
+	Overloaded:       "server overloaded",
+}
+
+// IsReserved reports whether c lies in the range reserved by the JSON-RPC
+// specification for pre-defined errors, -32768 to -32000 inclusive. Only the
+// codes defined by this package should be used from this range.
+func IsReserved(c Code) bool { return c >= -32768 && c <= -32000 }
+
+// IsApplication reports whether c is available for application-defined
+// errors, that is, whether it lies outside the reserved range.
+func IsApplication(c Code) bool { return !IsReserved(c) }
+
+// IsPredefined reports whether c is one of the codes in the reserved range
+// that are defined by this package. Since Register does not accept codes in
+// the reserved range, these are exactly the reserved codes with a message.
+func IsPredefined(c Code) bool {
+	if !IsReserved(c) {
+		return false
+	}
+	stdMu.RLock()
+	defer stdMu.RUnlock()
+	_, ok := stdError[c]
+	return ok
 }
 
 // Register adds a new Code value with the specified message string.  This
-// function will panic if the proposed value is already registered with a
-// different string.
+// function will panic if the proposed value is in the reserved range (see
+// IsReserved), or is already registered with a different string.
+//
+// Registered messages are used by Code.String and the errors returned by
+// Code.Err. It is safe to call Register concurrently with other functions
+// in this package, though codes are typically registered during package
+// initialization, e.g.,
+//
+//    var ErrQuotaExceeded = code.Register(-29000, "quota exceeded").Err()
+//
 func Register(value int32, message string) Code {
 	code := Code(value)
+	if IsReserved(code) {
+		panic(fmt.Sprintf("code %d is in the reserved range", code))
+	}
+	stdMu.Lock()
+	defer stdMu.Unlock()
 	if s, ok := stdError[code]; ok && s != message {
 		panic(fmt.Sprintf("code %d is already registered for %q", code, s))
 	}
@@ -29,6 +29,64 @@ func TestRegistrationError(t *testing.T) {
 	Register(int32(ParseError), "bogus")
 }
 
+func TestRegisterReserved(t *testing.T) {
+	for _, c := range []int32{-32768, -32500, -32001, -32000} {
+		func() {
+			defer func() {
+				if v := recover(); v == nil {
+					t.Errorf("Register(%d) did not panic", c)
+				}
+			}()
+			Register(c, "reserved")
+		}()
+	}
+}
+
+func TestIsReserved(t *testing.T) {
+	tests := []struct {
+		code Code
+		want bool
+	}{
+		{-32769, false},
+		{-32768, true},
+		{ParseError, true},
+		{InvalidRequest, true},
+		{DeadlineExceeded, true},
+		{-32001, true},
+		{-32000, true},
+		{-31999, false},
+		{0, false},
+		{1, false},
+	}
+	for _, test := range tests {
+		if got := IsReserved(test.code); got != test.want {
+			t.Errorf("IsReserved(%d): got %v, want %v", test.code, got, test.want)
+		}
+		if got := IsApplication(test.code); got == test.want {
+			t.Errorf("IsApplication(%d): got %v, want %v", test.code, got, !test.want)
+		}
+	}
+}
+
+func TestIsPredefined(t *testing.T) {
+	// Every code defined by this package is pre-defined.
+	for _, c := range []Code{
+		ParseError, InvalidRequest, MethodNotFound, InvalidParams, InternalError,
+		NoError, SystemError, Cancelled, DeadlineExceeded, Unauthorized, Overloaded,
+	} {
+		if !IsPredefined(c) {
+			t.Errorf("IsPredefined(%d): got false, want true", c)
+		}
+	}
+	// Other reserved codes, and registered application codes, are not.
+	app := Register(-29501, "test application code")
+	for _, c := range []Code{-32768, -32001, -32000, -31999, 0, 1, app} {
+		if IsPredefined(c) {
+			t.Errorf("IsPredefined(%d): got true, want false", c)
+		}
+	}
+}
+
 type testCoder Code
 
 func (t testCoder) Code() Code  { return Code(t) }
@@ -47,6 +105,8 @@ func TestFromError(t *testing.T) {
 		{fmt.Errorf("wrapped cancellation: %w", context.Canceled), Cancelled},
 		{context.DeadlineExceeded, DeadlineExceeded},
 		{fmt.Errorf("wrapped deadline: %w", context.DeadlineExceeded), DeadlineExceeded},
+		{fmt.Errorf("a: %w", fmt.Errorf("b: %w", fmt.Errorf("c: %w", context.DeadlineExceeded))), DeadlineExceeded},
+		{fmt.Errorf("a: %w", fmt.Errorf("b: %w", testCoder(MethodNotFound))), MethodNotFound},
 		{errors.New("other"), SystemError},
 		{io.EOF, SystemError},
 	}
@@ -118,3 +178,47 @@ func TestErr(t *testing.T) {
 		}
 	}
 }
+
+func TestRegisteredWrapped(t *testing.T) {
+	quota := Register(-29000, "quota exceeded")
+	errQuota := quota.Err()
+	if got, want := errQuota.Error(), "quota exceeded"; got != want {
+		t.Errorf("Err(): got %q, want %q", got, want)
+	}
+
+	// A registered code survives multiple layers of wrapping, and errors
+	// created from the same code are equivalent.
+	err := fmt.Errorf("handler: %w", fmt.Errorf("storage: %w", errQuota))
+	if got := FromError(err); got != quota {
+		t.Errorf("FromError(%v): got %v, want %v", err, got, quota)
+	}
+	if !errors.Is(err, quota.Err()) {
+		t.Errorf("Is(%v, %v): got false, want true", err, quota.Err())
+	}
+	if errors.Is(err, InternalError.Err()) {
+		t.Errorf("Is(%v, %v): got true, want false", err, InternalError.Err())
+	}
+
+	// A custom Coder buried in the chain is also recognized.
+	err = fmt.Errorf("outer: %w", fmt.Errorf("inner: %w", testCoder(quota)))
+	if got := FromError(err); got != quota {
+		t.Errorf("FromError(%v): got %v, want %v", err, got, quota)
+	}
+}
+
+func TestRegisterConcurrent(t *testing.T) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := int32(0); i < 100; i++ {
+			Register(-28000-i, fmt.Sprintf("code %d", i))
+		}
+	}()
+	for i := int32(0); i < 100; i++ {
+		_ = Code(-28000 - i).String()
+	}
+	<-done
+	if got, want := Code(-28099).String(), "code 99"; got != want {
+		t.Errorf("String: got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,18 @@
+module github.com/yinfei8/jrpc2/code/grpcstatus
+
+require (
+	github.com/yinfei8/jrpc2 v0.0.0
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20230822172742-b8732ec3820d
+	google.golang.org/grpc v1.59.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	google.golang.org/protobuf v1.31.0 // indirect
+)
+
+replace github.com/yinfei8/jrpc2 => ../..
+
+go 1.19
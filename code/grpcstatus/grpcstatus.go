@@ -0,0 +1,150 @@
+// Package grpcstatus provides conversions between jrpc2 error codes and
+// values and the status codes and values used by gRPC.
+//
+// This package is a separate module so that programs using jrpc2 do not
+// depend on gRPC unless they import it.
+package grpcstatus
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/code"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Domain is the value of the Domain field in the ErrorInfo detail attached to
+// a status by ToStatus.
+const Domain = "jrpc2"
+
+// Reason is the value of the Reason field in the ErrorInfo detail attached to
+// a status by ToStatus.
+const Reason = "JSONRPC_ERROR"
+
+// Keys of the ErrorInfo metadata written by ToStatus.
+const (
+	codeKey = "code"
+	dataKey = "data"
+)
+
+// toGRPC maps jrpc2 codes to gRPC codes.
+var toGRPC = map[code.Code]codes.Code{
+	code.NoError:          codes.OK,
+	code.ParseError:       codes.InvalidArgument,
+	code.InvalidRequest:   codes.InvalidArgument,
+	code.MethodNotFound:   codes.Unimplemented,
+	code.InvalidParams:    codes.InvalidArgument,
+	code.InternalError:    codes.Internal,
+	code.SystemError:      codes.Unknown,
+	code.Cancelled:        codes.Canceled,
+	code.DeadlineExceeded: codes.DeadlineExceeded,
+	code.Unauthorized:     codes.Unauthenticated,
+	code.Overloaded:       codes.ResourceExhausted,
+}
+
+// fromGRPC maps gRPC codes to jrpc2 codes.
+var fromGRPC = map[codes.Code]code.Code{
+	codes.OK:                code.NoError,
+	codes.Canceled:          code.Cancelled,
+	codes.InvalidArgument:   code.InvalidParams,
+	codes.OutOfRange:        code.InvalidParams,
+	codes.DeadlineExceeded:  code.DeadlineExceeded,
+	codes.Unimplemented:     code.MethodNotFound,
+	codes.Internal:          code.InternalError,
+	codes.DataLoss:          code.InternalError,
+	codes.Unauthenticated:   code.Unauthorized,
+	codes.ResourceExhausted: code.Overloaded,
+}
+
+// ToGRPC returns the gRPC status code corresponding to c.
+// The pre-defined codes map as follows:
+//
+//	NoError                                     OK
+//	ParseError, InvalidRequest, InvalidParams   InvalidArgument
+//	MethodNotFound                              Unimplemented
+//	InternalError                               Internal
+//	SystemError                                 Unknown
+//	Cancelled                                   Canceled
+//	DeadlineExceeded                            DeadlineExceeded
+//	Unauthorized                                Unauthenticated
+//	Overloaded                                  ResourceExhausted
+//
+// All other codes, including application-defined codes, map to Unknown.
+func ToGRPC(c code.Code) codes.Code {
+	if g, ok := toGRPC[c]; ok {
+		return g
+	}
+	return codes.Unknown
+}
+
+// FromGRPC returns the jrpc2 code corresponding to the gRPC status code g.
+// The canonical gRPC codes map as follows:
+//
+//	OK                            NoError
+//	Canceled                      Cancelled
+//	InvalidArgument, OutOfRange   InvalidParams
+//	DeadlineExceeded              DeadlineExceeded
+//	Unimplemented                 MethodNotFound
+//	Internal, DataLoss            InternalError
+//	Unauthenticated               Unauthorized
+//	ResourceExhausted             Overloaded
+//
+// All other codes, including Unknown, map to SystemError.
+func FromGRPC(g codes.Code) code.Code {
+	if c, ok := fromGRPC[g]; ok {
+		return c
+	}
+	return code.SystemError
+}
+
+// ToStatus converts e to a gRPC status. The status code is ToGRPC(e.Code())
+// and the status message is e.Message(). The original code and the error
+// data, if any, are recorded in an ErrorInfo detail so that FromStatus can
+// recover them exactly. If e == nil, ToStatus returns an OK status.
+func ToStatus(e *jrpc2.Error) *status.Status {
+	if e == nil {
+		return status.New(codes.OK, "")
+	}
+	st := status.New(ToGRPC(e.Code()), e.Message())
+	info := &errdetails.ErrorInfo{
+		Reason:   Reason,
+		Domain:   Domain,
+		Metadata: map[string]string{codeKey: strconv.Itoa(int(e.Code()))},
+	}
+	if e.HasData() {
+		info.Metadata[dataKey] = string(e.Data())
+	}
+	if ds, err := st.WithDetails(info); err == nil {
+		return ds
+	}
+	return st
+}
+
+// FromStatus converts st to a *jrpc2.Error, or returns nil if st reports
+// success. If st carries the ErrorInfo detail written by ToStatus, the
+// original code and error data are restored from it; otherwise the code is
+// FromGRPC(st.Code()) and the error has no data.
+func FromStatus(st *status.Status) *jrpc2.Error {
+	if st.Code() == codes.OK {
+		return nil
+	}
+	c := FromGRPC(st.Code())
+	var data json.RawMessage
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if !ok || info.GetDomain() != Domain || info.GetReason() != Reason {
+			continue
+		}
+		if v, err := strconv.ParseInt(info.Metadata[codeKey], 10, 32); err == nil {
+			c = code.Code(v)
+		}
+		if s, ok := info.Metadata[dataKey]; ok && json.Valid([]byte(s)) {
+			data = json.RawMessage(s)
+		}
+		break
+	}
+	return jrpc2.NewError(c, st.Message(), data)
+}
@@ -0,0 +1,139 @@
+package grpcstatus
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/code"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestToGRPC(t *testing.T) {
+	tests := []struct {
+		in   code.Code
+		want codes.Code
+	}{
+		{code.NoError, codes.OK},
+		{code.ParseError, codes.InvalidArgument},
+		{code.InvalidRequest, codes.InvalidArgument},
+		{code.MethodNotFound, codes.Unimplemented},
+		{code.InvalidParams, codes.InvalidArgument},
+		{code.InternalError, codes.Internal},
+		{code.SystemError, codes.Unknown},
+		{code.Cancelled, codes.Canceled},
+		{code.DeadlineExceeded, codes.DeadlineExceeded},
+		{code.Unauthorized, codes.Unauthenticated},
+		{code.Overloaded, codes.ResourceExhausted},
+
+		// Reserved but undefined, and application-defined codes.
+		{-32000, codes.Unknown},
+		{-32500, codes.Unknown},
+		{0, codes.Unknown},
+		{1, codes.Unknown},
+		{-29000, codes.Unknown},
+	}
+	for _, test := range tests {
+		if got := ToGRPC(test.in); got != test.want {
+			t.Errorf("ToGRPC(%d): got %v, want %v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestFromGRPC(t *testing.T) {
+	tests := []struct {
+		in   codes.Code
+		want code.Code
+	}{
+		{codes.OK, code.NoError},
+		{codes.Canceled, code.Cancelled},
+		{codes.Unknown, code.SystemError},
+		{codes.InvalidArgument, code.InvalidParams},
+		{codes.DeadlineExceeded, code.DeadlineExceeded},
+		{codes.NotFound, code.SystemError},
+		{codes.AlreadyExists, code.SystemError},
+		{codes.PermissionDenied, code.SystemError},
+		{codes.ResourceExhausted, code.Overloaded},
+		{codes.FailedPrecondition, code.SystemError},
+		{codes.Aborted, code.SystemError},
+		{codes.OutOfRange, code.InvalidParams},
+		{codes.Unimplemented, code.MethodNotFound},
+		{codes.Internal, code.InternalError},
+		{codes.Unavailable, code.SystemError},
+		{codes.DataLoss, code.InternalError},
+		{codes.Unauthenticated, code.Unauthorized},
+
+		// Not a canonical code.
+		{codes.Code(99), code.SystemError},
+	}
+	for _, test := range tests {
+		if got := FromGRPC(test.in); got != test.want {
+			t.Errorf("FromGRPC(%v): got %d, want %d", test.in, got, test.want)
+		}
+	}
+}
+
+// Verify that every canonical gRPC code that has a direct counterpart
+// survives a round trip through FromGRPC and ToGRPC.
+func TestRoundTripGRPC(t *testing.T) {
+	for g := codes.OK; g <= codes.Unauthenticated; g++ {
+		c := FromGRPC(g)
+		back := ToGRPC(c)
+		switch g {
+		case codes.OK, codes.Canceled, codes.Unknown, codes.InvalidArgument,
+			codes.DeadlineExceeded, codes.Unimplemented, codes.Internal,
+			codes.ResourceExhausted, codes.Unauthenticated:
+			if back != g {
+				t.Errorf("Round trip of %v: got %v (via %d)", g, back, c)
+			}
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tests := []*jrpc2.Error{
+		jrpc2.NewError(code.InvalidParams, "bad params", nil),
+		jrpc2.NewError(code.MethodNotFound, "no such method", nil),
+		jrpc2.NewError(code.DeadlineExceeded, "too slow", nil),
+		jrpc2.NewError(-29000, "application error", nil),
+		jrpc2.NewError(-29001, "with data", json.RawMessage(`{"a": 1, "b": [true, null]}`)),
+		jrpc2.NewError(code.InternalError, "", json.RawMessage(`"text"`)),
+	}
+	for _, e := range tests {
+		st := ToStatus(e)
+		if got, want := st.Code(), ToGRPC(e.Code()); got != want {
+			t.Errorf("ToStatus(%v) code: got %v, want %v", e, got, want)
+		}
+		if got, want := st.Message(), e.Message(); got != want {
+			t.Errorf("ToStatus(%v) message: got %q, want %q", e, got, want)
+		}
+
+		// Round trip through the wire format of the status.
+		back := FromStatus(status.FromProto(st.Proto()))
+		if !jrpc2.ErrorEqual(back, e) {
+			t.Errorf("FromStatus(ToStatus(%v)): got %v, data %s", e, back, back.Data())
+		}
+	}
+}
+
+func TestStatusNil(t *testing.T) {
+	if st := ToStatus(nil); st.Code() != codes.OK {
+		t.Errorf("ToStatus(nil): got %v, want OK", st.Code())
+	}
+	if e := FromStatus(status.New(codes.OK, "fine")); e != nil {
+		t.Errorf("FromStatus(OK): got %v, want nil", e)
+	}
+	if e := FromStatus(nil); e != nil {
+		t.Errorf("FromStatus(nil): got %v, want nil", e)
+	}
+}
+
+func TestFromStatusForeign(t *testing.T) {
+	// A status not produced by ToStatus uses the code mapping alone.
+	e := FromStatus(status.New(codes.Unimplemented, "nope"))
+	want := jrpc2.NewError(code.MethodNotFound, "nope", nil)
+	if !jrpc2.ErrorEqual(e, want) {
+		t.Errorf("FromStatus: got %v, want %v", e, want)
+	}
+}
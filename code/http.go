@@ -0,0 +1,100 @@
+package code
+
+import (
+	"net/http"
+	"sync"
+)
+
+// StatusClientClosedRequest is the non-standard HTTP status used by some
+// servers to report that the client cancelled a request before it completed.
+const StatusClientClosedRequest = 499
+
+// httpMu protects the HTTP status registry.
+var httpMu sync.RWMutex
+
+// toHTTP maps codes to HTTP status values. Entries added by RegisterHTTPStatus
+// take precedence over these defaults.
+var toHTTP = map[Code]int{
+	NoError:          http.StatusOK,
+	ParseError:       http.StatusBadRequest,
+	InvalidRequest:   http.StatusBadRequest,
+	MethodNotFound:   http.StatusNotFound,
+	InvalidParams:    http.StatusUnprocessableEntity,
+	InternalError:    http.StatusInternalServerError,
+	SystemError:      http.StatusInternalServerError,
+	Cancelled:        StatusClientClosedRequest,
+	DeadlineExceeded: http.StatusGatewayTimeout,
+	Unauthorized:     http.StatusUnauthorized,
+	Overloaded:       http.StatusServiceUnavailable,
+}
+
+// fromHTTP maps HTTP status values to codes. Entries added by
+// RegisterHTTPStatus take precedence over these defaults.
+var fromHTTP = map[int]Code{
+	http.StatusBadRequest:          InvalidRequest,
+	http.StatusUnauthorized:        Unauthorized,
+	http.StatusNotFound:            MethodNotFound,
+	http.StatusUnprocessableEntity: InvalidParams,
+	http.StatusRequestTimeout:      DeadlineExceeded,
+	StatusClientClosedRequest:      Cancelled,
+	http.StatusInternalServerError: InternalError,
+	http.StatusServiceUnavailable:  Overloaded,
+	http.StatusGatewayTimeout:      DeadlineExceeded,
+}
+
+// RegisterHTTPStatus records that c corresponds to the given HTTP status, for
+// use by ToHTTPStatus and FromHTTPStatus. It replaces any previous mapping for
+// c, and it makes c the code reported by FromHTTPStatus for status. This
+// function will panic if status is not a valid HTTP status (100 to 599).
+func RegisterHTTPStatus(c Code, status int) {
+	if status < 100 || status > 599 {
+		panic("invalid HTTP status")
+	}
+	httpMu.Lock()
+	defer httpMu.Unlock()
+	toHTTP[c] = status
+	fromHTTP[status] = c
+}
+
+// ToHTTPStatus returns an HTTP status value corresponding to c.
+// Codes with a mapping recorded by RegisterHTTPStatus use that mapping.
+// Otherwise, the pre-defined codes map as follows:
+//
+//    NoError                      200 OK
+//    ParseError, InvalidRequest   400 Bad Request
+//    Unauthorized                 401 Unauthorized
+//    MethodNotFound               404 Not Found
+//    InvalidParams                422 Unprocessable Entity
+//    Cancelled                    499 Client Closed Request
+//    InternalError, SystemError   500 Internal Server Error
+//    Overloaded                   503 Service Unavailable
+//    DeadlineExceeded             504 Gateway Timeout
+//
+// and any other code maps to 500 Internal Server Error.
+func ToHTTPStatus(c Code) int {
+	httpMu.RLock()
+	defer httpMu.RUnlock()
+	if s, ok := toHTTP[c]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// FromHTTPStatus returns a Code corresponding to the HTTP status s.
+// Statuses with a mapping recorded by RegisterHTTPStatus use that mapping.
+// Otherwise, 2xx statuses map to NoError, the statuses listed for ToHTTPStatus
+// map to the corresponding codes (400 to InvalidRequest, 500 to InternalError),
+// and 408 Request Timeout maps to DeadlineExceeded. Any other 4xx status maps
+// to InvalidRequest, and any other status to SystemError.
+func FromHTTPStatus(s int) Code {
+	httpMu.RLock()
+	defer httpMu.RUnlock()
+	if c, ok := fromHTTP[s]; ok {
+		return c
+	} else if s >= 200 && s < 300 {
+		return NoError
+	} else if s >= 400 && s < 500 {
+		return InvalidRequest
+	}
+	return SystemError
+}
@@ -0,0 +1,75 @@
+package code
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestHTTPStatus(t *testing.T) {
+	tests := []struct {
+		code   Code
+		status int
+	}{
+		{NoError, http.StatusOK},
+		{ParseError, http.StatusBadRequest},
+		{InvalidRequest, http.StatusBadRequest},
+		{MethodNotFound, http.StatusNotFound},
+		{InvalidParams, http.StatusUnprocessableEntity},
+		{InternalError, http.StatusInternalServerError},
+		{SystemError, http.StatusInternalServerError},
+		{Cancelled, StatusClientClosedRequest},
+		{DeadlineExceeded, http.StatusGatewayTimeout},
+		{Overloaded, http.StatusServiceUnavailable},
+		{Code(-12345), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		if got := ToHTTPStatus(test.code); got != test.status {
+			t.Errorf("ToHTTPStatus(%v): got %d, want %d", test.code, got, test.status)
+		}
+	}
+
+	rev := []struct {
+		status int
+		code   Code
+	}{
+		{http.StatusOK, NoError},
+		{http.StatusNoContent, NoError},
+		{http.StatusBadRequest, InvalidRequest},
+		{http.StatusNotFound, MethodNotFound},
+		{http.StatusUnprocessableEntity, InvalidParams},
+		{http.StatusRequestTimeout, DeadlineExceeded},
+		{StatusClientClosedRequest, Cancelled},
+		{http.StatusTeapot, InvalidRequest},
+		{http.StatusInternalServerError, InternalError},
+		{http.StatusServiceUnavailable, Overloaded},
+		{http.StatusGatewayTimeout, DeadlineExceeded},
+		{http.StatusBadGateway, SystemError},
+		{http.StatusMovedPermanently, SystemError},
+	}
+	for _, test := range rev {
+		if got := FromHTTPStatus(test.status); got != test.code {
+			t.Errorf("FromHTTPStatus(%d): got %v, want %v", test.status, got, test.code)
+		}
+	}
+}
+
+func TestRegisterHTTPStatus(t *testing.T) {
+	const quota Code = -27000
+	if got := ToHTTPStatus(quota); got != http.StatusInternalServerError {
+		t.Errorf("ToHTTPStatus(%v) before registration: got %d, want 500", quota, got)
+	}
+	RegisterHTTPStatus(quota, http.StatusTooManyRequests)
+	if got := ToHTTPStatus(quota); got != http.StatusTooManyRequests {
+		t.Errorf("ToHTTPStatus(%v): got %d, want %d", quota, got, http.StatusTooManyRequests)
+	}
+	if got := FromHTTPStatus(http.StatusTooManyRequests); got != quota {
+		t.Errorf("FromHTTPStatus(%d): got %v, want %v", http.StatusTooManyRequests, got, quota)
+	}
+
+	defer func() {
+		if v := recover(); v == nil {
+			t.Error("RegisterHTTPStatus with an invalid status did not panic")
+		}
+	}()
+	RegisterHTTPStatus(quota, 1000)
+}
@@ -2,7 +2,11 @@ package jrpc2
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"log"
 
 	"github.com/yinfei8/jrpc2/metrics"
 )
@@ -30,6 +34,64 @@ func InboundRequest(ctx context.Context) *Request {
 
 type inboundRequestKey struct{}
 
+// RawRequest returns the encoding of the inbound request associated with the
+// given context exactly as the server received it, before parsing, or nil if
+// ctx does not have an inbound request. For a request that was part of a
+// batch, it returns only the encoding of that element of the batch.
+//
+// The context passed to the handler and to the CheckRequest hook of the
+// server will include this value, so that either can verify a signature over
+// the request. The caller must not modify the contents of the slice.
+func RawRequest(ctx context.Context) []byte {
+	if v := ctx.Value(rawRequestKey{}); v != nil {
+		return v.(json.RawMessage)
+	}
+	return nil
+}
+
+type rawRequestKey struct{}
+
+// RequestLogger returns a logger for use by the handler of the inbound request
+// associated with ctx. Each message written to the logger is tagged with the
+// method name and ID of the request, for example
+//
+//    [method="Math.Add" id=5] adding 2 values
+//
+// and is written to the Logger of the server, with its prefix and flags, and
+// subject to its LogLimit. If the flags include log.Lshortfile or
+// log.Llongfile, the location reported is that of the call to the Print,
+// Printf, or Println method of the logger. The ID is omitted for a
+// notification. If the server has no Logger, or if ctx is not from a handler,
+// the messages are discarded.
+func RequestLogger(ctx context.Context) *log.Logger {
+	s, ok := ctx.Value(serverKey{}).(*Server)
+	req := InboundRequest(ctx)
+	if !ok || s.logOut == nil || req == nil {
+		return log.New(io.Discard, "", 0)
+	}
+	tag := fmt.Sprintf("[method=%q", req.Method())
+	if !req.IsNotification() {
+		tag += " id=" + req.ID()
+	}
+	return log.New(taggedWriter{out: s.logOut, tag: tag + "] "}, "", 0)
+}
+
+// A taggedWriter writes each message to out with a tag in front of it.
+type taggedWriter struct {
+	out logOutput
+	tag string
+}
+
+// taggedDepth is the depth of the caller of a *log.Logger method such as
+// Printf, relative to the Write method of its writer: Write is called by the
+// output method of the logger, which is called by Printf.
+const taggedDepth = 3
+
+func (w taggedWriter) Write(msg []byte) (int, error) {
+	w.out(taggedDepth+1, w.tag+string(msg), false)
+	return len(msg), nil
+}
+
 // PushNotify posts a server notification to the client. If the server does not
 // have push enabled (via the AllowPush option), it reports ErrPushUnsupported.
 // This function is for use by handlers, and will panic for a non-handler context.
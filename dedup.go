@@ -0,0 +1,153 @@
+package jrpc2
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/yinfei8/jrpc2/metrics"
+)
+
+// A DedupStore retains the results of requests carrying an idempotency key,
+// so that a retried request can be answered without calling its handler
+// again. See ServerOptions.IdempotencyKey.
+//
+// By default each server has its own store. A store may instead be shared by
+// several servers (see ServerOptions.IdempotencyStore), so that a request
+// retried on a new connection, as after a reconnect, is also recognized. A
+// DedupStore is safe for concurrent use by multiple goroutines.
+type DedupStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu    sync.Mutex
+	done  map[string]*dedupEntry // by method and idempotency key
+	queue *list.List             // retained entries, in order of expiry
+}
+
+// A dedupEntry is the result of a request, or a placeholder for a request
+// whose handler is still running.
+type dedupEntry struct {
+	key     string
+	ready   chan struct{} // closed when the handler has returned
+	ok      bool          // whether the result was retained
+	val     json.RawMessage
+	err     error
+	expires time.Time
+}
+
+// NewDedupStore constructs an empty store that retains each result for the
+// given duration after its handler returns. If ttl <= 0, results are retained
+// for 5 minutes.
+func NewDedupStore(ttl time.Duration) *DedupStore {
+	if ttl <= 0 {
+		ttl = 5 * time.Minute
+	}
+	return &DedupStore{
+		ttl:   ttl,
+		now:   time.Now,
+		done:  make(map[string]*dedupEntry),
+		queue: list.New(),
+	}
+}
+
+// Len reports the number of results currently retained by d, including the
+// placeholders for requests whose handlers are still running.
+func (d *DedupStore) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire()
+	return len(d.done)
+}
+
+// expire discards retained results whose time has elapsed. Since every result
+// is retained for the same duration, the queue is in order of expiry, and
+// only its expired prefix is examined. The caller must hold d.mu.
+func (d *DedupStore) expire() {
+	now := d.now()
+	for elt := d.queue.Front(); elt != nil; elt = d.queue.Front() {
+		e := elt.Value.(*dedupEntry)
+		if now.Before(e.expires) {
+			break
+		}
+		d.queue.Remove(elt)
+		if d.done[e.key] == e {
+			delete(d.done, e.key)
+		}
+	}
+}
+
+// A dedup answers the requests of a server that carry an idempotency key from
+// the results retained in its store. A nil *dedup does not record anything.
+type dedup struct {
+	key     func(context.Context, *Request) string
+	store   *DedupStore
+	metrics *metrics.M
+}
+
+func newDedup(key func(context.Context, *Request) string, store *DedupStore, m *metrics.M) *dedup {
+	if key == nil {
+		return nil
+	}
+	return &dedup{key: key, store: store, metrics: m}
+}
+
+// do calls run to handle req, unless req has the idempotency key of an earlier
+// request for the same method whose result is still retained, in which case
+// it returns that result. If the earlier request is still running, do waits
+// for it to finish, or for ctx to end.
+func (d *dedup) do(ctx context.Context, req *Request, run func() (json.RawMessage, error)) (json.RawMessage, error) {
+	if d == nil {
+		return run()
+	}
+	key := d.key(ctx, req)
+	if key == "" {
+		return run()
+	}
+	key = req.method + "\x00" + key
+	st := d.store
+
+	for {
+		st.mu.Lock()
+		st.expire()
+		e, ok := st.done[key]
+		if !ok {
+			e = &dedupEntry{key: key, ready: make(chan struct{})}
+			st.done[key] = e
+			st.mu.Unlock()
+			return st.run(ctx, e, run)
+		}
+		st.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-e.ready:
+		}
+		if e.ok {
+			d.metrics.Count("rpc.deduplicated", 1)
+			return e.val, e.err
+		}
+		// The earlier request did not complete; try again.
+	}
+}
+
+// run calls run and records its result in e. The result is not retained if
+// ctx ended before run returned, since it may reflect the cancellation.
+func (d *DedupStore) run(ctx context.Context, e *dedupEntry, run func() (json.RawMessage, error)) (val json.RawMessage, err error) {
+	defer func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if ctx.Err() == nil {
+			e.ok, e.val, e.err = true, val, err
+			e.expires = d.now().Add(d.ttl)
+			d.queue.PushBack(e)
+		} else {
+			delete(d.done, e.key)
+		}
+		close(e.ready)
+	}()
+	return run()
+}
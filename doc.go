@@ -144,13 +144,34 @@ Cancellation
 The *jrpc2.Client and *jrpc2.Server types support a non-standard cancellation
 protocol, consisting of a notification method "rpc.cancel" taking an array of
 request IDs to be cancelled. The server cancels the context of each method
-handler whose ID is named.
+handler whose ID is named. Each element of a batch is cancelled separately,
+and the other elements of the batch are not affected.
 
 When the context associated with a client request is cancelled, the client
 sends an "rpc.cancel" notification to the server for that request's ID.  The
 "rpc.cancel" method is automatically handled (unless disabled) by the
 *jrpc2.Server implementation from this package.
 
+The client may also give a reason for the cancellation, either set explicitly
+with jrpc2.WithCancelReason or taken from the cause of the context. The reason
+is sent as an additional object member {"reason": "..."} of the array, which
+servers that do not understand it ignore. The server logs the reason, and the
+handler can recover it as a *jrpc2.CancelError from jrpc2.CancelCause.
+
+A handler that makes calls to other servers should pass its own context to
+those calls, so that cancelling the inbound request also cancels the calls it
+has made downstream. A handler that creates a client for this purpose can use
+jrpc2.NewChildClient, which closes the client and abandons its pending calls
+when the handler's context ends:
+
+   func (h *proxy) Lookup(ctx context.Context, name string) (string, error) {
+      cli := jrpc2.NewChildClient(ctx, h.dial(), nil)
+      defer cli.Close()
+      var addr string
+      err := cli.CallResult(ctx, "Resolve", []string{name}, &addr)
+      return addr, err
+   }
+
 
 Services with Multiple Methods
 
@@ -169,6 +190,9 @@ a handler.Map for those methods:
 This assigner maps the name "Add" to the Add method, and the name "Mul" to the
 Mul method, of the math value.
 
+Options to NewService can change how methods are named, for example
+handler.MethodNames(handler.LowerCamel) gives the names "add" and "mul".
+
 This may be further combined with the handler.ServiceMap type to allow
 different services to work together:
 
@@ -210,14 +234,26 @@ By default, a *jrpc2.Server exports the following built-in non-standard
 extension methods:
 
   rpc.serverInfo(null) ⇒ jrpc2.ServerInfo
-  Returns a jrpc2.ServerInfo value giving server metrics.
+  Returns a jrpc2.ServerInfo value giving server metrics and the names and
+  descriptions of the methods the server exports.
 
   rpc.cancel([]int)  [notification]
   Request cancellation of the specified in-flight request IDs.
 
+  rpc.modules(null) ⇒ map[string][]string
+  Returns the names of the methods exported by the server, grouped by
+  namespace. This method is available only if the assigner of the server
+  groups its methods into namespaces, as a handler.ServiceMap does.
+
 The rpc.cancel method works only as a notification, and will report an error if
 called as an ordinary method.
 
+If push is enabled, the Shutdown method of the server sends the client the
+following notification before the server stops:
+
+  rpc.shutdown(null)  [server push]
+  The server is about to shut down; the client should reconnect elsewhere.
+
 These extension methods are enabled by default, but may be disabled by setting
 the DisableBuiltin server option to true when constructing the server.
 
@@ -1,6 +1,7 @@
 package jrpc2
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,17 +14,34 @@ type Error struct {
 	message string
 	code    code.Code
 	data    json.RawMessage
+	cause   error // the underlying error, if any; not sent to the client
 }
 
 // Error renders e to a human-readable string for the error interface.
 func (e Error) Error() string { return fmt.Sprintf("[%d] %s", e.code, e.message) }
 
+// Unwrap returns the underlying error wrapped by e, or nil if there is none.
+// An *Error has an underlying error if it was constructed by WrapError, or by
+// the server from a non-*Error value returned by a handler. The underlying
+// error is not transmitted, so errors received by a client never have one.
+func (e Error) Unwrap() error { return e.cause }
+
+// Is reports whether target is the error value for the code of e, as
+// constructed by the Err method of code.Code. Together with Unwrap, this
+// permits errors.Is to match e against both its code and its underlying
+// error, if any.
+func (e Error) Is(target error) bool { return target != nil && target == e.code.Err() }
+
 // Code returns the error code value associated with e.
 func (e Error) Code() code.Code { return e.code }
 
 // Message returns the message string associated with e.
 func (e Error) Message() string { return e.message }
 
+// Data returns the encoded error data associated with e, or nil if there is
+// none. The caller should not modify the contents of the result.
+func (e Error) Data() json.RawMessage { return e.data }
+
 // HasData reports whether e has error data to unmarshal.
 func (e Error) HasData() bool { return len(e.data) != 0 }
 
@@ -49,10 +67,74 @@ func (e *Error) UnmarshalJSON(data []byte) error {
 	}
 	e.code = code.Code(v.C)
 	e.message = v.M
-	e.data = v.D
+	e.data = compactData(v.D)
 	return nil
 }
 
+// NewError returns a new *Error with the specified code, message, and error
+// data, which should be nil or valid JSON. This is mainly useful to construct
+// expected values for comparison in tests; see ErrorEqual.
+func NewError(code code.Code, message string, data json.RawMessage) *Error {
+	return &Error{code: code, message: message, data: compactData(data)}
+}
+
+// ErrorEqual reports whether a and b have the same code, message, and error
+// data. Error data are equal if their encodings are identical, after removing
+// insignificant whitespace. The underlying errors of a and b, if any, are not
+// compared. Two nil errors are equal.
+func ErrorEqual(a, b *Error) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.code == b.code && a.message == b.message && bytes.Equal(a.data, b.data)
+}
+
+// compactData returns data with insignificant whitespace removed, so that
+// error data survive a round trip through JSON unchanged. If data are not
+// valid JSON, they are returned as-is.
+func compactData(data json.RawMessage) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// codeNameKey is the key under which withCodeName records the code name.
+const codeNameKey = "codeName"
+
+// withCodeName returns a copy of e whose error data include the string name
+// of its code under codeNameKey, or e itself if the data cannot hold it.
+func (e *Error) withCodeName() *Error {
+	name, err := json.Marshal(e.code.String())
+	if err != nil {
+		return e
+	}
+	field := `{"` + codeNameKey + `":` + string(name)
+	var data []byte
+	if len(e.data) == 0 {
+		data = []byte(field + "}")
+	} else {
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(e.data, &obj) != nil || obj == nil {
+			return e // not an object
+		} else if _, ok := obj[codeNameKey]; ok {
+			return e
+		} else if len(obj) == 0 {
+			data = []byte(field + "}")
+		} else {
+			trim := bytes.TrimSpace(e.data)
+			data = append([]byte(field+","), bytes.TrimSpace(trim[1:])...)
+		}
+	}
+	cp := *e
+	cp.data = data
+	return &cp
+}
+
 // ErrNoData indicates that there are no data to unmarshal.
 var ErrNoData = errors.New("no data to unmarshal")
 
@@ -64,6 +146,14 @@ var errServerStopped = errors.New("the server has been stopped")
 // explicit call to its Close method.
 var errClientStopped = errors.New("the client has been stopped")
 
+// ErrTooManyPending is returned by the client's call methods if sending the
+// request would exceed the limit set by the MaxPending client option.
+var ErrTooManyPending = errors.New("too many pending requests")
+
+// ErrDuplicateID is returned by a client call when the ID chosen for a request
+// is already in use by a pending request.
+var ErrDuplicateID = errors.New("duplicate request ID")
+
 // ErrConnClosed is returned by a server's push-to-client methods if they are
 // called after the client connection is closed.
 var ErrConnClosed = errors.New("client connection is closed")
@@ -75,6 +165,41 @@ func Errorf(code code.Code, msg string, args ...interface{}) error {
 	return DataErrorf(code, nil, msg, args...)
 }
 
+// ErrorWithHTTPStatus returns an error value of concrete type *Error having
+// the specified code and message, whose error data records an HTTP status to
+// report for the error, as a JSON object of the form {"httpStatus": status}.
+// Use the HTTPStatus method of *Error to recover the status.
+//
+// This is a convention for servers that may be reached via HTTP. For example,
+// the jhttp.Bridge uses the recorded status for its HTTP response.
+func ErrorWithHTTPStatus(code code.Code, status int, msg string) error {
+	return DataErrorf(code, httpStatusData{Status: status}, "%s", msg)
+}
+
+type httpStatusData struct {
+	Status int `json:"httpStatus"`
+}
+
+// HTTPStatus reports the HTTP status recorded in the error data of e, as by
+// ErrorWithHTTPStatus, and whether such a status was found.
+func (e Error) HTTPStatus() (int, bool) {
+	var v httpStatusData
+	if err := e.UnmarshalData(&v); err != nil || v.Status == 0 {
+		return 0, false
+	}
+	return v.Status, true
+}
+
+// WrapError returns an error value of concrete type *Error having the
+// specified code, whose message is the text of err and whose underlying error
+// (as reported by Unwrap) is err. If err == nil, WrapError returns nil.
+func WrapError(code code.Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{code: code, message: err.Error(), cause: err}
+}
+
 // DataErrorf returns an error value of concrete type *Error having the
 // specified code, error data, and formatted message string.
 // If v == nil this behaves identically to Errorf(code, msg, args...).
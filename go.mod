@@ -3,7 +3,9 @@ module github.com/yinfei8/jrpc2
 require (
 	github.com/google/go-cmp v0.5.1
 	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
-	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+	golang.org/x/sys v0.7.0
 )
 
-go 1.13
+require golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
+
+go 1.18
@@ -0,0 +1,84 @@
+package handler
+
+import (
+	"context"
+	"testing"
+)
+
+func BenchmarkNew(b *testing.B) {
+	type point struct {
+		X, Y int
+	}
+	ctx := context.Background()
+	tests := []struct {
+		desc   string
+		fn     interface{}
+		params string
+	}{
+		{"CtxError", func(context.Context) error { return nil }, ``},
+		{"CtxResult", func(context.Context) (int, error) { return 1, nil }, ``},
+		{"CtxStructResult", func(_ context.Context, p point) (int, error) {
+			return p.X + p.Y, nil
+		}, `,"params":{"X":1,"Y":2}`},
+		{"CtxPtrResult", func(_ context.Context, p *point) (int, error) {
+			return p.X + p.Y, nil
+		}, `,"params":{"X":1,"Y":2}`},
+		{"CtxStructError", func(_ context.Context, p point) error {
+			return nil
+		}, `,"params":{"X":1,"Y":2}`},
+		{"CtxVariadic", func(_ context.Context, vs ...int) (int, error) {
+			return len(vs), nil
+		}, `,"params":[1,2,3]`},
+	}
+	for _, test := range tests {
+		b.Run(test.desc, func(b *testing.B) {
+			h := New(test.fn)
+			req := mustParseReq(b, `{"jsonrpc":"2.0","id":1,"method":"M"`+test.params+`}`)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := h.Handle(ctx, req); err != nil {
+					b.Fatalf("Handle failed: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkNewTyped(b *testing.B) {
+	type point struct {
+		X, Y int
+	}
+	ctx := context.Background()
+	tests := []struct {
+		desc   string
+		h      Func
+		params string
+	}{
+		{"CtxError", NewTypedNoParams(func(context.Context) (interface{}, error) { return nil, nil }), ``},
+		{"CtxResult", NewTypedNoParams(func(context.Context) (int, error) { return 1, nil }), ``},
+		{"CtxStructResult", NewTyped(func(_ context.Context, p point) (int, error) {
+			return p.X + p.Y, nil
+		}), `,"params":{"X":1,"Y":2}`},
+		{"CtxPtrResult", NewTyped(func(_ context.Context, p *point) (int, error) {
+			return p.X + p.Y, nil
+		}), `,"params":{"X":1,"Y":2}`},
+		{"CtxStructError", NewTypedNoResult(func(_ context.Context, p point) error {
+			return nil
+		}), `,"params":{"X":1,"Y":2}`},
+	}
+	for _, test := range tests {
+		b.Run(test.desc, func(b *testing.B) {
+			req := mustParseReq(b, `{"jsonrpc":"2.0","id":1,"method":"M"`+test.params+`}`)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := test.h(ctx, req); err != nil {
+					b.Fatalf("Handle failed: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"time"
+	"unicode"
 
 	"github.com/yinfei8/jrpc2"
 	"github.com/yinfei8/jrpc2/code"
@@ -23,8 +25,134 @@ func (m Func) Handle(ctx context.Context, req *jrpc2.Request) (interface{}, erro
 	return m(ctx, req)
 }
 
+// Deprecated wraps h to mark its method as deprecated, with a message that
+// describes the deprecation, such as what the caller should use instead.
+//
+// The resulting handler behaves identically to h, and its responses are not
+// changed. However, a *jrpc2.Server logs a warning including msg the first
+// time the method is called, and counts calls to deprecated methods in the
+// "rpc.deprecatedCalls" server metric.
+func Deprecated(h jrpc2.Handler, msg string) jrpc2.Handler { return deprecated{h, msg} }
+
+type deprecated struct {
+	jrpc2.Handler
+	msg string
+}
+
+// Deprecated reports the deprecation message for d.
+func (d deprecated) Deprecated() string { return d.msg }
+
+// Describe returns the metadata for the underlying handler, if any, with the
+// deprecation message of d.
+func (d deprecated) Describe() Info {
+	info, _ := infoOf(d.Handler)
+	info.Deprecated = d.msg
+	return info
+}
+
+// WithContext wraps h so that each request is delivered to it with the
+// context returned by calling fn on the original request context. This allows
+// values needed by a particular method, such as a database handle, to be
+// attached to its context without affecting other methods.
+func WithContext(h jrpc2.Handler, fn func(context.Context) context.Context) jrpc2.Handler {
+	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		return h.Handle(fn(ctx), req)
+	})
+}
+
+// Chain returns a handler that applies the given middleware to h, so that
+// the first middleware is the outermost. For example, Chain(h, A, B) is
+// equivalent to A(B(h)). If no middleware is given, Chain returns h.
+func Chain(h jrpc2.Handler, mw ...func(jrpc2.Handler) jrpc2.Handler) jrpc2.Handler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// Safe wraps h so that a panic while handling a request is recovered and
+// reported as an error with code.InternalError, rather than terminating the
+// program.
+func Safe(h jrpc2.Handler) jrpc2.Handler {
+	return Func(func(ctx context.Context, req *jrpc2.Request) (v interface{}, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				v, err = nil, jrpc2.Errorf(code.InternalError, "handler panicked: %v", p)
+			}
+		}()
+		return h.Handle(ctx, req)
+	})
+}
+
+// Timed wraps h so that observe is called after each request is handled,
+// with the method name, the elapsed time, and the error reported by h.
+func Timed(h jrpc2.Handler, observe func(method string, d time.Duration, err error)) jrpc2.Handler {
+	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		start := time.Now()
+		v, err := h.Handle(ctx, req)
+		observe(req.Method(), time.Since(start), err)
+		return v, err
+	})
+}
+
+// MapApply returns a new Map with the same method names as m, in which the
+// handler for each name is the result of calling f with the name and the
+// handler from m. The map m is not modified. For example, to make every
+// method of m safe:
+//
+//    safe := handler.MapApply(m, func(_ string, h jrpc2.Handler) jrpc2.Handler {
+//       return handler.Safe(h)
+//    })
+//
+// If a handler in m has metadata (see Describer) and the handler returned by f
+// for it does not, the result is wrapped so that it reports the metadata of
+// the original.
+func MapApply(m Map, f func(name string, h jrpc2.Handler) jrpc2.Handler) Map {
+	out := make(Map, len(m))
+	for name, h := range m {
+		w := f(name, h)
+		if info, ok := infoOf(h); ok && w != nil {
+			if _, ok := infoOf(w); !ok {
+				w = WithInfo(w, info)
+			}
+		}
+		out[name] = w
+	}
+	return out
+}
+
+// Merge returns a new Map containing the methods of all the given maps, which
+// are not modified. If any method name is defined in more than one of the
+// maps, Merge reports an error naming the duplicates.
+func Merge(maps ...Map) (Map, error) {
+	out := make(Map)
+	seen := make(map[string]int) // name → number of definitions
+	for _, m := range maps {
+		for name, h := range m {
+			seen[name]++
+			out[name] = h
+		}
+	}
+	var dups []string
+	for name, n := range seen {
+		if n > 1 {
+			dups = append(dups, name)
+		}
+	}
+	if len(dups) != 0 {
+		sort.Strings(dups)
+		return nil, fmt.Errorf("duplicate method names: %s", strings.Join(dups, ", "))
+	}
+	return out, nil
+}
+
 // A Map is a trivial implementation of the jrpc2.Assigner interface that looks
 // up method names in a map of static jrpc2.Handler values.
+//
+// A Map must not be modified while it is in use by a server. Provided it is
+// not modified, its methods are safe for concurrent use, and Names reports a
+// consistent snapshot of the method names. To add and remove methods while a
+// server is running, use a SyncMap instead.
 type Map map[string]jrpc2.Handler
 
 // Assign implements part of the jrpc2.Assigner interface.
@@ -40,8 +168,35 @@ func (m Map) Names() []string {
 	return names
 }
 
+// Merge adds the methods of other to m. If any method name in other is
+// already defined in m, Merge reports an error naming the duplicates and m is
+// not modified.
+func (m Map) Merge(other Map) error {
+	var dups []string
+	for name := range other {
+		if _, ok := m[name]; ok {
+			dups = append(dups, name)
+		}
+	}
+	if len(dups) != 0 {
+		sort.Strings(dups)
+		return fmt.Errorf("duplicate method names: %s", strings.Join(dups, ", "))
+	}
+	m.MergeOverwrite(other)
+	return nil
+}
+
+// MergeOverwrite adds the methods of other to m. If a method name in other is
+// already defined in m, the handler from other replaces it.
+func (m Map) MergeOverwrite(other Map) {
+	for name, h := range other {
+		m[name] = h
+	}
+}
+
 // A ServiceMap combines multiple assigners into one, permitting a server to
-// export multiple services under different names.
+// export multiple services under different names. A ServiceMap is itself an
+// assigner, so service maps may be nested.
 //
 // Example:
 //    m := handler.ServiceMap{
@@ -49,35 +204,61 @@ func (m Map) Names() []string {
 //      "Bar": handler.NewService(barService),  // methods Bar.A, Bar.B, etc.
 //    }
 //
+// The assigner for the empty service name "", if there is one, serves as a
+// fallback namespace for methods that are not otherwise matched, and it
+// receives the full method name.
 type ServiceMap map[string]jrpc2.Assigner
 
 // Assign splits the inbound method name as Service.Method, and passes the
 // Method portion to the corresponding Service assigner. If method does not
-// have the form Service.Method, or if Service is not set in m, the lookup
-// fails and returns nil.
+// have the form Service.Method, or if Service is not set in m, the full method
+// name is passed to the fallback assigner for the empty service name if it is
+// set; otherwise the lookup fails and returns nil.
 func (m ServiceMap) Assign(ctx context.Context, method string) jrpc2.Handler {
 	parts := strings.SplitN(method, ".", 2)
-	if len(parts) == 1 {
-		return nil
-	} else if ass, ok := m[parts[0]]; ok {
-		return ass.Assign(ctx, parts[1])
+	if len(parts) == 2 && parts[0] != "" {
+		if ass, ok := m[parts[0]]; ok {
+			return ass.Assign(ctx, parts[1])
+		}
+	}
+	if ass, ok := m[""]; ok {
+		return ass.Assign(ctx, method)
 	}
 	return nil
 }
 
 // Names reports the composed names of all the methods in the service, each
-// having the form Service.Method.
+// having the form Service.Method, in sorted order. The names of methods in
+// the fallback namespace are reported without a service prefix.
 func (m ServiceMap) Names() []string {
 	var all []string
 	for svc, assigner := range m {
 		for _, name := range assigner.Names() {
-			all = append(all, svc+"."+name)
+			if svc != "" {
+				name = svc + "." + name
+			}
+			all = append(all, name)
 		}
 	}
 	sort.Strings(all)
 	return all
 }
 
+// Modules reports the names of the methods in each service of m, keyed by the
+// service name, without the service prefix and in sorted order. The methods
+// of the fallback namespace are reported under the empty service name. A
+// server whose assigner is a ServiceMap reports this value from its built-in
+// rpc.modules method.
+func (m ServiceMap) Modules() map[string][]string {
+	mods := make(map[string][]string, len(m))
+	for svc, assigner := range m {
+		names := append([]string(nil), assigner.Names()...)
+		sort.Strings(names)
+		mods[svc] = names
+	}
+	return mods
+}
+
 // New adapts a function to a jrpc2.Handler. The concrete value of fn must be a
 // function with one of the following type signatures:
 //
@@ -90,49 +271,160 @@ func (m ServiceMap) Names() []string {
 //    func(context.Context, ...X) (Y, error)
 //    func(context.Context, *jrpc2.Request) (Y, error)
 //    func(context.Context, *jrpc2.Request) (interface{}, error)
+//    func(context.Context, *jrpc2.Request, X) (Y, error)
+//
+// for JSON-marshalable types X and Y. The context.Context parameter may be
+// omitted from any of these forms, for functions that do not need it; for
+// example, func(X) (Y, error) and func() Y are also accepted. New will panic
+// if the type of fn does not have one of these forms.  The resulting method
+// will handle encoding and decoding of JSON and report appropriate errors.
 //
-// for JSON-marshalable types X and Y. New will panic if the type of fn does
-// not have one of these forms.  The resulting method will handle encoding and
-// decoding of JSON and report appropriate errors.
+// If Y is json.RawMessage, the result is assumed to be already encoded, and
+// the server sends it without re-encoding it (an empty message is sent as
+// null). A function that returns only an error has no result: A call to it
+// gets a null result, and for a notification nothing is encoded at all. A
+// function with an error result may also return the sentinel NoResult as its
+// error to report success without a result; any value of Y it returns is
+// then discarded without being encoded, and a call gets a null result.
+//
+// If X is a struct type, or a pointer to one, whose fields have "jrpc2" tags,
+// the decoded parameters are checked and defaults are applied as described
+// by Validate before fn is called. New will panic if any such tag is invalid.
 //
 // Functions adapted by in this way can obtain the *jrpc2.Request value using
 // the jrpc2.InboundRequest helper on the context value supplied by the server.
-func New(fn interface{}) Func {
-	m, err := newHandler(fn)
+// Alternatively, a function may accept the request as a parameter before the
+// decoded parameters X, with any of the result forms above. The parameters are
+// decoded and checked exactly as for a function that does not take the
+// request, including for notifications and requests without parameters.
+//
+// The options, if any, control how the parameters are decoded; for example:
+//
+//    h := handler.New(fn, handler.StrictFields(), handler.AllowNullParams())
+//
+func New(fn interface{}, opts ...Option) Func {
+	m, err := newHandler(fn, opts...)
 	if err != nil {
-		panic(err)
+		panic(fmt.Errorf("%w; %s", err, signatures))
 	}
 	return m
 }
 
+// signatures describes the function signatures accepted by New, for use in
+// error messages.
+const signatures = "accepted signatures are func([context.Context][, X]) error, " +
+	"func([context.Context][, X]) Y, and func([context.Context][, X]) (Y, error), " +
+	"where X may be T, *jrpc2.Request, a variadic ...T, or *jrpc2.Request followed by T, " +
+	"and the error may be handler.NoResult to report no result"
+
 // NewService adapts the methods of a value to a map from method names to
-// Handler implementations as constructed by New. It will panic if obj has no
-// exported methods with a suitable signature.
-func NewService(obj interface{}) Map {
+// Handler implementations as constructed by New. Only exported methods whose
+// signatures are accepted by New are included; by default each is named
+// after its Go method, and other methods are skipped. The options may change
+// these rules; see MethodNames and StrictMethods.
+//
+// NewService will panic if obj has no exported methods with a suitable
+// signature, or if two methods are given the same name.
+func NewService(obj interface{}, opts ...ServiceOption) Map {
+	var cfg serviceConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	out := make(Map)
 	val := reflect.ValueOf(obj)
 	typ := val.Type()
 
 	// This considers only exported methods, as desired.
+	var bad []string
 	for i, n := 0, val.NumMethod(); i < n; i++ {
 		mi := val.Method(i)
-		if v, err := newHandler(mi.Interface()); err == nil {
-			out[typ.Method(i).Name] = v
+		v, err := newHandler(mi.Interface(), cfg.hopts...)
+		if err != nil {
+			bad = append(bad, fmt.Sprintf("%s (%v)", typ.Method(i).Name, err))
+			continue
 		}
+		name := cfg.name(typ.Method(i).Name)
+		if _, ok := out[name]; ok {
+			panic(fmt.Sprintf("duplicate method name %q", name))
+		}
+		out[name] = v
 	}
-	if len(out) == 0 {
+	if cfg.strict && len(bad) != 0 {
+		panic("incompatible methods: " + strings.Join(bad, ", ") + "; " + signatures)
+	} else if len(out) == 0 {
 		panic("no matching exported methods")
 	}
 	return out
 }
 
+// A ServiceOption configures the behaviour of NewService.
+type ServiceOption func(*serviceConfig)
+
+type serviceConfig struct {
+	names  func(string) string
+	strict bool
+	hopts  []Option
+}
+
+func (c *serviceConfig) name(method string) string {
+	if c.names == nil {
+		return method
+	}
+	return c.names(method)
+}
+
+// MethodNames instructs NewService to name each method by calling f with
+// the name of its Go method. See also LowerCamel and Prefixed.
+func MethodNames(f func(method string) string) ServiceOption {
+	return func(c *serviceConfig) { c.names = f }
+}
+
+// StrictMethods instructs NewService to panic if any exported method of the
+// value does not have a signature accepted by New, rather than skipping it.
+func StrictMethods() ServiceOption {
+	return func(c *serviceConfig) { c.strict = true }
+}
+
+// LowerCamel converts an exported Go name into lower camel case, for use
+// with MethodNames. A leading run of capitals is treated as one word, so
+// for example "Add" becomes "add" and "HTTPStatus" becomes "httpStatus".
+func LowerCamel(name string) string {
+	rs := []rune(name)
+	for i := range rs {
+		if !unicode.IsUpper(rs[i]) {
+			break
+		} else if i > 0 && i+1 < len(rs) && unicode.IsLower(rs[i+1]) {
+			break // the start of the next word
+		}
+		rs[i] = unicode.ToLower(rs[i])
+	}
+	return string(rs)
+}
+
+// Prefixed returns a naming function for use with MethodNames that names
+// each method as prefix.Method, for example "Math.Add".
+func Prefixed(prefix string) func(string) string {
+	return func(method string) string { return prefix + "." + method }
+}
+
 var (
 	ctxType = reflect.TypeOf((*context.Context)(nil)).Elem() // type context.Context
 	errType = reflect.TypeOf((*error)(nil)).Elem()           // type error
 	reqType = reflect.TypeOf((*jrpc2.Request)(nil))          // type *jrpc2.Request
 )
 
-func newHandler(fn interface{}) (Func, error) {
+func newHandler(fn interface{}, opts ...Option) (Func, error) {
+	cfg := newConfig(opts)
+	f, err := buildHandler(fn, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.wrap(f), nil
+}
+
+// buildHandler adapts fn to a handler that decodes its parameters according
+// to cfg, as described by New.
+func buildHandler(fn interface{}, cfg handlerConfig) (Func, error) {
 	if fn == nil {
 		return nil, errors.New("nil method")
 	}
@@ -143,127 +435,193 @@ func newHandler(fn interface{}) (Func, error) {
 		return Func(f), nil
 	}
 
+	// Special cases: Functions that take no parameters and report only an
+	// error, or a result of type interface{}, can be called directly.
+	switch f := fn.(type) {
+	case func(context.Context) error:
+		return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+			if cfg.hasParams(req) {
+				return nil, errNoParams
+			}
+			return result(nil, f(ctx))
+		}), nil
+	case func(context.Context) (interface{}, error):
+		return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+			if cfg.hasParams(req) {
+				return nil, errNoParams
+			}
+			return result(f(ctx))
+		}), nil
+	}
+
 	// Check that fn is a function of one of the correct forms.
 	typ, err := checkFunctionType(fn)
 	if err != nil {
 		return nil, err
 	}
 
-	// Construct a function to unpack the parameters from the request message,
-	// based on the signature of the user's callback.
-	var newinput func(req *jrpc2.Request) ([]reflect.Value, error)
+	// All the decisions that depend on the signature of the user's callback
+	// are made here, once, so that the handler for each request only has to
+	// decode the parameters and make the call.
+	decodeOut := resultDecoder(typ)
+	f := reflect.ValueOf(fn)
+	call := f.Call
+	if typ.IsVariadic() {
+		call = f.CallSlice
+	}
 
-	if typ.NumIn() == 1 {
+	// If the function does not want the context, it is not passed.
+	np := typ.NumIn()
+	args := func(ctx context.Context, rest ...reflect.Value) []reflect.Value {
+		return rest
+	}
+	if hasContext(typ) {
+		np--
+		args = func(ctx context.Context, rest ...reflect.Value) []reflect.Value {
+			return append([]reflect.Value{reflect.ValueOf(ctx)}, rest...)
+		}
+	}
+
+	if np == 0 {
 		// Case 1: The function does not want any request parameters.
 		// Nothing needs to be decoded, but verify no parameters were passed.
-		newinput = func(req *jrpc2.Request) ([]reflect.Value, error) {
-			if req.HasParams() {
-				return nil, jrpc2.Errorf(code.InvalidParams, "no parameters accepted")
+		return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+			if cfg.hasParams(req) {
+				return nil, errNoParams
 			}
-			return nil, nil
-		}
+			return decodeOut(call(args(ctx)))
+		}), nil
 
-	} else if a := typ.In(1); a == reqType {
+	} else if np == 1 && typ.In(typ.NumIn()-1) == reqType {
 		// Case 2: The function wants the underlying *jrpc2.Request value.
-		newinput = func(req *jrpc2.Request) ([]reflect.Value, error) {
-			return []reflect.Value{reflect.ValueOf(req)}, nil
-		}
-
-	} else {
-		// Check whether the function wants a pointer to its argument.  We need
-		// to create one either way to support unmarshaling, but we need to
-		// indirect it back off if the callee didn't want it.
-
-		// Case 3a: The function wants a bare value, not a pointer.
-		argType := typ.In(1)
-		undo := reflect.Value.Elem
+		return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+			return decodeOut(call(args(ctx, reflect.ValueOf(req))))
+		}), nil
+	}
 
-		if argType.Kind() == reflect.Ptr {
-			// Case 3b: The function wants a pointer.
-			undo = func(v reflect.Value) reflect.Value { return v }
-			argType = argType.Elem()
+	// Case 3: The function wants a decoded argument, and possibly also the
+	// request. We need to allocate a pointer either way to support
+	// unmarshaling, but we need to indirect it back off if the callee wants a
+	// bare value rather than a pointer.
+	wantReq := np == 2
+	argType := typ.In(typ.NumIn() - 1)
+	wantPtr := argType.Kind() == reflect.Ptr
+	if wantPtr {
+		argType = argType.Elem()
+	}
+	check, err := checkType(argType)
+	if err != nil {
+		return nil, err
+	}
+	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		in := reflect.New(argType)
+		if err := cfg.decode(req, in.Interface()); err != nil {
+			return nil, cfg.decodeError(req, err)
 		}
-
-		newinput = func(req *jrpc2.Request) ([]reflect.Value, error) {
-			in := reflect.New(argType).Interface()
-			if err := req.UnmarshalParams(in); err != nil {
-				return nil, jrpc2.Errorf(code.InvalidParams, "invalid parameters: %v", err)
+		if check {
+			if err := Validate(in.Interface()); err != nil {
+				return nil, err
 			}
-			arg := reflect.ValueOf(in)
-			return []reflect.Value{undo(arg)}, nil
 		}
-	}
+		if !wantPtr {
+			in = in.Elem()
+		}
+		if wantReq {
+			return decodeOut(call(args(ctx, reflect.ValueOf(req), in)))
+		}
+		return decodeOut(call(args(ctx, in)))
+	}), nil
+}
 
-	// Construct a function to decode the result values.
-	var decodeOut func([]reflect.Value) (interface{}, error)
+// errNoParams is reported by handlers for functions that take no parameters,
+// when the request includes parameters.
+var errNoParams = jrpc2.Errorf(code.InvalidParams, "no parameters accepted")
+
+// NoResult is a sentinel error that a function adapted by New or NewTyped may
+// return to report that it succeeded, but has no result. The handler reports
+// neither a result nor an error, so a call gets a null result, and any other
+// value returned by the function is not encoded.
+var NoResult = errors.New("no result")
+
+// result returns the result and error reported by a handler for a function
+// that returned v and err, discarding v if err is not nil, and treating
+// NoResult as success without a result.
+func result(v interface{}, err error) (interface{}, error) {
+	if err == NoResult {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
 
+// resultDecoder returns a function that converts the result values of a call
+// to a function of type typ into a result and an error. The caller must have
+// checked the result types of typ, as checkResultTypes does.
+func resultDecoder(typ reflect.Type) func([]reflect.Value) (interface{}, error) {
 	switch typ.NumOut() {
 	case 1:
 		if typ.Out(0) == errType {
 			// A function that returns only error: Result is always nil.
-			decodeOut = func(vals []reflect.Value) (interface{}, error) {
-				oerr := vals[0].Interface()
-				if oerr != nil {
-					return nil, oerr.(error)
-				}
-				return nil, nil
-			}
-		} else {
-			// A function that returns a single non-error: err is always nil.
-			decodeOut = func(vals []reflect.Value) (interface{}, error) {
-				return vals[0].Interface(), nil
+			return func(vals []reflect.Value) (interface{}, error) {
+				oerr, _ := vals[0].Interface().(error)
+				return result(nil, oerr)
 			}
 		}
+		// A function that returns a single non-error: err is always nil.
+		return func(vals []reflect.Value) (interface{}, error) {
+			return vals[0].Interface(), nil
+		}
 	default:
 		// A function that returns a value and an error.
-		decodeOut = func(vals []reflect.Value) (interface{}, error) {
-			out, oerr := vals[0].Interface(), vals[1].Interface()
-			if oerr != nil {
-				return nil, oerr.(error)
-			}
-			return out, nil
+		return func(vals []reflect.Value) (interface{}, error) {
+			oerr, _ := vals[1].Interface().(error)
+			return result(vals[0].Interface(), oerr)
 		}
 	}
-
-	f := reflect.ValueOf(fn)
-	call := f.Call
-	if typ.IsVariadic() {
-		call = f.CallSlice
-	}
-
-	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
-		rest, ierr := newinput(req)
-		if ierr != nil {
-			return nil, ierr
-		}
-		args := append([]reflect.Value{reflect.ValueOf(ctx)}, rest...)
-		return decodeOut(call(args))
-	}), nil
 }
 
 func checkFunctionType(fn interface{}) (reflect.Type, error) {
 	typ := reflect.TypeOf(fn)
 	if typ.Kind() != reflect.Func {
-		return nil, errors.New("not a function")
-	} else if np := typ.NumIn(); np == 0 || np > 2 {
-		return nil, errors.New("wrong number of parameters")
-	} else if no := typ.NumOut(); no < 1 || no > 2 {
-		return nil, errors.New("wrong number of results")
-	} else if typ.In(0) != ctxType {
-		return nil, errors.New("first parameter is not context.Context")
-	} else if no == 2 && typ.Out(1) != errType {
-		return nil, errors.New("result is not of type error")
+		return nil, fmt.Errorf("%v is not a function", typ)
+	} else if np := typ.NumIn(); np > 3 {
+		return nil, fmt.Errorf("%v has %d parameters, want at most 3", typ, np)
+	} else if err := checkResultTypes(typ); err != nil {
+		return nil, err
+	} else if np == 3 && !hasContext(typ) {
+		return nil, fmt.Errorf("first parameter of %v is %v, want context.Context", typ, typ.In(0))
+	} else if np == 2 && !hasContext(typ) && typ.In(0) != reqType {
+		return nil, fmt.Errorf("first parameter of %v is %v, want context.Context or *jrpc2.Request", typ, typ.In(0))
+	} else if np == 3 && typ.In(1) != reqType {
+		return nil, fmt.Errorf("second parameter of %v is %v, want *jrpc2.Request", typ, typ.In(1))
 	}
 	return typ, nil
 }
 
+// hasContext reports whether the function type typ takes a context.Context as
+// its first parameter.
+func hasContext(typ reflect.Type) bool { return typ.NumIn() != 0 && typ.In(0) == ctxType }
+
+// checkResultTypes checks that the function type typ has one of the result
+// signatures accepted by New.
+func checkResultTypes(typ reflect.Type) error {
+	if no := typ.NumOut(); no < 1 || no > 2 {
+		return fmt.Errorf("%v has %d results, want 1 or 2", typ, no)
+	} else if no == 2 && typ.Out(1) != errType {
+		return fmt.Errorf("second result of %v is %v, want error", typ, typ.Out(1))
+	}
+	return nil
+}
+
 // Args is a wrapper that decodes an array of positional parameters into
 // concrete locations.
 //
 // Unmarshaling a JSON value into an Args value v succeeds if the JSON encodes
 // an array with length len(v), and unmarshaling each subvalue i into the
 // corresponding v[i] succeeds.  As a special case, if v[i] == nil the
-// corresponding value is discarded.
+// corresponding value is discarded. To accept arrays with extra elements,
+// unmarshal into v.AllowExtra() instead.
 //
 // Marshaling an Args value v into JSON succeeds if each element of the slice
 // is JSON marshalable, and yields a JSON array of length len(v) containing the
@@ -291,6 +649,12 @@ func (a Args) UnmarshalJSON(data []byte) error {
 	} else if len(elts) != len(a) {
 		return fmt.Errorf("wrong number of args (got %d, want %d)", len(elts), len(a))
 	}
+	return a.decode(elts)
+}
+
+// decode unmarshals each of elts into the corresponding element of a.
+// Precondition: len(elts) == len(a).
+func (a Args) decode(elts []json.RawMessage) error {
 	for i, elt := range elts {
 		if a[i] == nil {
 			continue
@@ -301,6 +665,26 @@ func (a Args) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// AllowExtra returns a value that unmarshals as a does, except that a JSON
+// array having more than len(a) elements is accepted, and the extra elements
+// are discarded. An array with fewer than len(a) elements is still an error.
+func (a Args) AllowExtra() json.Unmarshaler {
+	v := argsExtra(a)
+	return &v
+}
+
+type argsExtra Args
+
+func (a argsExtra) UnmarshalJSON(data []byte) error {
+	var elts []json.RawMessage
+	if err := json.Unmarshal(data, &elts); err != nil {
+		return fmt.Errorf("decoding args: %w", err)
+	} else if len(elts) < len(a) {
+		return fmt.Errorf("wrong number of args (got %d, want at least %d)", len(elts), len(a))
+	}
+	return Args(a).decode(elts[:len(a)])
+}
+
 // MarshalJSON supports JSON marshaling for a.
 func (a Args) MarshalJSON() ([]byte, error) {
 	if len(a) == 0 {
@@ -316,6 +700,9 @@ func (a Args) MarshalJSON() ([]byte, error) {
 // succeeds. If k does not exist in v, it is ignored.
 //
 // Marshaling an Obj into JSON works as for an ordinary map.
+//
+// To report an error for missing or unexpected keys, unmarshal into the
+// ObjDecoder returned by the Require or Strict methods instead.
 type Obj map[string]interface{}
 
 // UnmarshalJSON supports JSON unmarshaling into o.
@@ -324,6 +711,12 @@ func (o Obj) UnmarshalJSON(data []byte) error {
 	if err := json.Unmarshal(data, &base); err != nil {
 		return fmt.Errorf("decoding object: %v", err)
 	}
+	return o.decode(base)
+}
+
+// decode unmarshals the value for each key of base into the corresponding
+// location in o, ignoring keys that do not exist in o.
+func (o Obj) decode(base map[string]json.RawMessage) error {
 	for key, val := range base {
 		arg, ok := o[key]
 		if !ok {
@@ -334,3 +727,76 @@ func (o Obj) UnmarshalJSON(data []byte) error {
 	}
 	return nil
 }
+
+// Require returns an ObjDecoder that unmarshals as o does, but reports an
+// error if any of the specified keys is missing from the JSON object. If no
+// keys are given, all the keys of o are required.
+func (o Obj) Require(keys ...string) *ObjDecoder {
+	return &ObjDecoder{obj: o, required: keys, requireAll: len(keys) == 0}
+}
+
+// Strict returns an ObjDecoder that unmarshals as o does, but reports an
+// error if the JSON object has any keys that are not keys of o.
+func (o Obj) Strict() *ObjDecoder { return &ObjDecoder{obj: o, strict: true} }
+
+// An ObjDecoder unmarshals a JSON object into the locations of an Obj, with
+// additional checks for missing or unexpected keys. Use the Require and
+// Strict methods of Obj to construct one. The errors for missing and for
+// unexpected keys each name all the offending keys.
+type ObjDecoder struct {
+	obj        Obj
+	required   []string
+	requireAll bool
+	strict     bool
+}
+
+// Strict returns a copy of d that also reports an error if the JSON object has
+// any keys that are not keys of the underlying Obj.
+func (d *ObjDecoder) Strict() *ObjDecoder {
+	cp := *d
+	cp.strict = true
+	return &cp
+}
+
+// UnmarshalJSON supports JSON unmarshaling into d.
+func (d *ObjDecoder) UnmarshalJSON(data []byte) error {
+	var base map[string]json.RawMessage
+	if err := json.Unmarshal(data, &base); err != nil {
+		return fmt.Errorf("decoding object: %v", err)
+	}
+	required := d.required
+	if d.requireAll {
+		required = nil
+		for key := range d.obj {
+			required = append(required, key)
+		}
+	}
+	if missing := missingKeys(base, required); len(missing) != 0 {
+		return fmt.Errorf("missing required keys: %s", strings.Join(missing, ", "))
+	}
+	if d.strict {
+		var extra []string
+		for key := range base {
+			if _, ok := d.obj[key]; !ok {
+				extra = append(extra, key)
+			}
+		}
+		if len(extra) != 0 {
+			sort.Strings(extra)
+			return fmt.Errorf("unknown keys: %s", strings.Join(extra, ", "))
+		}
+	}
+	return d.obj.decode(base)
+}
+
+// missingKeys returns the keys that are not present in m, in sorted order.
+func missingKeys(m map[string]json.RawMessage, keys []string) []string {
+	var missing []string
+	for _, key := range keys {
+		if _, ok := m[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
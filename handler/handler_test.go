@@ -6,11 +6,18 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/channel"
+	"github.com/yinfei8/jrpc2/code"
+	"github.com/yinfei8/jrpc2/server"
 )
 
 // Verify that the New function correctly handles the various type signatures
@@ -33,18 +40,31 @@ func TestNew(t *testing.T) {
 		{v: func(context.Context, *jrpc2.Request) (byte, error) { return '0', nil }},
 		{v: func(context.Context) bool { return true }},
 		{v: func(context.Context, int) bool { return true }},
+		{v: func(context.Context, *jrpc2.Request, int) (int, error) { return 0, nil }},
+		{v: func(context.Context, *jrpc2.Request, []string) error { return nil }},
+		{v: func(context.Context, *jrpc2.Request, ...int) bool { return true }},
+
+		// ...including those without a context.
+		{v: func() error { return nil }},
+		{v: func() int { return 0 }},
+		{v: func(string) error { return nil }},
+		{v: func(int) (string, error) { return "", nil }},
+		{v: func(...int) int { return 0 }},
+		{v: func(*jrpc2.Request) (int, error) { return 0, nil }},
+		{v: func(*jrpc2.Request, []int) bool { return true }},
 
 		// Things that aren't supposed to work.
-		{v: func() error { return nil }, bad: true},                           // wrong # of params
-		{v: func(a, b, c int) bool { return false }, bad: true},               // ...
-		{v: func(byte) {}, bad: true},                                         // wrong # of results
-		{v: func(byte) (int, bool, error) { return 0, true, nil }, bad: true}, // ...
-		{v: func(string) error { return nil }, bad: true},                     // missing context
-		{v: func(a, b string) error { return nil }, bad: true},                // P1 is not context
-		{v: func(context.Context) (int, bool) { return 1, true }, bad: true},  // R2 is not error
+		{v: func(context.Context, int, int, int) error { return nil }, bad: true}, // wrong # of params
+		{v: func(a, b, c int) bool { return false }, bad: true},                   // ...
+		{v: func(byte) {}, bad: true},                                             // wrong # of results
+		{v: func(byte) (int, bool, error) { return 0, true, nil }, bad: true},     // ...
+		{v: func(a, b string) error { return nil }, bad: true},                    // P1 is not context or request
+		{v: func(context.Context) (int, bool) { return 1, true }, bad: true},      // R2 is not error
 
 		//lint:ignore ST1008 verify permuted error position does not match
 		{v: func(context.Context) (error, float64) { return nil, 0 }, bad: true}, // ...
+
+		{v: func(context.Context, int, *jrpc2.Request) error { return nil }, bad: true}, // P2 is not *Request
 	}
 	for _, test := range tests {
 		got, err := newHandler(test.v)
@@ -56,6 +76,129 @@ func TestNew(t *testing.T) {
 	}
 }
 
+// Verify that handlers constructed by New decode parameters and report
+// results and errors correctly for each kind of signature.
+func TestNewCall(t *testing.T) {
+	type args struct{ A, B int }
+	errFail := errors.New("failed")
+	ctx := context.Background()
+	tests := []struct {
+		fn      interface{}
+		params  string
+		want    interface{}
+		wantErr error
+	}{
+		{func(context.Context) error { return nil }, ``, nil, nil},
+		{func(context.Context) error { return errFail }, ``, nil, errFail},
+		{func(context.Context) (interface{}, error) { return "ok", nil }, ``, "ok", nil},
+		{func(context.Context) (int, error) { return 5, nil }, ``, 5, nil},
+		{func(context.Context) bool { return true }, ``, true, nil},
+		{func(_ context.Context, a args) int { return a.A + a.B }, `{"A":3,"B":4}`, 7, nil},
+		{func(_ context.Context, a *args) (int, error) { return a.A * a.B, nil }, `{"A":3,"B":4}`, 12, nil},
+		{func(_ context.Context, vs ...int) (int, error) { return len(vs), nil }, `[1,2,3]`, 3, nil},
+		{func(_ context.Context, req *jrpc2.Request) (string, error) {
+			return req.Method(), nil
+		}, `[]`, "M", nil},
+		{func(context.Context, []int) error { return errFail }, `[1]`, nil, errFail},
+
+		// Functions that report no result.
+		{func(context.Context) error { return NoResult }, ``, nil, nil},
+		{func(context.Context) (interface{}, error) { return "x", NoResult }, ``, nil, nil},
+		{func(context.Context, []int) (int, error) { return 5, NoResult }, `[1]`, nil, nil},
+
+		// Functions that do not take a context.
+		{func() (string, error) { return "ok", nil }, ``, "ok", nil},
+		{func() error { return errFail }, ``, nil, errFail},
+		{func(a args) int { return a.A - a.B }, `{"A":3,"B":4}`, -1, nil},
+		{func(vs ...int) int { return len(vs) }, `[1,2]`, 2, nil},
+		{func(req *jrpc2.Request) string { return req.Method() }, `{}`, "M", nil},
+		{func(req *jrpc2.Request, a *args) (string, error) {
+			return fmt.Sprint(req.Method(), a.A), nil
+		}, `{"A":1}`, "M1", nil},
+	}
+	for _, test := range tests {
+		req := `{"jsonrpc":"2.0","id":1,"method":"M"`
+		if test.params != "" {
+			req += `,"params":` + test.params
+		}
+		got, err := New(test.fn).Handle(ctx, mustParseReq(t, req+`}`))
+		if err != test.wantErr {
+			t.Errorf("Handle(%T, %s): got error %v, want %v", test.fn, test.params, err, test.wantErr)
+		} else if got != test.want {
+			t.Errorf("Handle(%T, %s): got %v, want %v", test.fn, test.params, got, test.want)
+		}
+	}
+
+	// Functions that take no parameters reject a request that has them.
+	for _, fn := range []interface{}{
+		func(context.Context) error { return nil },
+		func(context.Context) (interface{}, error) { return nil, nil },
+		func(context.Context) (int, error) { return 0, nil },
+		func() int { return 0 },
+	} {
+		req := mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"M","params":[1]}`)
+		_, err := New(fn).Handle(ctx, req)
+		if got := code.FromError(err); got != code.InvalidParams {
+			t.Errorf("Handle(%T) with params: got %v (%v), want %v", fn, got, err, code.InvalidParams)
+		}
+	}
+}
+
+// Verify that a function that takes the request along with its parameters
+// decodes the parameters exactly as one that takes only the parameters.
+func TestNewWithRequest(t *testing.T) {
+	type args struct {
+		A int `json:"a" jrpc2:"required"`
+		B int `json:"b" jrpc2:"default=5"`
+	}
+	ctx := context.Background()
+	plain := New(func(_ context.Context, a args) (int, error) { return a.A + a.B, nil })
+	var gotReq *jrpc2.Request
+	withReq := New(func(_ context.Context, req *jrpc2.Request, a args) (int, error) {
+		gotReq = req
+		return a.A + a.B, nil
+	})
+	for _, tail := range []string{
+		`"id":1,"params":{"a":1,"b":2}}`,
+		`"id":2,"params":{"a":3}}`,
+		`"id":3,"params":{"b":2}}`,
+		`"id":4,"params":{"a":"x"}}`,
+		`"id":5,"params":[1]}`,
+		`"id":6}`,
+		`"params":{"a":1}}`, // notification
+		`"params":{}}`,      // notification, missing a
+	} {
+		raw := `{"jsonrpc":"2.0","method":"M",` + tail
+		gotReq = nil
+		req := mustParseReq(t, raw)
+		want, wantErr := plain.Handle(ctx, req)
+		got, err := withReq.Handle(ctx, req)
+		if got != want || fmt.Sprint(err) != fmt.Sprint(wantErr) {
+			t.Errorf("Handle %s: got %v, %v; want %v, %v", raw, got, err, want, wantErr)
+		}
+		if err == nil && gotReq != req {
+			t.Errorf("Handle %s: got request %p, want %p", raw, gotReq, req)
+		}
+	}
+
+	// Pointer and variadic parameters also work.
+	ptr := New(func(_ context.Context, req *jrpc2.Request, a *args) string {
+		return fmt.Sprintf("%s %d", req.ID(), a.A)
+	})
+	if got, err := ptr.Handle(ctx, mustParseReq(t, `{"jsonrpc":"2.0","id":7,"method":"M","params":{"a":2}}`)); err != nil || got != "7 2" {
+		t.Errorf("Handle pointer: got %v, %v; want 7 2, nil", got, err)
+	}
+	vari := New(func(_ context.Context, req *jrpc2.Request, vs ...int) error {
+		if !req.IsNotification() || len(vs) != 3 {
+			return errors.New("wrong arguments")
+		}
+		return nil
+	})
+	if _, err := vari.Handle(ctx, mustParseReq(t, `{"jsonrpc":"2.0","method":"M","params":[1,2,3]}`)); err != nil {
+		t.Errorf("Handle variadic: unexpected error: %v", err)
+	}
+}
+
 type dummy struct{}
 
 func (dummy) Y1(context.Context) (int, error) { return 0, nil }
@@ -64,7 +207,7 @@ func (dummy) N1(string) {}
 
 func (dummy) Y2(_ context.Context, vs ...int) (int, error) { return len(vs), nil }
 
-func (dummy) N2() bool { return false }
+func (dummy) N2() (bool, int) { return false, 0 }
 
 func (dummy) Y3(context.Context) error { return errors.New("blah") }
 
@@ -98,6 +241,121 @@ func TestEmptyService(t *testing.T) {
 	t.Fatalf("NewService(empty): got %v, want panic", m)
 }
 
+type mixed struct{}
+
+func (mixed) Add(_ context.Context, vs []int) (int, error) {
+	sum := 0
+	for _, v := range vs {
+		sum += v
+	}
+	return sum, nil
+}
+
+func (mixed) GetHTTPStatus(context.Context) int { return 200 }
+
+func (mixed) Raw(_ context.Context, req *jrpc2.Request) (interface{}, error) {
+	return req.Method(), nil
+}
+
+func (mixed) Fail(context.Context) error { return errors.New("failed") }
+
+func (mixed) NoContext(vs []int) int { return len(vs) }
+
+func (mixed) NoResult(int) {}
+
+func (mixed) TooMany(_ context.Context, a, b int) error { return nil }
+
+// Verify that NewService options control naming and the handling of methods
+// with incompatible signatures.
+func TestNewServiceOptions(t *testing.T) {
+	tests := []struct {
+		opts []ServiceOption
+		want []string
+	}{
+		{nil, []string{"Add", "Fail", "GetHTTPStatus", "NoContext", "Raw"}},
+		{[]ServiceOption{MethodNames(LowerCamel)},
+			[]string{"add", "fail", "getHTTPStatus", "noContext", "raw"}},
+		{[]ServiceOption{MethodNames(Prefixed("Mixed"))},
+			[]string{"Mixed.Add", "Mixed.Fail", "Mixed.GetHTTPStatus", "Mixed.NoContext", "Mixed.Raw"}},
+	}
+	for _, test := range tests {
+		m := NewService(mixed{}, test.opts...)
+		if diff := cmp.Diff(test.want, m.Names()); diff != "" {
+			t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+		}
+	}
+
+	// The wrappers behave as those constructed by New.
+	m := NewService(mixed{}, MethodNames(LowerCamel))
+	ctx := context.Background()
+	req := mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"add","params":[1,2,3]}`)
+	if got, err := m.Assign(ctx, "add").Handle(ctx, req); err != nil || got != 6 {
+		t.Errorf("add: got %v, %v; want 6, nil", got, err)
+	}
+	req = mustParseReq(t, `{"jsonrpc":"2.0","id":2,"method":"raw"}`)
+	if got, err := m.Assign(ctx, "raw").Handle(ctx, req); err != nil || got != "raw" {
+		t.Errorf("raw: got %v, %v; want raw, nil", got, err)
+	}
+	req = mustParseReq(t, `{"jsonrpc":"2.0","id":4,"method":"noContext","params":[5,6]}`)
+	if got, err := m.Assign(ctx, "noContext").Handle(ctx, req); err != nil || got != 2 {
+		t.Errorf("noContext: got %v, %v; want 2, nil", got, err)
+	}
+	req = mustParseReq(t, `{"jsonrpc":"2.0","id":3,"method":"fail","params":[1]}`)
+	if got, err := m.Assign(ctx, "fail").Handle(ctx, req); err == nil {
+		t.Errorf("fail with params: got %v, want error", got)
+	}
+}
+
+func mustParseReq(t testing.TB, s string) *jrpc2.Request {
+	t.Helper()
+	reqs, err := jrpc2.ParseRequests([]byte(s))
+	if err != nil || len(reqs) != 1 {
+		t.Fatalf("ParseRequests(%#q): %v", s, err)
+	}
+	return reqs[0]
+}
+
+func TestNewServicePanics(t *testing.T) {
+	mustPanic := func(name, want string, f func()) {
+		t.Helper()
+		defer func() {
+			x := recover()
+			if x == nil {
+				t.Errorf("%s: did not panic", name)
+			} else if !strings.Contains(fmt.Sprint(x), want) {
+				t.Errorf("%s: got panic %v, want %q", name, x, want)
+			}
+		}()
+		f()
+	}
+
+	// In strict mode, incompatible methods are reported.
+	mustPanic("strict", "NoResult", func() { NewService(mixed{}, StrictMethods()) })
+	mustPanic("strict", "TooMany", func() { NewService(mixed{}, StrictMethods()) })
+
+	// Names that collide are reported.
+	same := func(string) string { return "same" }
+	mustPanic("collide", `duplicate method name "same"`, func() { NewService(mixed{}, MethodNames(same)) })
+}
+
+func TestLowerCamel(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", ""},
+		{"A", "a"},
+		{"Add", "add"},
+		{"ID", "id"},
+		{"HTTPStatus", "httpStatus"},
+		{"GetHTTPStatus", "getHTTPStatus"},
+		{"already", "already"},
+		{"X2Y", "x2Y"},
+	}
+	for _, test := range tests {
+		if got := LowerCamel(test.in); got != test.want {
+			t.Errorf("LowerCamel(%q): got %q, want %q", test.in, got, test.want)
+		}
+	}
+}
+
 // Verify that a ServiceMap assigns names correctly.
 func TestServiceMap(t *testing.T) {
 	tests := []struct {
@@ -129,6 +387,366 @@ func TestServiceMap(t *testing.T) {
 	}
 }
 
+// Verify that nested service maps compose, and that the empty service name
+// acts as a fallback namespace.
+func TestServiceMapNested(t *testing.T) {
+	h := Func(func(context.Context, *jrpc2.Request) (interface{}, error) { return nil, nil })
+	m := ServiceMap{
+		"db": ServiceMap{
+			"user":  Map{"get": h, "put": h},
+			"admin": Map{"drop": h},
+		},
+		"auth": Map{"login": h},
+		"":     Map{"ping": h, "x.y": h},
+	}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"db.user.get", true},
+		{"db.user.put", true},
+		{"db.admin.drop", true},
+		{"db.user", false}, // incomplete
+		{"db.nobody.get", false},
+		{"db.user.drop", false},
+		{"auth.login", true},
+		{"auth.logout", false}, // no fallback within a known service
+		{"ping", true},         // no dot: fallback
+		{"x.y", true},          // unknown service: fallback with the full name
+		{".ping", false},       // empty service: fallback with the full name
+		{"pong", false},
+		{"", false},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		got := m.Assign(ctx, test.name) != nil
+		if got != test.want {
+			t.Errorf("Assign(%q): got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	want := []string{"auth.login", "db.admin.drop", "db.user.get", "db.user.put", "ping", "x.y"}
+	if diff := cmp.Diff(want, m.Names()); diff != "" {
+		t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+	}
+
+	// Without a fallback, a name with no dot does not match.
+	delete(m, "")
+	if got := m.Assign(ctx, "ping"); got != nil {
+		t.Errorf("Assign(ping) without fallback: got %v, want nil", got)
+	}
+}
+
+type testKey struct{}
+
+// Verify that WithContext affects only the wrapped handler.
+func TestWithContext(t *testing.T) {
+	value := Func(func(ctx context.Context, _ *jrpc2.Request) (interface{}, error) {
+		return ctx.Value(testKey{}), nil
+	})
+	m := Map{
+		"With": WithContext(value, func(ctx context.Context) context.Context {
+			return context.WithValue(ctx, testKey{}, "injected")
+		}),
+		"Without": value,
+	}
+	ctx := context.Background()
+	tests := []struct {
+		method string
+		want   interface{}
+	}{
+		{"With", "injected"},
+		{"Without", nil},
+	}
+	for _, test := range tests {
+		got, err := m.Assign(ctx, test.method).Handle(ctx, nil)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.method, err)
+		} else if got != test.want {
+			t.Errorf("%s: got %v, want %v", test.method, got, test.want)
+		}
+	}
+}
+
+// Verify that Positional binds array and object parameters by position and
+// name, respectively.
+func TestPositional(t *testing.T) {
+	sub := Positional(func(_ context.Context, x, y int) error {
+		if x < y {
+			return errors.New("negative")
+		}
+		return nil
+	}, "x", "y")
+	greet := Positional(func(_ context.Context, name string, n int, suffix *string) (string, error) {
+		s := strings.Repeat("hello, "+name, n)
+		if suffix != nil {
+			s += *suffix
+		}
+		return s, nil
+	}, "name", "n?", "suffix?")
+
+	tests := []struct {
+		h       Func
+		params  string
+		want    interface{}
+		wantErr string
+	}{
+		{sub, `[5, 3]`, nil, ""},
+		{sub, `{"y": 3, "x": 5, "z": 0}`, nil, ""},
+		{sub, `[3, 5]`, nil, "negative"},
+		{sub, `[5]`, nil, "got 1 parameters, want 2"},
+		{sub, `[5, 3, 1]`, nil, "got 3 parameters, want 2"},
+		{sub, `{"x": 5}`, nil, `missing parameter "y" (want 2 parameters)`},
+		{sub, ``, nil, `missing parameter "x"`},
+		{sub, `[5, "three"]`, nil, `invalid parameter "y"`},
+		{sub, `17`, nil, "must be an array or object"},
+
+		{greet, `["bob", 1, "!"]`, "hello, bob!", ""},
+		{greet, `["bob", 2]`, "hello, bobhello, bob", ""},
+		{greet, `["bob"]`, "", ""},
+		{greet, `{"name": "bob", "suffix": "?", "n": 1}`, "hello, bob?", ""},
+		{greet, `{"name": "bob"}`, "", ""},
+		{greet, `[]`, nil, "got 0 parameters, want 1 to 3"},
+		{greet, `{"n": 1}`, nil, `missing parameter "name" (want 1 to 3 parameters)`},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		msg := `{"jsonrpc":"2.0","id":1,"method":"X"}`
+		if test.params != "" {
+			msg = `{"jsonrpc":"2.0","id":1,"method":"X","params":` + test.params + `}`
+		}
+		req := mustParseReq(t, msg)
+		got, err := test.h(ctx, req)
+		if test.wantErr == "" {
+			if err != nil {
+				t.Errorf("Params %s: unexpected error: %v", test.params, err)
+			} else if got != test.want {
+				t.Errorf("Params %s: got %v, want %v", test.params, got, test.want)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("Params %s: got %v, %v; want error %q", test.params, got, err, test.wantErr)
+		} else if test.wantErr != "negative" {
+			if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.InvalidParams {
+				t.Errorf("Params %s: got error %v, want code %v", test.params, err, code.InvalidParams)
+			}
+		}
+	}
+}
+
+// Verify that Positional rejects unsuitable functions and names.
+func TestPositionalInvalid(t *testing.T) {
+	tests := []struct {
+		fn    interface{}
+		names []string
+	}{
+		{nil, nil},
+		{"not a function", nil},
+		{func(int, int) error { return nil }, []string{"x"}},
+		{func(context.Context, int, int) error { return nil }, []string{"x"}},
+		{func(context.Context, int, int) error { return nil }, []string{"x", "x"}},
+		{func(context.Context, int, int) error { return nil }, []string{"x?", "y"}},
+		{func(context.Context, int, int) error { return nil }, []string{"x", "?"}},
+		{func(context.Context, ...int) error { return nil }, []string{"x"}},
+		{func(context.Context, int) (int, bool) { return 0, false }, []string{"x"}},
+	}
+	for _, test := range tests {
+		if got, err := newPositional(test.fn, test.names); err == nil {
+			t.Errorf("newPositional(%T, %q): got %v, want error", test.fn, test.names, got)
+		}
+	}
+}
+
+// Verify that Chain applies middleware in the documented order.
+func TestChain(t *testing.T) {
+	var trace []string
+	tag := func(name string) func(jrpc2.Handler) jrpc2.Handler {
+		return func(h jrpc2.Handler) jrpc2.Handler {
+			return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+				trace = append(trace, name)
+				return h.Handle(ctx, req)
+			})
+		}
+	}
+	base := Func(func(context.Context, *jrpc2.Request) (interface{}, error) {
+		trace = append(trace, "base")
+		return "ok", nil
+	})
+	h := Chain(base, tag("A"), tag("B"), tag("C"))
+	if got, err := h.Handle(context.Background(), nil); err != nil || got != "ok" {
+		t.Errorf("Handle: got %v, %v; want ok, nil", got, err)
+	}
+	if diff := cmp.Diff([]string{"A", "B", "C", "base"}, trace); diff != "" {
+		t.Errorf("Wrong call order: (-want, +got)\n%s", diff)
+	}
+}
+
+func TestSafe(t *testing.T) {
+	ctx := context.Background()
+	h := Safe(Func(func(_ context.Context, req *jrpc2.Request) (interface{}, error) {
+		if req.Method() == "Panic" {
+			panic("kaboom")
+		}
+		return "ok", nil
+	}))
+
+	if got, err := h.Handle(ctx, mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"OK"}`)); err != nil || got != "ok" {
+		t.Errorf("OK: got %v, %v; want ok, nil", got, err)
+	}
+	got, err := h.Handle(ctx, mustParseReq(t, `{"jsonrpc":"2.0","id":2,"method":"Panic"}`))
+	if e, ok := err.(*jrpc2.Error); !ok || e.Code() != code.InternalError {
+		t.Errorf("Panic: got %v, %v; want %v", got, err, code.InternalError)
+	} else if !strings.Contains(e.Message(), "kaboom") {
+		t.Errorf("Panic: message %q does not describe the panic", e.Message())
+	}
+}
+
+func TestTimed(t *testing.T) {
+	fail := errors.New("failed")
+	var gotMethod string
+	var gotErr error
+	var gotDur time.Duration
+	h := Timed(Func(func(context.Context, *jrpc2.Request) (interface{}, error) {
+		time.Sleep(5 * time.Millisecond)
+		return nil, fail
+	}), func(method string, d time.Duration, err error) {
+		gotMethod, gotDur, gotErr = method, d, err
+	})
+	if _, err := h.Handle(context.Background(), mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"Slow"}`)); err != fail {
+		t.Errorf("Handle: got error %v, want %v", err, fail)
+	}
+	if gotMethod != "Slow" || gotErr != fail || gotDur < 5*time.Millisecond {
+		t.Errorf("Observed %q, %v, %v; want Slow, >= 5ms, %v", gotMethod, gotDur, gotErr, fail)
+	}
+}
+
+// Verify that Merge combines maps, reports collisions, and together with
+// MapApply preserves the method names and metadata of the handlers.
+func TestMergeFunc(t *testing.T) {
+	h := New(func(context.Context) (string, error) { return "ok", nil })
+	info := Info{Summary: "Say OK"}
+	a := Map{"A": WithInfo(h, info), "B": h}
+	b := Map{"C": h}
+
+	m, err := Merge(a, b, nil)
+	if err != nil {
+		t.Fatalf("Merge: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"A", "B", "C"}, m.Names()); diff != "" {
+		t.Errorf("Wrong method names after Merge: (-want, +got)\n%s", diff)
+	}
+	if len(a) != 2 || len(b) != 1 {
+		t.Errorf("Merge modified its inputs: %v, %v", a, b)
+	}
+
+	// A collision anywhere reports all the duplicates.
+	if _, err := Merge(a, b, Map{"C": h, "D": h}, Map{"A": h}); err == nil {
+		t.Error("Merge with duplicates: got nil, wanted error")
+	} else if got, want := err.Error(), "duplicate method names: A, C"; got != want {
+		t.Errorf("Merge error: got %q, want %q", got, want)
+	}
+
+	// Wrapping with MapApply keeps the metadata, unless the wrapper has its own.
+	other := Info{Summary: "Wrapped"}
+	w := MapApply(m, func(name string, h jrpc2.Handler) jrpc2.Handler {
+		if name == "C" {
+			return WithInfo(Safe(h), other)
+		}
+		return Safe(h)
+	})
+	if diff := cmp.Diff(m.Names(), w.Names()); diff != "" {
+		t.Errorf("Wrong method names after MapApply: (-want, +got)\n%s", diff)
+	}
+	for _, test := range []struct {
+		method string
+		want   Info
+		ok     bool
+	}{
+		{"A", info, true},
+		{"B", Info{}, false},
+		{"C", other, true},
+	} {
+		got, ok := w.Describe(test.method)
+		if ok != test.ok || !cmp.Equal(got, test.want) {
+			t.Errorf("Describe(%q): got %+v, %v; want %+v, %v", test.method, got, ok, test.want, test.ok)
+		}
+	}
+	ctx := context.Background()
+	req := mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"A"}`)
+	if got, err := w["A"].Handle(ctx, req); err != nil || got != "ok" {
+		t.Errorf("Handle A: got %v, %v; want ok, nil", got, err)
+	}
+}
+
+// Verify that MapApply preserves the method names and leaves the input alone.
+func TestMapApply(t *testing.T) {
+	m := Map{
+		"A": New(func(context.Context) (string, error) { return "a", nil }),
+		"B": New(func(context.Context) (string, error) { panic("b") }),
+	}
+	var seen []string
+	safe := MapApply(m, func(name string, h jrpc2.Handler) jrpc2.Handler {
+		seen = append(seen, name)
+		return Safe(h)
+	})
+	if diff := cmp.Diff(m.Names(), safe.Names()); diff != "" {
+		t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+	}
+	if len(seen) != 2 {
+		t.Errorf("Apply function called for %q, want A and B", seen)
+	}
+
+	ctx := context.Background()
+	req := mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"B"}`)
+	if _, err := safe.Assign(ctx, "B").Handle(ctx, req); code.FromError(err) != code.InternalError {
+		t.Errorf("Safe B: got error %v, want %v", err, code.InternalError)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Original B did not panic; was the input map modified?")
+			}
+		}()
+		m.Assign(ctx, "B").Handle(ctx, req)
+	}()
+}
+
+// Verify that merging maps works and reports collisions.
+func TestMapMerge(t *testing.T) {
+	h1 := Func(func(context.Context, *jrpc2.Request) (interface{}, error) { return 1, nil })
+	h2 := Func(func(context.Context, *jrpc2.Request) (interface{}, error) { return 2, nil })
+	ctx := context.Background()
+
+	m := Map{"A": h1, "B": h1}
+	if err := m.Merge(Map{"C": h2, "D": h2}); err != nil {
+		t.Fatalf("Merge: unexpected error: %v", err)
+	}
+	if diff := cmp.Diff([]string{"A", "B", "C", "D"}, m.Names()); diff != "" {
+		t.Errorf("Wrong method names after Merge: (-want, +got)\n%s", diff)
+	}
+
+	// A collision reports all the duplicates and leaves m unchanged.
+	err := m.Merge(Map{"E": h2, "B": h2, "A": h2})
+	if err == nil {
+		t.Fatal("Merge with duplicates: got nil, wanted error")
+	} else if got, want := err.Error(), "duplicate method names: A, B"; got != want {
+		t.Errorf("Merge error: got %q, want %q", got, want)
+	}
+	if m.Assign(ctx, "E") != nil {
+		t.Error("Merge with duplicates modified the map")
+	}
+
+	// MergeOverwrite replaces existing methods.
+	m.MergeOverwrite(Map{"A": h2, "E": h2})
+	for _, name := range []string{"A", "E"} {
+		rsp, err := m.Assign(ctx, name).Handle(ctx, nil)
+		if err != nil || rsp != 2 {
+			t.Errorf("Handle(%q): got %v, %v; want 2, nil", name, rsp, err)
+		}
+	}
+}
+
 // Verify that argument decoding works.
 func TestArgs(t *testing.T) {
 	type stuff struct {
@@ -275,6 +893,82 @@ func TestObjUnmarshal(t *testing.T) {
 	}
 }
 
+func TestArgsAllowExtra(t *testing.T) {
+	var s string
+	var z int
+	tests := []struct {
+		json string
+		ok   bool
+	}{
+		{`["foo", 25]`, true},
+		{`["foo", 25, true, null]`, true},
+		{`["foo"]`, false},
+		{`{}`, false},
+		{`["foo", "bar"]`, false},
+	}
+	for _, test := range tests {
+		s, z = "", 0
+		err := json.Unmarshal([]byte(test.json), Args{&s, &z}.AllowExtra())
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Unmarshal %#q: got s=%q, z=%d, want error", test.json, s, z)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unmarshal %#q: unexpected error: %v", test.json, err)
+		} else if s != "foo" || z != 25 {
+			t.Errorf("Unmarshal %#q: got s=%q, z=%d, want foo, 25", test.json, s, z)
+		}
+	}
+}
+
+func TestObjDecoder(t *testing.T) {
+	var s string
+	var z int
+	obj := Obj{"s": &s, "z": &z}
+	tests := []struct {
+		input   string
+		dec     json.Unmarshaler
+		wantErr string
+	}{
+		{`{"s":"foo"}`, &obj, ""},
+		{`{"s":"foo"}`, obj.Require("s"), ""},
+		{`{"z":1}`, obj.Require("s"), "missing required keys: s"},
+		{`{}`, obj.Require(), "missing required keys: s, z"},
+		{`null`, obj.Require(), "missing required keys: s, z"},
+		{`{"s":"foo","z":1}`, obj.Require(), ""},
+		{`{"s":"foo","z":1,"q":2}`, obj.Require(), ""},
+		{`{"s":"foo","z":1,"q":2,"p":0}`, obj.Strict(), "unknown keys: p, q"},
+		{`{"z":1}`, obj.Strict(), ""},
+		{`{"z":1,"q":2}`, obj.Require("z").Strict(), "unknown keys: q"},
+		{`{"q":2}`, obj.Require("z").Strict(), "missing required keys: z"},
+		{`{"s":"foo","z":"bar"}`, obj.Require().Strict(), `decoding "z"`},
+		{`[]`, obj.Strict(), "decoding object"},
+	}
+	for _, test := range tests {
+		err := json.Unmarshal([]byte(test.input), test.dec)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("Unmarshal %#q: unexpected error: %v", test.input, err)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("Unmarshal %#q: got error %v, want %q", test.input, err, test.wantErr)
+		}
+	}
+
+	// The decoders work as request parameters.
+	s, z = "", 0
+	req := mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"X","params":{"s":"ok","z":3}}`)
+	if err := req.UnmarshalParams(obj.Require().Strict()); err != nil {
+		t.Errorf("UnmarshalParams: unexpected error: %v", err)
+	} else if s != "ok" || z != 3 {
+		t.Errorf("UnmarshalParams: got s=%q, z=%d, want ok, 3", s, z)
+	}
+	req = mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"X","params":["ok",3,"extra"]}`)
+	if err := req.UnmarshalParams(Args{&s, &z}.AllowExtra()); err != nil {
+		t.Errorf("UnmarshalParams: unexpected error: %v", err)
+	}
+}
+
 func ExampleArgs_unmarshal() {
 	const input = `[25, false, "apple"]`
 
@@ -315,3 +1009,905 @@ func ExampleObj_unmarshal() {
 	// Output:
 	// uid=501, name="P. T. Barnum"
 }
+
+type vInner struct {
+	Name  string `json:"name" jrpc2:"required"`
+	Label string `json:"label,omitempty" jrpc2:"default=none"`
+}
+
+type vEmbed struct {
+	Mode string `json:"mode" jrpc2:"default=\"fast\""`
+}
+
+type vParams struct {
+	vEmbed
+	ID     int       `json:"id" jrpc2:"required"`
+	Limit  int       `json:"limit" jrpc2:"default=10"`
+	Ratio  *float64  `json:"ratio" jrpc2:"default=0.5"`
+	Tags   []string  `json:"tags" jrpc2:"default=[\"a\",\"b\"]"`
+	Owner  *vInner   `json:"owner"`
+	Items  []vInner  `json:"items"`
+	Extra  [2]vInner `json:"-"`
+	Plain  string
+	hidden int `jrpc2:"required"`
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string // JSON encoding of the result, if no error
+		missing string // missing fields, if an error is expected
+	}{
+		{`{"id":1}`,
+			`{"mode":"fast","id":1,"limit":10,"ratio":0.5,"tags":["a","b"],"owner":null,"items":null,"Plain":""}`, ""},
+		{`{"id":2,"limit":3,"mode":"slow","ratio":2,"tags":[],"Plain":"p"}`,
+			`{"mode":"slow","id":2,"limit":3,"ratio":2,"tags":[],"owner":null,"items":null,"Plain":"p"}`, ""},
+		{`{"id":3,"owner":{"name":"x"},"items":[{"name":"y","label":"L"}]}`,
+			`{"mode":"fast","id":3,"limit":10,"ratio":0.5,"tags":["a","b"],` +
+				`"owner":{"name":"x","label":"none"},"items":[{"name":"y","label":"L"}],"Plain":""}`, ""},
+		{`{}`, "", "id, Extra[0].name, Extra[1].name"},
+		{`{"owner":{},"items":[{"name":"a"},{},{"label":"q"}]}`, "",
+			"id, owner.name, items[1].name, items[2].name, Extra[0].name, Extra[1].name"},
+	}
+	for _, test := range tests {
+		var p vParams
+		if test.missing == "" {
+			p.Extra = [2]vInner{{Name: "e1"}, {Name: "e2"}}
+		}
+		if err := json.Unmarshal([]byte(test.input), &p); err != nil {
+			t.Fatalf("Unmarshal %#q: %v", test.input, err)
+		}
+		err := Validate(&p)
+		if test.missing != "" {
+			want := "missing required parameters: " + test.missing
+			if code.FromError(err) != code.InvalidParams || !strings.Contains(err.Error(), want) {
+				t.Errorf("Validate %#q: got %v, want %q", test.input, err, want)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Validate %#q: unexpected error: %v", test.input, err)
+			continue
+		}
+		got, err := json.Marshal(p)
+		if err != nil {
+			t.Fatalf("Marshal: %v", err)
+		}
+		if string(got) != test.want {
+			t.Errorf("Validate %#q:\n got %s\nwant %s", test.input, got, test.want)
+		}
+	}
+
+	// Defaults are not shared between values.
+	var p1, p2 vParams
+	p1.ID, p2.ID = 1, 2
+	p1.Extra = [2]vInner{{Name: "a"}, {Name: "b"}}
+	p2.Extra = p1.Extra
+	if err := Validate(&p1); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	p1.Tags[0] = "changed"
+	if err := Validate(&p2); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+	if p2.Tags[0] != "a" {
+		t.Errorf("Default tags: got %q, want a", p2.Tags[0])
+	}
+
+	if err := Validate(vParams{}); err == nil {
+		t.Error("Validate of non-pointer: got nil, want error")
+	}
+}
+
+func TestValidateBadTags(t *testing.T) {
+	tests := []interface{}{
+		&struct {
+			A int `jrpc2:"default=bogus"`
+		}{},
+		&struct {
+			A int `jrpc2:"required,default=1"`
+		}{},
+		&struct {
+			A int `jrpc2:"optional"`
+		}{},
+		&struct {
+			A []struct {
+				B bool `jrpc2:"default=maybe"`
+			}
+		}{},
+	}
+	for _, v := range tests {
+		if err := Validate(v); err == nil {
+			t.Errorf("Validate(%T): got nil, want error", v)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("New with %T: did not panic", v)
+				}
+			}()
+			New(reflect.MakeFunc(
+				reflect.FuncOf([]reflect.Type{ctxType, reflect.TypeOf(v)}, []reflect.Type{errType}, false),
+				func([]reflect.Value) []reflect.Value { return []reflect.Value{reflect.Zero(errType)} },
+			).Interface())
+		}()
+	}
+}
+
+// Verify that handlers constructed by New validate tagged parameters.
+func TestNewValidate(t *testing.T) {
+	h := New(func(_ context.Context, p vInner) (string, error) {
+		return p.Name + "/" + p.Label, nil
+	})
+	ctx := context.Background()
+	tests := []struct {
+		params string
+		want   string
+		code   code.Code
+	}{
+		{`{"name":"a"}`, "a/none", code.NoError},
+		{`{"name":"a","label":"b"}`, "a/b", code.NoError},
+		{`{"label":"b"}`, "", code.InvalidParams},
+		{`{}`, "", code.InvalidParams},
+	}
+	for _, test := range tests {
+		req := mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"M","params":`+test.params+`}`)
+		got, err := h.Handle(ctx, req)
+		if c := code.FromError(err); c != test.code {
+			t.Errorf("Handle(%s): got code %v (%v), want %v", test.params, c, err, test.code)
+		} else if err == nil && got != test.want {
+			t.Errorf("Handle(%s): got %v, want %q", test.params, got, test.want)
+		}
+	}
+}
+
+// Verify that a Proxy handler forwards calls and notifications upstream.
+func TestProxy(t *testing.T) {
+	noted := make(chan string, 1)
+	up := server.NewLocal(Map{
+		"Sum": New(func(_ context.Context, vs []int) int {
+			sum := 0
+			for _, v := range vs {
+				sum += v
+			}
+			return sum
+		}),
+		"Fail": New(func(context.Context) error {
+			return jrpc2.NewError(-29000, "upstream failed", json.RawMessage(`{"why":"testing"}`))
+		}),
+		"Note": New(func(ctx context.Context, msg []string) error {
+			noted <- jrpc2.InboundRequest(ctx).Method() + ":" + strings.Join(msg, ",")
+			return nil
+		}),
+	}, nil)
+	defer up.Close()
+
+	proxy := Proxy(up.Client)
+	loc := server.NewLocal(Map{"Sum": proxy, "Fail": proxy, "Note": proxy}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	var sum int
+	if err := loc.Client.CallResult(ctx, "Sum", []int{1, 2, 3, 4}, &sum); err != nil {
+		t.Errorf("Call(Sum): unexpected error: %v", err)
+	} else if sum != 10 {
+		t.Errorf("Call(Sum): got %d, want 10", sum)
+	}
+
+	_, err := loc.Client.Call(ctx, "Fail", nil)
+	want := jrpc2.NewError(-29000, "upstream failed", json.RawMessage(`{"why":"testing"}`))
+	if e, ok := err.(*jrpc2.Error); !ok || !jrpc2.ErrorEqual(e, want) {
+		t.Errorf("Call(Fail): got %v, want %v", err, want)
+	}
+
+	if err := loc.Client.Notify(ctx, "Note", []string{"hello"}); err != nil {
+		t.Errorf("Notify(Note): unexpected error: %v", err)
+	}
+	select {
+	case got := <-noted:
+		if got != "Note:hello" {
+			t.Errorf("Notification: got %q, want %q", got, "Note:hello")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Timed out waiting for forwarded notification")
+	}
+}
+
+// Verify that pre-encoded results from New handlers are sent as-is.
+func TestNewRawResult(t *testing.T) {
+	loc := server.NewLocal(Map{
+		"Raw": New(func(context.Context) (json.RawMessage, error) {
+			return json.RawMessage(`{"a": [1, 2], "b": "c"}`), nil
+		}),
+		"Empty": New(func(context.Context) json.RawMessage { return nil }),
+		"Bad": New(func(context.Context) (json.RawMessage, error) {
+			return json.RawMessage(`{"a":`), nil
+		}),
+		"Void": New(func(context.Context) error { return nil }),
+		"None": New(func(context.Context) (json.RawMessage, error) {
+			return json.RawMessage(`{"a":`), NoResult // not sent
+		}),
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	for method, want := range map[string]string{
+		"Raw":   `{"a":[1,2],"b":"c"}`,
+		"Empty": `null`,
+		"Void":  `null`,
+		"None":  `null`,
+	} {
+		rsp, err := loc.Client.Call(ctx, method, nil)
+		if err != nil {
+			t.Errorf("Call(%s): unexpected error: %v", method, err)
+		} else if got := rsp.ResultString(); got != want {
+			t.Errorf("Call(%s): got %#q, want %#q", method, got, want)
+		}
+	}
+	if rsp, err := loc.Client.Call(ctx, "Bad", nil); err == nil {
+		t.Errorf("Call(Bad): got %#q, want error", rsp.ResultString())
+	}
+}
+
+// Verify that New reports the accepted signatures when it panics.
+func TestNewPanicMessage(t *testing.T) {
+	tests := []struct {
+		fn   interface{}
+		want string
+	}{
+		{func(context.Context, int, int, int) error { return nil }, "has 4 parameters, want at most 3"},
+		{func(context.Context, int, int) error { return nil }, "second parameter of func(context.Context, int, int) error is int, want *jrpc2.Request"},
+		{func(int, int, int) error { return nil }, "first parameter of func(int, int, int) error is int, want context.Context"},
+		{func(int, int) error { return nil }, "first parameter of func(int, int) error is int, want context.Context or *jrpc2.Request"},
+		{func(context.Context) {}, "has 0 results, want 1 or 2"},
+		{func(context.Context) (int, int) { return 0, 0 }, "second result of func(context.Context) (int, int) is int, want error"},
+		{"nope", "string is not a function"},
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				msg := fmt.Sprint(recover())
+				if !strings.Contains(msg, test.want) {
+					t.Errorf("New(%T): got panic %q, want %q", test.fn, msg, test.want)
+				} else if !strings.Contains(msg, "accepted signatures are func([context.Context][, X]) error") {
+					t.Errorf("New(%T): panic %q does not list accepted signatures", test.fn, msg)
+				} else if !strings.Contains(msg, "handler.NoResult") {
+					t.Errorf("New(%T): panic %q does not mention NoResult", test.fn, msg)
+				}
+			}()
+			New(test.fn)
+		}()
+	}
+}
+
+func TestPattern(t *testing.T) {
+	named := func(name string) jrpc2.Handler {
+		return New(func(ctx context.Context) (string, error) {
+			return fmt.Sprintf("%s[%s,%s]", name, PathParam(ctx, 0), PathParam(ctx, 1)), nil
+		})
+	}
+	p := NewPattern(Map{
+		"device.*.status": named("status"),
+		"device.*.*":      named("any"),
+		"*.A1.status":     named("a1"),
+		"*.*.status":      named("wild"),
+		"device.list":     named("list"),
+		"*.list":          named("lists"),
+	})
+
+	if diff := cmp.Diff(p.Names(), []string{
+		"*.*.status", "*.A1.status", "*.list", "device.*.*", "device.*.status", "device.list",
+	}); diff != "" {
+		t.Errorf("Wrong names (-got, +want):\n%s", diff)
+	}
+
+	ctx := context.Background()
+	tests := []struct {
+		method, want string
+	}{
+		{"device.list", "list[,]"},
+		{"thing.list", "lists[thing,]"},
+		{"device.A1.status", "status[A1,]"},
+		{"device.B2.status", "status[B2,]"},
+		{"device.B2.reset", "any[B2,reset]"},
+		{"sensor.A1.status", "a1[sensor,]"},
+		{"sensor.B2.status", "wild[sensor,B2]"},
+
+		// No matching pattern.
+		{"device", ""},
+		{"device.A1", ""},
+		{"device.A1.status.extra", ""},
+		{"device..status", ""},
+		{"sensor.B2.reset", ""},
+	}
+	for _, test := range tests {
+		h := p.Assign(ctx, test.method)
+		if h == nil {
+			if test.want != "" {
+				t.Errorf("Assign(%q): got nil, want %q", test.method, test.want)
+			}
+			continue
+		} else if test.want == "" {
+			t.Errorf("Assign(%q): got a handler, want nil", test.method)
+			continue
+		}
+		got, err := h.Handle(ctx, mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"`+test.method+`"}`))
+		if err != nil {
+			t.Errorf("Handle(%q): unexpected error: %v", test.method, err)
+		} else if got != test.want {
+			t.Errorf("Handle(%q): got %v, want %q", test.method, got, test.want)
+		}
+	}
+
+	if got := PathParam(ctx, 0); got != "" {
+		t.Errorf("PathParam of a plain context: got %q, want empty", got)
+	}
+
+	// A handler selected by a wildcard keeps its metadata and deprecation.
+	dp := NewPattern(Map{
+		"old.*": Deprecated(WithInfo(named("old"), Info{Summary: "Old things"}), "use new.*"),
+		"doc.*": WithInfo(named("doc"), Info{Summary: "Documented"}),
+	})
+	oh := dp.Assign(ctx, "old.x")
+	if d, ok := oh.(interface{ Deprecated() string }); !ok || d.Deprecated() != "use new.*" {
+		t.Errorf("Assign(old.x): handler is not deprecated")
+	}
+	if info, ok := infoOf(oh); !ok || info.Summary != "Old things" || info.Deprecated != "use new.*" {
+		t.Errorf("Assign(old.x): got info %+v, %v; want summary and deprecation", info, ok)
+	}
+	dh := dp.Assign(ctx, "doc.x")
+	if _, ok := dh.(interface{ Deprecated() string }); ok {
+		t.Errorf("Assign(doc.x): handler is deprecated, want not")
+	}
+	if info, ok := infoOf(dh); !ok || info.Summary != "Documented" {
+		t.Errorf("Assign(doc.x): got info %+v, %v; want summary", info, ok)
+	}
+	if got, err := dh.Handle(ctx, mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"doc.x"}`)); err != nil || got != "doc[x,]" {
+		t.Errorf("Handle(doc.x): got %v, %v; want doc[x,]", got, err)
+	}
+
+	for _, bad := range []string{"", "a..b", "a.", "dev*.status", "a.**"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewPattern(%q): did not panic", bad)
+				}
+			}()
+			NewPattern(Map{bad: named("bad")})
+		}()
+	}
+}
+
+// Verify that the options to New control how parameters are decoded.
+func TestNewOptions(t *testing.T) {
+	type params struct{ A int }
+	getA := func(_ context.Context, p params) int { return p.A }
+	noArgs := func(context.Context) int { return 0 }
+
+	// The server reports null parameters literally for "Null" methods, as a
+	// context decoder may do.
+	decodeNull := func(ctx context.Context, method string, p json.RawMessage) (context.Context, json.RawMessage, error) {
+		if strings.HasPrefix(method, "Null") {
+			return ctx, json.RawMessage("null"), nil
+		}
+		return ctx, p, nil
+	}
+	tests := []struct {
+		desc   string
+		strict bool // set StrictParams on the server
+		m      Map
+	}{
+		{"Lenient", false, Map{
+			"Default":  New(getA),
+			"Strict":   New(getA, StrictFields()),
+			"Lenient":  New(getA, LenientFields()),
+			"NullArgs": New(noArgs),
+			"NullOK":   New(noArgs, AllowNullParams()),
+			"NullA":    New(getA, AllowNullParams(), StrictFields()),
+		}},
+		{"Strict", true, Map{
+			"Default": New(getA),
+			"Lenient": NewMap(map[string]interface{}{"Lenient": getA}, LenientFields())["Lenient"],
+		}},
+	}
+	ctx := context.Background()
+	for _, test := range tests {
+		t.Run(test.desc, func(t *testing.T) {
+			loc := server.NewLocal(test.m, &server.LocalOptions{
+				Server: &jrpc2.ServerOptions{StrictParams: test.strict, DecodeContext: decodeNull},
+			})
+			defer loc.Close()
+
+			call := func(method string, p interface{}, want code.Code) {
+				t.Helper()
+				var got int
+				err := loc.Client.CallResult(ctx, method, p, &got)
+				if c := code.FromError(err); c != want {
+					t.Errorf("Call(%s, %v): got code %v (%v), want %v", method, p, c, err, want)
+				}
+			}
+			extra := map[string]int{"A": 1, "B": 2}
+			for _, name := range test.m.Names() {
+				switch name {
+				case "Default":
+					want := code.NoError
+					if test.strict {
+						want = code.InvalidParams
+					}
+					call(name, extra, want)
+				case "Strict":
+					call(name, extra, code.InvalidParams)
+					call(name, map[string]int{"A": 1}, code.NoError)
+				case "Lenient":
+					call(name, extra, code.NoError)
+				case "NullArgs":
+					call(name, nil, code.InvalidParams)
+				case "NullOK", "NullA":
+					call(name, nil, code.NoError)
+				}
+			}
+		})
+	}
+}
+
+// Verify that the names of a SyncMap can be listed while it is modified.
+func TestSyncMapConcurrent(t *testing.T) {
+	h := New(func(context.Context) error { return nil })
+	s := NewSyncMap(Map{"base": h})
+	ctx := context.Background()
+
+	const numWriters = 4
+	const numOps = 200
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numOps; j++ {
+				name := fmt.Sprintf("m%d.%d", i, j%10)
+				if j%3 == 2 {
+					s.Delete(name)
+				} else {
+					s.Set(name, h)
+				}
+			}
+		}()
+	}
+
+	// While the writers are running, every snapshot must be sorted, free of
+	// duplicates, and include the method that is never removed.
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		names := s.Names()
+		for i, name := range names {
+			if i > 0 && names[i-1] >= name {
+				t.Fatalf("Names not sorted and unique: %q", names)
+			}
+		}
+		if s.Assign(ctx, "base") == nil {
+			t.Fatal("Assign(base): got nil")
+		}
+		found := false
+		for _, name := range names {
+			found = found || name == "base"
+		}
+		if !found {
+			t.Fatalf("Names missing base: %q", names)
+		}
+	}
+
+	// Check the final state: Each writer last touched each of its names with
+	// a Set, except those whose final operation was a Delete.
+	want := []string{"base"}
+	for i := 0; i < numWriters; i++ {
+		for k := 0; k < 10; k++ {
+			last := numOps - 10 + k
+			if last%3 != 2 {
+				want = append(want, fmt.Sprintf("m%d.%d", i, k))
+			}
+		}
+	}
+	sort.Strings(want)
+	if diff := cmp.Diff(want, s.Names()); diff != "" {
+		t.Errorf("Final names (-want, +got):\n%s", diff)
+	}
+
+	// An unmodified Map may be listed concurrently, and every listing is the
+	// same snapshot.
+	m := Map{"a": h, "b": h, "c": h}
+	var mwg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		mwg.Add(1)
+		go func() {
+			defer mwg.Done()
+			for j := 0; j < numOps; j++ {
+				if got := m.Names(); len(got) != 3 || got[0] != "a" || got[2] != "c" {
+					t.Errorf("Map names: got %q, want [a b c]", got)
+					return
+				}
+			}
+		}()
+	}
+	mwg.Wait()
+
+	// A zero SyncMap is ready for use.
+	var z SyncMap
+	z.Set("x", h)
+	if got := z.Names(); len(got) != 1 || got[0] != "x" {
+		t.Errorf("Zero SyncMap names: got %q, want [x]", got)
+	}
+}
+
+// Verify that handlers constructed by NewTyped and its variants behave the
+// same as those constructed by New for the same functions.
+func TestNewTyped(t *testing.T) {
+	type args struct {
+		A int    `json:"a"`
+		B string `json:"b" jrpc2:"required"`
+	}
+	errApp := jrpc2.NewError(-29000, "application error", json.RawMessage(`{"x":1}`))
+	errPlain := errors.New("plain error")
+
+	byValue := func(_ context.Context, a args) (string, error) {
+		if a.A < 0 {
+			return "", errApp
+		} else if a.A == 0 {
+			return "", errPlain
+		}
+		return fmt.Sprintf("%d:%s", a.A, a.B), nil
+	}
+	byPtr := func(_ context.Context, a *args) (string, error) { return byValue(context.Background(), *a) }
+	noParams := func(context.Context) (int, error) { return 5, nil }
+	noResult := func(_ context.Context, a args) error {
+		_, err := byValue(context.Background(), a)
+		return err
+	}
+	sentinel := func(_ context.Context, a args) (string, error) {
+		if a.A == 2 {
+			return "unused", NoResult
+		}
+		return byValue(context.Background(), a)
+	}
+
+	pairs := []struct {
+		desc         string
+		typed, plain Func
+	}{
+		{"Value", NewTyped(byValue), New(byValue)},
+		{"Pointer", NewTyped(byPtr), New(byPtr)},
+		{"Strict", NewTyped(byValue, StrictFields()), New(byValue, StrictFields())},
+		{"NoParams", NewTypedNoParams(noParams), New(noParams)},
+		{"NoResult", NewTypedNoResult(noResult), New(noResult)},
+		{"Sentinel", NewTyped(sentinel), New(sentinel)},
+	}
+	inputs := []string{
+		``,
+		`,"params":{"a":1,"b":"x"}`,
+		`,"params":{"a":2,"b":"y","c":true}`,
+		`,"params":{"a":-1,"b":"z"}`,
+		`,"params":{"a":0,"b":"z"}`,
+		`,"params":{"a":1}`,
+		`,"params":{"a":"wrong"}`,
+		`,"params":[1,2]`,
+	}
+	ctx := context.Background()
+	for _, p := range pairs {
+		for _, in := range inputs {
+			req := mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"M"`+in+`}`)
+			tv, terr := p.typed(ctx, req)
+			pv, perr := p.plain(ctx, req)
+			if tv != pv {
+				t.Errorf("%s %s: typed result %v, plain result %v", p.desc, in, tv, pv)
+			}
+			if fmt.Sprint(terr) != fmt.Sprint(perr) || code.FromError(terr) != code.FromError(perr) {
+				t.Errorf("%s %s: typed error %v, plain error %v", p.desc, in, terr, perr)
+			}
+			if perr == errApp && terr != errApp {
+				t.Errorf("%s %s: typed error %v was not passed through", p.desc, in, terr)
+			}
+		}
+	}
+}
+
+func TestInfo(t *testing.T) {
+	h := New(func(context.Context) (string, error) { return "ok", nil })
+	info := Info{
+		Summary: "Report OK",
+		Result:  json.RawMessage(`{"type":"string"}`),
+	}
+	m := Map{
+		"Plain":     h,
+		"Doc":       WithInfo(h, info),
+		"DocDep":    Deprecated(WithInfo(h, info), "use Doc"),
+		"DepDoc":    WithInfo(Deprecated(h, "use Doc"), info),
+		"DepNoInfo": Deprecated(h, "gone"),
+	}
+	withDep := info
+	withDep.Deprecated = "use Doc"
+	tests := []struct {
+		method string
+		want   Info
+		ok     bool
+	}{
+		{"Plain", Info{}, false},
+		{"Missing", Info{}, false},
+		{"Doc", info, true},
+		{"DocDep", withDep, true},
+		{"DepDoc", withDep, true},
+		{"DepNoInfo", Info{Deprecated: "gone"}, true},
+	}
+	for _, test := range tests {
+		got, ok := m.Describe(test.method)
+		if ok != test.ok {
+			t.Errorf("Describe(%q): got ok=%v, want %v", test.method, ok, test.ok)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("Describe(%q): (-want, +got):\n%s", test.method, diff)
+		}
+	}
+
+	// Wrapping preserves the deprecation marker, whatever the order.
+	for _, name := range []string{"DocDep", "DepDoc"} {
+		if d, ok := m[name].(interface{ Deprecated() string }); !ok || d.Deprecated() != "use Doc" {
+			t.Errorf("Method %q is not marked deprecated", name)
+		}
+	}
+
+	// Wrapped handlers behave as the original.
+	req := mustParseReq(t, `{"jsonrpc":"2.0","id":1,"method":"Doc"}`)
+	if got, err := m["Doc"].Handle(context.Background(), req); err != nil || got != "ok" {
+		t.Errorf("Handle: got %v, %v; want ok, nil", got, err)
+	}
+
+	// The encoding of Info is stable.
+	bits, err := json.Marshal(withDep)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	const want = `{"summary":"Report OK","result":{"type":"string"},"deprecated":"use Doc"}`
+	if got := string(bits); got != want {
+		t.Errorf("Marshal Info: got %#q, want %#q", got, want)
+	}
+
+	s := NewSyncMap(m)
+	if got, ok := s.Describe("Doc"); !ok || got.Summary != info.Summary {
+		t.Errorf("SyncMap Describe(Doc): got %+v, %v", got, ok)
+	}
+}
+
+func TestTimeDuration(t *testing.T) {
+	utc := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	zone := time.FixedZone("", -7*3600)
+	offset := func(t time.Time) int { _, off := t.Zone(); return off }
+
+	timeTests := []struct {
+		input string
+		want  time.Time
+	}{
+		{`"2021-03-04T05:06:07Z"`, utc},
+		{`"2021-03-03T22:06:07-07:00"`, utc.In(zone)},
+		{`"2021-03-04T05:06:07.25Z"`, utc.Add(250 * time.Millisecond)},
+		{`1614834367`, utc},                                // seconds
+		{`1614834367250`, utc.Add(250 * time.Millisecond)}, // milliseconds
+		{`99999999999`, time.Unix(99999999999, 0)},         // largest seconds
+		{`100000000000`, time.UnixMilli(100000000000)},     // smallest millis
+		{`-1614834367`, time.Unix(-1614834367, 0)},         // before the epoch
+	}
+	for _, test := range timeTests {
+		var got Time
+		if err := json.Unmarshal([]byte(test.input), &got); err != nil {
+			t.Errorf("Unmarshal %s: unexpected error: %v", test.input, err)
+			continue
+		} else if !got.Equal(test.want) {
+			t.Errorf("Unmarshal %s: got %v, want %v", test.input, got, test.want)
+		}
+
+		// Round trip, preserving the instant and the zone offset.
+		bits, err := json.Marshal(got)
+		if err != nil {
+			t.Errorf("Marshal %v: unexpected error: %v", got, err)
+			continue
+		}
+		var back Time
+		if err := json.Unmarshal(bits, &back); err != nil {
+			t.Errorf("Unmarshal %s: unexpected error: %v", bits, err)
+		} else if !back.Equal(got.Time) {
+			t.Errorf("Round trip %s: got %v, want %v", bits, back, got)
+		} else if _, a := back.Zone(); a != offset(test.want) {
+			t.Errorf("Round trip %s: zone offset changed from %v to %v", bits, test.want, back)
+		}
+	}
+
+	durTests := []struct {
+		input string
+		want  time.Duration
+	}{
+		{`"5s"`, 5 * time.Second},
+		{`"1h2m3.5s"`, time.Hour + 2*time.Minute + 3500*time.Millisecond},
+		{`"-250ms"`, -250 * time.Millisecond},
+		{`1500`, 1500 * time.Millisecond},
+		{`0`, 0},
+	}
+	for _, test := range durTests {
+		var got Duration
+		if err := json.Unmarshal([]byte(test.input), &got); err != nil {
+			t.Errorf("Unmarshal %s: unexpected error: %v", test.input, err)
+			continue
+		} else if got.Duration != test.want {
+			t.Errorf("Unmarshal %s: got %v, want %v", test.input, got, test.want)
+		}
+		bits, err := json.Marshal(got)
+		if err != nil {
+			t.Errorf("Marshal %v: unexpected error: %v", got, err)
+			continue
+		}
+		var back Duration
+		if err := json.Unmarshal(bits, &back); err != nil {
+			t.Errorf("Unmarshal %s: unexpected error: %v", bits, err)
+		} else if back != got {
+			t.Errorf("Round trip %s: got %v, want %v", bits, back, got)
+		}
+	}
+
+	// Null leaves the value unchanged.
+	v := struct {
+		T Time
+		D Duration
+	}{Time{utc}, Duration{time.Second}}
+	if err := json.Unmarshal([]byte(`{"T":null,"D":null}`), &v); err != nil {
+		t.Errorf("Unmarshal null: unexpected error: %v", err)
+	} else if !v.T.Equal(utc) || v.D.Duration != time.Second {
+		t.Errorf("Unmarshal null: got %v, %v; want %v, %v", v.T, v.D, utc, time.Second)
+	}
+
+	// Invalid values are reported as InvalidParams errors naming the value.
+	type params struct {
+		When  Time     `json:"when"`
+		Delay Duration `json:"delay"`
+	}
+	h := New(func(_ context.Context, p params) error { return nil })
+	for _, test := range []struct {
+		params, value string
+	}{
+		{`{"when":"yesterday"}`, `"yesterday"`},
+		{`{"when":1.5}`, "1.5"},
+		{`{"when":true}`, "true"},
+		{`{"delay":"soon"}`, `"soon"`},
+		{`{"delay":2.5}`, "2.5"},
+		{`{"delay":1e30}`, "1e30"},
+	} {
+		req := mustParseReq(t, fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"x","params":%s}`, test.params))
+		_, err := h.Handle(context.Background(), req)
+		if got := code.FromError(err); got != code.InvalidParams {
+			t.Errorf("Params %s: got error %v, want code %v", test.params, err, code.InvalidParams)
+		} else if !strings.Contains(err.Error(), test.value) {
+			t.Errorf("Params %s: error %q does not mention %s", test.params, err, test.value)
+		}
+	}
+}
+
+// Verify the encoding of nil results on the wire with the NullResult option.
+func TestNullResult(t *testing.T) {
+	type result struct{ X int }
+	obj := NullResult(json.RawMessage(`{}`))
+	cch, sch := channel.Direct()
+	srv := jrpc2.NewServer(Map{
+		"Default": New(func(context.Context) (interface{}, error) { return nil, nil }),
+		"Object":  New(func(context.Context) (interface{}, error) { return nil, nil }, obj),
+		"Array":   New(func(context.Context) error { return nil }, NullResult(json.RawMessage(`[]`))),
+		"Pointer": New(func(context.Context) (*result, error) { return nil, nil }, obj),
+		"Typed":   NewTyped(func(context.Context, []int) (map[string]int, error) { return nil, nil }, obj),
+		"NonNil":  New(func(context.Context) (*result, error) { return &result{X: 1}, nil }, obj),
+		"Raw":     New(func(context.Context) (json.RawMessage, error) { return json.RawMessage(`null`), nil }, obj),
+		"Error": New(func(context.Context) (interface{}, error) {
+			return nil, jrpc2.Errorf(code.Code(17), "failed")
+		}, obj),
+		"Wrapped": WithNullResult(Func(func(context.Context, *jrpc2.Request) (interface{}, error) {
+			return nil, nil
+		}), json.RawMessage(`{}`)),
+	}, nil).Start(sch)
+	defer func() { cch.Close(); srv.Wait() }()
+
+	tests := []struct {
+		method, want string
+	}{
+		{"Default", `{"jsonrpc":"2.0","id":1,"result":null}`},
+		{"Object", `{"jsonrpc":"2.0","id":1,"result":{}}`},
+		{"Array", `{"jsonrpc":"2.0","id":1,"result":[]}`},
+		{"Pointer", `{"jsonrpc":"2.0","id":1,"result":{}}`},
+		{"Typed", `{"jsonrpc":"2.0","id":1,"result":{}}`},
+		{"NonNil", `{"jsonrpc":"2.0","id":1,"result":{"X":1}}`},
+		{"Raw", `{"jsonrpc":"2.0","id":1,"result":{}}`},
+		{"Error", `{"jsonrpc":"2.0","id":1,"error":{"code":17,"message":"failed"}}`},
+		{"Wrapped", `{"jsonrpc":"2.0","id":1,"result":{}}`},
+	}
+	for _, test := range tests {
+		params := ""
+		if test.method == "Typed" {
+			params = `,"params":[]`
+		}
+		req := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q%s}`, test.method, params)
+		if err := cch.Send([]byte(req)); err != nil {
+			t.Fatalf("Send %s: %v", req, err)
+		}
+		rsp, err := cch.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if got := string(rsp); got != test.want {
+			t.Errorf("Call %q: got %#q, want %#q", test.method, got, test.want)
+		}
+	}
+
+	// Notifications are not affected, and get no response.
+	if err := cch.Send([]byte(`{"jsonrpc":"2.0","method":"Object"}`)); err != nil {
+		t.Fatalf("Send notification: %v", err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("NullResult with invalid JSON did not panic")
+			}
+		}()
+		NullResult(json.RawMessage(`{`))
+	}()
+}
+
+func TestDecodeError(t *testing.T) {
+	type args struct{ X int }
+	hide := DecodeError(func(req *jrpc2.Request, err error) error {
+		return jrpc2.Errorf(code.InvalidParams, "bad parameters for %s", req.Method())
+	})
+	wrap := DecodeError(func(_ *jrpc2.Request, err error) error {
+		return jrpc2.Errorf(code.Code(-32001), "decode: %v", err)
+	})
+	fallback := DecodeError(func(*jrpc2.Request, error) error { return nil })
+	fn := func(context.Context, args) (int, error) { return 1, nil }
+
+	cch, sch := channel.Direct()
+	srv := jrpc2.NewServer(Map{
+		"Default":  New(fn),
+		"Hide":     New(fn, hide),
+		"Wrap":     New(fn, wrap),
+		"Fallback": New(fn, fallback),
+		"Typed":    NewTyped(fn, hide),
+		"Strict":   New(fn, hide, StrictFields()),
+	}, nil).Start(sch)
+	defer func() { cch.Close(); srv.Wait() }()
+
+	const badType = `{"X":"no"}`
+	tests := []struct {
+		method, params, want string
+	}{
+		{"Default", badType, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid parameters: json: cannot unmarshal string into Go struct field args.X of type int"}}`},
+		{"Hide", badType, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"bad parameters for Hide"}}`},
+		{"Wrap", badType, `{"jsonrpc":"2.0","id":1,"error":{"code":-32001,"message":"decode: json: cannot unmarshal string into Go struct field args.X of type int"}}`},
+		{"Fallback", badType, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"invalid parameters: json: cannot unmarshal string into Go struct field args.X of type int"}}`},
+		{"Typed", badType, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"bad parameters for Typed"}}`},
+		{"Strict", `{"X":1,"Y":2}`, `{"jsonrpc":"2.0","id":1,"error":{"code":-32602,"message":"bad parameters for Strict"}}`},
+
+		// Successful calls are not affected.
+		{"Hide", `{"X":1}`, `{"jsonrpc":"2.0","id":1,"result":1}`},
+		{"Typed", `{"X":1}`, `{"jsonrpc":"2.0","id":1,"result":1}`},
+	}
+	for _, test := range tests {
+		req := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q,"params":%s}`, test.method, test.params)
+		if err := cch.Send([]byte(req)); err != nil {
+			t.Fatalf("Send %s: %v", req, err)
+		}
+		rsp, err := cch.Recv()
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if got := string(rsp); got != test.want {
+			t.Errorf("Call %q %s:\n got %#q\nwant %#q", test.method, test.params, got, test.want)
+		}
+	}
+}
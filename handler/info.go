@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"github.com/yinfei8/jrpc2"
+)
+
+// Info describes a method for discovery and documentation. It is metadata
+// recorded when the handler is registered, and does not affect how requests
+// are handled. The JSON encoding of an Info is stable, so that servers and
+// external documentation generators can rely on it.
+//
+// Info is an alias for jrpc2.MethodInfo, so that a server can report the
+// metadata of its methods (see jrpc2.ServerInfo) for an assigner such as a
+// Map or a SyncMap that implements a Describe method.
+type Info = jrpc2.MethodInfo
+
+// A Describer is a handler that carries documentation metadata. Handlers
+// returned by WithInfo and Deprecated implement this interface.
+type Describer interface {
+	jrpc2.Handler
+
+	// Describe returns the metadata for the handler.
+	Describe() Info
+}
+
+// WithInfo returns a handler that behaves identically to h, and whose Describe
+// method returns info. If h is marked as deprecated by Deprecated, the result
+// remains so, and the deprecation message of h is reported by Describe.
+func WithInfo(h jrpc2.Handler, info Info) jrpc2.Handler {
+	if d, ok := h.(deprecated); ok {
+		return deprecated{WithInfo(d.Handler, info), d.msg}
+	}
+	return described{h, info}
+}
+
+type described struct {
+	jrpc2.Handler
+	info Info
+}
+
+// Describe returns the metadata for d.
+func (d described) Describe() Info { return d.info }
+
+// infoOf returns the metadata for h, and reports whether h has any.
+func infoOf(h jrpc2.Handler) (Info, bool) {
+	if d, ok := h.(Describer); ok {
+		return d.Describe(), true
+	}
+	return Info{}, false
+}
+
+// Describe returns the metadata for the specified method of m, and reports
+// whether the method exists in m and has metadata.
+func (m Map) Describe(method string) (Info, bool) { return infoOf(m[method]) }
+
+// Describe returns the metadata for the specified method of s, and reports
+// whether the method exists in s and has metadata.
+func (s *SyncMap) Describe(method string) (Info, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return infoOf(s.m[method])
+}
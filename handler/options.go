@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/code"
+)
+
+// An Option controls how a handler constructed by New decodes the parameters
+// of its requests and reports its results. Options apply only to the handler
+// they are given to, and take precedence over the StrictParams setting of the
+// server.
+//
+// Options for decoding have no effect on functions that receive only the
+// *jrpc2.Request, since those functions decode their own parameters.
+type Option func(*handlerConfig)
+
+type handlerConfig struct {
+	strict     bool            // reject unknown object keys
+	lenient    bool            // ignore unknown object keys, even if the server is strict
+	allowNull  bool            // treat "null" parameters as absent
+	nullResult json.RawMessage // if set, report this in place of a nil result
+
+	decodeErr func(*jrpc2.Request, error) error // if set, reports decoding errors
+}
+
+// StrictFields instructs the handler to reject parameters that are objects
+// with keys that do not correspond to fields of the parameter type, as
+// jrpc2.StrictFields does. It overrides LenientFields.
+func StrictFields() Option {
+	return func(c *handlerConfig) { c.strict, c.lenient = true, false }
+}
+
+// LenientFields instructs the handler to ignore unknown object keys in its
+// parameters, even if the server has the StrictParams option set. It
+// overrides StrictFields.
+func LenientFields() Option {
+	return func(c *handlerConfig) { c.strict, c.lenient = false, true }
+}
+
+// AllowNullParams instructs the handler to treat parameters that are
+// literally null as if they were absent. A function that takes no parameters
+// then accepts a null, and a function that takes parameters receives the zero
+// value of its parameter type.
+func AllowNullParams() Option {
+	return func(c *handlerConfig) { c.allowNull = true }
+}
+
+// DecodeError instructs the handler to report the error returned by f when
+// the parameters of a request cannot be decoded, instead of the default
+// error. The function receives the request and the error reported by the
+// decoder, and should return an error constructed by jrpc2.Errorf or
+// jrpc2.NewError, to choose its code and message. If f returns nil, the
+// default error is reported.
+//
+// By default, the handler reports an error with code code.InvalidParams whose
+// message includes the text of the decoding error. For example, to omit the
+// details of the error:
+//
+//    handler.New(fn, handler.DecodeError(func(_ *jrpc2.Request, err error) error {
+//       return jrpc2.Errorf(code.InvalidParams, "malformed request")
+//    }))
+//
+// Errors reported by validation (see Validate), and by a function that takes
+// no parameters when given some, are not decoding errors.
+func DecodeError(f func(req *jrpc2.Request, err error) error) Option {
+	return func(c *handlerConfig) { c.decodeErr = f }
+}
+
+// NullResult instructs the handler to report enc as the result of a
+// successful call whose result is nil, instead of null. A result is nil if it
+// is a nil interface, pointer, map, or slice, or a json.RawMessage that is
+// empty or null. For example, NullResult(json.RawMessage("{}")) makes the
+// handler report an empty object. NullResult panics if enc is not valid JSON.
+//
+// The JSON-RPC 2.0 specification requires every successful response to have
+// a result, so there is no option to omit it. Notifications do not have
+// responses, and are not affected.
+func NullResult(enc json.RawMessage) Option {
+	if !json.Valid(enc) {
+		panic("handler.NullResult: invalid JSON result " + string(enc))
+	}
+	enc = append(json.RawMessage(nil), enc...)
+	return func(c *handlerConfig) { c.nullResult = enc }
+}
+
+// WithNullResult returns a handler that behaves as h, except that it reports
+// enc instead of a nil result, as described for NullResult. It is useful to
+// apply the option to handlers not constructed by New, for example with
+// MapApply. WithNullResult panics if enc is not valid JSON.
+func WithNullResult(h jrpc2.Handler, enc json.RawMessage) jrpc2.Handler {
+	return newConfig([]Option{NullResult(enc)}).wrap(h.Handle)
+}
+
+// NewMap constructs a Map by calling New with each of the functions in fns
+// and the given options, so that the same options can be applied to several
+// methods at once. It will panic if New would panic for any of the functions.
+func NewMap(fns map[string]interface{}, opts ...Option) Map {
+	m := make(Map, len(fns))
+	for name, fn := range fns {
+		m[name] = New(fn, opts...)
+	}
+	return m
+}
+
+// HandlerOptions instructs NewService to construct the handler for each
+// method with the given options.
+func HandlerOptions(opts ...Option) ServiceOption {
+	return func(c *serviceConfig) { c.hopts = append(c.hopts, opts...) }
+}
+
+func newConfig(opts []Option) handlerConfig {
+	var cfg handlerConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// hasParams reports whether req has parameters, according to c.
+func (c handlerConfig) hasParams(req *jrpc2.Request) bool {
+	return req.HasParams() && !(c.allowNull && isNullParams(req))
+}
+
+// decode decodes the parameters of req into v, according to c.
+func (c handlerConfig) decode(req *jrpc2.Request, v interface{}) error {
+	switch {
+	case !c.hasParams(req):
+		return nil
+	case c.strict:
+		return req.UnmarshalParams(jrpc2.StrictFields(v))
+	case c.lenient:
+		return json.Unmarshal([]byte(req.ParamString()), v)
+	}
+	return req.UnmarshalParams(v)
+}
+
+// decodeError returns the error to report when decoding the parameters of req
+// failed with err, according to c.
+func (c handlerConfig) decodeError(req *jrpc2.Request, err error) error {
+	if c.decodeErr != nil {
+		if derr := c.decodeErr(req, err); derr != nil {
+			return derr
+		}
+	}
+	if _, ok := err.(*jrpc2.Error); ok {
+		return err // already reported as invalid parameters
+	}
+	return jrpc2.Errorf(code.InvalidParams, "invalid parameters: %v", err)
+}
+
+// wrap returns a handler that calls f and reports its results according to c.
+func (c handlerConfig) wrap(f Func) Func {
+	if c.nullResult == nil {
+		return f
+	}
+	enc := c.nullResult
+	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		v, err := f(ctx, req)
+		if err == nil && isNilResult(v) {
+			return enc, nil
+		}
+		return v, err
+	})
+}
+
+// isNilResult reports whether v would be encoded as a JSON null.
+func isNilResult(v interface{}) bool {
+	switch t := v.(type) {
+	case nil:
+		return true
+	case json.RawMessage:
+		return len(t) == 0 || strings.TrimSpace(string(t)) == "null"
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+func isNullParams(req *jrpc2.Request) bool {
+	return strings.TrimSpace(req.ParamString()) == "null"
+}
@@ -0,0 +1,150 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/yinfei8/jrpc2"
+)
+
+// A Pattern is an implementation of the jrpc2.Assigner interface that looks
+// up method names by matching them against patterns, for use when the method
+// names cannot be enumerated in advance.
+//
+// A pattern is a sequence of segments separated by periods ("."). Each
+// segment is either a literal string, or a wildcard "*" that matches any
+// single non-empty segment of the method name. For example, the pattern
+//
+//    device.*.status
+//
+// matches "device.A1.status" and "device.xyz.status", but not
+// "device.status" or "device.a.b.status". The segments matched by wildcards
+// are available to the handler via PathParam.
+//
+// If more than one pattern matches a method name, the most specific one is
+// chosen: Comparing the patterns segment by segment from left to right, the
+// pattern with a literal segment at the first position where the other has a
+// wildcard takes precedence. A pattern without wildcards is therefore always
+// preferred, and "device.*.status" is preferred over "*.A1.status".
+type Pattern struct {
+	rules []patternRule // in order of precedence
+}
+
+type patternRule struct {
+	pattern string
+	segs    []string // "*" denotes a wildcard
+	handler jrpc2.Handler
+}
+
+// NewPattern constructs a Pattern that assigns methods matching the patterns
+// that are the keys of m to the corresponding handlers. It panics if any of
+// the patterns is invalid: A pattern is invalid if it has an empty segment,
+// or a segment containing "*" that is not a wildcard.
+func NewPattern(m Map) *Pattern {
+	p := new(Pattern)
+	for pat, h := range m {
+		segs := strings.Split(pat, ".")
+		for _, seg := range segs {
+			if seg == "" {
+				panic(fmt.Sprintf("pattern %q has an empty segment", pat))
+			} else if seg != "*" && strings.Contains(seg, "*") {
+				panic(fmt.Sprintf("pattern %q has an invalid wildcard segment %q", pat, seg))
+			}
+		}
+		p.rules = append(p.rules, patternRule{pattern: pat, segs: segs, handler: h})
+	}
+	sort.Slice(p.rules, func(i, j int) bool {
+		a, b := p.rules[i].segs, p.rules[j].segs
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		for k := range a {
+			if aw, bw := a[k] == "*", b[k] == "*"; aw != bw {
+				return bw // the literal segment is more specific
+			} else if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+	return p
+}
+
+// Assign implements part of the jrpc2.Assigner interface. The handler for the
+// most specific pattern matching method is returned, or nil if no pattern
+// matches.
+func (p *Pattern) Assign(ctx context.Context, method string) jrpc2.Handler {
+	segs := strings.Split(method, ".")
+	for _, r := range p.rules {
+		params, ok := r.match(segs)
+		if !ok {
+			continue
+		} else if len(params) == 0 {
+			return r.handler
+		}
+		return withPathParams(r.handler, params)
+	}
+	return nil
+}
+
+// withPathParams wraps h so that each request is delivered to it with params
+// attached to its context. If h has metadata (see Describer), or is marked as
+// deprecated, the result does too.
+func withPathParams(h jrpc2.Handler, params []string) jrpc2.Handler {
+	var out jrpc2.Handler = Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		return h.Handle(context.WithValue(ctx, pathParamsKey{}, params), req)
+	})
+	if info, ok := infoOf(h); ok {
+		out = described{out, info}
+	}
+	if d, ok := h.(interface{ Deprecated() string }); ok {
+		out = deprecated{out, d.Deprecated()}
+	}
+	return out
+}
+
+// Names implements part of the jrpc2.Assigner interface. It reports the
+// patterns themselves, in sorted order.
+func (p *Pattern) Names() []string {
+	names := make([]string, len(p.rules))
+	for i, r := range p.rules {
+		names[i] = r.pattern
+	}
+	sort.Strings(names)
+	return names
+}
+
+// match reports whether segs matches the pattern of r, and if so returns the
+// segments matched by wildcards.
+func (r patternRule) match(segs []string) ([]string, bool) {
+	if len(segs) != len(r.segs) {
+		return nil, false
+	}
+	var params []string
+	for i, seg := range r.segs {
+		if seg == "*" {
+			if segs[i] == "" {
+				return nil, false
+			}
+			params = append(params, segs[i])
+		} else if seg != segs[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+type pathParamsKey struct{}
+
+// PathParam returns the segment of the method name matched by the ith
+// wildcard (counting from 0) of the pattern that selected the handler for
+// ctx, as assigned by a Pattern. It returns "" if ctx is not from such a
+// handler, or if the pattern has no wildcard i.
+func PathParam(ctx context.Context, i int) string {
+	if params, ok := ctx.Value(pathParamsKey{}).([]string); ok && i >= 0 && i < len(params) {
+		return params[i]
+	}
+	return ""
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/code"
+)
+
+// Positional adapts a function that takes several parameters to a
+// jrpc2.Handler. The concrete value of fn must be a function of the form
+//
+//    func(context.Context, X1, X2, ..., Xn) R
+//
+// for JSON-marshalable types X1...Xn, where R is any of the result forms
+// accepted by New. The names give the names of the parameters X1...Xn in
+// order, and Positional will panic if len(names) != n, or if fn does not have
+// a suitable type.
+//
+// The request parameters may be an array, whose elements are bound to the
+// parameters in order, or an object, whose fields are bound to parameters
+// by name. Object fields not matching any name are ignored.
+//
+// A name ending in "?" marks its parameter as optional, and the "?" is not
+// part of the name. An optional parameter that is not given in the request
+// is passed as the zero value of its type. Optional parameters may only be
+// followed by other optional parameters. If the request gives the wrong number
+// of parameters, or omits a required parameter, the handler reports an error
+// with code.InvalidParams.
+//
+// For example:
+//
+//    handler.Positional(func(ctx context.Context, x, y int) (int, error) {
+//       return x + y, nil
+//    }, "x", "y")
+//
+// accepts parameters such as [1, 2] or {"x": 1, "y": 2}.
+func Positional(fn interface{}, names ...string) Func {
+	m, err := newPositional(fn, names)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+func newPositional(fn interface{}, names []string) (Func, error) {
+	if fn == nil {
+		return nil, errors.New("nil method")
+	}
+	typ := reflect.TypeOf(fn)
+	if typ.Kind() != reflect.Func {
+		return nil, errors.New("not a function")
+	} else if typ.IsVariadic() {
+		return nil, errors.New("variadic functions are not supported")
+	} else if np := typ.NumIn(); np == 0 || typ.In(0) != ctxType {
+		return nil, errors.New("first parameter is not context.Context")
+	} else if np-1 != len(names) {
+		return nil, fmt.Errorf("function has %d parameters, but %d names given", np-1, len(names))
+	} else if err := checkResultTypes(typ); err != nil {
+		return nil, err
+	}
+
+	// Parse the parameter names, and check that all the required parameters
+	// precede the optional ones.
+	params := make([]string, len(names))
+	seen := make(map[string]bool)
+	nreq := len(names)
+	for i, name := range names {
+		if strings.HasSuffix(name, "?") {
+			name = strings.TrimSuffix(name, "?")
+			if i < nreq {
+				nreq = i
+			}
+		} else if i > nreq {
+			return nil, fmt.Errorf("required parameter %q follows an optional parameter", name)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty name for parameter %d", i+1)
+		} else if seen[name] {
+			return nil, fmt.Errorf("duplicate parameter name %q", name)
+		}
+		seen[name] = true
+		params[i] = name
+	}
+	want := fmt.Sprint(len(params))
+	if nreq < len(params) {
+		want = fmt.Sprintf("%d to %d", nreq, len(params))
+	}
+
+	// Construct a function to bind the request parameters to arguments.
+	bind := func(req *jrpc2.Request) ([]reflect.Value, error) {
+		var raw []json.RawMessage // the encoded argument values, nil if absent
+		var pv json.RawMessage
+		if err := req.UnmarshalParams(&pv); err != nil {
+			return nil, err
+		}
+		switch pv = bytes.TrimSpace(pv); {
+		case len(pv) == 0:
+			raw = make([]json.RawMessage, len(params))
+
+		case pv[0] == '[':
+			if err := json.Unmarshal(pv, &raw); err != nil {
+				return nil, jrpc2.Errorf(code.InvalidParams, "invalid parameters: %v", err)
+			} else if len(raw) < nreq || len(raw) > len(params) {
+				return nil, jrpc2.Errorf(code.InvalidParams, "got %d parameters, want %s", len(raw), want)
+			}
+			raw = append(raw, make([]json.RawMessage, len(params)-len(raw))...)
+
+		case pv[0] == '{':
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(pv, &obj); err != nil {
+				return nil, jrpc2.Errorf(code.InvalidParams, "invalid parameters: %v", err)
+			}
+			raw = make([]json.RawMessage, len(params))
+			for i, name := range params {
+				raw[i] = obj[name]
+			}
+
+		default:
+			return nil, jrpc2.Errorf(code.InvalidParams, "parameters must be an array or object")
+		}
+
+		args := make([]reflect.Value, len(params))
+		for i, name := range params {
+			arg := reflect.New(typ.In(i + 1))
+			if raw[i] == nil {
+				if i < nreq {
+					return nil, jrpc2.Errorf(code.InvalidParams, "missing parameter %q (want %s parameters)", name, want)
+				}
+			} else if err := json.Unmarshal(raw[i], arg.Interface()); err != nil {
+				return nil, jrpc2.Errorf(code.InvalidParams, "invalid parameter %q: %v", name, err)
+			}
+			args[i] = arg.Elem()
+		}
+		return args, nil
+	}
+
+	decodeOut := resultDecoder(typ)
+	call := reflect.ValueOf(fn).Call
+	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		rest, err := bind(req)
+		if err != nil {
+			return nil, err
+		}
+		args := append([]reflect.Value{reflect.ValueOf(ctx)}, rest...)
+		return decodeOut(call(args))
+	}), nil
+}
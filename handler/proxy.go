@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/yinfei8/jrpc2"
+)
+
+// Proxy returns a handler that forwards each request it receives to the
+// server at the other end of cli, using the same method name and parameters.
+//
+// For a call, the result reported by the upstream server is returned as-is,
+// or if the upstream server reports an error, that error is returned with its
+// code, message, and data intact. For a notification, Proxy forwards the
+// notification and returns without waiting for a reply.
+//
+// The context passed to the handler governs the upstream request, so that if
+// the inbound request is cancelled, so is the upstream request.
+func Proxy(cli *jrpc2.Client) jrpc2.Handler {
+	return Func(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		var params interface{}
+		if req.HasParams() {
+			params = json.RawMessage(req.ParamString())
+		}
+		if req.IsNotification() {
+			return nil, cli.Notify(ctx, req.Method(), params)
+		}
+		rsp, err := cli.Call(ctx, req.Method(), params)
+		if err != nil {
+			return nil, err
+		}
+		var result json.RawMessage
+		if err := rsp.UnmarshalResult(&result); err != nil {
+			return nil, err
+		}
+		return result, nil
+	})
+}
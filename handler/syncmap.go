@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/yinfei8/jrpc2"
+)
+
+// A SyncMap is an implementation of the jrpc2.Assigner interface that looks
+// up method names in a map of jrpc2.Handler values, like Map, but which may be
+// safely modified while it is in use by a server. A zero SyncMap is empty and
+// ready for use. A SyncMap must not be copied after first use.
+type SyncMap struct {
+	mu sync.RWMutex
+	m  Map
+}
+
+// NewSyncMap returns a new SyncMap containing the methods of m. The map m is
+// copied, so later changes to m do not affect the result.
+func NewSyncMap(m Map) *SyncMap {
+	s := &SyncMap{m: make(Map, len(m))}
+	s.m.MergeOverwrite(m)
+	return s
+}
+
+// Assign implements part of the jrpc2.Assigner interface.
+func (s *SyncMap) Assign(_ context.Context, method string) jrpc2.Handler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m[method]
+}
+
+// Names implements part of the jrpc2.Assigner interface. It returns a sorted
+// snapshot of the method names defined at the time of the call, and is safe
+// to call concurrently with Set and Delete.
+func (s *SyncMap) Names() []string {
+	s.mu.RLock()
+	names := make([]string, 0, len(s.m))
+	for name := range s.m {
+		names = append(names, name)
+	}
+	s.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Set adds or replaces the handler for the specified method name.
+func (s *SyncMap) Set(method string, h jrpc2.Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		s.m = make(Map)
+	}
+	s.m[method] = h
+}
+
+// Delete removes the handler for the specified method name, if it exists.
+func (s *SyncMap) Delete(method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, method)
+}
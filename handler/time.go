@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Time is a wrapper for time.Time that can be used as a field of a parameter
+// struct. It accepts either of the following JSON encodings:
+//
+//    "2006-01-02T15:04:05Z07:00"  an RFC 3339 timestamp, with optional fractional seconds
+//    1136214245                   an integer count of seconds or milliseconds since the Unix epoch
+//
+// An integer whose absolute value is less than 1e11 is taken as seconds, and
+// any other integer as milliseconds. This rule is unambiguous for times after
+// March 1973 and before the year 5138; encode times outside that range as
+// RFC 3339 strings instead.
+//
+// A JSON null leaves the value unchanged. A Time encodes as an RFC 3339
+// string, preserving its time zone offset. An invalid encoding is reported as
+// a *json.UnmarshalTypeError, to which the decoder adds the name of the field
+// being decoded.
+type Time struct {
+	time.Time
+}
+
+// secondsLimit is the magnitude below which an integer Time is interpreted as
+// seconds rather than milliseconds since the epoch.
+const secondsLimit = 1e11
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (t *Time) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		return nil
+	} else if len(data) != 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		v, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return typeError(data, t)
+		}
+		t.Time = v
+		return nil
+	}
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return typeError(data, t)
+	} else if n > -secondsLimit && n < secondsLimit {
+		t.Time = time.Unix(n, 0)
+	} else {
+		t.Time = time.UnixMilli(n)
+	}
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (t Time) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Time.Format(time.RFC3339Nano))
+}
+
+// Duration is a wrapper for time.Duration that can be used as a field of a
+// parameter struct. It accepts either of the following JSON encodings:
+//
+//    "1m30s"  a string in the format accepted by time.ParseDuration
+//    90000    an integer count of milliseconds
+//
+// A JSON null leaves the value unchanged. A Duration encodes as a string in
+// the format of time.Duration.String. Invalid encodings are reported as for
+// Time.
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		return nil
+	} else if len(data) != 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return typeError(data, d)
+		}
+		d.Duration = v
+		return nil
+	}
+	n, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil || n > maxMillis || n < -maxMillis {
+		return typeError(data, d)
+	}
+	d.Duration = time.Duration(n) * time.Millisecond
+	return nil
+}
+
+// maxMillis is the largest count of milliseconds representable as a Duration.
+const maxMillis = int64(1<<63-1) / int64(time.Millisecond)
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.Duration.String())
+}
+
+// typeError reports that data cannot be decoded into the value v points to.
+func typeError(data []byte, v interface{}) error {
+	return &json.UnmarshalTypeError{
+		Value: string(data),
+		Type:  reflect.TypeOf(v).Elem(),
+	}
+}
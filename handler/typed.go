@@ -0,0 +1,97 @@
+package handler
+
+import (
+	"context"
+	"reflect"
+
+	"github.com/yinfei8/jrpc2"
+)
+
+// NewTyped adapts a function to a jrpc2.Handler, as New does, but the
+// signature of fn is checked by the compiler rather than at run time, and the
+// handler does not use reflection to call it.
+//
+// The resulting handler decodes parameters, validates them, and reports
+// errors exactly as a handler constructed by New for the same function
+// would, and accepts the same options. In particular, if fn returns an error
+// of concrete type *jrpc2.Error, it is passed through unchanged, and if the
+// parameters cannot be decoded, the handler reports an error with code
+// code.InvalidParams without calling fn.
+//
+// Use New for functions whose signatures are not known until run time.
+func NewTyped[P, R any](fn func(context.Context, P) (R, error), opts ...Option) Func {
+	decode := newDecoder[P](opts)
+	return newConfig(opts).wrap(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		p, err := decode(req)
+		if err != nil {
+			return nil, err
+		}
+		return result(fn(ctx, p))
+	})
+}
+
+// NewTypedNoParams is a variant of NewTyped for a function that does not
+// accept any parameters. The resulting handler reports an error with code
+// code.InvalidParams if the request has parameters.
+func NewTypedNoParams[R any](fn func(context.Context) (R, error), opts ...Option) Func {
+	cfg := newConfig(opts)
+	return cfg.wrap(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		if cfg.hasParams(req) {
+			return nil, errNoParams
+		}
+		return result(fn(ctx))
+	})
+}
+
+// NewTypedNoResult is a variant of NewTyped for a function that reports only
+// an error. On success, or if fn returns NoResult, the result of the call is
+// null.
+func NewTypedNoResult[P any](fn func(context.Context, P) error, opts ...Option) Func {
+	decode := newDecoder[P](opts)
+	return newConfig(opts).wrap(func(ctx context.Context, req *jrpc2.Request) (interface{}, error) {
+		p, err := decode(req)
+		if err != nil {
+			return nil, err
+		}
+		return result(nil, fn(ctx, p))
+	})
+}
+
+// newDecoder returns a function that decodes the parameters of a request
+// into a value of type P, as the handler constructed by New for a function
+// with a parameter of type P would. It panics if P has invalid "jrpc2" tags.
+func newDecoder[P any](opts []Option) func(*jrpc2.Request) (P, error) {
+	cfg := newConfig(opts)
+
+	// As New does, pass a pointer to a zero value rather than nil if the
+	// parameter is a pointer type. Only this case requires reflection.
+	var newP func() P
+	typ := reflect.TypeOf((*P)(nil)).Elem()
+	base := typ
+	if typ.Kind() == reflect.Ptr {
+		base = typ.Elem()
+		newP = func() P { return reflect.New(base).Interface().(P) }
+	}
+	check, err := checkType(base)
+	if err != nil {
+		panic(err)
+	}
+
+	return func(req *jrpc2.Request) (P, error) {
+		var p P
+		var dst interface{} = &p
+		if newP != nil {
+			p = newP()
+			dst = p
+		}
+		if err := cfg.decode(req, dst); err != nil {
+			return p, cfg.decodeError(req, err)
+		}
+		if check {
+			if err := Validate(dst); err != nil {
+				return p, err
+			}
+		}
+		return p, nil
+	}
+}
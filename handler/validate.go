@@ -0,0 +1,265 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/code"
+)
+
+// Validate checks and updates the fields of the struct that v points to,
+// according to the "jrpc2" tags on its fields. The tag options are:
+//
+//    jrpc2:"required"      the field must not have its zero value
+//    jrpc2:"default=text"  if the field has its zero value, set it to text
+//
+// The text of a default is decoded as JSON into the type of the field; for a
+// field of string type, text that is not valid JSON is used verbatim, so that
+// `jrpc2:"default=10"` and `jrpc2:"default=none"` both work as expected.
+//
+// Validate checks nested structs, pointers to structs, and slices and arrays
+// of these recursively. If any required fields are missing, Validate reports
+// an error with code.InvalidParams that names all of them, using their JSON
+// field names. Otherwise it returns nil after applying any defaults.
+//
+// Handlers constructed by New call Validate on their decoded parameters when
+// the parameter type has any fields with a "jrpc2" tag.
+func Validate(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("validate: argument must be a non-nil pointer")
+	}
+	if ok, err := checkType(rv.Type().Elem()); err != nil {
+		return err
+	} else if !ok {
+		return nil // nothing to validate
+	}
+	var missing []string
+	if err := validate(rv.Elem(), "", &missing); err != nil {
+		return err
+	}
+	if len(missing) != 0 {
+		return jrpc2.Errorf(code.InvalidParams, "missing required parameters: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// validate checks v, whose location is described by path, and appends the
+// paths of any missing required fields to *missing.
+func validate(v reflect.Value, path string, missing *[]string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return validate(v.Elem(), path, missing)
+		}
+	case reflect.Slice, reflect.Array:
+		if !mayHaveRules(v.Type().Elem()) {
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := validate(v.Index(i), fmt.Sprintf("%s[%d]", path, i), missing); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		rules, err := rulesFor(v.Type())
+		if err != nil {
+			return err
+		}
+		for _, r := range rules {
+			f := v.Field(r.index)
+			name := r.name
+			if name == "" {
+				name = path // an embedded struct, whose fields are promoted
+			} else if path != "" {
+				name = path + "." + name
+			}
+			if f.IsZero() {
+				if r.required {
+					*missing = append(*missing, name)
+					continue
+				} else if r.def != nil && f.CanAddr() {
+					if err := json.Unmarshal(r.def, f.Addr().Interface()); err != nil {
+						return fmt.Errorf("setting default for %s: %v", name, err)
+					}
+					continue
+				}
+			}
+			if err := validate(f, name, missing); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A fieldRule describes how to validate a single field of a struct.
+type fieldRule struct {
+	index    int             // the index of the field in its struct
+	name     string          // the JSON name of the field, "" if embedded
+	required bool            // the field must not be zero
+	def      json.RawMessage // the default value, or nil
+}
+
+var (
+	ruleCache  sync.Map // :: reflect.Type → []fieldRule
+	checkCache sync.Map // :: reflect.Type → typeCheck
+)
+
+type typeCheck struct {
+	ok  bool
+	err error
+}
+
+// checkType reports whether values of type t need to be validated, or an
+// error if any of the tags reachable from t is invalid. The results are
+// cached.
+func checkType(t reflect.Type) (bool, error) {
+	if v, ok := checkCache.Load(t); ok {
+		c := v.(typeCheck)
+		return c.ok, c.err
+	}
+	ok, err := hasRules(t, make(map[reflect.Type]bool))
+	checkCache.Store(t, typeCheck{ok: ok, err: err})
+	return ok, err
+}
+
+// rulesFor returns the rules for the fields of struct type t that have tags
+// or may contain values that have tags. The results are cached.
+func rulesFor(t reflect.Type) ([]fieldRule, error) {
+	if v, ok := ruleCache.Load(t); ok {
+		return v.([]fieldRule), nil
+	}
+	var rules []fieldRule
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue // unexported
+		}
+		tag, ok := f.Tag.Lookup("jrpc2")
+		if !ok && !mayHaveRules(f.Type) {
+			continue
+		}
+		r := fieldRule{index: i, name: jsonName(f)}
+		if tag != "" {
+			if err := r.parse(tag, f.Type); err != nil {
+				return nil, fmt.Errorf("field %s of %v: %v", f.Name, t, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	ruleCache.Store(t, rules)
+	return rules, nil
+}
+
+// parse parses the options in tag for a field of type ftype into r.
+func (r *fieldRule) parse(tag string, ftype reflect.Type) error {
+	for tag != "" {
+		var opt string
+		if strings.HasPrefix(tag, "default=") {
+			opt, tag = tag, "" // the default value extends to the end of the tag
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			opt, tag = tag[:i], tag[i+1:]
+		} else {
+			opt, tag = tag, ""
+		}
+		switch {
+		case opt == "required":
+			r.required = true
+		case strings.HasPrefix(opt, "default="):
+			def, err := parseDefault(strings.TrimPrefix(opt, "default="), ftype)
+			if err != nil {
+				return err
+			}
+			r.def = def
+		default:
+			return fmt.Errorf("unknown tag option %q", opt)
+		}
+	}
+	if r.required && r.def != nil {
+		return errors.New("a required field may not have a default")
+	}
+	return nil
+}
+
+// parseDefault returns the JSON encoding of the default value text for a
+// field of type ftype, or an error if text is not a valid value of that type.
+func parseDefault(text string, ftype reflect.Type) (json.RawMessage, error) {
+	def := json.RawMessage(text)
+	if err := json.Unmarshal(def, reflect.New(ftype).Interface()); err == nil {
+		return def, nil
+	}
+	base := ftype
+	for base.Kind() == reflect.Ptr {
+		base = base.Elem()
+	}
+	if base.Kind() == reflect.String {
+		return json.Marshal(text)
+	}
+	return nil, fmt.Errorf("invalid default %q for type %v", text, ftype)
+}
+
+// jsonName returns the name used for f in JSON encoding, or "" if f is an
+// embedded struct whose fields are promoted.
+func jsonName(f reflect.StructField) string {
+	name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+	if name != "" && name != "-" {
+		return name
+	} else if t := f.Type; f.Anonymous && name == "" {
+		if t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() == reflect.Struct {
+			return ""
+		}
+	}
+	return f.Name
+}
+
+// mayHaveRules reports whether values of type t may contain structs, and so
+// may need to be validated.
+func mayHaveRules(t reflect.Type) bool {
+	for {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array:
+			t = t.Elem()
+		case reflect.Struct:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// hasRules reports whether values of type t have any fields with a "jrpc2"
+// tag, possibly in nested structs. It reports an error if any of the tags
+// reachable from t is invalid.
+func hasRules(t reflect.Type, seen map[reflect.Type]bool) (bool, error) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || seen[t] {
+		return false, nil
+	}
+	seen[t] = true
+	rules, err := rulesFor(t)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	for _, r := range rules {
+		if r.required || r.def != nil {
+			found = true
+		} else if ok, err := hasRules(t.Field(r.index).Type, seen); err != nil {
+			return false, err
+		} else if ok {
+			found = true
+		}
+	}
+	return found, nil
+}
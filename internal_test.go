@@ -24,6 +24,7 @@ func TestParseRequests(t *testing.T) {
 	}{
 		// An empty batch is valid and produces no results.
 		{`[]`, nil, nil},
+		{" [\n] ", nil, nil},
 
 		// An empty single request is invalid but returned anyway.
 		{`{}`, []*Request{{}}, ErrInvalidVersion},
@@ -296,13 +297,15 @@ func TestMarshalResponse(t *testing.T) {
 		err    *Error
 		result string
 		want   string
+		null   string // the encoding with ExplicitNull, if different
 	}{
-		{"", nil, "", `{"jsonrpc":"2.0"}`},
-		{"null", nil, "", `{"jsonrpc":"2.0","id":null}`},
+		{"", nil, "", `{"jsonrpc":"2.0"}`, `{"jsonrpc":"2.0","result":null}`},
+		{"null", nil, "", `{"jsonrpc":"2.0","id":null}`, `{"jsonrpc":"2.0","id":null,"result":null}`},
+		{"789", nil, "null", `{"jsonrpc":"2.0","id":789,"result":null}`, ""},
 		{"123", Errorf(code.ParseError, "failed").(*Error), "",
-			`{"jsonrpc":"2.0","id":123,"error":{"code":-32700,"message":"failed"}}`},
+			`{"jsonrpc":"2.0","id":123,"error":{"code":-32700,"message":"failed"}}`, ""},
 		{"456", nil, `{"ok":true,"values":[4,5,6]}`,
-			`{"jsonrpc":"2.0","id":456,"result":{"ok":true,"values":[4,5,6]}}`},
+			`{"jsonrpc":"2.0","id":456,"result":{"ok":true,"values":[4,5,6]}}`, ""},
 	}
 	for _, test := range tests {
 		rsp := &Response{id: test.id, err: test.err}
@@ -316,5 +319,106 @@ func TestMarshalResponse(t *testing.T) {
 		} else if s := string(got); s != test.want {
 			t.Errorf("Marshaling %+v: got %#q, want %#q", rsp, s, test.want)
 		}
+
+		want := test.null
+		if want == "" {
+			want = test.want
+		}
+		got, err = json.Marshal(rsp.ExplicitNull())
+		if err != nil {
+			t.Errorf("Marshaling %+v with explicit null: unexpected error: %v", rsp, err)
+		} else if s := string(got); s != want {
+			t.Errorf("Marshaling %+v with explicit null: got %#q, want %#q", rsp, s, want)
+		}
+	}
+}
+
+func TestLogLimiter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	lim := &logLimiter{max: 3, now: func() time.Time { return now }}
+
+	type result struct {
+		N  int
+		OK bool
+	}
+	var got []result
+	step := func(force bool) {
+		n, ok := lim.allow(force)
+		got = append(got, result{n, ok})
+	}
+
+	// A burst is cut off at the limit, but forced messages are written.
+	for i := 0; i < 5; i++ {
+		step(false)
+	}
+	step(true)
+	step(false)
+
+	// After a second, the limit is renewed, and the first message written
+	// reports those discarded since the forced one.
+	now = now.Add(time.Second)
+	step(false)
+	step(false)
+
+	want := []result{
+		{0, true}, {0, true}, {0, true}, {0, false}, {0, false},
+		{2, true}, {0, false},
+		{1, true}, {0, true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Log limiter results (-want, +got):\n%s", diff)
+	}
+}
+
+func TestDedupExpire(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store := NewDedupStore(time.Minute)
+	store.now = func() time.Time { return now }
+	d := newDedup(func(_ context.Context, req *Request) string {
+		return string(req.params)
+	}, store, nil)
+
+	var calls int
+	call := func(key string) {
+		req := &Request{method: "M", params: json.RawMessage(key)}
+		d.do(context.Background(), req, func() (json.RawMessage, error) {
+			calls++
+			return nil, nil
+		})
+	}
+
+	// Retain results at one-second intervals.
+	for _, key := range []string{"a", "b", "c"} {
+		call(key)
+		now = now.Add(time.Second)
+	}
+	if n := store.Len(); n != 3 {
+		t.Fatalf("Len: got %d, want 3", n)
+	}
+
+	// Expiry discards results from the front of the queue, in order.
+	now = time.Unix(1000, 0).Add(time.Minute + time.Second)
+	if n := store.Len(); n != 1 {
+		t.Errorf("Len after two results expire: got %d, want 1", n)
+	}
+	if _, ok := store.done["M\x00c"]; !ok {
+		t.Error("The latest result was discarded early")
+	}
+	if n := store.queue.Len(); n != 1 {
+		t.Errorf("Queue length: got %d, want 1", n)
+	}
+
+	// A result retained again after expiry joins the back of the queue.
+	call("a")
+	call("c") // retained
+	if calls != 4 {
+		t.Errorf("Handler calls: got %d, want 4", calls)
+	}
+	now = now.Add(time.Second)
+	if n := store.Len(); n != 1 {
+		t.Errorf("Len after c expires: got %d, want 1", n)
+	}
+	if _, ok := store.done["M\x00a"]; !ok {
+		t.Error("The result retained again for a was discarded early")
 	}
 }
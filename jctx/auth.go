@@ -0,0 +1,197 @@
+package jctx
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/code"
+)
+
+// An Authorizer computes an authorization token for a call to the specified
+// method with the given encoded parameters. A token may be any byte string;
+// it is transmitted in the "auth" field of the context wrapper.
+type Authorizer func(ctx context.Context, method string, params []byte) ([]byte, error)
+
+type authorizerKey struct{}
+
+type tokenKey struct{}
+
+type namedAuthorizersKey struct{}
+
+type namedTokensKey struct{}
+
+// WithAuthorizer attaches auth to ctx, so that Encode calls it to compute an
+// authorization token for each request. If auth reports an error, Encode fails
+// with that error. If auth == nil, the resulting context has no authorizer.
+func WithAuthorizer(ctx context.Context, auth Authorizer) context.Context {
+	return context.WithValue(ctx, authorizerKey{}, auth)
+}
+
+// AuthToken returns the authorization token attached to ctx by Decode, or
+// returns ErrNoToken if the request did not include a token.
+func AuthToken(ctx context.Context) ([]byte, error) {
+	if tok, ok := ctx.Value(tokenKey{}).([]byte); ok {
+		return tok, nil
+	}
+	return nil, ErrNoToken
+}
+
+// WithNamedAuthorizer attaches auth to ctx under the given name, so that
+// Encode calls it to compute a named authorization token for each request, in
+// addition to the tokens of any authorizers already attached with other names
+// and of the authorizer attached by WithAuthorizer. This allows a request to
+// carry several tokens, for example one identifying the caller and another
+// granting a capability. The named tokens are transmitted in the "auths"
+// field of the context wrapper.
+//
+// An authorizer attached with a name replaces any attached earlier with the
+// same name. If auth == nil, the authorizer with that name is removed. The
+// name must not be empty, since AuthTokens reports the token of the unnamed
+// authorizer under the empty name; WithNamedAuthorizer panics if it is.
+func WithNamedAuthorizer(ctx context.Context, name string, auth Authorizer) context.Context {
+	if name == "" {
+		panic("jctx: empty authorizer name")
+	}
+	old, _ := ctx.Value(namedAuthorizersKey{}).(map[string]Authorizer)
+	auths := make(map[string]Authorizer, len(old)+1)
+	for key, val := range old {
+		auths[key] = val
+	}
+	if auth == nil {
+		delete(auths, name)
+	} else {
+		auths[name] = auth
+	}
+	return context.WithValue(ctx, namedAuthorizersKey{}, auths)
+}
+
+// AuthTokens returns all the authorization tokens attached to ctx by Decode:
+// the tokens computed by named authorizers (see WithNamedAuthorizer) under
+// their names, and the token computed by the authorizer attached by
+// WithAuthorizer, if any, under the empty name. It returns nil if the request
+// did not include any tokens. The caller must not modify the result.
+func AuthTokens(ctx context.Context) map[string][]byte {
+	named, _ := ctx.Value(namedTokensKey{}).(map[string][]byte)
+	tok, err := AuthToken(ctx)
+	if err != nil {
+		return named
+	}
+	all := map[string][]byte{"": tok}
+	for name, val := range named {
+		all[name] = val
+	}
+	return all
+}
+
+// encodeTokens computes the tokens of the named authorizers of ctx for a call
+// to method with the given params. It returns nil if ctx has no named
+// authorizers.
+func encodeTokens(ctx context.Context, method string, params []byte) (map[string][]byte, error) {
+	auths, _ := ctx.Value(namedAuthorizersKey{}).(map[string]Authorizer)
+	if len(auths) == 0 {
+		return nil, nil
+	}
+	toks := make(map[string][]byte, len(auths))
+	for name, auth := range auths {
+		tok, err := auth(ctx, method, params)
+		if err != nil {
+			return nil, fmt.Errorf("authorizer %q: %w", name, err)
+		}
+		toks[name] = tok
+	}
+	return toks, nil
+}
+
+// ErrNoToken is returned by the AuthToken function if the context does not
+// contain an authorization token.
+var ErrNoToken = errors.New("authorization token not present")
+
+// A Verifier checks the authorization token for a request to the specified
+// method with the given encoded parameters. The token is nil if the request
+// did not include one. If the token is acceptable, the verifier returns a
+// context for the request, derived from ctx; typically it attaches the
+// identity of the caller using WithPrincipal. Otherwise, it reports an error
+// explaining why the request is rejected.
+type Verifier func(ctx context.Context, method string, params, token []byte) (context.Context, error)
+
+// VerifyDecoder returns a function suitable for the DecodeContext field of
+// jrpc2.ServerOptions, that decodes each request as Decode does and then
+// calls verify with its authorization token. The handler for the request
+// receives the context returned by verify.
+//
+// If verify reports an error, the request fails without reaching the
+// CheckRequest hook or the handler. If the error has concrete type
+// *jrpc2.Error, it is reported to the client unchanged; otherwise the error
+// reported has code code.Unauthorized and includes the text of the error.
+func VerifyDecoder(verify Verifier) func(context.Context, string, json.RawMessage) (context.Context, json.RawMessage, error) {
+	return func(ctx context.Context, method string, req json.RawMessage) (context.Context, json.RawMessage, error) {
+		ctx, params, err := Decode(ctx, method, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		tok, _ := AuthToken(ctx)
+		vctx, err := verify(ctx, method, params, tok)
+		if err != nil {
+			if _, ok := err.(*jrpc2.Error); !ok {
+				err = jrpc2.Errorf(code.Unauthorized, "%v", err)
+			}
+			return nil, nil, err
+		}
+		return vctx, params, nil
+	}
+}
+
+// A TokensVerifier checks all the authorization tokens of a request to the
+// specified method with the given encoded parameters, as reported by
+// AuthTokens. The tokens are nil if the request did not include any. Like a
+// Verifier, it returns a context for the request derived from ctx if the
+// tokens are acceptable, or otherwise reports an error explaining why the
+// request is rejected.
+type TokensVerifier func(ctx context.Context, method string, params []byte, tokens map[string][]byte) (context.Context, error)
+
+// VerifyTokensDecoder returns a function suitable for the DecodeContext field
+// of jrpc2.ServerOptions, that decodes each request as Decode does and then
+// calls verify with all its authorization tokens, as VerifyDecoder does with
+// a single token. This allows a server to require several tokens, for example
+// a token identifying the caller together with a capability token.
+//
+// If verify reports an error of concrete type *jrpc2.Error, it is reported to
+// the client unchanged; otherwise the error reported has the code given by
+// reject, and includes the text of the error. If reject == 0, the code is
+// code.Unauthorized, as for VerifyDecoder.
+func VerifyTokensDecoder(verify TokensVerifier, reject code.Code) func(context.Context, string, json.RawMessage) (context.Context, json.RawMessage, error) {
+	if reject == 0 {
+		reject = code.Unauthorized
+	}
+	return func(ctx context.Context, method string, req json.RawMessage) (context.Context, json.RawMessage, error) {
+		ctx, params, err := Decode(ctx, method, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		vctx, err := verify(ctx, method, params, AuthTokens(ctx))
+		if err != nil {
+			if _, ok := err.(*jrpc2.Error); !ok {
+				err = jrpc2.Errorf(reject, "%v", err)
+			}
+			return nil, nil, err
+		}
+		return vctx, params, nil
+	}
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context derived from ctx that records p as the
+// verified identity of the caller. It is intended for use by a Verifier.
+func WithPrincipal(ctx context.Context, p interface{}) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// Principal returns the identity of the caller attached to ctx by
+// WithPrincipal, or nil if there is none. A handler on a server using
+// VerifyDecoder can use it to recover the identity established by the
+// verifier.
+func Principal(ctx context.Context) interface{} { return ctx.Value(principalKey{}) }
@@ -0,0 +1,68 @@
+package jctx
+
+import (
+	"context"
+	"fmt"
+)
+
+// DefaultMaxHops is the default limit on the number of times a request may be
+// forwarded. See Options.MaxHops.
+const DefaultMaxHops = 8
+
+type hopsKey struct{}    // the hop count received by Decode
+type forwardKey struct{} // the hop count to be sent by Encode
+
+// Forward returns a context for an outbound call made while handling the
+// request whose context ctx was produced by Decode, so that the call carries
+// the same values to the next server: Encode sends the metadata, deadline,
+// and trace context of ctx, as it does for any context.
+//
+// If ctx has an Authorizer (see WithAuthorizer), Encode calls it to compute a
+// token for the outbound method. Otherwise, if the inbound request carried an
+// authorization token, Encode sends the same token. Likewise, unless ctx has
+// named authorizers (see WithNamedAuthorizer), Encode sends the named tokens
+// of the inbound request.
+//
+// To guard against requests forwarded in a cycle, the wrapper records how many
+// times the request has been forwarded, and Decode reports an error if the
+// count exceeds a limit (see Options.MaxHops).
+func Forward(ctx context.Context) context.Context {
+	hops, _ := ctx.Value(hopsKey{}).(int)
+	ctx = context.WithValue(ctx, forwardKey{}, hops+1)
+	if _, ok := ctx.Value(namedAuthorizersKey{}).(map[string]Authorizer); !ok {
+		named, _ := ctx.Value(namedTokensKey{}).(map[string][]byte)
+		for name, tok := range named {
+			if name == "" {
+				continue // not a valid authorizer name
+			}
+			tok := tok
+			ctx = WithNamedAuthorizer(ctx, name, func(context.Context, string, []byte) ([]byte, error) {
+				return tok, nil
+			})
+		}
+	}
+	if auth, _ := ctx.Value(authorizerKey{}).(Authorizer); auth != nil {
+		return ctx
+	} else if tok, err := AuthToken(ctx); err == nil {
+		return WithAuthorizer(ctx, func(context.Context, string, []byte) ([]byte, error) {
+			return tok, nil
+		})
+	}
+	return ctx
+}
+
+// Hops reports the number of times the request whose context ctx was produced
+// by Decode had been forwarded before it was received. It returns 0 if the
+// request was sent directly by its client.
+func Hops(ctx context.Context) int {
+	hops, _ := ctx.Value(hopsKey{}).(int)
+	return hops
+}
+
+// checkHops reports an error if hops exceeds the limit set by o.
+func (o *Options) checkHops(hops int) error {
+	if max := o.maxHops(); max >= 0 && hops > max {
+		return fmt.Errorf("request forwarded %d times, exceeding the limit of %d", hops, max)
+	}
+	return nil
+}
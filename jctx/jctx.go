@@ -17,17 +17,56 @@
 //      "jctx": "1",
 //      "payload":  <original-params>,
 //      "deadline": <rfc-3339-timestamp>,
-//      "meta":     <json-value>
+//      "timeout":  <milliseconds>,
+//      "meta":     <json-value>,
+//      "auth":     <base64-token>,
+//      "auths":    {<name>: <base64-token>, ...},
+//      "hops":     <forward-count>,
+//      "traceparent": <w3c-traceparent>,
+//      "tracestate":  <w3c-tracestate>
 //    }
 //
 // Of these, only the "jctx" marker is required; the others are assumed to be
 // empty if they do not appear in the message.
 //
+// Wire Versions
+//
+// The format above is version 1. Version 2 has the same fields, except that
+// "meta" is always an object whose members are named metadata keys (see
+// below), binary metadata values are carried in a separate object, and the
+// relative timeout is always sent with a deadline:
+//
+//    {
+//      "jctx": "2",
+//      "payload":  <original-params>,
+//      "deadline": <rfc-3339-timestamp>,
+//      "timeout":  <milliseconds>,
+//      "meta":     {<key>: <json-value>, ...},
+//      "bin":      {<key>: <base64-value>, ...},
+//      "auth":     <base64-token>,
+//      "auths":    {<name>: <base64-token>, ...},
+//      "hops":     <forward-count>,
+//      "traceparent": <w3c-traceparent>,
+//      "tracestate":  <w3c-tracestate>
+//    }
+//
+// Decode accepts either version. Encode produces version 1 unless the Version
+// option selects version 2, since decoders that predate version 2 reject it.
+// To migrate, update the servers first, and then set the Version option of
+// their clients. Future versions will add fields only; decoders ignore
+// fields they do not recognize.
+//
 // Deadlines and Timeouts
 //
 // If the parent context contains a deadline, it is encoded into the wrapper as
 // an RFC 3339 timestamp in UTC, for example "2009-11-10T23:00:00.00000015Z".
 //
+// If the clocks of the client and the server disagree, a deadline may appear
+// to have passed when the server receives it. The SkewTolerance option of the
+// decoder can extend such deadlines. Alternatively, the encoder can also send
+// the time remaining until the deadline as a relative timeout (see the
+// SendTimeout option), which the decoder can prefer (see PreferTimeout).
+//
 // Metadata
 //
 // The jctx.WithMetadata function allows the caller to attach an arbitrary
@@ -35,47 +74,221 @@
 // wire during a JSON-RPC call. The recipient can decode this value from the
 // context using the jctx.UnmarshalMetadata function.
 //
+// Authorization
+//
+// The jctx.WithAuthorizer function attaches to a context a function that
+// computes an authorization token for each call. The token is transmitted
+// over the wire, and the recipient can recover it from the context using the
+// jctx.AuthToken function. A server can check tokens before its handlers run
+// by setting its DecodeContext option to the result of jctx.VerifyDecoder.
+//
+// A request can also carry several tokens, each computed by an authorizer
+// attached with a name by jctx.WithNamedAuthorizer. The recipient can recover
+// all the tokens of a request using jctx.AuthTokens, and a server can check
+// them together using jctx.VerifyTokensDecoder.
+//
+// Forwarding
+//
+// A server that calls another server while handling a request can pass along
+// the values it received by making the call with the context returned by
+// jctx.Forward. The "hops" field of the wrapper counts how many times the
+// request has been forwarded, so that Decode can reject requests forwarded
+// in a cycle.
+//
+// Trace Context
+//
+// The jctx.WithTraceParent and jctx.WithTraceState functions attach a W3C
+// Trace Context (https://www.w3.org/TR/trace-context/) to a context, and the
+// recipient can recover it using jctx.TraceParent and jctx.TraceState. The
+// Inject and Extract functions copy the trace context between a context and
+// a Carrier, to support propagators such as those of OpenTelemetry.
+//
+// Named Metadata
+//
+// Independent packages can attach metadata to the same context without
+// interfering with each other by using named keys: The jctx.WithMetadataValue
+// function attaches a value under a key, and jctx.MetadataValue decodes the
+// value for a key. When a context has named metadata, "meta" is encoded as a
+// JSON object whose members are the named keys, for example:
+//
+//    "meta": {"tenant": "acme", "trace": {"id": "4bf92f35"}}
+//
+// The value attached by WithMetadata is the value of the reserved key
+// DefaultMetadataKey. If a context has no named metadata, it is encoded as
+// the whole "meta" value, as in earlier versions of this package. Otherwise it
+// is encoded as the member of the object whose name is DefaultMetadataKey.
+//
+// On the receiving side, if "meta" is an object, each of its members is
+// available under its name via MetadataValue, and MetadataKeys reports the
+// names. UnmarshalMetadata decodes the member named DefaultMetadataKey if
+// there is one, and otherwise the whole "meta" value.
+//
+// The jctx.WithMetadataBytes function attaches a binary value under a key,
+// which the recipient can recover using jctx.MetadataBytes. In version 2
+// wrappers, binary values are encoded in base64 in the "bin" object; in
+// version 1, they are encoded as JSON strings containing base64 in "meta".
+// Either way, MetadataValue decodes a binary value as a base64 string.
+//
 package jctx
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"time"
 )
 
-const wireVersion = "1"
+// Versions of the wire format, see Options.Version.
+const (
+	Version1 = 1
+	Version2 = 2
+)
 
 // wireContext is the encoded representation of a context value. It includes
 // the deadline together with an underlying payload carrying the original
 // request parameters. The resulting message replaces the parameters of the
 // original JSON-RPC request.
 type wireContext struct {
-	V *string `json:"jctx"` // must be wireVersion
+	V *string `json:"jctx"` // "1" or "2"
 
 	Deadline *time.Time      `json:"deadline,omitempty"` // encoded in UTC
 	Payload  json.RawMessage `json:"payload,omitempty"`
 	Metadata json.RawMessage `json:"meta,omitempty"`
+	Token    []byte          `json:"auth,omitempty"`
+
+	Tokens map[string][]byte `json:"auths,omitempty"` // see WithNamedAuthorizer
+
+	Timeout *int64 `json:"timeout,omitempty"` // milliseconds, see Options.SendTimeout
+	Hops    int    `json:"hops,omitempty"`    // see Forward
+
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+
+	Binary map[string][]byte `json:"bin,omitempty"` // version 2 only
+}
+
+// version reports the wire version of c, or 0 if it is not supported.
+func (c *wireContext) version() int {
+	switch *c.V {
+	case "1":
+		return Version1
+	case "2":
+		return Version2
+	}
+	return 0
+}
+
+// metadataSize returns the total size in bytes of the encoded metadata in c.
+func (c *wireContext) metadataSize() int {
+	n := len(c.Metadata)
+	for key, val := range c.Binary {
+		n += len(key) + len(val)
+	}
+	return n
 }
 
 // Encode encodes the specified context and request parameters for transmission.
 // If a deadline is set on ctx, it is converted to UTC before encoding.
-// If metadata are set on ctx (see jctx.WithMetadata), they are included.
+// If metadata are set on ctx (see jctx.WithMetadata and jctx.WithMetadataValue),
+// they are included, as is the trace context of ctx (see jctx.WithTraceParent).
+//
+// The wrapper, not counting params, may be no larger than DefaultMaxSize. Use
+// the Encode method of Options to change this limit.
 func Encode(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error) {
-	v := wireVersion
+	return (*Options)(nil).Encode(ctx, method, params)
+}
+
+// Encode encodes the specified context and request parameters as Encode does,
+// subject to the options in o.
+func (o *Options) Encode(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, error) {
+	version := o.version()
+	if version != Version1 && version != Version2 {
+		return nil, fmt.Errorf("unsupported context version %d", version)
+	}
+	v := strconv.Itoa(version)
 	c := wireContext{V: &v, Payload: params}
 	if dl, ok := ctx.Deadline(); ok {
 		utcdl := dl.In(time.UTC)
 		c.Deadline = &utcdl
+		if o.sendTimeout() || version >= Version2 {
+			ms := time.Until(dl).Milliseconds()
+			c.Timeout = &ms
+		}
 	}
 
 	// If there are metadata in the context, attach them.
+	if err := c.encodeMetadata(ctx, version); err != nil {
+		return nil, err
+	}
+	if tc, ok := ctx.Value(traceKey{}).(traceContext); ok {
+		c.TraceParent, c.TraceState = tc.parent, tc.state
+	}
+	c.Hops, _ = ctx.Value(forwardKey{}).(int)
+
+	// If there is an authorizer in the context, attach its token.
+	if auth, _ := ctx.Value(authorizerKey{}).(Authorizer); auth != nil {
+		tok, err := auth(ctx, method, params)
+		if err != nil {
+			return nil, err
+		}
+		c.Token = tok
+	}
+	toks, err := encodeTokens(ctx, method, params)
+	if err != nil {
+		return nil, err
+	}
+	c.Tokens = toks
+
+	enc, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	} else if max := o.maxEncodeSize(); max >= 0 && len(enc)-len(params) > max {
+		return nil, fmt.Errorf("context wrapper for %q is %d bytes with %d bytes of metadata, exceeding the limit of %d",
+			method, len(enc)-len(params), c.metadataSize(), max)
+	}
+	return enc, nil
+}
+
+// encodeMetadata sets the metadata fields of c from the metadata attached to
+// ctx, in the given wire version.
+func (c *wireContext) encodeMetadata(ctx context.Context, version int) error {
+	var dflt json.RawMessage
 	if v := ctx.Value(metadataKey{}); v != nil {
-		c.Metadata = v.(json.RawMessage)
+		dflt = v.(json.RawMessage)
+	}
+	named := namedMetadata(ctx)
+	if version == Version1 && len(named) == 0 {
+		c.Metadata = dflt // the format that predates named keys
+		return nil
 	}
 
-	return json.Marshal(c)
+	obj := make(map[string]json.RawMessage)
+	for key, val := range named {
+		if version >= Version2 && val.bin != nil {
+			if c.Binary == nil {
+				c.Binary = make(map[string][]byte)
+			}
+			c.Binary[key] = val.bin
+		} else {
+			obj[key] = val.encoded()
+		}
+	}
+	if dflt != nil && !(len(named) != 0 && isImplicit(ctx, dflt)) {
+		obj[DefaultMetadataKey] = dflt
+	}
+	if len(obj) == 0 {
+		return nil
+	}
+	bits, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	c.Metadata = bits
+	return nil
 }
 
 // Decode decodes the specified request message as a context-wrapped request,
@@ -83,34 +296,262 @@ func Encode(ctx context.Context, method string, params json.RawMessage) (json.Ra
 // If the request does not have a context wrapper, it is returned as-is.
 //
 // If the encoded request specifies a deadline, that deadline is set in the
-// context value returned.
+// context value returned. The Decode method of Options can adjust deadlines
+// to tolerate differences between the clocks of the client and the server.
 //
 // If the request includes context metadata, they are attached and can be
-// recovered using jctx.UnmarshalMetadata.
+// recovered using jctx.UnmarshalMetadata. If the metadata are a JSON object,
+// each of its members can also be recovered by name using jctx.MetadataValue.
+// If the request includes an authorization token, it can be recovered using
+// jctx.AuthToken. If the request includes a valid trace context, it can be
+// recovered using jctx.TraceParent and jctx.TraceState.
+//
+// If the embedded parameters themselves have a context wrapper, as happens if
+// a client encodes its context twice, Decode reports an error. Use the Decode
+// method of Options to unwrap nested wrappers, or to reject wrappers with
+// unknown fields. Decode also reports an error if the metadata are larger
+// than DefaultMaxSize; the Decode method of Options can change this limit.
 func Decode(ctx context.Context, method string, req json.RawMessage) (context.Context, json.RawMessage, error) {
+	return (*Options)(nil).Decode(ctx, method, req)
+}
+
+// Decode decodes the specified request message as Decode does, subject to the
+// options in o.
+func (o *Options) Decode(ctx context.Context, method string, req json.RawMessage) (context.Context, json.RawMessage, error) {
+	for depth := 0; ; depth++ {
+		c, ok, err := o.parse(req)
+		if err != nil {
+			return nil, nil, err
+		} else if !ok {
+			return ctx, req, nil // fall back assuming an un-wrapped message
+		}
+		ctx, err = o.attach(ctx, c)
+		if err != nil {
+			return nil, nil, err
+		} else if !isWrapped(c.Payload) {
+			return ctx, c.Payload, nil
+		} else if depth >= o.maxNesting() {
+			return nil, nil, errors.New("request parameters are wrapped more than once")
+		}
+		req = c.Payload
+	}
+}
+
+// parse decodes req as a wrapper, and reports whether it is one.
+func (o *Options) parse(req json.RawMessage) (*wireContext, bool, error) {
 	if len(req) == 0 || req[0] != '{' {
-		return ctx, req, nil // an empty message or non-object has no wrapper
+		return nil, false, nil // an empty message or non-object has no wrapper
 	}
 	var c wireContext
 	if err := json.Unmarshal(req, &c); err != nil || c.V == nil {
-		return ctx, req, nil // fall back assuming an un-wrapped message
-	} else if *c.V != wireVersion {
-		return nil, nil, fmt.Errorf("invalid context version %q", *c.V)
+		return nil, false, nil
+	}
+	switch c.version() {
+	case Version1:
+		if c.Binary != nil && o.strictFields() {
+			return nil, false, errors.New("invalid context: binary metadata in version 1")
+		}
+		c.Binary = nil // not defined in version 1
+	case Version2:
+		if len(c.Metadata) != 0 && c.Metadata[0] != '{' && string(c.Metadata) != "null" {
+			return nil, false, errors.New("invalid context: metadata must be an object")
+		}
+	default:
+		return nil, false, fmt.Errorf("invalid context version %q", *c.V)
+	}
+	if err := o.checkHops(c.Hops); err != nil {
+		return nil, false, err
+	}
+	if max := o.maxDecodeMetadata(); max >= 0 && c.metadataSize() > max {
+		return nil, false, fmt.Errorf("context metadata is %d bytes, exceeding the limit of %d", c.metadataSize(), max)
+	}
+	if o.strictFields() {
+		dec := json.NewDecoder(bytes.NewReader(req))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(new(wireContext)); err != nil {
+			return nil, false, fmt.Errorf("invalid context: %v", err)
+		}
+	}
+	return &c, true, nil
+}
+
+// isWrapped reports whether msg has a context wrapper.
+func isWrapped(msg json.RawMessage) bool {
+	if len(msg) == 0 || msg[0] != '{' {
+		return false
+	}
+	var probe struct {
+		V *string `json:"jctx"`
+	}
+	return json.Unmarshal(msg, &probe) == nil && probe.V != nil
+}
+
+// attach returns a context derived from ctx with the values encoded in c.
+func (o *Options) attach(ctx context.Context, c *wireContext) (context.Context, error) {
+	if c.version() >= Version2 {
+		ctx = decodeMetadataV2(ctx, c.Metadata, c.Binary)
+	} else if c.Metadata != nil {
+		ctx = decodeMetadata(ctx, c.Metadata)
 	}
 	if c.Metadata != nil {
-		ctx = context.WithValue(ctx, metadataKey{}, c.Metadata)
+		ctx = context.WithValue(ctx, rawMetadataKey{}, c.Metadata)
+	}
+	if c.Token != nil {
+		ctx = context.WithValue(ctx, tokenKey{}, c.Token)
 	}
-	if c.Deadline != nil && !c.Deadline.IsZero() {
+	if c.Tokens != nil {
+		ctx = context.WithValue(ctx, namedTokensKey{}, c.Tokens)
+	}
+	ctx = context.WithValue(ctx, hopsKey{}, c.Hops)
+	if c.TraceParent != "" {
+		// Per the W3C specification, a malformed trace context is discarded.
+		if tctx, err := WithTraceParent(ctx, c.TraceParent); err == nil {
+			ctx = tctx
+			if tctx, err := WithTraceState(ctx, c.TraceState); err == nil {
+				ctx = tctx
+			}
+		}
+	}
+	if dl, ok, err := o.deadline(c); err != nil {
+		return nil, err
+	} else if ok {
 		var ignored context.CancelFunc
-		ctx, ignored = context.WithDeadline(ctx, (*c.Deadline).In(time.UTC))
+		ctx, ignored = context.WithDeadline(ctx, dl)
 		_ = ignored // the caller cannot use this value
 	}
+	return ctx, nil
+}
 
-	return ctx, c.Payload, nil
+// deadline returns the deadline encoded in c, adjusted according to the
+// options in o, and reports whether c has one.
+func (o *Options) deadline(c *wireContext) (time.Time, bool, error) {
+	now := time.Now()
+	if c.Timeout != nil && o.preferTimeout() {
+		return now.Add(time.Duration(*c.Timeout) * time.Millisecond).In(time.UTC), true, nil
+	} else if c.Deadline == nil || c.Deadline.IsZero() {
+		return time.Time{}, false, nil
+	}
+	dl := c.Deadline.In(time.UTC)
+	if late := now.Sub(dl); late <= 0 {
+		return dl, true, nil // the deadline has not passed
+	} else if tol := o.skewTolerance(); late < tol {
+		return now.Add(tol).In(time.UTC), true, nil
+	} else if o.rejectExpired() {
+		return time.Time{}, false, fmt.Errorf("deadline %s expired %v ago", dl.Format(time.RFC3339Nano), late)
+	}
+	return dl, true, nil
+}
+
+// decodeMetadata attaches the encoded version 1 metadata meta to ctx.
+func decodeMetadata(ctx context.Context, meta json.RawMessage) context.Context {
+	var obj map[string]json.RawMessage
+	if meta[0] != '{' || json.Unmarshal(meta, &obj) != nil {
+		return context.WithValue(ctx, metadataKey{}, meta)
+	}
+	dflt, ok := obj[DefaultMetadataKey]
+	if !ok {
+		// The sender may predate named keys. Mark the value, so that it is
+		// not sent again in addition to the named values if ctx is forwarded.
+		dflt = meta
+		ctx = context.WithValue(ctx, implicitKey{}, meta)
+	}
+	return attachMetadata(ctx, dflt, obj, nil)
+}
+
+// decodeMetadataV2 attaches the encoded version 2 metadata meta and binary
+// values bin to ctx. Malformed metadata are discarded.
+func decodeMetadataV2(ctx context.Context, meta json.RawMessage, bin map[string][]byte) context.Context {
+	var obj map[string]json.RawMessage
+	if len(meta) != 0 && json.Unmarshal(meta, &obj) != nil {
+		obj = nil
+	}
+	return attachMetadata(ctx, obj[DefaultMetadataKey], obj, bin)
+}
+
+// attachMetadata attaches the default metadata value dflt, if it is not nil,
+// and the named values in obj and bin other than DefaultMetadataKey to ctx.
+func attachMetadata(ctx context.Context, dflt json.RawMessage, obj map[string]json.RawMessage, bin map[string][]byte) context.Context {
+	if dflt != nil {
+		ctx = context.WithValue(ctx, metadataKey{}, dflt)
+	}
+	named := make(map[string]metaValue)
+	for key, val := range obj {
+		if key != DefaultMetadataKey && val != nil {
+			named[key] = metaValue{json: val}
+		}
+	}
+	for key, val := range bin {
+		if key != DefaultMetadataKey && val != nil {
+			named[key] = metaValue{bin: val}
+		}
+	}
+	if len(named) != 0 {
+		ctx = context.WithValue(ctx, namedKey{}, named)
+	}
+	return ctx
 }
 
 type metadataKey struct{}
 
+// implicitKey is the context key for a default metadata value that was decoded
+// from an object without a DefaultMetadataKey member, and so is implied by the
+// named values.
+type implicitKey struct{}
+
+// isImplicit reports whether dflt is the implicit default value of ctx.
+func isImplicit(ctx context.Context, dflt json.RawMessage) bool {
+	imp, _ := ctx.Value(implicitKey{}).(json.RawMessage)
+	return len(imp) != 0 && len(dflt) == len(imp) && &dflt[0] == &imp[0]
+}
+
+// rawMetadataKey is the context key for the metadata of a decoded wrapper, as
+// they were received.
+type rawMetadataKey struct{}
+
+// namedKey is the context key for a map from metadata keys to their values.
+// A zero value in the map marks a key whose value was removed. The map is not
+// modified once it is attached to a context.
+type namedKey struct{}
+
+// A metaValue is a named metadata value: either an encoded JSON value, or a
+// binary value attached by WithMetadataBytes.
+type metaValue struct {
+	json json.RawMessage
+	bin  []byte
+}
+
+func (v metaValue) isZero() bool { return v.json == nil && v.bin == nil }
+
+// encoded returns the JSON encoding of v. A binary value is encoded as a
+// base64 string.
+func (v metaValue) encoded() json.RawMessage {
+	if v.bin != nil {
+		bits, _ := json.Marshal(v.bin) // cannot fail
+		return bits
+	}
+	return v.json
+}
+
+// DefaultMetadataKey is the reserved metadata key whose value is attached by
+// WithMetadata and decoded by UnmarshalMetadata.
+const DefaultMetadataKey = ""
+
+// namedMetadata returns a new map of the named metadata values attached to
+// ctx, excluding removed keys. It returns nil if there are none.
+func namedMetadata(ctx context.Context) map[string]metaValue {
+	m, _ := ctx.Value(namedKey{}).(map[string]metaValue)
+	var out map[string]metaValue
+	for key, val := range m {
+		if val.isZero() {
+			continue
+		} else if out == nil {
+			out = make(map[string]metaValue)
+		}
+		out[key] = val
+	}
+	return out
+}
+
 // WithMetadata attaches the specified metadata value to the context.  The meta
 // value must support encoding to JSON. In case of error, the original value of
 // ctx is returned along with the error. If meta == nil, the resulting context
@@ -142,6 +583,125 @@ func UnmarshalMetadata(ctx context.Context, meta interface{}) error {
 	return ErrNoMetadata
 }
 
-// ErrNoMetadata is returned by the UnmarshalMetadata function if the context
-// does not contain a metadata value.
+// Metadata returns the encoded metadata of the context wrapper from which ctx
+// was decoded, exactly as received in its "meta" field, and reports whether
+// there were any. Binary values of a version 2 wrapper are not included; use
+// MetadataBytes to recover them. Metadata attached to ctx after decoding, for
+// example by WithMetadata, do not affect the result.
+//
+// Metadata allows code that handles requests generically, such as an audit
+// logger, to record the metadata without knowing their structure; the server
+// applies its DecodeContext hook before calling the CheckRequest hook and the
+// methods of its RPCLogger, so their contexts include the metadata.
+func Metadata(ctx context.Context) (json.RawMessage, bool) {
+	meta, ok := ctx.Value(rawMetadataKey{}).(json.RawMessage)
+	return meta, ok
+}
+
+// WithMetadataValue attaches the specified metadata value to the context under
+// the given key, replacing any value previously attached under that key. Values
+// attached under other keys are not affected. The value must support encoding
+// to JSON. In case of error, the original value of ctx is returned along with
+// the error. If v == nil, the resulting context has no value for key.
+//
+// WithMetadataValue(ctx, DefaultMetadataKey, v) is equivalent to
+// WithMetadata(ctx, v).
+func WithMetadataValue(ctx context.Context, key string, v interface{}) (context.Context, error) {
+	if key == DefaultMetadataKey {
+		return WithMetadata(ctx, v)
+	}
+	var val metaValue
+	if v != nil {
+		enc, err := json.Marshal(v)
+		if err != nil {
+			return ctx, err
+		}
+		val.json = enc
+	}
+	return withNamedValue(ctx, key, val), nil
+}
+
+// withNamedValue returns a context derived from ctx in which key has val.
+func withNamedValue(ctx context.Context, key string, val metaValue) context.Context {
+	// Copy the existing map, so that contexts sharing it are not affected.
+	old, _ := ctx.Value(namedKey{}).(map[string]metaValue)
+	m := make(map[string]metaValue, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	m[key] = val
+	return context.WithValue(ctx, namedKey{}, m)
+}
+
+// MetadataValue decodes the metadata value attached to ctx under the given key
+// into v, or returns ErrNoMetadata if ctx does not have a value for that key.
+//
+// MetadataValue(ctx, DefaultMetadataKey, v) is equivalent to
+// UnmarshalMetadata(ctx, v).
+func MetadataValue(ctx context.Context, key string, v interface{}) error {
+	if key == DefaultMetadataKey {
+		return UnmarshalMetadata(ctx, v)
+	}
+	m, _ := ctx.Value(namedKey{}).(map[string]metaValue)
+	if val := m[key]; !val.isZero() {
+		return json.Unmarshal(val.encoded(), v)
+	}
+	return ErrNoMetadata
+}
+
+// WithMetadataBytes attaches the binary value data to the context under the
+// given key, replacing any value previously attached under that key. If
+// data == nil, the resulting context has no value for key. The value can be
+// recovered using MetadataBytes, or using MetadataValue as a base64 string.
+//
+// WithMetadataBytes(ctx, DefaultMetadataKey, data) attaches data as the JSON
+// string containing its base64 encoding, as WithMetadata would.
+func WithMetadataBytes(ctx context.Context, key string, data []byte) context.Context {
+	if key == DefaultMetadataKey {
+		var v interface{}
+		if data != nil {
+			v = data
+		}
+		ctx, _ = WithMetadata(ctx, v) // cannot fail
+		return ctx
+	}
+	return withNamedValue(ctx, key, metaValue{bin: data})
+}
+
+// MetadataBytes returns the binary metadata value attached to ctx under the
+// given key, or ErrNoMetadata if ctx does not have a value for that key.
+// A value attached by WithMetadataValue (or by a peer that does not support
+// binary values) is accepted if it is a base64 string; otherwise
+// MetadataBytes reports an error.
+func MetadataBytes(ctx context.Context, key string) ([]byte, error) {
+	if key != DefaultMetadataKey {
+		m, _ := ctx.Value(namedKey{}).(map[string]metaValue)
+		if val := m[key]; val.bin != nil {
+			return val.bin, nil
+		}
+	}
+	var data []byte
+	if err := MetadataValue(ctx, key, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// MetadataKeys returns the keys of the metadata values attached to ctx, in
+// lexicographic order. If ctx has a value for DefaultMetadataKey, it is
+// included.
+func MetadataKeys(ctx context.Context) []string {
+	var keys []string
+	for key := range namedMetadata(ctx) {
+		keys = append(keys, key)
+	}
+	if v, _ := ctx.Value(metadataKey{}).(json.RawMessage); v != nil {
+		keys = append(keys, DefaultMetadataKey)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ErrNoMetadata is returned by the UnmarshalMetadata and MetadataValue
+// functions if the context does not contain the requested metadata value.
 var ErrNoMetadata = errors.New("context metadata not present")
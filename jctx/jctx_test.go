@@ -3,8 +3,13 @@ package jctx
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 var bicent = time.Date(1976, 7, 4, 1, 2, 3, 4, time.UTC)
@@ -151,3 +156,845 @@ func TestMetadata(t *testing.T) {
 		t.Errorf("Metadata(clr): got %+v, %v; want %v", bad, err, ErrNoMetadata)
 	}
 }
+
+func TestMetadataValue(t *testing.T) {
+	base := context.Background()
+	ctx, err := WithMetadata(base, "default")
+	if err != nil {
+		t.Fatalf("WithMetadata failed: %v", err)
+	}
+	ctx, err = WithMetadataValue(ctx, "tenant", "acme")
+	if err != nil {
+		t.Fatalf("WithMetadataValue(tenant) failed: %v", err)
+	}
+	ctx, err = WithMetadataValue(ctx, "trace", map[string]int{"id": 25})
+	if err != nil {
+		t.Fatalf("WithMetadataValue(trace) failed: %v", err)
+	}
+
+	// Replacing one key does not affect the others, nor the parent context.
+	mod, err := WithMetadataValue(ctx, "tenant", nil)
+	if err != nil {
+		t.Fatalf("WithMetadataValue(tenant, nil) failed: %v", err)
+	}
+	var s string
+	if err := MetadataValue(mod, "tenant", &s); err != ErrNoMetadata {
+		t.Errorf("MetadataValue(mod, tenant): got %q, %v; want %v", s, err, ErrNoMetadata)
+	}
+	if err := MetadataValue(ctx, "tenant", &s); err != nil || s != "acme" {
+		t.Errorf("MetadataValue(ctx, tenant): got %q, %v; want acme", s, err)
+	}
+
+	enc, err := Encode(ctx, "dummy", nil)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	const want = `{"jctx":"1","meta":{"":"default","tenant":"acme","trace":{"id":25}}}`
+	if got := string(enc); got != want {
+		t.Errorf("Encode: got %#q, want %#q", got, want)
+	}
+
+	dec, _, err := Decode(base, "dummy", enc)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"", "tenant", "trace"}, MetadataKeys(dec)); diff != "" {
+		t.Errorf("MetadataKeys (-want, +got):\n%s", diff)
+	}
+	if err := UnmarshalMetadata(dec, &s); err != nil || s != "default" {
+		t.Errorf("UnmarshalMetadata(dec): got %q, %v; want default", s, err)
+	}
+	if err := MetadataValue(dec, "tenant", &s); err != nil || s != "acme" {
+		t.Errorf("MetadataValue(dec, tenant): got %q, %v; want acme", s, err)
+	}
+	var trace struct{ ID int }
+	if err := MetadataValue(dec, "trace", &trace); err != nil || trace.ID != 25 {
+		t.Errorf("MetadataValue(dec, trace): got %+v, %v; want ID 25", trace, err)
+	}
+	if err := MetadataValue(dec, "other", &s); err != ErrNoMetadata {
+		t.Errorf("MetadataValue(dec, other): got %v, want %v", err, ErrNoMetadata)
+	}
+
+	// An object sent without named keys is visible both ways.
+	dec, _, err = Decode(base, "dummy", []byte(`{"jctx":"1","meta":{"user":"bob"}}`))
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	var user struct{ User string }
+	if err := UnmarshalMetadata(dec, &user); err != nil || user.User != "bob" {
+		t.Errorf("UnmarshalMetadata(legacy): got %+v, %v; want bob", user, err)
+	}
+	if err := MetadataValue(dec, "user", &s); err != nil || s != "bob" {
+		t.Errorf("MetadataValue(legacy, user): got %q, %v; want bob", s, err)
+	}
+}
+
+func TestAuthToken(t *testing.T) {
+	base := context.Background()
+	ctx := WithAuthorizer(base, func(_ context.Context, method string, params []byte) ([]byte, error) {
+		return []byte(method + ":" + string(params)), nil
+	})
+	enc, err := Encode(ctx, "M", json.RawMessage(`[1]`))
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	const want = `{"jctx":"1","payload":[1],"auth":"TTpbMV0="}`
+	if got := string(enc); got != want {
+		t.Errorf("Encode: got %#q, want %#q", got, want)
+	}
+
+	dec, _, err := Decode(base, "M", enc)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if tok, err := AuthToken(dec); err != nil || string(tok) != "M:[1]" {
+		t.Errorf("AuthToken: got %q, %v; want M:[1]", tok, err)
+	}
+	if tok, err := AuthToken(base); err != ErrNoToken {
+		t.Errorf("AuthToken(base): got %q, %v; want %v", tok, err, ErrNoToken)
+	}
+
+	// An authorizer that fails causes Encode to fail.
+	fail := WithAuthorizer(base, func(context.Context, string, []byte) ([]byte, error) {
+		return nil, errors.New("no credentials")
+	})
+	if enc, err := Encode(fail, "M", nil); err == nil {
+		t.Errorf("Encode: got %#q, want error", enc)
+	}
+}
+
+func TestNamedAuthTokens(t *testing.T) {
+	base := context.Background()
+	static := func(tok string) Authorizer {
+		return func(context.Context, string, []byte) ([]byte, error) { return []byte(tok), nil }
+	}
+	ctx := WithAuthorizer(base, static("main"))
+	ctx = WithNamedAuthorizer(ctx, "id", static("alice"))
+	ctx = WithNamedAuthorizer(ctx, "cap", static("old"))
+	ctx = WithNamedAuthorizer(ctx, "cap", func(_ context.Context, method string, _ []byte) ([]byte, error) {
+		return []byte("call:" + method), nil
+	})
+	ctx = WithNamedAuthorizer(ctx, "gone", static("x"))
+	ctx = WithNamedAuthorizer(ctx, "gone", nil)
+	enc, err := Encode(ctx, "M", json.RawMessage(`[1]`))
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	const want = `{"jctx":"1","payload":[1],"auth":"bWFpbg==","auths":{"cap":"Y2FsbDpN","id":"YWxpY2U="}}`
+	if got := string(enc); got != want {
+		t.Errorf("Encode: got %#q, want %#q", got, want)
+	}
+
+	dec, _, err := Decode(base, "M", enc)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	wantToks := map[string][]byte{"": []byte("main"), "id": []byte("alice"), "cap": []byte("call:M")}
+	if diff := cmp.Diff(wantToks, AuthTokens(dec)); diff != "" {
+		t.Errorf("AuthTokens (-want, +got):\n%s", diff)
+	}
+	if toks := AuthTokens(base); toks != nil {
+		t.Errorf("AuthTokens(base): got %q, want nil", toks)
+	}
+
+	// A request forwarded without authorizers carries the same tokens.
+	fwd, err := Encode(Forward(dec), "N", nil)
+	if err != nil {
+		t.Fatalf("Encode forwarded failed: %v", err)
+	}
+	const wantFwd = `{"jctx":"1","auth":"bWFpbg==","auths":{"cap":"Y2FsbDpN","id":"YWxpY2U="},"hops":1}`
+	if got := string(fwd); got != wantFwd {
+		t.Errorf("Encode forwarded: got %#q, want %#q", got, wantFwd)
+	}
+
+	// A named authorizer that fails causes Encode to fail.
+	fail := WithNamedAuthorizer(base, "id", func(context.Context, string, []byte) ([]byte, error) {
+		return nil, errors.New("no credentials")
+	})
+	if enc, err := Encode(fail, "M", nil); err == nil || !strings.Contains(err.Error(), `"id"`) {
+		t.Errorf("Encode: got %#q, %v; want error naming the authorizer", enc, err)
+	}
+
+	// The empty name is reserved for the unnamed authorizer.
+	func() {
+		defer func() {
+			if x := recover(); x == nil {
+				t.Error("WithNamedAuthorizer with an empty name did not panic")
+			}
+		}()
+		WithNamedAuthorizer(base, "", static("anon"))
+	}()
+}
+
+type mapCarrier map[string]string
+
+func (m mapCarrier) Get(key string) string { return m[key] }
+func (m mapCarrier) Set(key, value string) { m[key] = value }
+func (m mapCarrier) Keys() []string {
+	var keys []string
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestTraceContext(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	const ts = "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7"
+
+	base := context.Background()
+	tests := []struct {
+		name       string
+		input      string
+		wantParent string
+		wantState  string
+	}{
+		{"Absent", `{"jctx":"1"}`, "", ""},
+		{"ParentOnly", `{"jctx":"1","traceparent":"` + tp + `"}`, tp, ""},
+		{"Both", `{"jctx":"1","traceparent":"` + tp + `","tracestate":"` + ts + `"}`, tp, ts},
+		{"FutureVersion", `{"jctx":"1","traceparent":"cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz"}`,
+			"cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz", ""},
+		{"BadState", `{"jctx":"1","traceparent":"` + tp + `","tracestate":"bogus"}`, tp, ""},
+
+		// Malformed trace parents are discarded along with their state.
+		{"Upper", `{"jctx":"1","traceparent":"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01","tracestate":"a=b"}`, "", ""},
+		{"Short", `{"jctx":"1","traceparent":"00-4bf92f35-00f067aa0ba902b7-01"}`, "", ""},
+		{"ZeroTrace", `{"jctx":"1","traceparent":"00-00000000000000000000000000000000-00f067aa0ba902b7-01"}`, "", ""},
+		{"ZeroParent", `{"jctx":"1","traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"}`, "", ""},
+		{"BadVersion", `{"jctx":"1","traceparent":"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}`, "", ""},
+		{"Trailing", `{"jctx":"1","traceparent":"` + tp + `-extra"}`, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, _, err := Decode(base, "M", json.RawMessage(test.input))
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			got, ok := TraceParent(ctx)
+			if got != test.wantParent || ok != (test.wantParent != "") {
+				t.Errorf("TraceParent: got %q, %v; want %q", got, ok, test.wantParent)
+			}
+			if got := TraceState(ctx); got != test.wantState {
+				t.Errorf("TraceState: got %q, want %q", got, test.wantState)
+			}
+		})
+	}
+
+	// Round trip through a carrier, as a propagator would use it.
+	ctx := Extract(base, mapCarrier{"traceparent": tp, "tracestate": ts})
+	enc, err := Encode(ctx, "M", nil)
+	if err != nil {
+		t.Fatalf("Encode failed: %v", err)
+	}
+	dec, _, err := Decode(base, "M", enc)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	out := make(mapCarrier)
+	Inject(dec, out)
+	if diff := cmp.Diff(mapCarrier{"traceparent": tp, "tracestate": ts}, out); diff != "" {
+		t.Errorf("Injected trace context (-want, +got):\n%s", diff)
+	}
+
+	// An invalid carrier leaves the context unchanged.
+	if ctx := Extract(base, mapCarrier{"traceparent": "bogus"}); ctx != base {
+		t.Error("Extract with an invalid traceparent changed the context")
+	}
+	if _, err := WithTraceParent(base, "bogus"); err == nil {
+		t.Error("WithTraceParent(bogus): got nil, want error")
+	}
+	if _, err := WithTraceState(base, ts); err == nil {
+		t.Error("WithTraceState without a parent: got nil, want error")
+	}
+	out = make(mapCarrier)
+	Inject(base, out)
+	if len(out) != 0 {
+		t.Errorf("Inject(base): got %v, want empty", out)
+	}
+}
+
+func TestNestedWrappers(t *testing.T) {
+	base := context.Background()
+	inner, err := WithMetadata(base, "inner")
+	if err != nil {
+		t.Fatalf("WithMetadata: %v", err)
+	}
+	once, err := Encode(inner, "M", json.RawMessage(`[1]`))
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	outer, err := WithMetadata(base, "outer")
+	if err != nil {
+		t.Fatalf("WithMetadata: %v", err)
+	}
+	twice, err := Encode(outer, "M", once)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	thrice, err := Encode(base, "M", twice)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+
+	// By default, a nested wrapper is an error.
+	if _, params, err := Decode(base, "M", twice); err == nil {
+		t.Errorf("Decode(twice): got %#q, want error", params)
+	}
+
+	tests := []struct {
+		max   int
+		input json.RawMessage
+		ok    bool
+	}{
+		{1, twice, true},
+		{1, thrice, false},
+		{2, thrice, true},
+		{5, once, true},
+	}
+	for _, test := range tests {
+		opts := &Options{MaxNesting: test.max}
+		ctx, params, err := opts.Decode(base, "M", test.input)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Decode(max=%d, %#q): got %#q, want error", test.max, test.input, params)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("Decode(max=%d, %#q): unexpected error: %v", test.max, test.input, err)
+			continue
+		}
+		if got := string(params); got != "[1]" {
+			t.Errorf("Decode(max=%d): got params %#q, want [1]", test.max, got)
+		}
+		var meta string
+		if err := UnmarshalMetadata(ctx, &meta); err != nil || meta != "inner" {
+			t.Errorf("Decode(max=%d): got metadata %q, %v; want inner", test.max, meta, err)
+		}
+	}
+}
+
+func TestStrictFields(t *testing.T) {
+	const input = `{"jctx":"1","payload":[1],"deadlin":"2018-06-09T20:45:33Z"}`
+	base := context.Background()
+
+	// By default, unknown fields are ignored.
+	if _, params, err := Decode(base, "M", json.RawMessage(input)); err != nil {
+		t.Errorf("Decode: unexpected error: %v", err)
+	} else if got := string(params); got != "[1]" {
+		t.Errorf("Decode: got params %#q, want [1]", got)
+	}
+
+	opts := &Options{StrictFields: true}
+	if _, params, err := opts.Decode(base, "M", json.RawMessage(input)); err == nil {
+		t.Errorf("Decode strict: got %#q, want error", params)
+	} else if !strings.Contains(err.Error(), "deadlin") {
+		t.Errorf("Decode strict: got error %v, want it to name the field", err)
+	}
+
+	// Strict mode accepts known fields, and does not affect unwrapped input.
+	for _, in := range []string{
+		`{"jctx":"1","payload":[1],"meta":{"a":1},"auth":"YQ=="}`,
+		`{"extra":true}`,
+	} {
+		if _, _, err := opts.Decode(base, "M", json.RawMessage(in)); err != nil {
+			t.Errorf("Decode strict %#q: unexpected error: %v", in, err)
+		}
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	base := context.Background()
+	big, err := WithMetadata(base, strings.Repeat("x", DefaultMaxSize))
+	if err != nil {
+		t.Fatalf("WithMetadata: %v", err)
+	}
+	small, err := WithMetadata(base, strings.Repeat("x", 100))
+	if err != nil {
+		t.Fatalf("WithMetadata: %v", err)
+	}
+	params := json.RawMessage(`"` + strings.Repeat("p", 2*DefaultMaxSize) + `"`)
+
+	// Large parameters do not count against the limit, but large metadata do.
+	if _, err := Encode(small, "M", params); err != nil {
+		t.Errorf("Encode small: unexpected error: %v", err)
+	}
+	if enc, err := Encode(big, "M", nil); err == nil {
+		t.Errorf("Encode big: got %d bytes, want error", len(enc))
+	} else if !strings.Contains(err.Error(), "exceeding the limit") {
+		t.Errorf("Encode big: got error %v, want it to describe the limit", err)
+	}
+
+	tight := &Options{MaxEncodeSize: 64, MaxDecodeMetadata: 64}
+	if enc, err := tight.Encode(small, "M", nil); err == nil {
+		t.Errorf("Encode small with limit 64: got %#q, want error", enc)
+	}
+	unlimited := &Options{MaxEncodeSize: -1, MaxDecodeMetadata: -1}
+	enc, err := unlimited.Encode(big, "M", nil)
+	if err != nil {
+		t.Fatalf("Encode big without limit: unexpected error: %v", err)
+	}
+
+	// The decoder enforces its own limit.
+	if _, _, err := Decode(base, "M", enc); err == nil {
+		t.Error("Decode big: got nil, want error")
+	}
+	if ctx, _, err := unlimited.Decode(base, "M", enc); err != nil {
+		t.Errorf("Decode big without limit: unexpected error: %v", err)
+	} else if err := UnmarshalMetadata(ctx, new(string)); err != nil {
+		t.Errorf("UnmarshalMetadata: unexpected error: %v", err)
+	}
+	enc, err = Encode(small, "M", nil)
+	if err != nil {
+		t.Fatalf("Encode small: %v", err)
+	}
+	if _, _, err := tight.Decode(base, "M", enc); err == nil {
+		t.Error("Decode small with limit 64: got nil, want error")
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	base := context.Background()
+	wrap := func(dl time.Time, timeout *time.Duration) json.RawMessage {
+		msg := `{"jctx":"1","deadline":"` + dl.UTC().Format(time.RFC3339Nano) + `"`
+		if timeout != nil {
+			msg += `,"timeout":` + strconv.FormatInt(timeout.Milliseconds(), 10)
+		}
+		return json.RawMessage(msg + `}`)
+	}
+	ptr := func(d time.Duration) *time.Duration { return &d }
+
+	const tol = 5 * time.Second
+	tests := []struct {
+		name  string
+		opts  *Options
+		input json.RawMessage
+		want  time.Duration // expected time remaining, approximately
+		fail  bool
+	}{
+		// The client clock is behind the server: The deadline appears passed.
+		{"BehindDefault", nil, wrap(time.Now().Add(-2*time.Second), nil), -2 * time.Second, false},
+		{"BehindTolerated", &Options{SkewTolerance: tol},
+			wrap(time.Now().Add(-2*time.Second), nil), tol, false},
+		{"BehindTooFar", &Options{SkewTolerance: tol},
+			wrap(time.Now().Add(-time.Minute), nil), -time.Minute, false},
+		{"BehindRejected", &Options{SkewTolerance: tol, RejectExpired: true},
+			wrap(time.Now().Add(-time.Minute), nil), 0, true},
+		{"BehindTimeout", &Options{PreferTimeout: true},
+			wrap(time.Now().Add(-2*time.Second), ptr(3*time.Second)), 3 * time.Second, false},
+
+		// The client clock is ahead of the server: The deadline appears later.
+		{"AheadDefault", &Options{SkewTolerance: tol},
+			wrap(time.Now().Add(time.Hour), ptr(time.Second)), time.Hour, false},
+		{"AheadTimeout", &Options{PreferTimeout: true},
+			wrap(time.Now().Add(time.Hour), ptr(time.Second)), time.Second, false},
+		{"TimeoutIgnored", nil, wrap(time.Now().Add(time.Hour), ptr(time.Second)), time.Hour, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, _, err := test.opts.Decode(base, "M", test.input)
+			if test.fail {
+				if err == nil {
+					t.Errorf("Decode %#q: got nil, want error", test.input)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("Decode %#q: unexpected error: %v", test.input, err)
+			}
+			dl, ok := ctx.Deadline()
+			if !ok {
+				t.Fatal("Decoded context has no deadline")
+			}
+			if got := time.Until(dl); got > test.want || got < test.want-time.Second {
+				t.Errorf("Time remaining: got %v, want about %v", got, test.want)
+			}
+		})
+	}
+
+	// The encoder sends a relative timeout only if asked.
+	ctx, cancel := context.WithTimeout(base, time.Minute)
+	defer cancel()
+	for _, opts := range []*Options{nil, {SendTimeout: true}} {
+		enc, err := opts.Encode(ctx, "M", nil)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		var c wireContext
+		if err := json.Unmarshal(enc, &c); err != nil {
+			t.Fatalf("Invalid wrapper %#q: %v", enc, err)
+		}
+		if (c.Timeout != nil) != opts.sendTimeout() {
+			t.Errorf("Encode %+v: got timeout %v", opts, c.Timeout)
+		} else if c.Timeout != nil && (*c.Timeout > 60000 || *c.Timeout < 59000) {
+			t.Errorf("Encode: got timeout %dms, want about 60000", *c.Timeout)
+		}
+	}
+}
+
+// observe returns a summary of the values attached to a context, for
+// comparison across wire versions.
+func observe(t *testing.T, ctx context.Context) map[string]string {
+	t.Helper()
+	obs := make(map[string]string)
+	if dl, ok := ctx.Deadline(); ok {
+		obs["deadline"] = dl.UTC().Truncate(time.Second).Format(time.RFC3339)
+	}
+	for _, key := range MetadataKeys(ctx) {
+		var raw json.RawMessage
+		if err := MetadataValue(ctx, key, &raw); err != nil {
+			t.Errorf("MetadataValue(%q): unexpected error: %v", key, err)
+		}
+		obs["meta:"+key] = string(raw)
+		if bits, err := MetadataBytes(ctx, key); err == nil {
+			obs["bin:"+key] = string(bits)
+		}
+	}
+	if tok, err := AuthToken(ctx); err == nil {
+		obs["auth"] = string(tok)
+	}
+	if tp, ok := TraceParent(ctx); ok {
+		obs["trace"] = tp + " " + TraceState(ctx)
+	}
+	return obs
+}
+
+func TestWireVersions(t *testing.T) {
+	const tp = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	base := context.Background()
+	deadline, cancel := context.WithDeadline(base, time.Now().Add(time.Hour).Truncate(time.Second))
+	defer cancel()
+	withMeta := func(ctx context.Context, key string, v interface{}) context.Context {
+		ctx, err := WithMetadataValue(ctx, key, v)
+		if err != nil {
+			t.Fatalf("WithMetadataValue(%q): %v", key, err)
+		}
+		return ctx
+	}
+	binary := []byte{0, 1, 2, 0xfe, 0xff, '"'}
+	traced, err := WithTraceParent(base, tp)
+	if err != nil {
+		t.Fatalf("WithTraceParent: %v", err)
+	}
+	traced, err = WithTraceState(traced, "a=b")
+	if err != nil {
+		t.Fatalf("WithTraceState: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want map[string]string // the values expected after decoding
+
+		// Version 1 does not distinguish a default value that is an object
+		// from a set of named values, so either is decoded as both. These are
+		// the additional values decoded from version 1.
+		legacy map[string]string
+	}{
+		{"Empty", base, map[string]string{}, nil},
+		{"Deadline", deadline, map[string]string{
+			"deadline": time.Now().Add(time.Hour).UTC().Truncate(time.Second).Format(time.RFC3339),
+		}, nil},
+		{"Default", withMeta(base, DefaultMetadataKey, map[string]int{"x": 1}), map[string]string{
+			"meta:": `{"x":1}`,
+		}, map[string]string{"meta:x": "1"}},
+		{"DefaultString", withMeta(base, DefaultMetadataKey, "Zm9v"), map[string]string{
+			"meta:": `"Zm9v"`, "bin:": "foo",
+		}, nil},
+		{"Named", withMeta(withMeta(base, "a", 1), "b", []string{"c"}), map[string]string{
+			"meta:a": `1`, "meta:b": `["c"]`,
+		}, map[string]string{"meta:": `{"a":1,"b":["c"]}`}},
+		{"Binary", WithMetadataBytes(base, "tok", binary), map[string]string{
+			"meta:tok": `"AAEC/v8i"`, "bin:tok": string(binary),
+		}, map[string]string{"meta:": `{"tok":"AAEC/v8i"}`}},
+		{"EmptyBinary", WithMetadataBytes(base, "tok", []byte{}), map[string]string{
+			"meta:tok": `""`, "bin:tok": "",
+		}, map[string]string{"meta:": `{"tok":""}`}},
+		{"Mixed", WithMetadataBytes(withMeta(withMeta(base, DefaultMetadataKey, true), "a", "x"), "tok", binary), map[string]string{
+			"meta:": `true`, "meta:a": `"x"`, "meta:tok": `"AAEC/v8i"`, "bin:tok": string(binary),
+		}, nil},
+		{"Auth", WithAuthorizer(base, func(context.Context, string, []byte) ([]byte, error) {
+			return []byte("secret"), nil
+		}), map[string]string{"auth": "secret"}, nil},
+		{"Trace", traced, map[string]string{"trace": tp + " a=b"}, nil},
+	}
+	for _, test := range tests {
+		for _, version := range []int{0, Version1, Version2} {
+			t.Run(test.name+"/v"+strconv.Itoa(version), func(t *testing.T) {
+				enc, err := (&Options{Version: version}).Encode(test.ctx, "M", json.RawMessage(`[1]`))
+				if err != nil {
+					t.Fatalf("Encode: unexpected error: %v", err)
+				}
+				wantV := `{"jctx":"1"`
+				if version == Version2 {
+					wantV = `{"jctx":"2"`
+				}
+				if !strings.HasPrefix(string(enc), wantV) {
+					t.Errorf("Encode: got %#q, want version prefix %#q", enc, wantV)
+				}
+
+				ctx, params, err := Decode(base, "M", enc)
+				if err != nil {
+					t.Fatalf("Decode %#q: unexpected error: %v", enc, err)
+				}
+				if got := string(params); got != "[1]" {
+					t.Errorf("Decode: got params %#q, want [1]", got)
+				}
+				want := test.want
+				if version != Version2 && test.legacy != nil {
+					want = make(map[string]string)
+					for _, m := range []map[string]string{test.want, test.legacy} {
+						for k, v := range m {
+							want[k] = v
+						}
+					}
+				}
+				if diff := cmp.Diff(want, observe(t, ctx)); diff != "" {
+					t.Errorf("Decode %#q: wrong values (-want, +got):\n%s", enc, diff)
+				}
+			})
+		}
+	}
+
+	if enc, err := (&Options{Version: 3}).Encode(base, "M", nil); err == nil {
+		t.Errorf("Encode version 3: got %#q, want error", enc)
+	}
+}
+
+func TestDecodeVersion2(t *testing.T) {
+	base := context.Background()
+	tests := []struct {
+		input string
+		want  map[string]string
+	}{
+		// In version 2, "meta" is always a set of named values, even if it has
+		// no default member.
+		{`{"jctx":"2","meta":{"a":1}}`, map[string]string{"meta:a": "1"}},
+		{`{"jctx":"2","meta":{"":{"a":1}}}`, map[string]string{"meta:": `{"a":1}`}},
+		{`{"jctx":"2","meta":null}`, map[string]string{}},
+		{`{"jctx":"2","bin":{"k":"AAE="},"meta":{"k":"ignored","j":2}}`, map[string]string{
+			"meta:k": `"AAE="`, "bin:k": "\x00\x01", "meta:j": "2",
+		}},
+
+		// Binary values are not defined in version 1.
+		{`{"jctx":"1","bin":{"k":"AAE="}}`, map[string]string{}},
+
+		// A relative timeout is not preferred unless requested.
+		{`{"jctx":"2","deadline":"2200-01-01T00:00:00Z","timeout":1000}`, map[string]string{
+			"deadline": "2200-01-01T00:00:00Z",
+		}},
+	}
+	for _, test := range tests {
+		ctx, _, err := Decode(base, "M", json.RawMessage(test.input))
+		if err != nil {
+			t.Errorf("Decode %#q: unexpected error: %v", test.input, err)
+			continue
+		}
+		if diff := cmp.Diff(test.want, observe(t, ctx)); diff != "" {
+			t.Errorf("Decode %#q: wrong values (-want, +got):\n%s", test.input, diff)
+		}
+	}
+
+	for _, bad := range []string{
+		`{"jctx":"3"}`,
+		`{"jctx":"2","meta":[1]}`,
+		`{"jctx":"2","meta":"x"}`,
+	} {
+		if _, _, err := Decode(base, "M", json.RawMessage(bad)); err == nil {
+			t.Errorf("Decode %#q: got nil error, want error", bad)
+		}
+	}
+	strict := &Options{StrictFields: true}
+	if _, _, err := strict.Decode(base, "M", json.RawMessage(`{"jctx":"1","bin":{}}`)); err == nil {
+		t.Error("Decode strict: got nil error for binary metadata in version 1")
+	}
+}
+
+func TestMetadataBytes(t *testing.T) {
+	base := context.Background()
+	if _, err := MetadataBytes(base, "k"); err != ErrNoMetadata {
+		t.Errorf("MetadataBytes(empty): got %v, want %v", err, ErrNoMetadata)
+	}
+
+	ctx := WithMetadataBytes(base, "k", []byte("data"))
+	if got, err := MetadataBytes(ctx, "k"); err != nil || string(got) != "data" {
+		t.Errorf("MetadataBytes(k): got %q, %v; want data", got, err)
+	}
+	var s string
+	if err := MetadataValue(ctx, "k", &s); err != nil || s != "ZGF0YQ==" {
+		t.Errorf("MetadataValue(k): got %q, %v; want base64 of data", s, err)
+	}
+
+	// A JSON value that is not a base64 string is not binary.
+	ctx, err := WithMetadataValue(ctx, "k", 25)
+	if err != nil {
+		t.Fatalf("WithMetadataValue: %v", err)
+	}
+	if got, err := MetadataBytes(ctx, "k"); err == nil {
+		t.Errorf("MetadataBytes(k=25): got %q, want error", got)
+	}
+	if _, err := MetadataBytes(WithMetadataBytes(ctx, "k", nil), "k"); err != ErrNoMetadata {
+		t.Errorf("MetadataBytes(removed): got %v, want %v", err, ErrNoMetadata)
+	}
+
+	ctx = WithMetadataBytes(base, DefaultMetadataKey, []byte{1, 2})
+	if got, err := MetadataBytes(ctx, DefaultMetadataKey); err != nil || string(got) != "\x01\x02" {
+		t.Errorf("MetadataBytes(default): got %q, %v; want [1 2]", got, err)
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{
+		`{"jctx":"1"}`,
+		`{"jctx":"1","payload":[1,2],"deadline":"2018-06-09T20:45:33Z","meta":{"a":1,"":"x"}}`,
+		`{"jctx":"1","meta":"plain","auth":"c2VjcmV0","timeout":100}`,
+		`{"jctx":"1","traceparent":"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01","tracestate":"a=b"}`,
+		`{"jctx":"2","payload":{"jctx":"2"},"meta":{"k":[]},"bin":{"b":"AAE="}}`,
+		`{"jctx":"2","deadline":"0001-01-01T00:00:00Z","timeout":-5,"bin":{"":""}}`,
+		`[1,2,3]`,
+		`{"jctx":7}`,
+		`not JSON`,
+		``,
+	} {
+		f.Add([]byte(seed))
+	}
+	opts := []*Options{nil, {MaxNesting: 2, StrictFields: true, PreferTimeout: true, SkewTolerance: time.Second}}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		for _, o := range opts {
+			ctx, params, err := o.Decode(context.Background(), "M", input)
+			if err != nil {
+				continue
+			} else if len(params) != 0 && !json.Valid(params) {
+				continue // an unwrapped request is returned unchecked
+			}
+			// Whatever was decoded must be accessible without panicking, and
+			// must survive a round trip.
+			MetadataKeys(ctx)
+			observe(t, ctx)
+			for _, version := range []int{Version1, Version2} {
+				enc, err := (&Options{Version: version, MaxEncodeSize: -1}).Encode(ctx, "M", params)
+				if err != nil {
+					t.Fatalf("Encode v%d: unexpected error: %v", version, err)
+				}
+				if _, _, err := (&Options{MaxDecodeMetadata: -1, MaxNesting: 2}).Decode(context.Background(), "M", enc); err != nil {
+					t.Fatalf("Decode of %#q: unexpected error: %v", enc, err)
+				}
+			}
+		}
+	})
+}
+
+func TestRawMetadata(t *testing.T) {
+	base := context.Background()
+	if meta, ok := Metadata(base); ok {
+		t.Errorf("Metadata(empty): got %#q, want none", meta)
+	}
+	for _, input := range []string{
+		`{"jctx":"1","meta":{"user":"alice"}}`,
+		`{"jctx":"1","meta":[1, 2]}`,
+		`{"jctx":"2","meta":{"":1,"a":2},"bin":{"b":"AA=="}}`,
+	} {
+		var c struct {
+			Meta json.RawMessage `json:"meta"`
+		}
+		if err := json.Unmarshal([]byte(input), &c); err != nil {
+			t.Fatalf("Invalid input %#q: %v", input, err)
+		}
+		ctx, _, err := Decode(base, "M", json.RawMessage(input))
+		if err != nil {
+			t.Fatalf("Decode %#q: unexpected error: %v", input, err)
+		}
+		// Metadata attached after decoding do not change the result.
+		ctx, err = WithMetadata(ctx, "replaced")
+		if err != nil {
+			t.Fatalf("WithMetadata: %v", err)
+		}
+		if meta, ok := Metadata(ctx); !ok || string(meta) != string(c.Meta) {
+			t.Errorf("Metadata(%#q): got %#q, %v; want %#q", input, meta, ok, c.Meta)
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	base := context.Background()
+	in := `{"jctx":"1","meta":{"user":"alice"},"auth":"c2VjcmV0","hops":2}`
+	ctx, _, err := Decode(base, "M", json.RawMessage(in))
+	if err != nil {
+		t.Fatalf("Decode: unexpected error: %v", err)
+	}
+	if got := Hops(ctx); got != 2 {
+		t.Errorf("Hops: got %d, want 2", got)
+	}
+
+	// The forwarded context re-sends the token, and counts the hop.
+	enc, err := Encode(Forward(ctx), "N", nil)
+	if err != nil {
+		t.Fatalf("Encode: unexpected error: %v", err)
+	}
+	const want = `{"jctx":"1","meta":{"user":"alice"},"auth":"c2VjcmV0","hops":3}`
+	if got := string(enc); got != want {
+		t.Errorf("Encode forwarded: got %#q, want %#q", got, want)
+	}
+
+	// An authorizer in the context takes precedence over the inbound token.
+	var methods []string
+	actx := WithAuthorizer(ctx, func(_ context.Context, method string, _ []byte) ([]byte, error) {
+		methods = append(methods, method)
+		return []byte("new"), nil
+	})
+	enc, err = Encode(Forward(actx), "N", nil)
+	if err != nil {
+		t.Fatalf("Encode: unexpected error: %v", err)
+	}
+	fctx, _, err := Decode(base, "N", enc)
+	if err != nil {
+		t.Fatalf("Decode: unexpected error: %v", err)
+	}
+	if tok, err := AuthToken(fctx); err != nil || string(tok) != "new" {
+		t.Errorf("AuthToken: got %q, %v; want new", tok, err)
+	}
+	if diff := cmp.Diff([]string{"N"}, methods); diff != "" {
+		t.Errorf("Authorizer calls (-want, +got):\n%s", diff)
+	}
+
+	// Named tokens are forwarded, except one with an empty name, which cannot
+	// be given to WithNamedAuthorizer.
+	nctx, _, err := Decode(base, "M", json.RawMessage(`{"jctx":"1","auths":{"":"YQ==","id":"Yg=="}}`))
+	if err != nil {
+		t.Fatalf("Decode: unexpected error: %v", err)
+	}
+	enc, err = Encode(Forward(nctx), "N", nil)
+	if err != nil {
+		t.Fatalf("Encode: unexpected error: %v", err)
+	}
+	if got, want := string(enc), `{"jctx":"1","auths":{"id":"Yg=="},"hops":1}`; got != want {
+		t.Errorf("Encode forwarded named: got %#q, want %#q", got, want)
+	}
+
+	// A context that was not forwarded does not count a hop.
+	enc, err = Encode(ctx, "N", nil)
+	if err != nil {
+		t.Fatalf("Encode: unexpected error: %v", err)
+	}
+	if strings.Contains(string(enc), "hops") {
+		t.Errorf("Encode unforwarded: got %#q, want no hop count", enc)
+	}
+
+	// The hop count is limited.
+	tests := []struct {
+		opts *Options
+		hops int
+		ok   bool
+	}{
+		{nil, DefaultMaxHops, true},
+		{nil, DefaultMaxHops + 1, false},
+		{&Options{MaxHops: 1}, 1, true},
+		{&Options{MaxHops: 1}, 2, false},
+		{&Options{MaxHops: -1}, 1000, true},
+	}
+	for _, test := range tests {
+		in := `{"jctx":"1","hops":` + strconv.Itoa(test.hops) + `}`
+		_, _, err := test.opts.Decode(base, "M", json.RawMessage(in))
+		if ok := err == nil; ok != test.ok {
+			t.Errorf("Decode(%+v, %#q): got error %v, want ok=%v", test.opts, in, err, test.ok)
+		}
+	}
+}
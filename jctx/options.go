@@ -0,0 +1,127 @@
+package jctx
+
+import "time"
+
+// Options control the behaviour of the Encode and Decode methods. A nil
+// *Options provides default values as described.
+type Options struct {
+	// The version of the wire format produced by Encode, Version1 or
+	// Version2. If zero, Encode uses Version1, which all decoders accept;
+	// Encode reports an error for any other version. Decode accepts either
+	// version regardless of this setting.
+	Version int
+
+	// The maximum size in bytes of the context wrapper produced by Encode, not
+	// counting the request parameters it carries. If the wrapper is larger,
+	// typically because of large metadata, Encode reports an error. If zero,
+	// the limit is DefaultMaxSize; if negative, there is no limit.
+	MaxEncodeSize int
+
+	// The maximum size in bytes of the encoded metadata Decode will attach to
+	// a context. If a wrapper has larger metadata, Decode reports an error.
+	// If zero, the limit is DefaultMaxSize; if negative, there is no limit.
+	MaxDecodeMetadata int
+
+	// The maximum number of nested context wrappers to remove from a request,
+	// beyond the first. If the parameters of a request remain wrapped once
+	// this many have been removed, Decode reports an error. The values of the
+	// wrappers are applied in order from the outermost, so that inner values
+	// replace outer ones, except that a deadline can only be shortened.
+	// If zero, any nested wrapper is an error.
+	MaxNesting int
+
+	// The maximum number of times a request may have been forwarded (see
+	// Forward). If a wrapper has a larger hop count, Decode reports an error.
+	// If zero, the limit is DefaultMaxHops; if negative, there is no limit.
+	MaxHops int
+
+	// If true, reject a context wrapper that has fields not defined by this
+	// package. By default, unknown fields are ignored.
+	StrictFields bool
+
+	// If true, Encode transmits the time remaining until the deadline as a
+	// relative timeout in milliseconds, in addition to the deadline itself.
+	SendTimeout bool
+
+	// If true, and a context wrapper has a relative timeout, Decode sets the
+	// deadline of the context to the timeout after the time of decoding,
+	// ignoring the absolute deadline. Network delays are not accounted for,
+	// but this is not affected by differences between the clocks of the
+	// client and the server.
+	PreferTimeout bool
+
+	// If positive, a deadline that has already passed by less than this
+	// duration when Decode receives it, as happens if the clock of the client
+	// is behind that of the server, is replaced by a deadline this duration
+	// after the time of decoding.
+	SkewTolerance time.Duration
+
+	// If true, Decode reports an error for a deadline that has already passed
+	// (by at least SkewTolerance). By default, the deadline is attached to
+	// the context as given, and the context has therefore already ended.
+	RejectExpired bool
+}
+
+// DefaultMaxSize is the default limit on the size of context metadata. See
+// Options.MaxEncodeSize and Options.MaxDecodeMetadata.
+const DefaultMaxSize = 64 << 10
+
+// sizeLimit returns the effective limit for a size option with value n, or -1
+// if there is no limit.
+func sizeLimit(n int) int {
+	if n == 0 {
+		return DefaultMaxSize
+	} else if n < 0 {
+		return -1
+	}
+	return n
+}
+
+func (o *Options) maxEncodeSize() int {
+	if o == nil {
+		return DefaultMaxSize
+	}
+	return sizeLimit(o.MaxEncodeSize)
+}
+
+func (o *Options) maxDecodeMetadata() int {
+	if o == nil {
+		return DefaultMaxSize
+	}
+	return sizeLimit(o.MaxDecodeMetadata)
+}
+
+func (o *Options) version() int {
+	if o == nil || o.Version == 0 {
+		return Version1
+	}
+	return o.Version
+}
+
+func (o *Options) maxHops() int {
+	if o == nil || o.MaxHops == 0 {
+		return DefaultMaxHops
+	} else if o.MaxHops < 0 {
+		return -1
+	}
+	return o.MaxHops
+}
+
+func (o *Options) maxNesting() int {
+	if o == nil || o.MaxNesting < 0 {
+		return 0
+	}
+	return o.MaxNesting
+}
+
+func (o *Options) strictFields() bool  { return o != nil && o.StrictFields }
+func (o *Options) sendTimeout() bool   { return o != nil && o.SendTimeout }
+func (o *Options) preferTimeout() bool { return o != nil && o.PreferTimeout }
+func (o *Options) rejectExpired() bool { return o != nil && o.RejectExpired }
+
+func (o *Options) skewTolerance() time.Duration {
+	if o == nil || o.SkewTolerance < 0 {
+		return 0
+	}
+	return o.SkewTolerance
+}
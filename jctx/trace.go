@@ -0,0 +1,174 @@
+package jctx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A Carrier stores trace context fields by name. Its method set matches the
+// TextMapCarrier interface of OpenTelemetry, so that a propagator can inject
+// trace context into, or extract it from, a context used with this package.
+type Carrier interface {
+	Get(key string) string
+	Set(key, value string)
+	Keys() []string
+}
+
+// The names of the trace context fields, as defined by the W3C specification.
+const (
+	traceParentField = "traceparent"
+	traceStateField  = "tracestate"
+)
+
+type traceKey struct{}
+
+// traceContext is the trace context attached to a context.
+type traceContext struct {
+	parent, state string
+}
+
+// WithTraceParent attaches the W3C traceparent value tp to the context, so
+// that Encode transmits it to the recipient. It reports an error if tp is not
+// a valid traceparent value, and in that case the original value of ctx is
+// returned. Any tracestate previously attached to ctx is discarded.
+func WithTraceParent(ctx context.Context, tp string) (context.Context, error) {
+	if err := checkTraceParent(tp); err != nil {
+		return ctx, err
+	}
+	return context.WithValue(ctx, traceKey{}, traceContext{parent: tp}), nil
+}
+
+// WithTraceState attaches the W3C tracestate value ts to the context, so that
+// Encode transmits it along with the traceparent. It reports an error if ts
+// is not a valid tracestate value, or if ctx has no traceparent, and in that
+// case the original value of ctx is returned. An empty ts removes the
+// tracestate.
+func WithTraceState(ctx context.Context, ts string) (context.Context, error) {
+	tc, ok := ctx.Value(traceKey{}).(traceContext)
+	if !ok {
+		return ctx, errors.New("no traceparent for tracestate")
+	} else if err := checkTraceState(ts); err != nil {
+		return ctx, err
+	}
+	tc.state = ts
+	return context.WithValue(ctx, traceKey{}, tc), nil
+}
+
+// TraceParent returns the traceparent value attached to ctx, and reports
+// whether there is one. On a server using Decode, it is the traceparent sent
+// by the client, if that was valid.
+func TraceParent(ctx context.Context) (string, bool) {
+	tc, ok := ctx.Value(traceKey{}).(traceContext)
+	return tc.parent, ok
+}
+
+// TraceState returns the tracestate value attached to ctx, or "" if there is
+// none.
+func TraceState(ctx context.Context) string {
+	tc, _ := ctx.Value(traceKey{}).(traceContext)
+	return tc.state
+}
+
+// Inject copies the trace context attached to ctx, if any, into c under the
+// field names "traceparent" and "tracestate". On a server, this allows a
+// propagator to extract the trace context sent by the client from c.
+func Inject(ctx context.Context, c Carrier) {
+	if tc, ok := ctx.Value(traceKey{}).(traceContext); ok {
+		c.Set(traceParentField, tc.parent)
+		if tc.state != "" {
+			c.Set(traceStateField, tc.state)
+		}
+	}
+}
+
+// Extract returns a context derived from ctx that carries the trace context
+// stored in c, so that Encode transmits it. On a client, this allows a
+// propagator to inject the current trace context into c for transmission.
+// If c does not contain a valid traceparent, ctx is returned unchanged; an
+// invalid tracestate is discarded.
+func Extract(ctx context.Context, c Carrier) context.Context {
+	tctx, err := WithTraceParent(ctx, c.Get(traceParentField))
+	if err != nil {
+		return ctx
+	}
+	if ts := c.Get(traceStateField); ts != "" {
+		if sctx, err := WithTraceState(tctx, ts); err == nil {
+			return sctx
+		}
+	}
+	return tctx
+}
+
+// checkTraceParent reports whether tp is a valid traceparent value:
+//
+//    version "-" trace-id "-" parent-id "-" trace-flags
+//
+// where the fields are 2, 32, 16, and 2 lowercase hex digits. Version ff is
+// invalid, and neither the trace ID nor the parent ID may be all zeroes. A
+// version other than 00 may have further fields following the flags.
+func checkTraceParent(tp string) error {
+	bad := func(why string) error { return fmt.Errorf("invalid traceparent %q: %s", tp, why) }
+	if len(tp) < 55 {
+		return bad("too short")
+	}
+	ver, tid, pid, flags := tp[0:2], tp[3:35], tp[36:52], tp[53:55]
+	if tp[2] != '-' || tp[35] != '-' || tp[52] != '-' {
+		return bad("malformed")
+	} else if !isLowerHex(ver) || !isLowerHex(tid) || !isLowerHex(pid) || !isLowerHex(flags) {
+		return bad("fields must be lowercase hex")
+	} else if ver == "ff" {
+		return bad("invalid version")
+	} else if ver == "00" && len(tp) != 55 {
+		return bad("wrong length for version 00")
+	} else if len(tp) > 55 && tp[55] != '-' {
+		return bad("malformed")
+	} else if strings.Trim(tid, "0") == "" {
+		return bad("zero trace ID")
+	} else if strings.Trim(pid, "0") == "" {
+		return bad("zero parent ID")
+	}
+	return nil
+}
+
+// maxTraceState is the maximum number of list members in a tracestate.
+const maxTraceState = 32
+
+// checkTraceState reports whether ts is a valid tracestate value, a list of
+// up to 32 comma-separated key=value members. Only the overall structure is
+// checked, not the spelling of the keys.
+func checkTraceState(ts string) error {
+	if ts == "" {
+		return nil
+	}
+	members := strings.Split(ts, ",")
+	if len(members) > maxTraceState {
+		return fmt.Errorf("invalid tracestate: more than %d members", maxTraceState)
+	}
+	for _, m := range members {
+		m = strings.Trim(m, " \t")
+		if m == "" {
+			continue // empty members are permitted
+		}
+		key, val, ok := strings.Cut(m, "=")
+		if !ok || key == "" || val == "" {
+			return fmt.Errorf("invalid tracestate member %q", m)
+		}
+		for _, c := range m {
+			if c < 0x20 || c > 0x7e {
+				return fmt.Errorf("invalid tracestate member %q", m)
+			}
+		}
+	}
+	return nil
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
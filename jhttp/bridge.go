@@ -22,6 +22,9 @@ import (
 // If the request completes, whether or not there is an error, the HTTP
 // response is 200 (OK) for ordinary requests or 204 (No Response) for
 // notifications, and the response body contains the JSON-RPC response.
+// However, if the request is a single call (not a batch) that fails with an
+// error whose data records an HTTP status, as constructed by
+// jrpc2.ErrorWithHTTPStatus, the HTTP response has that status instead.
 //
 // If the HTTP request method is not "POST", the bridge reports 405 (Method Not
 // Allowed). If the Content-Type is not application/json, the bridge reports
@@ -106,10 +109,16 @@ func (b *Bridge) serveInternal(w http.ResponseWriter, req *http.Request) error {
 	}
 
 	// If the original request was a single message, make sure we encode the
-	// response the same way.
+	// response the same way. A single error may also specify an HTTP status.
 	var reply []byte
+	status := http.StatusOK
 	if len(rsps) == 1 && (len(body) == 0 || body[0] != '[') {
 		reply, err = json.Marshal(rsps[0])
+		if e := rsps[0].Error(); e != nil {
+			if s, ok := e.HTTPStatus(); ok {
+				status = s
+			}
+		}
 	} else {
 		reply, err = json.Marshal(rsps)
 	}
@@ -118,6 +127,7 @@ func (b *Bridge) serveInternal(w http.ResponseWriter, req *http.Request) error {
 	}
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Length", strconv.Itoa(len(reply)))
+	w.WriteHeader(status)
 	w.Write(reply)
 	return nil
 }
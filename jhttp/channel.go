@@ -86,6 +86,11 @@ func (c *Channel) Recv() ([]byte, error) {
 			// ok, but no message to report; wait for another
 			continue
 		default:
+			// An error status with a JSON body carries a JSON-RPC error
+			// response (see Bridge); report it as a message.
+			if next.rsp.Header.Get("Content-Type") == "application/json" && len(data) != 0 {
+				return data, err
+			}
 			return nil, fmt.Errorf("unexpected HTTP status %s", next.rsp.Status)
 		}
 	}
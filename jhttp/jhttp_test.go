@@ -202,3 +202,65 @@ func TestChannel(t *testing.T) {
 		t.Errorf("Recv = (%#q, %v), want (nil, %v", string(got), err, io.EOF)
 	}
 }
+
+func TestBridgeHTTPStatus(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Slow": handler.New(func(context.Context) error {
+			return jrpc2.ErrorWithHTTPStatus(-29000, http.StatusTooManyRequests, "slow down")
+		}),
+		"Fail": handler.New(func(context.Context) error {
+			return errors.New("plain failure")
+		}),
+	}, nil)
+	defer loc.Close()
+
+	b := NewBridge(loc.Client)
+	defer b.Close()
+	hsrv := httptest.NewServer(b)
+	defer hsrv.Close()
+
+	tests := []struct {
+		body   string
+		status int
+		want   string
+	}{
+		// A single call with an embedded status reports that status.
+		{`{"jsonrpc":"2.0","id":1,"method":"Slow"}`, http.StatusTooManyRequests,
+			`{"jsonrpc":"2.0","id":1,"error":{"code":-29000,"message":"slow down","data":{"httpStatus":429}}}`},
+
+		// An error without an embedded status is reported as before.
+		{`{"jsonrpc":"2.0","id":2,"method":"Fail"}`, http.StatusOK,
+			`{"jsonrpc":"2.0","id":2,"error":{"code":-32098,"message":"plain failure"}}`},
+
+		// A batch does not use the embedded status.
+		{`[{"jsonrpc":"2.0","id":3,"method":"Slow"}]`, http.StatusOK,
+			`[{"jsonrpc":"2.0","id":3,"error":{"code":-29000,"message":"slow down","data":{"httpStatus":429}}}]`},
+	}
+	for _, test := range tests {
+		rsp, err := http.Post(hsrv.URL, "application/json", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("POST request failed: %v", err)
+		}
+		body, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			t.Errorf("Reading POST body: %v", err)
+		}
+		if rsp.StatusCode != test.status {
+			t.Errorf("POST %#q: got status %d, want %d", test.body, rsp.StatusCode, test.status)
+		}
+		if got := string(body); got != test.want {
+			t.Errorf("POST %#q: got body %#q, want %#q", test.body, got, test.want)
+		}
+	}
+
+	// A client using the HTTP channel receives the error and its status.
+	cli := jrpc2.NewClient(NewChannel(hsrv.URL), nil)
+	defer cli.Close()
+	_, err := cli.Call(context.Background(), "Slow", nil)
+	if e, ok := err.(*jrpc2.Error); !ok {
+		t.Errorf("Call(Slow): got error %v, want *jrpc2.Error", err)
+	} else if s, ok := e.HTTPStatus(); !ok || s != http.StatusTooManyRequests {
+		t.Errorf("Call(Slow): got status %d, %v; want %d, true", s, ok, http.StatusTooManyRequests)
+	}
+}
@@ -1,11 +1,21 @@
 package jrpc2_test
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -16,10 +26,11 @@ import (
 	"github.com/yinfei8/jrpc2/code"
 	"github.com/yinfei8/jrpc2/handler"
 	"github.com/yinfei8/jrpc2/jctx"
+	"github.com/yinfei8/jrpc2/metrics"
 	"github.com/yinfei8/jrpc2/server"
 )
 
-var notAuthorized = code.Register(-32095, "request not authorized")
+var notAuthorized = code.Register(-30095, "request not authorized")
 
 var testOK = handler.New(func(ctx context.Context) (string, error) {
 	return "OK", nil
@@ -82,7 +93,7 @@ func (dummy) Ping(ctx context.Context, req *jrpc2.Request) error {
 }
 
 // Unrelated should not be picked up by the server.
-func (dummy) Unrelated() string { return "ceci n'est pas une méthode" }
+func (dummy) Unrelated(int, int) string { return "ceci n'est pas une méthode" }
 
 var callTests = []struct {
 	method string
@@ -476,6 +487,60 @@ func TestErrors(t *testing.T) {
 	}
 }
 
+// Verify that error codes, and *jrpc2.Error values, are recovered from errors
+// wrapped by handlers.
+func TestWrappedErrors(t *testing.T) {
+	wrap := func(err error) error {
+		return fmt.Errorf("outer: %w", fmt.Errorf("middle: %w", fmt.Errorf("inner: %w", err)))
+	}
+	loc := server.NewLocal(handler.Map{
+		"Deadline": handler.New(func(context.Context) error {
+			return wrap(context.DeadlineExceeded)
+		}),
+		"Coder": handler.New(func(context.Context) error {
+			return wrap(notAuthorized.Err())
+		}),
+		"Error": handler.New(func(context.Context) error {
+			return wrap(jrpc2.DataErrorf(-29999, []int{1, 2}, "bad thing"))
+		}),
+	}, nil)
+	defer loc.Close()
+
+	tests := []struct {
+		method   string
+		code     code.Code
+		message  string
+		wantData string
+	}{
+		{"Deadline", code.DeadlineExceeded, "outer: middle: inner: context deadline exceeded", ""},
+		{"Coder", notAuthorized, "outer: middle: inner: request not authorized", ""},
+		{"Error", -29999, "bad thing", "[1,2]"},
+	}
+	for _, test := range tests {
+		// N.B. Use Batch, since Call converts some codes to context errors.
+		rsps, err := loc.Client.Batch(context.Background(), []jrpc2.Spec{{Method: test.method}})
+		if err != nil {
+			t.Fatalf("Batch(%q): unexpected error: %v", test.method, err)
+		}
+		e := rsps[0].Error()
+		if e == nil {
+			t.Errorf("Call(%q): got no error, wanted one", test.method)
+			continue
+		}
+		if e.Code() != test.code {
+			t.Errorf("Call(%q): got code %v, want %v", test.method, e.Code(), test.code)
+		}
+		if e.Message() != test.message {
+			t.Errorf("Call(%q): got message %q, want %q", test.method, e.Message(), test.message)
+		}
+		var data json.RawMessage
+		e.UnmarshalData(&data)
+		if got := string(data); got != test.wantData {
+			t.Errorf("Call(%q): got data %#q, want %#q", test.method, got, test.wantData)
+		}
+	}
+}
+
 // Test that a client correctly reports bad parameters.
 func TestBadCallParams(t *testing.T) {
 	loc := server.NewLocal(handler.Map{
@@ -615,6 +680,7 @@ func TestOtherClient(t *testing.T) {
 
 		// An empty batch request should report a single error object.
 		{`[]`, `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty request batch"}}`},
+		{" [ \n] ", `{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"empty request batch"}}`},
 
 		// An invalid batch request should report a single error object.
 		{`[1]`, `[{"jsonrpc":"2.0","id":null,"error":{"code":-32700,"message":"request is not a JSON object"}}]`},
@@ -934,6 +1000,293 @@ func TestRequestHook(t *testing.T) {
 	})
 }
 
+// Verify that a jctx.Verifier can reject requests and identify the caller.
+func TestVerifyDecoder(t *testing.T) {
+	type checked struct {
+		Method, Params, Token string
+	}
+	var got []checked
+	loc := server.NewLocal(handler.Map{
+		"Whoami": handler.New(func(ctx context.Context, _ []string) string {
+			user, _ := jctx.Principal(ctx).(string)
+			return user
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			DecodeContext: jctx.VerifyDecoder(func(ctx context.Context, method string, params, token []byte) (context.Context, error) {
+				got = append(got, checked{method, string(params), string(token)})
+				if user := strings.TrimPrefix(string(token), "user:"); user != string(token) {
+					return jctx.WithPrincipal(ctx, user), nil
+				} else if token == nil {
+					return nil, errors.New("missing token")
+				}
+				return nil, jrpc2.Errorf(notAuthorized, "bad token %q", token)
+			}),
+		},
+		Client: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer loc.Close()
+
+	auth := func(tok string) context.Context {
+		return jctx.WithAuthorizer(context.Background(), func(_ context.Context, method string, params []byte) ([]byte, error) {
+			return []byte(tok), nil
+		})
+	}
+	tests := []struct {
+		ctx      context.Context
+		want     string
+		code     code.Code
+		errtext  string
+		verified checked
+	}{
+		{auth("user:alice"), "alice", code.NoError, "",
+			checked{"Whoami", `["x"]`, "user:alice"}},
+		{context.Background(), "", code.Unauthorized, "missing token",
+			checked{"Whoami", `["x"]`, ""}},
+		{auth("guest"), "", notAuthorized, `bad token "guest"`,
+			checked{"Whoami", `["x"]`, "guest"}},
+	}
+	for _, test := range tests {
+		got = nil
+		var rsp string
+		err := loc.Client.CallResult(test.ctx, "Whoami", []string{"x"}, &rsp)
+		if c := code.FromError(err); c != test.code {
+			t.Errorf("Call: got error %v (code %v), want code %v", err, c, test.code)
+		} else if err != nil && !strings.Contains(err.Error(), test.errtext) {
+			t.Errorf("Call: got error %v, want %q", err, test.errtext)
+		} else if rsp != test.want {
+			t.Errorf("Call: got %q, want %q", rsp, test.want)
+		}
+		if diff := cmp.Diff([]checked{test.verified}, got); diff != "" {
+			t.Errorf("Verifier calls (-want, +got):\n%s", diff)
+		}
+	}
+}
+
+// Verify that a jctx.TokensVerifier receives all the tokens of a request, and
+// that its rejections are reported with the configured code.
+func TestVerifyTokensDecoder(t *testing.T) {
+	const capDenied = code.Code(-30091)
+	var got []map[string]string
+	loc := server.NewLocal(handler.Map{
+		"Whoami": handler.New(func(ctx context.Context) string {
+			user, _ := jctx.Principal(ctx).(string)
+			return user
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			DecodeContext: jctx.VerifyTokensDecoder(func(ctx context.Context, method string, params []byte, tokens map[string][]byte) (context.Context, error) {
+				seen := make(map[string]string)
+				for name, tok := range tokens {
+					seen[name] = string(tok)
+				}
+				got = append(got, seen)
+
+				user := strings.TrimPrefix(string(tokens["id"]), "user:")
+				if user == "" || user == string(tokens["id"]) {
+					return nil, fmt.Errorf("invalid identity token %q", tokens["id"])
+				} else if string(tokens["cap"]) != "call:"+method {
+					return nil, fmt.Errorf("capability %q does not permit %s", tokens["cap"], method)
+				}
+				return jctx.WithPrincipal(ctx, user), nil
+			}, capDenied),
+		},
+		Client: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer loc.Close()
+
+	auth := func(id, capability string) context.Context {
+		ctx := context.Background()
+		for name, tok := range map[string]string{"id": id, "cap": capability} {
+			tok := tok
+			ctx = jctx.WithNamedAuthorizer(ctx, name, func(context.Context, string, []byte) ([]byte, error) {
+				return []byte(tok), nil
+			})
+		}
+		return ctx
+	}
+	tests := []struct {
+		ctx      context.Context
+		want     string
+		code     code.Code
+		errtext  string
+		verified map[string]string
+	}{
+		{auth("user:alice", "call:Whoami"), "alice", code.NoError, "",
+			map[string]string{"id": "user:alice", "cap": "call:Whoami"}},
+
+		// One of the two tokens is invalid.
+		{auth("user:alice", "call:Other"), "", capDenied, `capability "call:Other" does not permit Whoami`,
+			map[string]string{"id": "user:alice", "cap": "call:Other"}},
+		{auth("guest", "call:Whoami"), "", capDenied, `invalid identity token "guest"`,
+			map[string]string{"id": "guest", "cap": "call:Whoami"}},
+
+		// A single unnamed token is reported under the empty name.
+		{jctx.WithAuthorizer(context.Background(), func(context.Context, string, []byte) ([]byte, error) {
+			return []byte("user:bob"), nil
+		}), "", capDenied, `invalid identity token ""`, map[string]string{"": "user:bob"}},
+	}
+	for _, test := range tests {
+		got = nil
+		var rsp string
+		err := loc.Client.CallResult(test.ctx, "Whoami", nil, &rsp)
+		if c := code.FromError(err); c != test.code {
+			t.Errorf("Call: got error %v (code %v), want code %v", err, c, test.code)
+		} else if err != nil && !strings.Contains(err.Error(), test.errtext) {
+			t.Errorf("Call: got error %v, want %q", err, test.errtext)
+		} else if rsp != test.want {
+			t.Errorf("Call: got %q, want %q", rsp, test.want)
+		}
+		if diff := cmp.Diff([]map[string]string{test.verified}, got); diff != "" {
+			t.Errorf("Verifier calls (-want, +got):\n%s", diff)
+		}
+	}
+}
+
+// Verify that jctx.Forward carries the context of a request through a server
+// to another server it calls, and that forwarding loops are cut off.
+func TestForwardContext(t *testing.T) {
+	type seen struct {
+		User  string
+		Token string
+		Hops  int
+		Dead  bool
+	}
+	backend := server.NewLocal(handler.Map{
+		"Who": handler.New(func(ctx context.Context) (seen, error) {
+			var s seen
+			var meta map[string]string
+			if err := jctx.UnmarshalMetadata(ctx, &meta); err != nil {
+				return s, err
+			}
+			tok, _ := jctx.AuthToken(ctx)
+			_, dead := ctx.Deadline()
+			return seen{meta["user"], string(tok), jctx.Hops(ctx), dead}, nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{DecodeContext: jctx.Decode},
+		Client: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer backend.Close()
+
+	var front server.Local
+	front = server.NewLocal(handler.Map{
+		"Who": handler.New(func(ctx context.Context) (json.RawMessage, error) {
+			rsp, err := backend.Client.Call(jctx.Forward(ctx), "Who", nil)
+			if err != nil {
+				return nil, err
+			}
+			return json.RawMessage(rsp.ResultString()), nil
+		}),
+		"Loop": handler.New(func(ctx context.Context) error {
+			_, err := front.Client.Call(jctx.Forward(ctx), "Loop", nil)
+			return err
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			DecodeContext: (&jctx.Options{MaxHops: 3}).Decode,
+			Concurrency:   8,
+		},
+		Client: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer front.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ctx, err := jctx.WithMetadata(ctx, map[string]string{"user": "alice"})
+	if err != nil {
+		t.Fatalf("WithMetadata: %v", err)
+	}
+	ctx = jctx.WithAuthorizer(ctx, func(context.Context, string, []byte) ([]byte, error) {
+		return []byte("secret"), nil
+	})
+
+	var got seen
+	if err := front.Client.CallResult(ctx, "Who", nil, &got); err != nil {
+		t.Fatalf("Call(Who): unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(seen{"alice", "secret", 1, true}, got); diff != "" {
+		t.Errorf("Values at the backend (-want, +got):\n%s", diff)
+	}
+
+	if _, err := front.Client.Call(ctx, "Loop", nil); err == nil {
+		t.Error("Call(Loop): got nil error, want error")
+	} else if !strings.Contains(err.Error(), "forwarded 4 times") {
+		t.Errorf("Call(Loop): got error %v, want hop limit", err)
+	}
+}
+
+// auditLogger is an RPCLogger that records the caller of each request, taken
+// from its jctx metadata.
+type auditLogger struct {
+	mu  sync.Mutex
+	log []string
+}
+
+func (a *auditLogger) record(ctx context.Context, what string) {
+	meta, ok := jctx.Metadata(ctx)
+	if !ok {
+		meta = json.RawMessage("none")
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.log = append(a.log, what+" "+string(meta))
+}
+
+func (a *auditLogger) LogRequest(ctx context.Context, req *jrpc2.Request) {
+	a.record(ctx, "request "+req.Method())
+}
+
+func (a *auditLogger) LogResponse(ctx context.Context, rsp *jrpc2.Response) {
+	a.record(ctx, "response "+jrpc2.InboundRequest(ctx).Method())
+}
+
+// Verify that the values decoded by DecodeContext are visible to CheckRequest
+// and to the RPC logger, including for requests that CheckRequest rejects.
+func TestDecodeContextOrdering(t *testing.T) {
+	audit := new(auditLogger)
+	loc := server.NewLocal(handler.Map{"Test": testOK}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			DecodeContext: jctx.Decode,
+			CheckRequest: func(ctx context.Context, req *jrpc2.Request) error {
+				audit.record(ctx, "check "+req.Method())
+				var caller struct {
+					User string `json:"user"`
+				}
+				if err := jctx.UnmarshalMetadata(ctx, &caller); err != nil || caller.User == "" {
+					return jrpc2.Errorf(notAuthorized, "no caller")
+				}
+				return nil
+			},
+			RPCLog: audit,
+		},
+		Client: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+	})
+	defer loc.Close()
+
+	alice, err := jctx.WithMetadata(context.Background(), map[string]string{"user": "alice"})
+	if err != nil {
+		t.Fatalf("WithMetadata: %v", err)
+	}
+	if _, err := loc.Client.Call(alice, "Test", nil); err != nil {
+		t.Errorf("Call(Test) as alice: unexpected error: %v", err)
+	}
+	if _, err := loc.Client.Call(context.Background(), "Test", nil); code.FromError(err) != notAuthorized {
+		t.Errorf("Call(Test) anonymous: got %v, want code %v", err, notAuthorized)
+	}
+
+	want := []string{
+		`check Test {"user":"alice"}`,
+		`request Test {"user":"alice"}`,
+		`response Test {"user":"alice"}`,
+		`check Test none`,
+		`response Test none`,
+	}
+	if diff := cmp.Diff(want, audit.log); diff != "" {
+		t.Errorf("Audit log (-want, +got):\n%s", diff)
+	}
+}
+
 // Verify that calling a wrapped method which takes no parameters, but in which
 // the caller provided parameters, will correctly report an error.
 func TestNoParams(t *testing.T) {
@@ -965,6 +1318,177 @@ func TestRPCServerInfo(t *testing.T) {
 	}
 }
 
+// Verify that rpc.serverInfo reports method descriptions when the assigner
+// provides them, alongside the plain list of names.
+func TestServerInfoMethodInfo(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Add": handler.WithInfo(handler.New(func(_ context.Context, vs []int) (int, error) {
+			return len(vs), nil
+		}), handler.Info{
+			Summary: "Add some numbers",
+			Params:  json.RawMessage(`{"type":"array"}`),
+			Result:  json.RawMessage(`{"type":"integer"}`),
+		}),
+		"Old":  handler.Deprecated(testOK, "use Test"),
+		"Test": testOK,
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	si, err := jrpc2.RPCServerInfo(ctx, loc.Client)
+	if err != nil {
+		t.Fatalf("RPCServerInfo failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"Add", "Old", "Test"}, si.Methods); diff != "" {
+		t.Errorf("Wrong method names: (-want, +got)\n%s", diff)
+	}
+	want := []jrpc2.MethodDesc{
+		{Name: "Add", MethodInfo: jrpc2.MethodInfo{
+			Summary: "Add some numbers",
+			Params:  json.RawMessage(`{"type":"array"}`),
+			Result:  json.RawMessage(`{"type":"integer"}`),
+		}},
+		{Name: "Old", MethodInfo: jrpc2.MethodInfo{Deprecated: "use Test"}},
+		{Name: "Test"},
+	}
+	if diff := cmp.Diff(want, si.MethodInfo); diff != "" {
+		t.Errorf("Wrong method info: (-want, +got)\n%s", diff)
+	}
+
+	// The descriptions are flat objects on the wire, and the legacy list of
+	// names is unchanged.
+	var raw struct {
+		Methods    []string          `json:"methods"`
+		MethodInfo []json.RawMessage `json:"methodInfo"`
+	}
+	if err := loc.Client.CallResult(ctx, "rpc.serverInfo", nil, &raw); err != nil {
+		t.Fatalf("Call rpc.serverInfo failed: %v", err)
+	}
+	if len(raw.Methods) != 3 || len(raw.MethodInfo) != 3 {
+		t.Fatalf("Wrong result: got %d names, %d descriptions; want 3, 3", len(raw.Methods), len(raw.MethodInfo))
+	}
+	if got, want := string(raw.MethodInfo[2]), `{"name":"Test"}`; got != want {
+		t.Errorf("Method info for Test: got %s, want %s", got, want)
+	}
+
+	// An assigner that cannot describe its methods reports only names.
+	loc2 := server.NewLocal(handler.ServiceMap{"S": handler.Map{"M": testOK}}, nil)
+	defer loc2.Close()
+	si2, err := jrpc2.RPCServerInfo(ctx, loc2.Client)
+	if err != nil {
+		t.Fatalf("RPCServerInfo failed: %v", err)
+	}
+	if diff := cmp.Diff([]jrpc2.MethodDesc{{Name: "S.M"}}, si2.MethodInfo); diff != "" {
+		t.Errorf("Wrong method info: (-want, +got)\n%s", diff)
+	}
+}
+
+// Verify that rpc.modules groups the methods of a service map by namespace.
+func TestRPCModules(t *testing.T) {
+	loc := server.NewLocal(handler.ServiceMap{
+		"Math": handler.Map{"Add": testOK, "Mul": testOK},
+		"Text": handler.ServiceMap{
+			"Case": handler.Map{"Upper": testOK},
+			"":     handler.Map{"Len": testOK},
+		},
+		"": handler.Map{"Ping": testOK},
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	got, err := jrpc2.RPCModules(ctx, loc.Client)
+	if err != nil {
+		t.Fatalf("RPCModules failed: %v", err)
+	}
+	want := map[string][]string{
+		"Math": {"Add", "Mul"},
+		"Text": {"Case.Upper", "Len"},
+		"":     {"Ping"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Wrong modules: (-want, +got)\n%s", diff)
+	}
+
+	// A server whose assigner has no namespaces does not have the method.
+	plain := server.NewLocal(handler.Map{"Test": testOK}, nil)
+	defer plain.Close()
+	if got, err := jrpc2.RPCModules(ctx, plain.Client); code.FromError(err) != code.MethodNotFound {
+		t.Errorf("RPCModules(Map): got %v, %v; want method not found", got, err)
+	}
+}
+
+// Verify that WaitReady retries until the server accepts requests.
+func TestWaitReady(t *testing.T) {
+	var ready, attempts int32
+	loc := server.NewLocal(handler.Map{"Test": testOK}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			CheckRequest: func(context.Context, *jrpc2.Request) error {
+				atomic.AddInt32(&attempts, 1)
+				if atomic.LoadInt32(&ready) == 0 {
+					return jrpc2.Errorf(code.SystemError, "starting up")
+				}
+				return nil
+			},
+		},
+	})
+	defer loc.Close()
+
+	time.AfterFunc(50*time.Millisecond, func() { atomic.StoreInt32(&ready, 1) })
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := jrpc2.WaitReady(ctx, loc.Client); err != nil {
+		t.Fatalf("WaitReady: unexpected error: %v", err)
+	}
+	if n := atomic.LoadInt32(&attempts); n < 2 {
+		t.Errorf("WaitReady: got %d attempts, want at least 2", n)
+	}
+
+	// If the server is never ready, WaitReady gives up when ctx ends.
+	atomic.StoreInt32(&ready, 0)
+	short, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := jrpc2.WaitReady(short, loc.Client); err != context.DeadlineExceeded {
+		t.Errorf("WaitReady (never ready): got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// Other errors are reported without retrying.
+	loc.Client.Close()
+	if err := jrpc2.WaitReady(ctx, loc.Client); err == nil || err == context.DeadlineExceeded {
+		t.Errorf("WaitReady (closed): got %v, want the client error", err)
+	}
+}
+
+// Verify that WaitReady accepts any reply from the server, other than one
+// reporting that it is not yet up, without waiting.
+func TestWaitReadyAnswered(t *testing.T) {
+	tests := []struct {
+		name string
+		opts *jrpc2.ServerOptions
+	}{
+		{"NoBuiltin", &jrpc2.ServerOptions{DisableBuiltin: true}},
+		{"OtherPrefix", &jrpc2.ServerOptions{BuiltinPrefix: "sys."}},
+		{"Rejected", &jrpc2.ServerOptions{
+			CheckRequest: func(context.Context, *jrpc2.Request) error {
+				return jrpc2.Errorf(code.Unauthorized, "go away")
+			},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			loc := server.NewLocal(handler.Map{"Test": testOK}, &server.LocalOptions{
+				Server: test.opts,
+			})
+			defer loc.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if err := jrpc2.WaitReady(ctx, loc.Client); err != nil {
+				t.Errorf("WaitReady: unexpected error: %v", err)
+			}
+		})
+	}
+}
+
 func TestNetwork(t *testing.T) {
 	tests := []struct {
 		input, want string
@@ -1148,3 +1672,2894 @@ func TestServerFromContext(t *testing.T) {
 		t.Errorf("ServerFromContext: got %p, want %p", got, loc.Server)
 	}
 }
+
+// Verify that the client enforces its limit on pending requests.
+func TestClientMaxPending(t *testing.T) {
+	const maxPending = 3
+
+	started := make(chan struct{}, maxPending)
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Stall": handler.New(func(ctx context.Context) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		}),
+		"Note": handler.New(func(context.Context) error { return nil }),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: maxPending + 1},
+		Client: &jrpc2.ClientOptions{MaxPending: maxPending},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// Fill up the pending set with calls that will not complete until released.
+	errc := make(chan error, maxPending)
+	for i := 0; i < maxPending; i++ {
+		go func() {
+			_, err := loc.Client.Call(ctx, "Stall", nil)
+			errc <- err
+		}()
+	}
+	for i := 0; i < maxPending; i++ {
+		<-started
+	}
+
+	// Another call should fail without being sent.
+	if rsp, err := loc.Client.Call(ctx, "Stall", nil); err != jrpc2.ErrTooManyPending {
+		t.Errorf("Call(Stall): got %v, %v; want %v", rsp, err, jrpc2.ErrTooManyPending)
+	}
+
+	// A batch containing a call should also fail.
+	if rsps, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Note", Notify: true},
+		{Method: "Stall"},
+	}); err != jrpc2.ErrTooManyPending {
+		t.Errorf("Batch: got %v, %v; want %v", rsps, err, jrpc2.ErrTooManyPending)
+	}
+
+	// Notifications do not count toward the limit.
+	if err := loc.Client.Notify(ctx, "Note", nil); err != nil {
+		t.Errorf("Notify(Note): unexpected error: %v", err)
+	}
+
+	// Once the pending calls are released, they should all succeed.
+	close(release)
+	for i := 0; i < maxPending; i++ {
+		if err := <-errc; err != nil {
+			t.Errorf("Call(Stall): unexpected error: %v", err)
+		}
+	}
+
+	// With the pending set drained, a new call should work.
+	if _, err := loc.Client.Call(ctx, "Stall", nil); err != nil {
+		t.Errorf("Call(Stall) after release: unexpected error: %v", err)
+	}
+}
+
+// Verify that deprecated methods work, and that the server reports them.
+func TestDeprecatedMethod(t *testing.T) {
+	var buf bytes.Buffer
+	loc := server.NewLocal(handler.Map{
+		"Old": handler.Deprecated(testOK, "use New instead"),
+		"New": testOK,
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Logger: log.New(&buf, "", 0)},
+	})
+	ctx := context.Background()
+	for _, method := range []string{"Old", "New", "Old"} {
+		rsp, err := loc.Client.Call(ctx, method, nil)
+		if err != nil {
+			t.Errorf("Call(%q): unexpected error: %v", method, err)
+		} else if got := rsp.ResultString(); got != `"OK"` {
+			t.Errorf("Call(%q): got result %#q, want %#q", method, got, `"OK"`)
+		}
+	}
+	info := loc.Server.ServerInfo()
+	loc.Close()
+
+	if got := info.Counter["rpc.deprecatedCalls"]; got != 2 {
+		t.Errorf("Metric rpc.deprecatedCalls: got %d, want 2", got)
+	}
+	const want = `Method "Old" is deprecated: use New instead`
+	if got := strings.Count(buf.String(), want); got != 1 {
+		t.Errorf("Deprecation warnings in log: got %d, want 1\n%s", got, buf.String())
+	}
+}
+
+// Verify that the server limits the rate of debug logs during a burst, but
+// does not discard messages that report errors.
+func TestLogLimit(t *testing.T) {
+	const limit = 5
+	const burst = 20
+
+	var buf bytes.Buffer
+	loc := server.NewLocal(handler.Map{"Test": testOK}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			Logger:   log.New(&buf, "", 0),
+			LogLimit: limit,
+		},
+	})
+	var specs []jrpc2.Spec
+	for i := 0; i < burst; i++ {
+		specs = append(specs, jrpc2.Spec{Method: "Test"}, jrpc2.Spec{Method: "Missing"})
+	}
+	start := time.Now()
+	if _, err := loc.Client.Batch(context.Background(), specs); err != nil {
+		t.Fatalf("Batch: unexpected error: %v", err)
+	}
+	loc.Close()
+	elapsed := time.Since(start)
+
+	logs := buf.String()
+	if got := strings.Count(logs, `no such method "Missing"`); got != burst {
+		t.Errorf("Error messages in log: got %d, want %d", got, burst)
+	}
+	max := limit * (int(elapsed/time.Second) + 1)
+	if got := strings.Count(logs, "Checking request"); got > max {
+		t.Errorf("Request messages in log: got %d, want at most %d", got, max)
+	}
+	if !strings.Contains(logs, "log messages discarded]") {
+		t.Errorf("Log does not report discarded messages:\n%s", logs)
+	}
+}
+
+// Verify that handlers can log through a logger tagged with the request.
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	loc := server.NewLocal(handler.Map{
+		"Log": handler.New(func(ctx context.Context, msg []string) error {
+			jrpc2.RequestLogger(ctx).Printf("handling %s", msg[0])
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Logger: log.New(&buf, "srv: ", 0)},
+	})
+	ctx := context.Background()
+	if _, err := loc.Client.Call(ctx, "Log", []string{"call"}); err != nil {
+		t.Errorf("Call(Log): unexpected error: %v", err)
+	}
+	if err := loc.Client.Notify(ctx, "Log", []string{"note"}); err != nil {
+		t.Errorf("Notify(Log): unexpected error: %v", err)
+	}
+	loc.Close()
+
+	var got []string
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.Contains(line, "handling") {
+			got = append(got, line)
+		}
+	}
+	want := []string{
+		`srv: [method="Log" id=1] handling call`,
+		`srv: [method="Log"] handling note`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Handler log lines (-want, +got):\n%s", diff)
+	}
+
+	// Outside a handler, or without a server logger, messages are discarded.
+	jrpc2.RequestLogger(ctx).Print("discarded")
+}
+
+// Verify that a request logger reports the location of the handler's call.
+func TestRequestLoggerCaller(t *testing.T) {
+	for _, limit := range []int{0, 10} {
+		var buf bytes.Buffer
+		var want string
+		loc := server.NewLocal(handler.Map{
+			"Log": handler.New(func(ctx context.Context) error {
+				_, file, line, _ := runtime.Caller(0)
+				jrpc2.RequestLogger(ctx).Print("here") // on the line after Caller
+				want = fmt.Sprintf("%s:%d: ", filepath.Base(file), line+1)
+				return nil
+			}),
+		}, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{
+				Logger:   log.New(&buf, "", log.Lshortfile),
+				LogLimit: limit,
+			},
+		})
+		if _, err := loc.Client.Call(context.Background(), "Log", nil); err != nil {
+			t.Errorf("Call(Log): unexpected error: %v", err)
+		}
+		loc.Close()
+
+		var got string
+		for _, line := range strings.Split(buf.String(), "\n") {
+			if strings.HasSuffix(line, "] here") {
+				got = line
+			}
+		}
+		if !strings.HasPrefix(got, want) {
+			t.Errorf("LogLimit %d: got log line %q, want prefix %q", limit, got, want)
+		}
+	}
+}
+
+// Verify that the messages of a request logger count against the LogLimit of
+// the server.
+func TestRequestLoggerLimit(t *testing.T) {
+	const limit = 3
+	const burst = 20
+
+	var buf bytes.Buffer
+	loc := server.NewLocal(handler.Map{
+		"Log": handler.New(func(ctx context.Context) error {
+			lg := jrpc2.RequestLogger(ctx)
+			for i := 0; i < burst; i++ {
+				lg.Printf("message %d", i)
+			}
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			Logger:   log.New(&buf, "", 0),
+			LogLimit: limit,
+		},
+	})
+	start := time.Now()
+	if _, err := loc.Client.Call(context.Background(), "Log", nil); err != nil {
+		t.Errorf("Call(Log): unexpected error: %v", err)
+	}
+	loc.Close()
+	elapsed := time.Since(start)
+
+	logs := buf.String()
+	max := limit * (int(elapsed/time.Second) + 1)
+	if got := strings.Count(logs, "] message "); got > max {
+		t.Errorf("Handler messages in log: got %d, want at most %d\n%s", got, max, logs)
+	}
+	if !strings.Contains(logs, "log messages discarded]") {
+		t.Errorf("Log does not report discarded messages:\n%s", logs)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	const concurrency = 3
+
+	// Each call to Wait blocks until concurrency calls are active at once,
+	// which succeeds only if the pool admits as many handlers as the
+	// concurrency limit, even though the requested pool is smaller.
+	var active, peak int32
+	arrived := make(chan struct{})
+	var nwait int32
+	loc := server.NewLocal(handler.Map{
+		"Wait": handler.New(func(ctx context.Context) error {
+			if atomic.AddInt32(&nwait, 1) == concurrency {
+				close(arrived)
+			}
+			select {
+			case <-arrived:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}),
+		"Echo": handler.New(func(ctx context.Context, vs []int) (int, error) {
+			n := atomic.AddInt32(&active, 1)
+			defer atomic.AddInt32(&active, -1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			return vs[0], nil
+		}),
+		"Stall": handler.New(func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: concurrency, WorkerPool: 1},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	t.Run("Concurrency", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		errc := make(chan error, concurrency)
+		for i := 0; i < concurrency; i++ {
+			go func() { _, err := loc.Client.Call(ctx, "Wait", nil); errc <- err }()
+		}
+		for i := 0; i < concurrency; i++ {
+			if err := <-errc; err != nil {
+				t.Errorf("Call(Wait): unexpected error: %v", err)
+			}
+		}
+	})
+
+	t.Run("Results", func(t *testing.T) {
+		const numCalls = 50
+		errc := make(chan error, numCalls)
+		for i := 0; i < numCalls; i++ {
+			i := i
+			go func() {
+				var got int
+				err := loc.Client.CallResult(ctx, "Echo", []int{i}, &got)
+				if err == nil && got != i {
+					err = fmt.Errorf("got %d, want %d", got, i)
+				}
+				errc <- err
+			}()
+		}
+		rsps, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+			{Method: "Echo", Params: []int{100}},
+			{Method: "Echo", Params: []int{200}},
+			{Method: "Echo", Params: []int{300}},
+		})
+		if err != nil {
+			t.Fatalf("Batch failed: %v", err)
+		}
+		for i, rsp := range rsps {
+			var got int
+			if err := rsp.UnmarshalResult(&got); err != nil {
+				t.Errorf("Batch response %d: %v", i, err)
+			} else if want := 100 * (i + 1); got != want {
+				t.Errorf("Batch response %d: got %d, want %d", i, got, want)
+			}
+		}
+		for i := 0; i < numCalls; i++ {
+			if err := <-errc; err != nil {
+				t.Errorf("Call(Echo): %v", err)
+			}
+		}
+		if p := atomic.LoadInt32(&peak); p > concurrency {
+			t.Errorf("Peak concurrency: got %d, want at most %d", p, concurrency)
+		}
+	})
+
+	t.Run("Cancellation", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		if rsp, err := loc.Client.Call(ctx, "Stall", nil); err != context.DeadlineExceeded {
+			t.Errorf("Call(Stall): got %v, %v; want %v", rsp, err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestClientReuseID(t *testing.T) {
+	var mu sync.Mutex
+	nextID := `7`
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Test": testOK,
+		"Stall": handler.New(func(context.Context) error {
+			close(started)
+			<-release
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{
+			NewID: func() json.RawMessage {
+				mu.Lock()
+				defer mu.Unlock()
+				return json.RawMessage(nextID)
+			},
+		},
+	})
+	defer loc.Close()
+	setID := func(id string) { mu.Lock(); defer mu.Unlock(); nextID = id }
+
+	// Sequential calls may reuse an ID once the prior response is delivered.
+	// Cancelling the context of a completed call must not affect a later call
+	// that reuses its ID.
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		rsp, err := loc.Client.Call(ctx, "Test", nil)
+		cancel()
+		if err != nil {
+			t.Fatalf("Call %d: unexpected error: %v", i+1, err)
+		} else if got := rsp.ID(); got != "7" {
+			t.Errorf("Call %d: got ID %q, want 7", i+1, got)
+		}
+	}
+
+	// IDs that are not strings or numbers are rejected.
+	setID(`{"bad":true}`)
+	if rsp, err := loc.Client.Call(context.Background(), "Test", nil); err == nil {
+		t.Errorf("Call with object ID: got %v, wanted error", rsp)
+	}
+	setID(`"s"`)
+	if rsp, err := loc.Client.Batch(context.Background(), []jrpc2.Spec{
+		{Method: "Test"}, {Method: "Test"},
+	}); err != jrpc2.ErrDuplicateID {
+		t.Errorf("Batch with repeated ID: got %v, %v; want %v", rsp, err, jrpc2.ErrDuplicateID)
+	}
+
+	// While a request is pending, its ID may not be reused.
+	done := make(chan error, 1)
+	go func() {
+		_, err := loc.Client.Call(context.Background(), "Stall", nil)
+		done <- err
+	}()
+	<-started
+	if rsp, err := loc.Client.Call(context.Background(), "Test", nil); err != jrpc2.ErrDuplicateID {
+		t.Errorf("Call with pending ID: got %v, %v; want %v", rsp, err, jrpc2.ErrDuplicateID)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Call(Stall): unexpected error: %v", err)
+	}
+	if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
+		t.Errorf("Call after completion: unexpected error: %v", err)
+	}
+}
+
+type errLogger struct {
+	mu   sync.Mutex
+	errs map[string]error
+}
+
+func (*errLogger) LogRequest(context.Context, *jrpc2.Request) {}
+
+func (e *errLogger) LogResponse(ctx context.Context, rsp *jrpc2.Response) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.errs[jrpc2.InboundRequest(ctx).Method()] = rsp.Error()
+}
+
+// Verify that errors constructed by the server retain the handler's error as
+// their underlying cause, for use by middleware on the server side.
+func TestErrorUnwrap(t *testing.T) {
+	errSentinel := errors.New("the sentinel")
+	elog := &errLogger{errs: make(map[string]error)}
+	loc := server.NewLocal(handler.Map{
+		"Plain": handler.New(func(context.Context) error {
+			return fmt.Errorf("plain: %w", errSentinel)
+		}),
+		"Wrap": handler.New(func(context.Context) error {
+			return jrpc2.WrapError(notAuthorized, errSentinel)
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{RPCLog: elog},
+	})
+	ctx := context.Background()
+	for _, method := range []string{"Plain", "Wrap"} {
+		_, err := loc.Client.Call(ctx, method, nil)
+		if err == nil {
+			t.Errorf("Call(%q): got nil, wanted error", method)
+		} else if errors.Is(err, errSentinel) {
+			t.Errorf("Call(%q): client error %v should not have a cause", method, err)
+		}
+	}
+	loc.Close()
+
+	tests := []struct {
+		method string
+		code   code.Code
+	}{
+		{"Plain", code.SystemError},
+		{"Wrap", notAuthorized},
+	}
+	for _, test := range tests {
+		err := elog.errs[test.method]
+		if !errors.Is(err, errSentinel) {
+			t.Errorf("Server error for %q: %v is not %v", test.method, err, errSentinel)
+		}
+		if !errors.Is(err, test.code.Err()) {
+			t.Errorf("Server error for %q: %v is not %v", test.method, err, test.code.Err())
+		}
+		if errors.Is(err, code.InternalError.Err()) {
+			t.Errorf("Server error for %q: %v should not be %v", test.method, err, code.InternalError.Err())
+		}
+	}
+
+	if err := jrpc2.WrapError(code.InvalidParams, nil); err != nil {
+		t.Errorf("WrapError(nil): got %v, want nil", err)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	type meta struct {
+		Key string `json:"idempotencyKey"`
+	}
+	var calls int32
+	count := handler.New(func(ctx context.Context) (int32, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	})
+	const ttl = 100 * time.Millisecond
+	loc := server.NewLocal(handler.Map{"Count": count, "Other": count}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{EncodeContext: jctx.Encode},
+		Server: &jrpc2.ServerOptions{
+			DecodeContext: jctx.Decode,
+			IdempotencyKey: func(ctx context.Context, _ *jrpc2.Request) string {
+				var m meta
+				jctx.UnmarshalMetadata(ctx, &m)
+				return m.Key
+			},
+			IdempotencyTTL: ttl,
+		},
+	})
+	defer loc.Close()
+
+	call := func(method, key string) int32 {
+		t.Helper()
+		ctx := context.Background()
+		if key != "" {
+			var err error
+			ctx, err = jctx.WithMetadata(ctx, meta{Key: key})
+			if err != nil {
+				t.Fatalf("WithMetadata: %v", err)
+			}
+		}
+		var got int32
+		if err := loc.Client.CallResult(ctx, method, nil, &got); err != nil {
+			t.Fatalf("Call(%q, key=%q): unexpected error: %v", method, key, err)
+		}
+		return got
+	}
+
+	// A retry with the same key gets the same result without a new call.
+	first := call("Count", "k1")
+	if got := call("Count", "k1"); got != first {
+		t.Errorf("Retry with key k1: got %d, want %d", got, first)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Handler calls after retry: got %d, want 1", got)
+	}
+
+	// Other keys, other methods, and requests without a key are not affected.
+	if got := call("Count", "k2"); got == first {
+		t.Errorf("Call with key k2: got cached result %d", got)
+	}
+	if got := call("Other", "k1"); got == first {
+		t.Errorf("Call Other with key k1: got cached result %d", got)
+	}
+	if a, b := call("Count", ""), call("Count", ""); a == b {
+		t.Errorf("Calls without a key: both got %d", a)
+	}
+
+	// Concurrent duplicates run the handler once.
+	before := atomic.LoadInt32(&calls)
+	results := make(chan int32, 5)
+	for i := 0; i < cap(results); i++ {
+		go func() { results <- call("Count", "k3") }()
+	}
+	want := <-results
+	for i := 1; i < cap(results); i++ {
+		if got := <-results; got != want {
+			t.Errorf("Concurrent call with key k3: got %d, want %d", got, want)
+		}
+	}
+	if got := atomic.LoadInt32(&calls) - before; got != 1 {
+		t.Errorf("Handler calls for concurrent duplicates: got %d, want 1", got)
+	}
+
+	// After the retention period, the handler runs again.
+	time.Sleep(ttl + 10*time.Millisecond)
+	if got := call("Count", "k1"); got == first {
+		t.Errorf("Call with key k1 after expiry: got cached result %d", got)
+	}
+
+	if got := loc.Server.ServerInfo().Counter["rpc.deduplicated"]; got != 5 {
+		t.Errorf("Metric rpc.deduplicated: got %d, want 5", got)
+	}
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	var calls int32
+	count := handler.New(func(ctx context.Context) (int32, error) {
+		return atomic.AddInt32(&calls, 1), nil
+	})
+	const ttl = 50 * time.Millisecond
+	store := jrpc2.NewDedupStore(ttl)
+	newLocal := func() server.Local {
+		return server.NewLocal(handler.Map{"Count": count}, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{
+				IdempotencyKey: func(context.Context, *jrpc2.Request) string {
+					return "key"
+				},
+				IdempotencyStore: store,
+			},
+		})
+	}
+
+	// A request retried on another connection is answered from the store
+	// shared by the servers.
+	loc1, loc2 := newLocal(), newLocal()
+	defer loc1.Close()
+	defer loc2.Close()
+	var first, second int32
+	ctx := context.Background()
+	if err := loc1.Client.CallResult(ctx, "Count", nil, &first); err != nil {
+		t.Fatalf("Call(Count) on the first server: %v", err)
+	}
+	if err := loc2.Client.CallResult(ctx, "Count", nil, &second); err != nil {
+		t.Fatalf("Call(Count) on the second server: %v", err)
+	}
+	if second != first {
+		t.Errorf("Retry on the second server: got %d, want %d", second, first)
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("Handler calls: got %d, want 1", got)
+	}
+	if n := store.Len(); n != 1 {
+		t.Errorf("Store length: got %d, want 1", n)
+	}
+	if got := loc2.Server.ServerInfo().Counter["rpc.deduplicated"]; got != 1 {
+		t.Errorf("Metric rpc.deduplicated on the second server: got %d, want 1", got)
+	}
+
+	// The results expire after the retention period of the store.
+	time.Sleep(ttl + 10*time.Millisecond)
+	if n := store.Len(); n != 0 {
+		t.Errorf("Store length after expiry: got %d, want 0", n)
+	}
+}
+
+func TestReservedErrorCodes(t *testing.T) {
+	h := handler.Map{
+		"Reserved": handler.New(func(context.Context) error {
+			return jrpc2.Errorf(-32001, "future built-in")
+		}),
+		"Defined": handler.New(func(context.Context) error {
+			return jrpc2.Errorf(code.InvalidParams, "bad params")
+		}),
+		"Denied": handler.New(func(context.Context) error {
+			return code.Unauthorized.Err()
+		}),
+		"Busy": handler.New(func(context.Context) error {
+			return code.Overloaded.Err()
+		}),
+	}
+	tests := []struct {
+		strict   bool
+		method   string
+		want     code.Code
+		wantWarn bool
+	}{
+		{false, "Reserved", -32001, true},
+		{false, "Defined", code.InvalidParams, false},
+		{true, "Reserved", code.InternalError, true},
+		{true, "Defined", code.InvalidParams, false},
+		{true, "Denied", code.Unauthorized, false},
+		{true, "Busy", code.Overloaded, false},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		loc := server.NewLocal(h, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{
+				Logger:           log.New(&buf, "", 0),
+				StrictErrorCodes: test.strict,
+			},
+		})
+		_, err := loc.Client.Call(context.Background(), test.method, nil)
+		loc.Close()
+		if got := code.FromError(err); got != test.want {
+			t.Errorf("Call(%q) strict=%v: got code %v, want %v", test.method, test.strict, got, test.want)
+		}
+		warned := strings.Contains(buf.String(), "reserved error code")
+		if warned != test.wantWarn {
+			t.Errorf("Call(%q) strict=%v: warning logged %v, want %v", test.method, test.strict, warned, test.wantWarn)
+		}
+	}
+}
+
+func TestClientCloseWait(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	defer close(release)
+	loc := server.NewLocal(handler.Map{
+		"Slow": handler.New(func(ctx context.Context) error {
+			started <- struct{}{}
+			select {
+			case <-ctx.Done():
+			case <-release:
+			}
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 2},
+	})
+	defer loc.Server.Stop()
+
+	errc := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := loc.Client.Call(context.Background(), "Slow", nil)
+			errc <- err
+		}()
+	}
+	<-started
+	<-started
+
+	n, err := loc.Client.CloseWait()
+	if err != nil {
+		t.Errorf("CloseWait: unexpected error: %v", err)
+	}
+	if n != 2 {
+		t.Errorf("CloseWait: got %d abandoned requests, want 2", n)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err == nil {
+			t.Error("Call(Slow): got nil error after close, wanted an error")
+		}
+	}
+
+	// Closing again reports nothing further.
+	if n, err := loc.Client.CloseWait(); n != 0 || err != nil {
+		t.Errorf("CloseWait again: got %d, %v; want 0, nil", n, err)
+	}
+}
+
+func TestErrorEqual(t *testing.T) {
+	tests := []struct {
+		a, b *jrpc2.Error
+		want bool
+	}{
+		{nil, nil, true},
+		{jrpc2.NewError(1, "x", nil), nil, false},
+		{nil, jrpc2.NewError(1, "x", nil), false},
+		{jrpc2.NewError(1, "x", nil), jrpc2.NewError(1, "x", nil), true},
+		{jrpc2.NewError(1, "x", nil), jrpc2.NewError(2, "x", nil), false},
+		{jrpc2.NewError(1, "x", nil), jrpc2.NewError(1, "y", nil), false},
+		{jrpc2.NewError(1, "x", json.RawMessage(`[1, 2]`)),
+			jrpc2.NewError(1, "x", json.RawMessage(`[1,2]`)), true},
+		{jrpc2.NewError(1, "x", json.RawMessage(`[1,2]`)),
+			jrpc2.NewError(1, "x", json.RawMessage(`[2,1]`)), false},
+		{jrpc2.NewError(1, "x", json.RawMessage(`null`)), jrpc2.NewError(1, "x", nil), false},
+	}
+	for _, test := range tests {
+		if got := jrpc2.ErrorEqual(test.a, test.b); got != test.want {
+			t.Errorf("ErrorEqual(%v, %v): got %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+
+	// Errors received from a server compare equal to expected values.
+	loc := server.NewLocal(handler.Map{
+		"Fail": handler.New(func(context.Context) error {
+			return jrpc2.DataErrorf(-29000, map[string]int{"limit": 5}, "over the limit")
+		}),
+	}, nil)
+	defer loc.Close()
+	_, err := loc.Client.Call(context.Background(), "Fail", nil)
+	want := jrpc2.NewError(-29000, "over the limit", json.RawMessage(`{"limit": 5}`))
+	if e, ok := err.(*jrpc2.Error); !ok || !jrpc2.ErrorEqual(e, want) {
+		t.Errorf("Call(Fail): got error %v, want %v", err, want)
+	} else if got := string(e.Data()); got != `{"limit":5}` {
+		t.Errorf("Call(Fail): got data %#q, want %#q", got, `{"limit":5}`)
+	}
+}
+
+func TestErrorRoundTrip(t *testing.T) {
+	tests := []*jrpc2.Error{
+		jrpc2.NewError(0, "", nil),
+		jrpc2.NewError(code.InvalidParams, "bad", nil),
+		jrpc2.NewError(-29000, "with data", json.RawMessage(`{ "a" : [1, 2, "three"] }`)),
+		jrpc2.NewError(-29001, "null data", json.RawMessage(`null`)),
+		jrpc2.NewError(7, "unicode ☃ and \"quotes\"", json.RawMessage(`"s"`)),
+	}
+	for _, want := range tests {
+		bits, err := json.Marshal(want)
+		if err != nil {
+			t.Errorf("Marshal %v: unexpected error: %v", want, err)
+			continue
+		}
+		got := new(jrpc2.Error)
+		if err := json.Unmarshal(bits, got); err != nil {
+			t.Errorf("Unmarshal %#q: unexpected error: %v", bits, err)
+		} else if !jrpc2.ErrorEqual(got, want) {
+			t.Errorf("Round trip of %v via %#q: got %v", want, bits, got)
+		}
+
+		// The encoding is also stable after a second round trip.
+		again, err := json.Marshal(got)
+		if err != nil {
+			t.Errorf("Marshal %v: unexpected error: %v", got, err)
+		} else if !bytes.Equal(again, bits) {
+			t.Errorf("Re-encoding: got %#q, want %#q", again, bits)
+		}
+	}
+}
+
+func TestChildClient(t *testing.T) {
+	// The downstream server stalls until its request is cancelled.
+	downStarted := make(chan struct{})
+	cch, sch := channel.Direct()
+	down := jrpc2.NewServer(handler.Map{
+		"Stall": handler.New(func(ctx context.Context) error {
+			close(downStarted)
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	}, &jrpc2.ServerOptions{Concurrency: 2}).Start(sch)
+	defer down.Stop()
+
+	// The upstream handler forwards to the downstream server with a child
+	// client bound to the inbound request's context.
+	downErr := make(chan error, 1)
+	up := server.NewLocal(handler.Map{
+		"Forward": handler.New(func(ctx context.Context) error {
+			cli := jrpc2.NewChildClient(ctx, cch, nil)
+			defer cli.Close()
+
+			// N.B. Use a background context, so that only the closure of the
+			// child client can abort the call.
+			_, err := cli.Call(context.Background(), "Stall", nil)
+			downErr <- err
+			return err
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 2},
+	})
+	defer up.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	upErr := make(chan error, 1)
+	go func() {
+		_, err := up.Client.Call(ctx, "Forward", nil)
+		upErr <- err
+	}()
+
+	// Cancelling the inbound request aborts the downstream call.
+	<-downStarted
+	cancel()
+	if err := <-upErr; err != context.Canceled {
+		t.Errorf("Call(Forward): got error %v, want %v", err, context.Canceled)
+	}
+	select {
+	case err := <-downErr:
+		if err == nil {
+			t.Error("Downstream call: got nil error, wanted an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Downstream call was not cancelled")
+	}
+}
+
+func TestErrorCodeNames(t *testing.T) {
+	h := handler.Map{
+		"NoData": handler.New(func(context.Context) error {
+			return jrpc2.Errorf(code.InvalidParams, "bad params")
+		}),
+		"Object": handler.New(func(context.Context) error {
+			return jrpc2.DataErrorf(notAuthorized, map[string]int{"uid": 5}, "no")
+		}),
+		"Named": handler.New(func(context.Context) error {
+			return jrpc2.DataErrorf(-29876, map[string]string{"codeName": "mine"}, "no")
+		}),
+		"Array": handler.New(func(context.Context) error {
+			return jrpc2.DataErrorf(code.InternalError, []int{1, 2}, "no")
+		}),
+	}
+	tests := []struct {
+		names  bool
+		method string
+		want   string
+	}{
+		{false, "NoData", ``},
+		{false, "Object", `{"uid":5}`},
+		{true, "NoData", `{"codeName":"invalid parameters"}`},
+		{true, "Object", `{"codeName":"request not authorized","uid":5}`},
+		{true, "Named", `{"codeName":"mine"}`},
+		{true, "Array", `[1,2]`},
+		{true, "NoSuchMethod", `{"codeName":"method not found"}`},
+	}
+	for _, test := range tests {
+		loc := server.NewLocal(h, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{ErrorCodeNames: test.names},
+		})
+		_, err := loc.Client.Call(context.Background(), test.method, nil)
+		loc.Close()
+		e, ok := err.(*jrpc2.Error)
+		if !ok {
+			t.Errorf("Call(%q) names=%v: got %v, want *Error", test.method, test.names, err)
+			continue
+		}
+		if got := string(e.Data()); got != test.want {
+			t.Errorf("Call(%q) names=%v: got data %#q, want %#q", test.method, test.names, got, test.want)
+		}
+	}
+}
+
+func TestBuiltinPrefix(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"rpc.serverInfo": handler.New(func(context.Context) (string, error) {
+			return "application", nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{BuiltinPrefix: "sys."},
+		Client: &jrpc2.ClientOptions{BuiltinPrefix: "sys."},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// The built-in methods are served under the configured prefix.
+	var info jrpc2.ServerInfo
+	if err := loc.Client.CallResult(ctx, "sys.serverInfo", nil, &info); err != nil {
+		t.Fatalf("Call sys.serverInfo failed: %v", err)
+	}
+	if len(info.Methods) != 1 || info.Methods[0] != "rpc.serverInfo" {
+		t.Errorf("sys.serverInfo: got methods %+q, want [rpc.serverInfo]", info.Methods)
+	}
+
+	// Methods with the default prefix go to the assigner.
+	var got string
+	if err := loc.Client.CallResult(ctx, "rpc.serverInfo", nil, &got); err != nil {
+		t.Errorf("Call rpc.serverInfo failed: %v", err)
+	} else if got != "application" {
+		t.Errorf("Call rpc.serverInfo: got %q, want application", got)
+	}
+
+	// Other methods with the configured prefix are reserved.
+	if _, err := loc.Client.Call(ctx, "sys.nonesuch", nil); code.FromError(err) != code.MethodNotFound {
+		t.Errorf("Call sys.nonesuch: got %v, want %v", err, code.MethodNotFound)
+	}
+
+	// The cancel method works only as a notification.
+	if _, err := loc.Client.Call(ctx, "sys.cancel", []int{1}); code.FromError(err) != code.MethodNotFound {
+		t.Errorf("Call sys.cancel: got %v, want %v", err, code.MethodNotFound)
+	}
+	if err := loc.Client.Notify(ctx, "sys.cancel", []int{1}); err != nil {
+		t.Errorf("Notify sys.cancel: %v", err)
+	}
+
+	// The wrappers for the built-in methods use the prefix of the client.
+	if si, err := jrpc2.RPCServerInfo(ctx, loc.Client); err != nil {
+		t.Errorf("RPCServerInfo: unexpected error: %v", err)
+	} else if len(si.Methods) != 1 || si.Methods[0] != "rpc.serverInfo" {
+		t.Errorf("RPCServerInfo: got methods %+q, want [rpc.serverInfo]", si.Methods)
+	}
+	mods := server.NewLocal(handler.ServiceMap{
+		"Math": handler.Map{"Add": testOK},
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{BuiltinPrefix: "sys."},
+		Client: &jrpc2.ClientOptions{BuiltinPrefix: "sys."},
+	})
+	defer mods.Close()
+	if got, err := jrpc2.RPCModules(ctx, mods.Client); err != nil {
+		t.Errorf("RPCModules: unexpected error: %v", err)
+	} else if diff := cmp.Diff(map[string][]string{"Math": {"Add"}}, got); diff != "" {
+		t.Errorf("RPCModules (-want, +got):\n%s", diff)
+	}
+}
+
+func TestClientBuiltinPrefix(t *testing.T) {
+	cancelled := make(chan json.RawMessage, 1)
+	loc := server.NewLocal(handler.Map{
+		"Stall": handler.New(func(context.Context) error {
+			select {
+			case <-cancelled:
+			case <-time.After(10 * time.Second): // shouldn't happen
+				t.Error("Timeout waiting for cancellation")
+			}
+			return nil
+		}),
+
+		// With builtins disabled, the server passes the cancellation through
+		// to this handler, so we can see where the client sent it.
+		"sys.cancel": handler.New(func(_ context.Context, ids json.RawMessage) error {
+			cancelled <- ids
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{DisableBuiltin: true, Concurrency: 2},
+		Client: &jrpc2.ClientOptions{BuiltinPrefix: "sys."},
+	})
+	defer loc.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := loc.Client.Call(ctx, "Stall", nil); err != context.DeadlineExceeded {
+		t.Errorf("Stall: got error %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	var ran int32
+	loc := server.NewLocal(handler.Map{
+		"Run": handler.New(func(context.Context) error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{PauseLimit: 5},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// Calls issued while the server is paused do not run.
+	loc.Server.Pause()
+	const numCalls = 5
+	errc := make(chan error, numCalls)
+	for i := 0; i < numCalls; i++ {
+		go func() {
+			_, err := loc.Client.Call(ctx, "Run", nil)
+			errc <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&ran); n != 0 {
+		t.Errorf("While paused: %d calls ran, want 0", n)
+	}
+
+	// Once resumed, all the waiting calls run.
+	loc.Server.Resume()
+	for i := 0; i < numCalls; i++ {
+		if err := <-errc; err != nil {
+			t.Errorf("Call failed: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&ran); n != numCalls {
+		t.Errorf("After resume: %d calls ran, want %d", n, numCalls)
+	}
+
+	// Built-in methods bypass the pause, but other calls still wait.
+	loc.Server.Pause()
+	if _, err := jrpc2.RPCServerInfo(ctx, loc.Client); err != nil {
+		t.Errorf("rpc.serverInfo while paused: %v", err)
+	}
+	go func() {
+		_, err := loc.Client.Call(ctx, "Run", nil)
+		errc <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	if n := atomic.LoadInt32(&ran); n != numCalls {
+		t.Errorf("While paused: %d calls ran, want %d", n, numCalls)
+	}
+	loc.Server.Resume()
+	if err := <-errc; err != nil {
+		t.Errorf("Call failed: %v", err)
+	}
+}
+
+// Verify that a paused server with a full buffer rejects further calls, but
+// still answers calls to the built-in methods.
+func TestPauseLimit(t *testing.T) {
+	var ran int32
+	loc := server.NewLocal(handler.Map{
+		"Run": handler.New(func(context.Context) error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{PauseLimit: 1},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	loc.Server.Pause()
+	held := loc.Client.CallAsync(ctx, "Run", nil)
+	for loc.Server.ServerInfo().Counter["rpc.requests"] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The buffer is full, so the next call is rejected.
+	_, err := loc.Client.Call(ctx, "Run", nil)
+	if got := code.FromError(err); got != code.Overloaded {
+		t.Errorf("Call while full: got error %v, want code %v", err, code.Overloaded)
+	}
+
+	// Built-in methods are still read and answered.
+	tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if _, err := jrpc2.RPCServerInfo(tctx, loc.Client); err != nil {
+		t.Errorf("rpc.serverInfo while full: %v", err)
+	}
+	if n := atomic.LoadInt32(&ran); n != 0 {
+		t.Errorf("While paused: %d calls ran, want 0", n)
+	}
+
+	loc.Server.Resume()
+	if _, err := held.Await(ctx); err != nil {
+		t.Errorf("Held call: unexpected error: %v", err)
+	}
+	if n := atomic.LoadInt32(&ran); n != 1 {
+		t.Errorf("After resume: %d calls ran, want 1", n)
+	}
+}
+
+// Verify that draining a paused server finishes the calls it holds.
+func TestDrainPaused(t *testing.T) {
+	loc := server.NewLocal(handler.Map{"Test": testOK}, nil)
+	defer loc.Client.Close()
+	ctx := context.Background()
+
+	loc.Server.Pause()
+	held := loc.Client.CallAsync(ctx, "Test", nil)
+	for loc.Server.ServerInfo().Counter["rpc.requests"] == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	dctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := loc.Server.Drain(dctx); err != nil {
+		t.Errorf("Drain: unexpected error: %v", err)
+	}
+	if _, err := held.Await(ctx); err != nil {
+		t.Errorf("Held call: unexpected error: %v", err)
+	}
+}
+
+func TestOnOrphanResponse(t *testing.T) {
+	cch, sch := channel.Direct()
+	got := make(chan *jrpc2.Response, 2)
+	cli := jrpc2.NewClient(cch, &jrpc2.ClientOptions{
+		OnOrphanResponse: func(rsp *jrpc2.Response) { got <- rsp },
+	})
+	defer func() { sch.Close(); cli.Close() }()
+
+	// Inject responses for requests the client never issued.
+	if err := sch.Send([]byte(`{"jsonrpc":"2.0","id":"bogus","result":[1,2]}`)); err != nil {
+		t.Fatalf("Send result: %v", err)
+	}
+	if err := sch.Send([]byte(`{"jsonrpc":"2.0","id":99,"error":{"code":-32603,"message":"oops"}}`)); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+
+	for _, want := range []struct {
+		id, result string
+		code       code.Code
+	}{
+		{`"bogus"`, `[1,2]`, code.NoError},
+		{`99`, ``, code.InternalError},
+	} {
+		select {
+		case rsp := <-got:
+			if rsp.ID() != want.id {
+				t.Errorf("Orphan ID: got %s, want %s", rsp.ID(), want.id)
+			}
+			if r := rsp.ResultString(); r != want.result {
+				t.Errorf("Orphan result: got %#q, want %#q", r, want.result)
+			}
+			c := code.NoError
+			if e := rsp.Error(); e != nil {
+				c = e.Code()
+			}
+			if c != want.code {
+				t.Errorf("Orphan error: got code %v, want %v", c, want.code)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for orphan response")
+		}
+	}
+}
+
+// Verify that the orphan hook may use the client without deadlocking.
+func TestOnOrphanResponseReentrant(t *testing.T) {
+	cch, sch := channel.Direct()
+	done := make(chan error, 1)
+	var cli *jrpc2.Client
+	cli = jrpc2.NewClient(cch, &jrpc2.ClientOptions{
+		OnOrphanResponse: func(rsp *jrpc2.Response) {
+			err := cli.Notify(context.Background(), "Orphan", []string{rsp.ID()})
+			cli.Close()
+			done <- err
+		},
+	})
+
+	if err := sch.Send([]byte(`{"jsonrpc":"2.0","id":"bogus","result":null}`)); err != nil {
+		t.Fatalf("Send result: %v", err)
+	}
+	bits, err := sch.Recv()
+	if err != nil {
+		t.Fatalf("Recv notification: %v", err)
+	}
+	const want = `{"jsonrpc":"2.0","method":"Orphan","params":["\"bogus\""]}`
+	if got := string(bits); got != want {
+		t.Errorf("Notification: got %#q, want %#q", got, want)
+	}
+	sch.Close() // let the client's Close finish
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Notify from hook: unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the orphan hook")
+	}
+}
+
+func TestStrictParams(t *testing.T) {
+	type params struct {
+		A string `json:"alpha"`
+		B int    `json:"bravo"`
+	}
+	h := handler.Map{
+		"Test": handler.New(func(_ context.Context, p params) (string, error) {
+			return fmt.Sprintf("%s/%d", p.A, p.B), nil
+		}),
+	}
+	tests := []struct {
+		strict bool
+		params interface{}
+		want   string
+		code   code.Code
+	}{
+		{false, handler.Obj{"alpha": "a", "bravo": 1}, "a/1", code.NoError},
+		{false, handler.Obj{"alpha": "a", "bravo": 1, "charlie": 2}, "a/1", code.NoError},
+		{true, handler.Obj{"alpha": "a", "bravo": 1}, "a/1", code.NoError},
+		{true, handler.Obj{"alpha": "a"}, "a/0", code.NoError},
+		{true, handler.Obj{"alpha": "a", "bravo": 1, "charlie": 2}, "", code.InvalidParams},
+	}
+	for _, test := range tests {
+		loc := server.NewLocal(h, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{StrictParams: test.strict},
+		})
+		var got string
+		err := loc.Client.CallResult(context.Background(), "Test", test.params, &got)
+		loc.Close()
+		if c := code.FromError(err); c != test.code {
+			t.Errorf("Call(%v) strict=%v: got error %v, want code %v", test.params, test.strict, err, test.code)
+		} else if got != test.want {
+			t.Errorf("Call(%v) strict=%v: got %q, want %q", test.params, test.strict, got, test.want)
+		}
+	}
+}
+
+func TestStrictFieldsDecode(t *testing.T) {
+	reqs, err := jrpc2.ParseRequests([]byte(`{"jsonrpc":"2.0","id":1,"method":"M","params":{"a":1,"b":2}}`))
+	if err != nil {
+		t.Fatalf("ParseRequests: %v", err)
+	}
+	var v struct {
+		A int `json:"a"`
+		B int `json:"b"`
+	}
+	if err := reqs[0].UnmarshalParams(jrpc2.StrictFields(&v)); err != nil {
+		t.Fatalf("UnmarshalParams: unexpected error: %v", err)
+	} else if v.A != 1 || v.B != 2 {
+		t.Errorf("UnmarshalParams: got %+v, want {A:1 B:2}", v)
+	}
+}
+
+// Verify that the metric keys defined by the server can be listed.
+func TestMetricsKeys(t *testing.T) {
+	m := metrics.New()
+	m.SetLabel("version", "1.0")
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(context.Context) error { return nil }),
+	}, &server.LocalOptions{Server: &jrpc2.ServerOptions{Metrics: m}})
+	if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
+		t.Fatalf("Call(Test) failed: %v", err)
+	}
+	if _, err := loc.Client.Call(context.Background(), "Nonesuch", nil); err == nil {
+		t.Fatal("Call(Nonesuch): got nil, want error")
+	}
+	loc.Close()
+
+	keys := make(map[string]bool)
+	for _, key := range m.Keys() {
+		keys[key] = true
+	}
+	for _, want := range []string{"rpc.requests", "rpc.bytesRead", "rpc.bytesWritten", "rpc.errors", "version"} {
+		if !keys[want] {
+			t.Errorf("Keys: missing %q (got %q)", want, m.Keys())
+		}
+	}
+
+	kinds := make(map[metrics.Key]bool)
+	for _, key := range m.TypedKeys() {
+		kinds[key] = true
+	}
+	for _, want := range []metrics.Key{
+		{Name: "rpc.requests", Kind: metrics.Counter},
+		{Name: "rpc.bytesRead", Kind: metrics.Counter},
+		{Name: "rpc.bytesRead", Kind: metrics.MaxValue},
+		{Name: "version", Kind: metrics.Label},
+	} {
+		if !kinds[want] {
+			t.Errorf("TypedKeys: missing %s %q", want.Kind, want.Name)
+		}
+	}
+	if kinds[metrics.Key{Name: "rpc.requests", Kind: metrics.MaxValue}] {
+		t.Error("TypedKeys: unexpected maxValue rpc.requests")
+	}
+
+	var nilM *metrics.M
+	if got := nilM.Keys(); got != nil {
+		t.Errorf("Keys of nil: got %q, want nil", got)
+	}
+}
+
+// Verify that numeric request IDs are preserved exactly by the client and the
+// server, including integers that cannot be represented as a float64.
+func TestLargeIntegerID(t *testing.T) {
+	const bigID = `9007199254740993` // 2^53 + 1
+	hugeID := strings.Repeat("9", 400)
+
+	echoID := handler.New(func(ctx context.Context) (string, error) {
+		return jrpc2.InboundRequest(ctx).ID(), nil
+	})
+
+	t.Run("Server", func(t *testing.T) {
+		cch, sch := channel.Direct()
+		srv := jrpc2.NewServer(handler.Map{"ID": echoID}, nil).Start(sch)
+		defer func() { cch.Close(); srv.Wait() }()
+
+		for _, id := range []string{bigID, "-" + bigID, hugeID} {
+			req := `{"jsonrpc":"2.0","id":` + id + `,"method":"ID"}`
+			if err := cch.Send([]byte(req)); err != nil {
+				t.Fatalf("Send %#q failed: %v", req, err)
+			}
+			raw, err := cch.Recv()
+			if err != nil {
+				t.Fatalf("Recv failed: %v", err)
+			}
+			want := `{"jsonrpc":"2.0","id":` + id + `,"result":"` + id + `"}`
+			if got := string(raw); got != want {
+				t.Errorf("Call with ID %s: got %#q, want %#q", id, got, want)
+			}
+		}
+	})
+
+	t.Run("Client", func(t *testing.T) {
+		var mu sync.Mutex
+		var nextID string
+		loc := server.NewLocal(handler.Map{"ID": echoID}, &server.LocalOptions{
+			Client: &jrpc2.ClientOptions{
+				NewID: func() json.RawMessage {
+					mu.Lock()
+					defer mu.Unlock()
+					return json.RawMessage(nextID)
+				},
+			},
+		})
+		defer loc.Close()
+
+		for _, id := range []string{bigID, hugeID} {
+			mu.Lock()
+			nextID = id
+			mu.Unlock()
+			rsp, err := loc.Client.Call(context.Background(), "ID", nil)
+			if err != nil {
+				t.Fatalf("Call with ID %s: unexpected error: %v", id, err)
+			}
+			var got string
+			if err := rsp.UnmarshalResult(&got); err != nil {
+				t.Fatalf("UnmarshalResult: %v", err)
+			}
+			if got != id {
+				t.Errorf("Server saw ID %s, want %s", got, id)
+			}
+			if rsp.ID() != id {
+				t.Errorf("Response ID: got %s, want %s", rsp.ID(), id)
+			}
+		}
+	})
+}
+
+// Verify that the client rejects array parameters when ForceObjectParams is set.
+func TestForceObjectParams(t *testing.T) {
+	var calls int32
+	loc := server.NewLocal(handler.Map{
+		"Test": handler.New(func(ctx context.Context, req *jrpc2.Request) (string, error) {
+			atomic.AddInt32(&calls, 1)
+			return req.ParamString(), nil
+		}),
+	}, &server.LocalOptions{
+		Client: &jrpc2.ClientOptions{ForceObjectParams: true},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// Object and absent parameters are sent as usual.
+	for _, params := range []interface{}{nil, map[string]int{"x": 1}, struct{ Y bool }{true}} {
+		if _, err := loc.Client.Call(ctx, "Test", params); err != nil {
+			t.Errorf("Call(Test, %v): unexpected error: %v", params, err)
+		}
+	}
+
+	// Array parameters are rejected without sending.
+	checkErr := func(what string, err error) {
+		t.Helper()
+		if code.FromError(err) != code.InvalidRequest {
+			t.Errorf("%s: got %v, want code %v", what, err, code.InvalidRequest)
+		}
+	}
+	_, err := loc.Client.Call(ctx, "Test", []int{1, 2})
+	checkErr("Call with array", err)
+	checkErr("Notify with array", loc.Client.Notify(ctx, "Test", []string{"a"}))
+	_, err = loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Test", Params: map[string]int{"ok": 1}},
+		{Method: "Test", Params: handler.Args{1, 2}},
+	})
+	checkErr("Batch with array", err)
+
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("Server got %d calls, want 3", n)
+	}
+}
+
+// Verify that the OnParseError hook is called for messages that cannot be
+// parsed, and not for valid requests.
+func TestOnParseError(t *testing.T) {
+	type parseErr struct {
+		raw  string
+		code code.Code
+	}
+	got := make(chan parseErr, 4)
+	cch, sch := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{"Test": testOK}, &jrpc2.ServerOptions{
+		OnParseError: func(raw []byte, err error) {
+			got <- parseErr{string(raw), code.FromError(err)}
+		},
+	}).Start(sch)
+	defer func() { cch.Close(); srv.Wait() }()
+
+	tests := []struct {
+		input string
+		fires bool
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"Test"}`, false},
+		{`{"bogus"][++`, true},
+		{`[{"jsonrpc":"2.0","id":2,"method":"Test"}, garbage]`, true},
+		{`{"jsonrpc":"1.0","id":3,"method":"Test"}`, false}, // invalid, but parsed
+	}
+	for _, test := range tests {
+		if err := cch.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		if _, err := cch.Recv(); err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		select {
+		case pe := <-got:
+			if !test.fires {
+				t.Errorf("Input %#q: unexpected hook call %+v", test.input, pe)
+			} else if pe.raw != test.input || pe.code != code.ParseError {
+				t.Errorf("Input %#q: hook got %#q, %v; want the input and %v",
+					test.input, pe.raw, pe.code, code.ParseError)
+			}
+		default:
+			if test.fires {
+				t.Errorf("Input %#q: hook was not called", test.input)
+			}
+		}
+	}
+}
+
+// sendGate is a channel whose Send reports each message on a Go channel
+// before sending it, so that a test can tell when a send has started.
+type sendGate struct {
+	channel.Channel
+	sent chan<- string
+}
+
+func (g sendGate) Send(msg []byte) error {
+	g.sent <- string(msg)
+	return g.Channel.Send(msg)
+}
+
+// Verify that the push queue buffers notifications for a slow client, and
+// applies the overflow policies.
+func TestPushQueue(t *testing.T) {
+	note := func(n int) string { return fmt.Sprintf(`{"jsonrpc":"2.0","method":"N","params":[%d]}`, n) }
+	tests := []struct {
+		policy jrpc2.PushPolicy
+		errs   []error  // errors from Notify for notifications 2-4
+		want   []string // notifications received after 1
+	}{
+		{jrpc2.PushDropNewest, []error{nil, nil, jrpc2.ErrPushOverflow}, []string{note(2), note(3)}},
+		{jrpc2.PushDropOldest, []error{nil, nil, nil}, []string{note(3), note(4)}},
+		{jrpc2.PushBlock, []error{nil, nil, context.DeadlineExceeded}, []string{note(2), note(3)}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy.String(), func(t *testing.T) {
+			m := metrics.New()
+			sent := make(chan string, 10)
+			cch, sch := channel.Direct()
+			srv := jrpc2.NewServer(handler.Map{}, &jrpc2.ServerOptions{
+				AllowPush:    true,
+				PushQueue:    2,
+				PushOverflow: test.policy,
+				Metrics:      m,
+			}).Start(sendGate{sch, sent})
+			ctx := context.Background()
+
+			// The first notification is taken by the sender, which then blocks
+			// because the client is not reading.
+			if err := srv.Notify(ctx, "N", []int{1}); err != nil {
+				t.Fatalf("Notify 1: unexpected error: %v", err)
+			}
+			<-sent
+
+			// The next two fill the queue, and the last overflows.
+			for i, want := range test.errs {
+				nctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+				err := srv.Notify(nctx, "N", []int{i + 2})
+				cancel()
+				if err != want {
+					t.Errorf("Notify %d: got error %v, want %v", i+2, err, want)
+				}
+			}
+
+			// Unblock the client and check what it receives.
+			for i, want := range append([]string{note(1)}, test.want...) {
+				got, err := cch.Recv()
+				if err != nil {
+					t.Fatalf("Recv %d: %v", i+1, err)
+				} else if string(got) != want {
+					t.Errorf("Recv %d: got %#q, want %#q", i+1, got, want)
+				}
+			}
+
+			cch.Close()
+			if err := srv.Wait(); err != nil {
+				t.Errorf("Server wait: unexpected error: %v", err)
+			}
+
+			snap := metrics.Snapshot{Counter: make(map[string]int64)}
+			m.Snapshot(snap)
+			if got := snap.Counter["rpc.pushOverflow"]; got != 1 {
+				t.Errorf("rpc.pushOverflow: got %d, want 1", got)
+			}
+			if got := snap.Counter["rpc.notifications"]; got != 3 {
+				t.Errorf("rpc.notifications: got %d, want 3", got)
+			}
+		})
+	}
+}
+
+// Verify that a notification blocked on a slow client does not stall the
+// handling of a concurrent call.
+func TestPushQueueNoStall(t *testing.T) {
+	sent := make(chan string, 10)
+	ran := make(chan struct{})
+	cch, sch := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Test": handler.New(func(ctx context.Context) string {
+			close(ran)
+			return "ok"
+		}),
+	}, &jrpc2.ServerOptions{
+		AllowPush: true,
+		PushQueue: 1,
+	}).Start(sendGate{sch, sent})
+	defer func() { cch.Close(); srv.Wait() }()
+
+	// The sender takes the notification, and blocks because the client is
+	// not reading.
+	if err := srv.Notify(context.Background(), "N", nil); err != nil {
+		t.Fatalf("Notify: unexpected error: %v", err)
+	}
+	<-sent
+
+	// The call is read and handled while the notification is blocked.
+	if err := cch.Send([]byte(`{"jsonrpc":"2.0","id":1,"method":"Test"}`)); err != nil {
+		t.Fatalf("Send call: %v", err)
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the handler; the server is stalled")
+	}
+	if got := len(srv.Inflight()); got > 1 {
+		t.Errorf("Inflight: got %d requests, want at most 1", got)
+	}
+
+	// Once the client reads, it receives the notification and the response.
+	for i, want := range []string{
+		`{"jsonrpc":"2.0","method":"N"}`,
+		`{"jsonrpc":"2.0","id":1,"result":"ok"}`,
+	} {
+		got, err := cch.Recv()
+		if err != nil {
+			t.Fatalf("Recv %d: %v", i+1, err)
+		} else if string(got) != want {
+			t.Errorf("Recv %d: got %#q, want %#q", i+1, got, want)
+		}
+	}
+}
+
+// Verify that the raw encoding of a request is available to the CheckRequest
+// hook and to the handler.
+func TestRawRequest(t *testing.T) {
+	checked := make(chan string, 4)
+	cch, sch := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Raw": handler.New(func(ctx context.Context) (string, error) {
+			return string(jrpc2.RawRequest(ctx)), nil
+		}),
+	}, &jrpc2.ServerOptions{
+		CheckRequest: func(ctx context.Context, req *jrpc2.Request) error {
+			checked <- string(jrpc2.RawRequest(ctx))
+			return nil
+		},
+	}).Start(sch)
+	defer func() { cch.Close(); srv.Wait() }()
+
+	if got := jrpc2.RawRequest(context.Background()); got != nil {
+		t.Errorf("RawRequest(background): got %#q, want nil", got)
+	}
+
+	tests := []struct {
+		input string
+		want  []string // the raw requests, in order of ID
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"Raw"}`,
+			[]string{`{"jsonrpc":"2.0","id":1,"method":"Raw"}`}},
+		{`{ "method" : "Raw",  "id":2, "jsonrpc":"2.0" }`,
+			[]string{`{ "method" : "Raw",  "id":2, "jsonrpc":"2.0" }`}},
+		{`[{"jsonrpc":"2.0","id":3,"method":"Raw"},
+		   { "id": 4, "method": "Raw", "jsonrpc": "2.0" }]`,
+			[]string{
+				`{"jsonrpc":"2.0","id":3,"method":"Raw"}`,
+				`{ "id": 4, "method": "Raw", "jsonrpc": "2.0" }`,
+			}},
+	}
+	for _, test := range tests {
+		if err := cch.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		rsp, err := cch.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		var results []struct {
+			ID     int    `json:"id"`
+			Result string `json:"result"`
+		}
+		if rsp[0] != '[' {
+			rsp = append(append([]byte("["), rsp...), ']')
+		}
+		if err := json.Unmarshal(rsp, &results); err != nil {
+			t.Fatalf("Decoding response %#q: %v", rsp, err)
+		}
+		sort.Slice(results, func(i, j int) bool { return results[i].ID < results[j].ID })
+
+		var got, gotCheck []string
+		for _, r := range results {
+			got = append(got, r.Result)
+			gotCheck = append(gotCheck, <-checked)
+		}
+		sort.Strings(gotCheck)
+		want := append([]string(nil), test.want...)
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("Input %#q: handler raw requests (-want, +got):\n%s", test.input, diff)
+		}
+		sort.Strings(want)
+		if diff := cmp.Diff(want, gotCheck); diff != "" {
+			t.Errorf("Input %#q: check raw requests (-want, +got):\n%s", test.input, diff)
+		}
+	}
+}
+
+// Verify that the client and server flush a buffered channel after each
+// message they send, so that calls over buffered channels complete.
+func TestBufferedChannel(t *testing.T) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	framing := channel.Buffered(channel.Line, 0)
+	srv := jrpc2.NewServer(handler.Map{
+		"Test": handler.New(func(ctx context.Context, ss []string) (string, error) {
+			if err := jrpc2.PushNotify(ctx, "note", ss); err != nil {
+				return "", err
+			}
+			return strings.Join(ss, " "), nil
+		}),
+	}, &jrpc2.ServerOptions{AllowPush: true}).Start(framing(sr, sw))
+	notes := make(chan string, 1)
+	cli := jrpc2.NewClient(framing(cr, cw), &jrpc2.ClientOptions{
+		OnNotify: func(req *jrpc2.Request) { notes <- req.Method() },
+	})
+	defer func() { cli.Close(); srv.Wait() }()
+
+	var got string
+	if err := cli.CallResult(context.Background(), "Test", []string{"a", "b"}, &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if got != "a b" {
+		t.Errorf("Call result: got %q, want %q", got, "a b")
+	}
+	if note := <-notes; note != "note" {
+		t.Errorf("Notification: got %q, want %q", note, "note")
+	}
+}
+
+// Verify that one element of a batch can be cancelled by its ID while the
+// other elements of the batch complete normally.
+func TestCancelBatchElement(t *testing.T) {
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	cch, sch := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Block": handler.New(func(ctx context.Context) error {
+			close(started)
+			<-ctx.Done()
+			close(stopped)
+			return ctx.Err()
+		}),
+		"After": handler.New(func(ctx context.Context) (string, error) {
+			<-stopped // wait until Block has been cancelled
+			if err := ctx.Err(); err != nil {
+				return "", err
+			}
+			return "ok", nil
+		}),
+	}, &jrpc2.ServerOptions{Concurrency: 3}).Start(sch) // no spare capacity for rpc.cancel
+	defer func() { cch.Close(); srv.Wait() }()
+
+	if err := cch.Send([]byte(`[
+  {"jsonrpc":"2.0","id":1,"method":"After"},
+  {"jsonrpc":"2.0","id":2,"method":"Block"},
+  {"jsonrpc":"2.0","id":3,"method":"After"}
+]`)); err != nil {
+		t.Fatalf("Send batch: %v", err)
+	}
+	<-started
+	if err := cch.Send([]byte(`{"jsonrpc":"2.0","method":"rpc.cancel","params":[2]}`)); err != nil {
+		t.Fatalf("Send cancel: %v", err)
+	}
+	rsp, err := cch.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	var got []struct {
+		ID     int          `json:"id"`
+		Result string       `json:"result"`
+		Error  *jrpc2.Error `json:"error"`
+	}
+	if err := json.Unmarshal(rsp, &got); err != nil {
+		t.Fatalf("Decoding response %#q: %v", rsp, err)
+	} else if len(got) != 3 {
+		t.Fatalf("Got %d responses, want 3: %#q", len(got), rsp)
+	}
+	for _, r := range got {
+		if r.ID == 2 {
+			if r.Error == nil || r.Error.Code() != code.Cancelled {
+				t.Errorf("Response %d: got %+v, want code %v", r.ID, r, code.Cancelled)
+			}
+		} else if r.Error != nil || r.Result != "ok" {
+			t.Errorf("Response %d: got %+v, want result ok", r.ID, r)
+		}
+	}
+}
+
+// Verify that the client rejects responses whose version marker is present
+// but incorrect, whether or not it tolerates a missing marker.
+func TestClientResponseVersion(t *testing.T) {
+	tests := []struct {
+		version string // the encoded version marker, or "" to omit it
+		allowV1 bool
+		want    string // the expected error message, or "" for success
+	}{
+		{`"2.0"`, false, ""},
+		{`"2.0"`, true, ""},
+		{``, false, "missing version marker"},
+		{``, true, ""},
+		{`"1.0"`, false, `incorrect version marker "1.0"`},
+		{`"1.0"`, true, `incorrect version marker "1.0"`},
+		{`""`, true, `incorrect version marker ""`},
+		{`2`, true, `incorrect version marker 2`},
+		{`null`, true, `incorrect version marker null`},
+		{`["2.0"]`, true, `incorrect version marker ["2.0"]`},
+	}
+	for _, test := range tests {
+		cch, sch := channel.Direct()
+		cli := jrpc2.NewClient(cch, &jrpc2.ClientOptions{AllowV1: test.allowV1})
+		go func() {
+			// A fake server that answers one request with the given marker.
+			req, err := sch.Recv()
+			if err != nil {
+				return
+			}
+			var msg struct {
+				ID json.RawMessage `json:"id"`
+			}
+			json.Unmarshal(req, &msg)
+			rsp := fmt.Sprintf(`{"id":%s,"result":"ok"}`, msg.ID)
+			if test.version != "" {
+				rsp = fmt.Sprintf(`{"jsonrpc":%s,"id":%s,"result":"ok"}`, test.version, msg.ID)
+			}
+			sch.Send([]byte(rsp))
+		}()
+
+		var got string
+		err := cli.CallResult(context.Background(), "Test", nil, &got)
+		if test.want == "" {
+			if err != nil || got != "ok" {
+				t.Errorf("Version %#q (allowV1=%v): got %q, %v; want ok, nil", test.version, test.allowV1, got, err)
+			}
+		} else if err == nil {
+			t.Errorf("Version %#q (allowV1=%v): got %q, want error", test.version, test.allowV1, got)
+		} else if c := code.FromError(err); c != code.InvalidRequest || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Version %#q (allowV1=%v): got error %v, want %v %q", test.version, test.allowV1, err, code.InvalidRequest, test.want)
+		}
+		sch.Close()
+		cli.Close()
+	}
+}
+
+// Verify that requests round-trip through Snapshot and RequestInfo.Request.
+func TestRequestSnapshot(t *testing.T) {
+	tests := []struct {
+		input string
+		want  jrpc2.RequestInfo
+	}{
+		{`{"jsonrpc":"2.0","id":1,"method":"A"}`, jrpc2.RequestInfo{ID: "1", Method: "A"}},
+		{`{"jsonrpc":"2.0","method":"B","params":[1,"two",null]}`, jrpc2.RequestInfo{
+			Method: "B",
+			Params: []interface{}{json.Number("1"), "two", nil},
+		}},
+		{`{"jsonrpc":"2.0","id":"x","method":"C","params":{"n":12345678901234567890,"ok":true}}`, jrpc2.RequestInfo{
+			ID:     `"x"`,
+			Method: "C",
+			Params: map[string]interface{}{"n": json.Number("12345678901234567890"), "ok": true},
+		}},
+	}
+	for _, test := range tests {
+		reqs, err := jrpc2.ParseRequests([]byte(test.input))
+		if err != nil {
+			t.Fatalf("ParseRequests %#q: %v", test.input, err)
+		}
+		snap := reqs[0].Snapshot()
+		if diff := cmp.Diff(test.want, snap); diff != "" {
+			t.Errorf("Snapshot %#q: (-want, +got):\n%s", test.input, diff)
+		}
+
+		req, err := snap.Request()
+		if err != nil {
+			t.Errorf("Request %+v: unexpected error: %v", snap, err)
+			continue
+		}
+		if req.ID() != reqs[0].ID() || req.Method() != reqs[0].Method() ||
+			req.ParamString() != reqs[0].ParamString() || req.IsNotification() != reqs[0].IsNotification() {
+			t.Errorf("Round trip %#q: got %q %q %#q, want %q %q %#q", test.input,
+				req.ID(), req.Method(), req.ParamString(),
+				reqs[0].ID(), reqs[0].Method(), reqs[0].ParamString())
+		}
+	}
+
+	// Invalid IDs are rejected.
+	if req, err := (jrpc2.RequestInfo{ID: "true", Method: "X"}).Request(); err == nil {
+		t.Errorf("Request with ID true: got %+v, want error", req)
+	}
+}
+
+// Verify that NewRequest marshals parameters as a client would.
+func TestNewRequest(t *testing.T) {
+	type point struct {
+		X, Y int
+	}
+	tests := []struct {
+		params interface{}
+		want   string // the encoded parameters
+		ok     bool
+	}{
+		{nil, "", true},
+		{[]int{1, 2}, "[1,2]", true},
+		{point{1, 2}, `{"X":1,"Y":2}`, true},
+		{json.RawMessage(` { "a" : 1 } `), `{"a":1}`, true},
+		{(*point)(nil), "", true}, // null means no parameters
+		{"string", "", false},
+		{17, "", false},
+		{func() {}, "", false},
+	}
+	for _, test := range tests {
+		req, err := jrpc2.NewRequest("M", test.params)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("NewRequest(%v): got %#q, want error", test.params, req.ParamString())
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("NewRequest(%v): unexpected error: %v", test.params, err)
+			continue
+		}
+		if got := req.ParamString(); got != test.want {
+			t.Errorf("NewRequest(%v): got params %#q, want %#q", test.params, got, test.want)
+		}
+		if req.Method() != "M" || !req.IsNotification() {
+			t.Errorf("NewRequest(%v): got method %q, notification %v; want M, true",
+				test.params, req.Method(), req.IsNotification())
+		}
+	}
+}
+
+func TestPeerCred(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skipf("Peer credentials are not supported on %s", runtime.GOOS)
+	}
+	lst, err := net.Listen("unix", filepath.Join(t.TempDir(), "sock"))
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer lst.Close()
+
+	type result struct {
+		UID, GID int
+		OK       bool
+	}
+	peer := handler.New(func(ctx context.Context) result {
+		cred, ok := jrpc2.PeerCred(ctx)
+		if !ok {
+			return result{}
+		}
+		return result{UID: cred.UID, GID: cred.GID, OK: true}
+	})
+	go server.Loop(lst, server.NewStatic(handler.Map{"Peer": peer}), nil)
+
+	conn, err := net.Dial("unix", lst.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	cli := jrpc2.NewClient(channel.RawJSON(conn, conn), nil)
+	defer cli.Close()
+
+	var got result
+	if err := cli.CallResult(context.Background(), "Peer", nil, &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if want := (result{UID: os.Getuid(), GID: os.Getgid(), OK: true}); got != want {
+		t.Errorf("Peer credentials: got %+v, want %+v", got, want)
+	}
+
+	// A server on a connection that is not a Unix socket has no credentials.
+	cpipe, spipe := net.Pipe()
+	srv := jrpc2.NewServer(handler.Map{"Peer": peer}, nil).StartConn(spipe, channel.RawJSON)
+	pcli := jrpc2.NewClient(channel.RawJSON(cpipe, cpipe), nil)
+	defer func() { pcli.Close(); srv.Wait() }()
+
+	if err := pcli.CallResult(context.Background(), "Peer", nil, &got); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	} else if got.OK {
+		t.Errorf("Peer credentials over a pipe: got %+v, want none", got)
+	}
+	if _, ok := jrpc2.PeerCred(context.Background()); ok {
+		t.Error("PeerCred(background) reported credentials")
+	}
+}
+
+func TestCallAsync(t *testing.T) {
+	release := make(map[string]chan struct{})
+	for _, s := range []string{"a", "b", "c", "stall"} {
+		release[s] = make(chan struct{})
+	}
+	loc := server.NewLocal(handler.Map{
+		"Wait": handler.New(func(ctx context.Context, ss []string) (string, error) {
+			s := ss[0]
+			select {
+			case <-release[s]:
+				return strings.ToUpper(s), nil
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}),
+	}, &server.LocalOptions{Server: &jrpc2.ServerOptions{Concurrency: 4}})
+	defer loc.Close()
+
+	ctx := context.Background()
+	ps := make(map[string]*jrpc2.Pending)
+	for _, s := range []string{"a", "b", "c"} {
+		ps[s] = loc.Client.CallAsync(ctx, "Wait", []string{s})
+	}
+
+	// Complete and await the calls in a different order than they were issued.
+	for _, s := range []string{"c", "a", "b"} {
+		close(release[s])
+		rsp, err := ps[s].Await(ctx)
+		if err != nil {
+			t.Fatalf("Await %q: unexpected error: %v", s, err)
+		}
+		var got string
+		if err := rsp.UnmarshalResult(&got); err != nil {
+			t.Errorf("Await %q: invalid result: %v", s, err)
+		} else if want := strings.ToUpper(s); got != want {
+			t.Errorf("Await %q: got %q, want %q", s, got, want)
+		}
+	}
+
+	// Awaiting again reports the same response.
+	if rsp, err := ps["a"].Await(ctx); err != nil || rsp.ResultString() != `"A"` {
+		t.Errorf("Await again: got %v, %v; want A", rsp, err)
+	}
+
+	// Ending the context of Await cancels a call that has not completed.
+	p := loc.Client.CallAsync(ctx, "Wait", []string{"stall"})
+	actx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if rsp, err := p.Await(actx); err != context.DeadlineExceeded {
+		t.Errorf("Await stall: got %v, %v; want %v", rsp, err, context.DeadlineExceeded)
+	}
+
+	// An error sending the request is reported by Await.
+	if rsp, err := loc.Client.CallAsync(ctx, "Wait", make(chan int)).Await(ctx); err == nil {
+		t.Errorf("Await invalid params: got %v, want error", rsp)
+	}
+}
+
+func TestErrorCodeMetrics(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Add": handler.New(func(_ context.Context, vs []int) int { return len(vs) }),
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	if _, err := loc.Client.Call(ctx, "Nonesuch", nil); code.FromError(err) != code.MethodNotFound {
+		t.Errorf("Call(Nonesuch): got %v, want method not found", err)
+	}
+	if _, err := loc.Client.Call(ctx, "Add", handler.Obj{"x": 1}); code.FromError(err) != code.InvalidParams {
+		t.Errorf("Call(Add): got %v, want invalid params", err)
+	}
+	if _, err := loc.Client.Batch(ctx, []jrpc2.Spec{
+		{Method: "Nonesuch"},
+		{Method: "Add", Params: []int{1, 2}},
+		{Method: "Nonesuch", Notify: true}, // no response, not counted
+	}); err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+
+	info := loc.Server.ServerInfo()
+	for name, want := range map[string]int64{
+		"rpc.errors.-32601": 2,
+		"rpc.errors.-32602": 1,
+		"rpc.errors.-32603": 0,
+	} {
+		if got := info.Counter[name]; got != want {
+			t.Errorf("Counter %q: got %d, want %d", name, got, want)
+		}
+	}
+}
+
+// Verify that the server counts calls and errors by method, and that the
+// number of methods counted separately is limited.
+func TestMethodMetrics(t *testing.T) {
+	m := metrics.New()
+	m.SetKeyLimit(2)
+	fail := handler.New(func(context.Context) error { return errors.New("no") })
+	loc := server.NewLocal(handler.Map{
+		"A": testOK,
+		"B": fail,
+		"C": testOK,
+		"D": testOK,
+	}, &server.LocalOptions{Server: &jrpc2.ServerOptions{Metrics: m}})
+	defer loc.Close()
+	ctx := context.Background()
+
+	for _, method := range []string{"A", "A", "B", "C", "D", "B"} {
+		loc.Client.Call(ctx, method, nil)
+	}
+	if err := loc.Client.Notify(ctx, "A", nil); err != nil {
+		t.Errorf("Notify(A): unexpected error: %v", err)
+	}
+	loc.Client.Call(ctx, "Nonesuch", nil) // not counted: no handler
+
+	info := loc.Server.ServerInfo()
+	want := map[string]map[string]int64{
+		"rpc.methodCalls":  {"A": 3, "B": 2, metrics.OtherKey: 2},
+		"rpc.methodErrors": {"B": 2},
+	}
+	if diff := cmp.Diff(want, info.Keyed); diff != "" {
+		t.Errorf("Keyed counters (-want, +got):\n%s", diff)
+	}
+}
+
+// Verify that a snapshot of metrics is a deep copy, and that published
+// metrics are visible through expvar.
+func TestMetricsValues(t *testing.T) {
+	m := metrics.New()
+	m.Count("c", 1)
+	m.SetMaxValue("max", 5)
+	m.SetLabel("label", "a")
+	m.CountBy("keyed", "k", 2)
+
+	snap := m.Values()
+	want := metrics.Snapshot{
+		Counter:      map[string]int64{"c": 1},
+		MaxValue:     map[string]int64{"max": 5},
+		Label:        map[string]interface{}{"label": "a"},
+		KeyedCounter: map[string]map[string]int64{"keyed": {"k": 2}},
+		Gauge:        map[string]int64{},
+		Rate:         map[string]metrics.Rates{},
+		Quantile:     map[string]metrics.Quantiles{},
+	}
+	if diff := cmp.Diff(want, snap); diff != "" {
+		t.Errorf("Values (-want, +got):\n%s", diff)
+	}
+
+	// Later changes do not affect the snapshot, at any depth.
+	m.Count("c", 1)
+	m.Count("d", 1)
+	m.SetMaxValue("max", 10)
+	m.SetLabel("label", nil)
+	m.CountBy("keyed", "k", 1)
+	m.CountBy("keyed", "j", 1)
+	if diff := cmp.Diff(want, snap); diff != "" {
+		t.Errorf("Values after changes (-want, +got):\n%s", diff)
+	}
+
+	// The snapshot has a stable encoding, and is published by expvar.
+	metrics.Publish("jrpc2_test_metrics", m)
+	v := expvar.Get("jrpc2_test_metrics")
+	if v == nil {
+		t.Fatal("Published metrics not found")
+	}
+	const wantJSON = `{"counters":{"c":2,"d":1},"maxValue":{"max":10},"keyed":{"keyed":{"j":1,"k":3}}}`
+	if got := v.String(); got != wantJSON {
+		t.Errorf("Published metrics: got %s, want %s", got, wantJSON)
+	}
+
+	var nilM *metrics.M
+	if got := nilM.Values(); got.Counter == nil || len(got.Counter) != 0 {
+		t.Errorf("Values(nil): got %+v, want empty", got)
+	}
+}
+
+func TestCancelReason(t *testing.T) {
+	t.Run("Wire", func(t *testing.T) {
+		cch, sch := channel.Direct()
+		cli := jrpc2.NewClient(cch, nil)
+		defer func() { sch.Close(); cli.Close() }()
+
+		tests := []struct {
+			reason string
+			want   string
+		}{
+			{"", `{"jsonrpc":"2.0","method":"rpc.cancel","params":[1]}`},
+			{"user hung up", `{"jsonrpc":"2.0","method":"rpc.cancel","params":[2,{"reason":"user hung up"}]}`},
+		}
+		for _, test := range tests {
+			ctx, cancel := context.WithCancel(context.Background())
+			if test.reason != "" {
+				ctx = jrpc2.WithCancelReason(ctx, test.reason)
+			}
+			errc := make(chan error, 1)
+			go func() { _, err := cli.Call(ctx, "Test", nil); errc <- err }()
+
+			if _, err := sch.Recv(); err != nil { // the call
+				t.Fatalf("Recv call: %v", err)
+			}
+			cancel()
+			if err := <-errc; err != context.Canceled {
+				t.Errorf("Call: got error %v, want %v", err, context.Canceled)
+			}
+			got, err := sch.Recv() // the cancellation
+			if err != nil {
+				t.Fatalf("Recv cancel: %v", err)
+			} else if string(got) != test.want {
+				t.Errorf("Cancel notification: got %#q, want %#q", got, test.want)
+			}
+		}
+	})
+
+	t.Run("Server", func(t *testing.T) {
+		if _, ok := jrpc2.CancelCause(context.Background()).(*jrpc2.CancelError); ok {
+			t.Fatal("CancelCause(background) reported a cancellation")
+		}
+		started := make(chan struct{})
+		causes := make(chan error, 1)
+		loc := server.NewLocal(handler.Map{
+			"Stall": handler.New(func(ctx context.Context) error {
+				close(started)
+				<-ctx.Done()
+				causes <- jrpc2.CancelCause(ctx)
+				return ctx.Err()
+			}),
+		}, nil)
+		defer loc.Close()
+
+		ctx, cancel := context.WithCancel(jrpc2.WithCancelReason(context.Background(), "too slow"))
+		go func() { <-started; cancel() }()
+		if _, err := loc.Client.Call(ctx, "Stall", nil); err != context.Canceled {
+			t.Errorf("Call(Stall): got error %v, want %v", err, context.Canceled)
+		}
+		cause := <-causes
+		if e, ok := cause.(*jrpc2.CancelError); ok {
+			if e.Reason != "too slow" {
+				t.Errorf("Cancel reason: got %q, want %q", e.Reason, "too slow")
+			}
+		} else if cause != context.Canceled { // Go versions without causes
+			t.Errorf("CancelCause: got %v, want a *CancelError", cause)
+		}
+
+		// Cancelling an unknown request with a reason, or with a malformed
+		// reason, is harmless.
+		for _, params := range []interface{}{
+			[]interface{}{99, map[string]string{"reason": "x"}},
+			[]interface{}{99, map[string]int{"reason": 1}},
+		} {
+			if err := loc.Client.Notify(context.Background(), "rpc.cancel", params); err != nil {
+				t.Errorf("Notify rpc.cancel %v: %v", params, err)
+			}
+		}
+	})
+}
+
+func TestServerShutdown(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	h := handler.Map{
+		"Slow": handler.New(func(ctx context.Context) (string, error) {
+			started <- struct{}{}
+			select {
+			case <-release:
+				return "done", nil
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}),
+	}
+	newLocal := func(notes chan<- string) server.Local {
+		return server.NewLocal(h, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{AllowPush: true, Concurrency: 2},
+			Client: &jrpc2.ClientOptions{
+				OnNotify: func(req *jrpc2.Request) { notes <- req.Method() },
+			},
+		})
+	}
+
+	t.Run("Finished", func(t *testing.T) {
+		// The client ignores the notification, but the server still stops
+		// once it has answered the call in flight.
+		notes := make(chan string, 1)
+		loc := newLocal(notes)
+		defer loc.Client.Close()
+
+		ctx := context.Background()
+		slow := loc.Client.CallAsync(ctx, "Slow", nil)
+		<-started
+
+		done := make(chan error, 1)
+		go func() { done <- loc.Server.Shutdown(ctx) }()
+		if got := <-notes; got != "rpc.shutdown" {
+			t.Errorf("Notification: got %q, want rpc.shutdown", got)
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("Shutdown returned while a call was in flight: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		release <- struct{}{}
+		if rsp, err := slow.Await(ctx); err != nil {
+			t.Errorf("Call(Slow): unexpected error: %v", err)
+		} else if got := rsp.ResultString(); got != `"done"` {
+			t.Errorf("Call(Slow): got %s, want done", got)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("Shutdown: unexpected error: %v", err)
+		}
+		if stat := loc.Server.WaitStatus(); !stat.Stopped() {
+			t.Errorf("Server status: got %+v, want stopped", stat)
+		}
+	})
+
+	t.Run("GraceExpires", func(t *testing.T) {
+		notes := make(chan string, 1)
+		loc := newLocal(notes)
+		defer loc.Client.Close()
+
+		slow := loc.Client.CallAsync(context.Background(), "Slow", nil)
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := loc.Server.Shutdown(ctx); err != context.DeadlineExceeded {
+			t.Errorf("Shutdown: got error %v, want %v", err, context.DeadlineExceeded)
+		}
+		if got := <-notes; got != "rpc.shutdown" {
+			t.Errorf("Notification: got %q, want rpc.shutdown", got)
+		}
+		if _, err := slow.Await(context.Background()); err == nil {
+			t.Error("Call(Slow): got nil error, want the call to fail")
+		}
+		if stat := loc.Server.WaitStatus(); !stat.Stopped() {
+			t.Errorf("Server status: got %+v, want stopped", stat)
+		}
+	})
+
+	t.Run("NoPush", func(t *testing.T) {
+		loc := server.NewLocal(handler.Map{"Test": testOK}, nil)
+		defer loc.Client.Close()
+		if err := loc.Server.Broadcast("x", nil); err != jrpc2.ErrPushUnsupported {
+			t.Errorf("Broadcast: got %v, want %v", err, jrpc2.ErrPushUnsupported)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := loc.Server.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: unexpected error: %v", err)
+		}
+	})
+}
+
+func TestServerDrain(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	h := handler.Map{
+		"Slow": handler.New(func(ctx context.Context) error {
+			started <- struct{}{}
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}),
+		"Quick": testOK,
+	}
+
+	t.Run("Finished", func(t *testing.T) {
+		loc := server.NewLocal(h, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{Concurrency: 1},
+		})
+		defer loc.Client.Close()
+		ctx := context.Background()
+
+		// The second call waits for the first to release the server.
+		slow := loc.Client.CallAsync(ctx, "Slow", nil)
+		<-started
+		quick := loc.Client.CallAsync(ctx, "Quick", nil)
+		for len(loc.Server.Inflight()) != 2 {
+			time.Sleep(time.Millisecond)
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- loc.Server.Drain(ctx) }()
+		select {
+		case err := <-done:
+			t.Fatalf("Drain returned early: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+		release <- struct{}{}
+		if _, err := slow.Await(ctx); err != nil {
+			t.Errorf("Call(Slow): unexpected error: %v", err)
+		}
+		if _, err := quick.Await(ctx); err != nil {
+			t.Errorf("Call(Quick): unexpected error: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Errorf("Drain: unexpected error: %v", err)
+		}
+		if stat := loc.Server.WaitStatus(); !stat.Stopped() {
+			t.Errorf("Server status: got %+v, want stopped", stat)
+		}
+	})
+
+	t.Run("Forced", func(t *testing.T) {
+		loc := server.NewLocal(h, nil)
+		defer loc.Client.Close()
+		p := loc.Client.CallAsync(context.Background(), "Slow", nil)
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := loc.Server.Drain(ctx); err != context.DeadlineExceeded {
+			t.Errorf("Drain: got %v, want %v", err, context.DeadlineExceeded)
+		}
+		if _, err := p.Await(context.Background()); err == nil {
+			t.Error("Call(Slow): got nil error, want the call to fail")
+		}
+	})
+}
+
+func TestEndedContextSkipsHandler(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	var ran int32
+	loc := server.NewLocal(handler.Map{
+		"Block": handler.New(func(context.Context) error {
+			close(started)
+			<-release
+			return nil
+		}),
+		"Dead": handler.New(func(context.Context) error {
+			atomic.AddInt32(&ran, 1)
+			return nil
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			Concurrency: 1,
+
+			// Simulate a request whose context ended before it was dispatched,
+			// for example because its deadline passed in transit.
+			DecodeContext: func(ctx context.Context, method string, params json.RawMessage) (context.Context, json.RawMessage, error) {
+				if method == "Dead" {
+					ctx, cancel := context.WithDeadline(ctx, time.Now().Add(-time.Second))
+					cancel()
+					return ctx, params, nil
+				}
+				return ctx, params, nil
+			},
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	// Without saturation, the handler does not run.
+	if _, err := loc.Client.Call(ctx, "Dead", nil); code.FromError(err) != code.DeadlineExceeded {
+		t.Errorf("Call(Dead): got %v, want deadline exceeded", err)
+	}
+
+	// With saturation, the request fails without waiting for capacity.
+	blocked := loc.Client.CallAsync(ctx, "Block", nil)
+	<-started
+	if _, err := loc.Client.Call(ctx, "Dead", nil); code.FromError(err) != code.DeadlineExceeded {
+		t.Errorf("Call(Dead) while saturated: got %v, want deadline exceeded", err)
+	}
+	close(release)
+	if _, err := blocked.Await(ctx); err != nil {
+		t.Errorf("Call(Block): unexpected error: %v", err)
+	}
+	if n := atomic.LoadInt32(&ran); n != 0 {
+		t.Errorf("Handler for Dead ran %d times, want 0", n)
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Hold": handler.New(func(ctx context.Context, ss []string) int {
+			started <- struct{}{}
+			<-release
+			return len(ss)
+		}),
+	}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{
+			Concurrency:  4,
+			MemoryBudget: 100,
+		},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	large := []string{strings.Repeat("a", 60)} // 66 bytes as params
+	small := []string{strings.Repeat("b", 20)} // 26 bytes as params
+
+	// The first large request fits the budget; while it is in flight, a
+	// second large request does not, but a small one does.
+	first := loc.Client.CallAsync(ctx, "Hold", large)
+	<-started
+	if _, err := loc.Client.Call(ctx, "Hold", large); code.FromError(err) != code.Overloaded {
+		t.Errorf("Call(large) over budget: got %v, want code %d", err, code.Overloaded)
+	}
+	second := loc.Client.CallAsync(ctx, "Hold", small)
+	<-started
+
+	// Concurrent large requests are rejected while the budget is exhausted,
+	// but built-in methods are not counted.
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := loc.Client.Call(ctx, "Hold", large); code.FromError(err) != code.Overloaded {
+				t.Errorf("Concurrent Call(large): got %v, want code %d", err, code.Overloaded)
+			}
+		}()
+	}
+	wg.Wait()
+	if _, err := loc.Client.Call(ctx, "rpc.serverInfo", nil); err != nil {
+		t.Errorf("Call(rpc.serverInfo): unexpected error: %v", err)
+	}
+
+	// Once the handlers return, their budget is released.
+	close(release)
+	for _, p := range []*jrpc2.Pending{first, second} {
+		if _, err := p.Await(ctx); err != nil {
+			t.Errorf("Held call: unexpected error: %v", err)
+		}
+	}
+	if _, err := loc.Client.Call(ctx, "Hold", large); err != nil {
+		t.Errorf("Call(large) after release: unexpected error: %v", err)
+	}
+
+	// A request larger than the whole budget is always rejected.
+	huge := []string{strings.Repeat("c", 100)}
+	if _, err := loc.Client.Call(ctx, "Hold", huge); code.FromError(err) != code.Overloaded {
+		t.Errorf("Call(huge): got %v, want code %d", err, code.Overloaded)
+	}
+
+	if got := loc.Server.ServerInfo().Counter["rpc.budgetExceeded"]; got != 5 {
+		t.Errorf("rpc.budgetExceeded: got %d, want 5", got)
+	}
+}
+
+func TestInflightGauge(t *testing.T) {
+	// The server reports the number of requests in flight.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	loc := server.NewLocal(handler.Map{
+		"Block": handler.New(func(context.Context) error {
+			close(started)
+			<-release
+			return nil
+		}),
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	inflight := func() int64 { return loc.Server.ServerInfo().Gauge["rpc.inflight"] }
+	if n := inflight(); n != 0 {
+		t.Errorf("rpc.inflight before call: got %d, want 0", n)
+	}
+	p := loc.Client.CallAsync(ctx, "Block", nil)
+	<-started
+	if n := inflight(); n != 1 {
+		t.Errorf("rpc.inflight during call: got %d, want 1", n)
+	}
+	close(release)
+	if _, err := p.Await(ctx); err != nil {
+		t.Fatalf("Call(Block): unexpected error: %v", err)
+	}
+	if n := inflight(); n != 0 {
+		t.Errorf("rpc.inflight after call: got %d, want 0", n)
+	}
+}
+
+func TestGaugesSharedMetrics(t *testing.T) {
+	// Servers that share a collector report their total requests in flight.
+	m := metrics.New()
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	newServer := func() server.Local {
+		return server.NewLocal(handler.Map{
+			"Block": handler.New(func(ctx context.Context) error {
+				started <- struct{}{}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-release:
+					return nil
+				}
+			}),
+		}, &server.LocalOptions{
+			Server: &jrpc2.ServerOptions{Metrics: m},
+		})
+	}
+	loc1, loc2 := newServer(), newServer()
+	defer loc2.Close()
+	ctx := context.Background()
+	inflight := func() int64 { return m.Values().Gauge["rpc.inflight"] }
+
+	p1 := loc1.Client.CallAsync(ctx, "Block", nil)
+	p2 := loc2.Client.CallAsync(ctx, "Block", nil)
+	<-started
+	<-started
+	if n := inflight(); n != 2 {
+		t.Errorf("rpc.inflight with both servers busy: got %d, want 2", n)
+	}
+
+	// Stopping a server releases its share, but does not hide the requests
+	// of the other.
+	loc1.Server.Stop()
+	p1.Await(ctx)
+	loc1.Close()
+	if n := inflight(); n != 1 {
+		t.Errorf("rpc.inflight after first server stopped: got %d, want 1", n)
+	}
+
+	close(release)
+	if _, err := p2.Await(ctx); err != nil {
+		t.Errorf("Call(Block): unexpected error: %v", err)
+	}
+	if n := inflight(); n != 0 {
+		t.Errorf("rpc.inflight after calls: got %d, want 0", n)
+	}
+
+	// Reset leaves the level of the gauge alone.
+	m.Reset()
+	if got, ok := m.Values().Gauge["rpc.inflight"]; !ok || got != 0 {
+		t.Errorf("rpc.inflight after Reset: got %d, %v; want 0, true", got, ok)
+	}
+}
+
+func TestInflight(t *testing.T) {
+	started := make(chan string, 3)
+	release := make(chan struct{})
+	block := handler.New(func(ctx context.Context) error {
+		started <- jrpc2.InboundRequest(ctx).Method()
+		<-release
+		return nil
+	})
+	loc := server.NewLocal(handler.Map{"Alpha": block, "Beta": block, "Gamma": block}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Concurrency: 3},
+	})
+	defer loc.Close()
+	ctx := context.Background()
+
+	if got := loc.Server.Inflight(); len(got) != 0 {
+		t.Errorf("Inflight before calls: got %+v, want empty", got)
+	}
+
+	before := time.Now()
+	alpha := loc.Client.CallAsync(ctx, "Alpha", nil)
+	<-started
+	beta := loc.Client.CallAsync(ctx, "Beta", nil)
+	<-started
+	if err := loc.Client.Notify(ctx, "Gamma", nil); err != nil {
+		t.Fatalf("Notify(Gamma): unexpected error: %v", err)
+	}
+	<-started
+
+	// Read the snapshot while the handlers are blocked. The notification is
+	// not included, since it has no ID.
+	got := loc.Server.Inflight()
+	var methods []string
+	for _, req := range got {
+		methods = append(methods, req.Method)
+		if req.Start.Before(before) || req.Start.After(time.Now()) {
+			t.Errorf("Request %s: start time %v out of range", req.ID, req.Start)
+		}
+	}
+	if diff := cmp.Diff([]string{"Alpha", "Beta"}, methods); diff != "" {
+		t.Errorf("Inflight methods (-want, +got):\n%s", diff)
+	}
+
+	// Once the handlers return, the requests are no longer in flight.
+	close(release)
+	for i, p := range []*jrpc2.Pending{alpha, beta} {
+		rsp, err := p.Await(ctx)
+		if err != nil {
+			t.Errorf("Call: unexpected error: %v", err)
+		} else if i < len(got) && got[i].ID != rsp.ID() {
+			t.Errorf("Inflight ID %d: got %q, want %q", i, got[i].ID, rsp.ID())
+		}
+	}
+	if got := loc.Server.Inflight(); len(got) != 0 {
+		t.Errorf("Inflight after calls: got %+v, want empty", got)
+	}
+}
+
+func TestServerRates(t *testing.T) {
+	// The server marks the rate of requests it receives.
+	now := time.Unix(2000, 0)
+	sm := metrics.New()
+	sm.SetClock(func() time.Time { return now })
+	loc := server.NewLocal(handler.Map{"Test": testOK}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Metrics: sm},
+	})
+	defer loc.Close()
+	for i := 0; i < 4; i++ {
+		if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
+			t.Fatalf("Call(Test): unexpected error: %v", err)
+		}
+	}
+	now = now.Add(time.Second)
+	if got := loc.Server.ServerInfo().Rate["rpc.requests"]; got.Last1s != 4 {
+		t.Errorf("Rate rpc.requests: got %+v, want 4 in the last second", got)
+	}
+}
+
+func TestExpectsReply(t *testing.T) {
+	var gets, logs int32
+	cch, sch := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{
+		"Get": handler.New(func(context.Context) string {
+			atomic.AddInt32(&gets, 1)
+			return "ok"
+		}),
+		"Log": handler.New(func(context.Context) error {
+			atomic.AddInt32(&logs, 1)
+			return nil
+		}),
+	}, &jrpc2.ServerOptions{
+		// Get is never used as a notification.
+		ExpectsReply: func(ctx context.Context, req *jrpc2.Request) bool {
+			return req.Method() == "Get"
+		},
+	}).Start(sch)
+	defer func() { cch.Close(); srv.Wait() }()
+
+	tests := []struct {
+		input, want string
+	}{
+		// A notification for a method that allows them is handled normally.
+		// The call that follows it ensures that it has been handled.
+		{`{"jsonrpc":"2.0","method":"Log"}`, ""},
+		{`{"jsonrpc":"2.0","id":1,"method":"Get"}`, `{"jsonrpc":"2.0","id":1,"result":"ok"}`},
+
+		// A notification for a method that expects a reply is rejected.
+		{`{"jsonrpc":"2.0","method":"Get"}`,
+			`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"missing request id for method \"Get\""}}`},
+
+		// Likewise within a batch, without affecting the other requests.
+		{`[{"jsonrpc":"2.0","method":"Get"},{"jsonrpc":"2.0","method":"Log"},{"jsonrpc":"2.0","id":2,"method":"Get"}]`,
+			`[{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"missing request id for method \"Get\""}},` +
+				`{"jsonrpc":"2.0","id":2,"result":"ok"}]`},
+	}
+	for _, test := range tests {
+		if err := cch.Send([]byte(test.input)); err != nil {
+			t.Fatalf("Send %#q failed: %v", test.input, err)
+		}
+		if test.want == "" {
+			continue
+		}
+		rsp, err := cch.Recv()
+		if err != nil {
+			t.Fatalf("Recv failed: %v", err)
+		}
+		if got := string(rsp); got != test.want {
+			t.Errorf("Input %#q:\n got %#q\nwant %#q", test.input, got, test.want)
+		}
+	}
+
+	if n := atomic.LoadInt32(&gets); n != 2 {
+		t.Errorf("Get handler called %d times, want 2", n)
+	}
+	if n := atomic.LoadInt32(&logs); n != 2 {
+		t.Errorf("Log handler called %d times, want 2", n)
+	}
+	if n := srv.ServerInfo().Counter["rpc.missingID"]; n != 2 {
+		t.Errorf("rpc.missingID: got %d, want 2", n)
+	}
+}
+
+// requestSink is a metrics.Sink that adds up the deltas reported for the
+// counter "rpc.requests".
+type requestSink struct{ requests int64 }
+
+func (s *requestSink) CountDelta(name string, n int64) {
+	if name == "rpc.requests" {
+		atomic.AddInt64(&s.requests, n)
+	}
+}
+
+func (*requestSink) SetMax(string, int64)    {}
+func (*requestSink) Observe(string, float64) {}
+
+func TestServerMetricsSink(t *testing.T) {
+	// The server metrics are mirrored to the sink, and each request is
+	// counted exactly once.
+	sink := new(requestSink)
+	const numCalls = 3
+	sm := metrics.NewWithSink(sink)
+	loc := server.NewLocal(handler.Map{"Test": testOK}, &server.LocalOptions{
+		Server: &jrpc2.ServerOptions{Metrics: sm},
+	})
+	for i := 0; i < numCalls; i++ {
+		if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
+			t.Fatalf("Call(Test): unexpected error: %v", err)
+		}
+	}
+	loc.Close()
+	if requests := atomic.LoadInt64(&sink.requests); requests != numCalls {
+		t.Errorf("Sink count of rpc.requests: got %d, want %d", requests, numCalls)
+	}
+	if got := sm.Values().Counter["rpc.requests"]; got != numCalls {
+		t.Errorf("Counter rpc.requests: got %d, want %d", got, numCalls)
+	}
+}
+
+// failingSender is a channel whose Send fails for messages selected by fail.
+type failingSender struct {
+	channel.Channel
+	fail func([]byte) bool
+}
+
+var errSendFailed = errors.New("send failed")
+
+func (f failingSender) Send(msg []byte) error {
+	if f.fail(msg) {
+		return errSendFailed
+	}
+	return f.Channel.Send(msg)
+}
+
+func TestSendErrorStopsServer(t *testing.T) {
+	cch, sch := channel.Direct()
+	srv := jrpc2.NewServer(handler.Map{"Test": testOK}, &jrpc2.ServerOptions{Concurrency: 2}).Start(failingSender{
+		Channel: sch,
+		fail:    func(msg []byte) bool { return bytes.HasPrefix(msg, []byte("[")) }, // batch replies
+	})
+
+	// A single response is delivered normally.
+	if err := cch.Send([]byte(`{"jsonrpc":"2.0","id":1,"method":"Test"}`)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if rsp, err := cch.Recv(); err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	} else if got, want := string(rsp), `{"jsonrpc":"2.0","id":1,"result":"OK"}`; got != want {
+		t.Errorf("Response: got %#q, want %#q", got, want)
+	}
+
+	// Sending the reply to a batch fails, and the server stops with the error
+	// instead of continuing with replies it cannot deliver.
+	if err := cch.Send([]byte(`[{"jsonrpc":"2.0","id":2,"method":"Test"},{"jsonrpc":"2.0","id":3,"method":"Test"}]`)); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	// The server closes its channel, so the client sees the end of input.
+	if rsp, err := cch.Recv(); err == nil {
+		t.Errorf("Recv after send failure: got %#q, want error", rsp)
+	}
+	cch.Close()
+	if err := srv.Wait(); err != errSendFailed {
+		t.Errorf("Wait: got %v, want %v", err, errSendFailed)
+	}
+	if got := srv.Inflight(); len(got) != 0 {
+		t.Errorf("Inflight after send failure: got %+v, want empty", got)
+	}
+}
+
+func TestLatencyMetric(t *testing.T) {
+	// The server records the latency of requests as selected by its options.
+	for _, lm := range []jrpc2.LatencyMetric{jrpc2.LatencyNone, jrpc2.LatencyHistogram, jrpc2.LatencyQuantiles} {
+		t.Run(lm.String(), func(t *testing.T) {
+			loc := server.NewLocal(handler.Map{"Test": testOK}, &server.LocalOptions{
+				Server: &jrpc2.ServerOptions{Latency: lm},
+			})
+			defer loc.Close()
+			for i := 0; i < 3; i++ {
+				if _, err := loc.Client.Call(context.Background(), "Test", nil); err != nil {
+					t.Fatalf("Call(Test): unexpected error: %v", err)
+				}
+			}
+			// Built-in methods are not recorded.
+			if _, err := jrpc2.RPCServerInfo(context.Background(), loc.Client); err != nil {
+				t.Fatalf("RPCServerInfo: unexpected error: %v", err)
+			}
+
+			info := loc.Server.ServerInfo()
+			var hist int64
+			for _, n := range info.Keyed["rpc.latency"] {
+				hist += n
+			}
+			sketch := info.Quantile["rpc.latency"].Count
+			switch lm {
+			case jrpc2.LatencyNone:
+				if hist != 0 || sketch != 0 {
+					t.Errorf("Latency recorded: histogram %d, sketch %d; want none", hist, sketch)
+				}
+			case jrpc2.LatencyHistogram:
+				if hist != 3 || sketch != 0 {
+					t.Errorf("Latency recorded: histogram %d, sketch %d; want histogram 3", hist, sketch)
+				}
+			case jrpc2.LatencyQuantiles:
+				if hist != 0 || sketch != 3 {
+					t.Errorf("Latency recorded: histogram %d, sketch %d; want sketch 3", hist, sketch)
+				}
+			}
+		})
+	}
+}
+
+func TestCallRaw(t *testing.T) {
+	loc := server.NewLocal(handler.Map{
+		"Add": handler.New(func(_ context.Context, vs []int) int {
+			sum := 0
+			for _, v := range vs {
+				sum += v
+			}
+			return sum
+		}),
+	}, nil)
+	defer loc.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		raw, id, result string
+		code            code.Code
+	}{
+		// Requests that carry their own ID.
+		{`{"jsonrpc":"2.0","id":"x1","method":"Add","params":[1,2]}`, `"x1"`, `3`, code.NoError},
+		{`{"params":[4,5], "method":"Add", "id":7, "jsonrpc":"2.0"}`, `7`, `9`, code.NoError},
+
+		// Requests to which the client assigns an ID.
+		{` { "jsonrpc": "2.0", "method": "Add", "params": [2, 3] } `, `1`, `5`, code.NoError},
+		{`{}`, `2`, ``, code.InvalidRequest},
+
+		// Malformed requests are reported by the server.
+		{`{"jsonrpc":"1.0","id":10,"method":"Add","params":[]}`, ``, ``, code.InvalidRequest},
+		{`{"jsonrpc":"2.0","id":11,"method":"Add","params":[1],"extra":true}`, ``, ``, code.InvalidRequest},
+		{`{"jsonrpc":"2.0","id":12,"method":"Add","params":"bogus"}`, ``, ``, code.InvalidRequest},
+		{`{"jsonrpc":"2.0","id":13,"method":"Nonesuch"}`, ``, ``, code.MethodNotFound},
+	}
+	for _, test := range tests {
+		rsp, err := loc.Client.CallRaw(ctx, json.RawMessage(test.raw))
+		if c := code.FromError(err); c != test.code {
+			t.Errorf("CallRaw(%#q): got error %v (code %v), want code %v", test.raw, err, c, test.code)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if got := rsp.ID(); got != test.id {
+			t.Errorf("CallRaw(%#q): got ID %s, want %s", test.raw, got, test.id)
+		}
+		if got := rsp.ResultString(); got != test.result {
+			t.Errorf("CallRaw(%#q): got result %s, want %s", test.raw, got, test.result)
+		}
+	}
+
+	// Requests that are not objects, or have invalid IDs, are not sent.
+	for _, raw := range []string{`[{"jsonrpc":"2.0","id":1,"method":"Add"}]`, `null`, `"x"`, `{`,
+		`{"id":null,"method":"Add"}`, `{"id":true,"method":"Add"}`} {
+		if rsp, err := loc.Client.CallRaw(ctx, json.RawMessage(raw)); err == nil {
+			t.Errorf("CallRaw(%#q): got %v, want error", raw, rsp)
+		}
+	}
+}
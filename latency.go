@@ -0,0 +1,78 @@
+package jrpc2
+
+import (
+	"time"
+
+	"github.com/yinfei8/jrpc2/metrics"
+)
+
+// A LatencyMetric determines how a server records the time taken by the
+// handlers of requests. See ServerOptions.Latency.
+type LatencyMetric int
+
+const (
+	// LatencyNone records no latency metric.
+	LatencyNone LatencyMetric = iota
+
+	// LatencyHistogram counts requests by latency in the keyed counter
+	// "rpc.latency", whose keys are the upper bounds of the buckets listed in
+	// LatencyBuckets, formatted as by time.Duration.String, and "+Inf" for
+	// the requests slower than all of them. A request is counted in the
+	// bucket with the least bound not less than its latency.
+	LatencyHistogram
+
+	// LatencyQuantiles records the latency of each request in milliseconds,
+	// in the quantile sketch "rpc.latency" (see metrics.M.ObserveQuantile).
+	LatencyQuantiles
+)
+
+// String returns a short name for the metric.
+func (l LatencyMetric) String() string {
+	switch l {
+	case LatencyNone:
+		return "none"
+	case LatencyHistogram:
+		return "histogram"
+	case LatencyQuantiles:
+		return "quantiles"
+	}
+	return "unknown"
+}
+
+// LatencyBuckets are the upper bounds of the latency histogram recorded by a
+// server with the LatencyHistogram option, in increasing order.
+var LatencyBuckets = []time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// latencyBucket returns the key of the histogram bucket for latency d.
+func latencyBucket(d time.Duration) string {
+	for _, b := range LatencyBuckets {
+		if d <= b {
+			return b.String()
+		}
+	}
+	return "+Inf"
+}
+
+// record adds the latency d of a request to m, according to l.
+func (l LatencyMetric) record(m *metrics.M, d time.Duration) {
+	switch l {
+	case LatencyHistogram:
+		m.CountBy("rpc.latency", latencyBucket(d), 1)
+	case LatencyQuantiles:
+		m.ObserveQuantile("rpc.latency", float64(d)/float64(time.Millisecond))
+	}
+}
@@ -0,0 +1,52 @@
+package jrpc2
+
+import (
+	"sync"
+	"time"
+)
+
+// A logLimiter limits the rate of debug log messages, for the LogLimit option
+// of the server.
+type logLimiter struct {
+	max int              // the maximum number of messages per second
+	now func() time.Time // the current time
+
+	mu      sync.Mutex
+	start   time.Time // the start of the current interval
+	n       int       // messages written during the current interval
+	dropped int       // messages discarded since the last one written
+}
+
+// allow reports whether a message may be written now, and if so the number of
+// messages discarded since the previous one was written. If force is true,
+// the message is allowed regardless of the limit, and it does not count
+// against the limit.
+func (l *logLimiter) allow(force bool) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now := l.now(); now.Sub(l.start) >= time.Second {
+		l.start = now
+		l.n = 0
+	}
+	if !force {
+		if l.n >= l.max {
+			l.dropped++
+			return 0, false
+		}
+		l.n++
+	}
+	n := l.dropped
+	l.dropped = 0
+	return n, true
+}
+
+// reportsError reports whether the arguments of a log message include a
+// non-nil error.
+func reportsError(args []interface{}) bool {
+	for _, arg := range args {
+		if err, ok := arg.(error); ok && err != nil {
+			return true
+		}
+	}
+	return false
+}
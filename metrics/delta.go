@@ -0,0 +1,113 @@
+package metrics
+
+import "strings"
+
+// Reset removes all the values of m, as if it were newly created. Functions
+// registered by RegisterGaugeFunc remain registered, gauges maintained by
+// AddGauge keep their values, and the settings of m, such as its key limit,
+// clock, and quantiles, are not changed. Reset of a view (see WithPrefix)
+// removes only the metrics of the view.
+//
+// Updates made concurrently with Reset may be lost. The next DeltaSnapshot
+// reports the values accumulated since the reset.
+func (m *M) Reset() {
+	if m == nil {
+		return
+	}
+	m, prefix := m.scope("")
+	in := func(name string) bool { return strings.HasPrefix(name, prefix) }
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counter.Range(func(name, _ interface{}) bool {
+		if in(name.(string)) {
+			m.counter.Delete(name)
+		}
+		return true
+	})
+	deleteIf(m.maxVal, in)
+	deleteIf(m.label, in)
+	deleteIf(m.keyed, in)
+	deleteIf(m.gauge, func(name string) bool { return in(name) && !m.level[name] })
+	deleteIf(m.rate, in)
+	deleteIf(m.sketch, in)
+	deleteIf(m.dcount, in)
+	deleteIf(m.dkeyed, in)
+}
+
+// deleteIf removes from v the entries whose names satisfy in.
+func deleteIf[V any](v map[string]V, in func(string) bool) {
+	for name := range v {
+		if in(name) {
+			delete(v, name)
+		}
+	}
+}
+
+// DeltaSnapshot returns a snapshot of the metrics of m, as Values does, except
+// that each counter and keyed counter reports the amount added to it since the
+// previous call of DeltaSnapshot (or since it was defined, or since the last
+// Reset). The totals reported by Snapshot and Values are not affected. This
+// allows an exporter to report the changes since its previous report.
+//
+// Maximum values, labels, gauges, rates, and quantile sketches are not
+// additive, so DeltaSnapshot always reports their current values, as Values
+// does.
+//
+// Each update of a counter is reported by exactly one DeltaSnapshot, even if
+// counters are updated concurrently. As for Snapshot, the counter values of a
+// delta snapshot are each exact as of some moment during the call. The
+// deltas are tracked by the collector, so calls made through a view (see
+// WithPrefix) advance the deltas reported for the same metrics through m.
+func (m *M) DeltaSnapshot() Snapshot {
+	snap := newSnapshot()
+	if m == nil {
+		return snap
+	}
+	base, prefix := m.scope("")
+	all := snap
+	if m.base != nil {
+		all = newSnapshot()
+	}
+	for name, f := range base.copyDelta(all, prefix) {
+		all.Gauge[name] = f()
+	}
+	if m.base != nil {
+		copyScoped(snap.Counter, all.Counter, prefix)
+		copyScoped(snap.MaxValue, all.MaxValue, prefix)
+		copyScoped(snap.Label, all.Label, prefix)
+		copyScoped(snap.KeyedCounter, all.KeyedCounter, prefix)
+		copyScoped(snap.Gauge, all.Gauge, prefix)
+		copyScoped(snap.Rate, all.Rate, prefix)
+		copyScoped(snap.Quantile, all.Quantile, prefix)
+	}
+	return snap
+}
+
+// copyDelta copies the values of m into snap as copyValues does, but replaces
+// the values of the counters and keyed counters whose names begin with prefix
+// by their deltas, and records their current values for the next call.
+func (m *M) copyDelta(snap Snapshot, prefix string) map[string]func() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fns := m.copyLocked(snap)
+	for name, val := range snap.Counter {
+		if strings.HasPrefix(name, prefix) {
+			snap.Counter[name] = val - m.dcount[name]
+			m.dcount[name] = val
+		}
+	}
+	for name, vals := range snap.KeyedCounter {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		last := m.dkeyed[name]
+		next := make(map[string]int64, len(vals))
+		for key, val := range vals {
+			next[key] = val
+			vals[key] = val - last[key]
+		}
+		m.dkeyed[name] = next
+	}
+	return fns
+}
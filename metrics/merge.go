@@ -0,0 +1,134 @@
+package metrics
+
+import "strings"
+
+// Merge adds the current values of the metrics of each of srcs to dst, so
+// that dst reports the metrics of several collectors combined. Metrics of each
+// kind are combined as follows:
+//
+//    counters, keyed counters   the values are added
+//    maximum values             the greatest value is kept
+//    gauges                     the values are added, replacing any function
+//                               registered for the gauge in dst
+//    rates                      the events of each second are added
+//    quantile sketches          the values observed are combined
+//    labels                     the value from the last src defining the label
+//                               is kept, replacing any value in dst
+//
+// Gauges computed by functions in srcs are sampled, and their values added.
+// Each src is snapshotted in turn, so a concurrent update of a src may or may
+// not be included. Since values are added, merging into the same dst again
+// counts them again; to combine the current values of several collectors,
+// merge them into a new collector:
+//
+//    total := metrics.New()
+//    metrics.Merge(total, a, b, c)
+//
+// Merge does nothing if dst is nil, and skips srcs that are nil. The dst
+// must not be one of srcs, nor share storage with one (see WithPrefix).
+func Merge(dst *M, srcs ...*M) {
+	if dst == nil {
+		return
+	}
+	for _, src := range srcs {
+		if src == nil {
+			continue
+		}
+		snap := src.Values()
+		for name, val := range snap.Counter {
+			dst.Count(name, val)
+		}
+		for name, val := range snap.MaxValue {
+			dst.SetMaxValue(name, val)
+		}
+		for name, vals := range snap.KeyedCounter {
+			for key, val := range vals {
+				dst.CountBy(name, key, val)
+			}
+		}
+		for name, val := range snap.Label {
+			dst.SetLabel(name, val)
+		}
+		for name, val := range snap.Gauge {
+			dst.addGauge(name, val)
+		}
+		for name, r := range src.rates() {
+			dst.addRate(name, r)
+		}
+		for name, s := range src.sketches() {
+			dst.addSketch(name, s)
+		}
+	}
+}
+
+// addGauge adds v to the gauge named, replacing any function registered for
+// the gauge.
+func (m *M) addGauge(name string, v int64) {
+	m, name = m.scope(name)
+	m.mu.Lock()
+	delete(m.gaugeFn, name)
+	m.gauge[name] += v
+	v = m.gauge[name]
+	m.mu.Unlock()
+	if m.sink != nil {
+		m.sink.Observe(name, float64(v))
+	}
+}
+
+// rates returns copies of the rates of m, current as of now.
+func (m *M) rates() map[string]rate {
+	base, prefix := m.scope("")
+	base.mu.Lock()
+	defer base.mu.Unlock()
+	now := base.now()
+	out := make(map[string]rate)
+	for name, r := range base.rate {
+		if strings.HasPrefix(name, prefix) {
+			r.advance(now)
+			out[strings.TrimPrefix(name, prefix)] = *r
+		}
+	}
+	return out
+}
+
+// addRate adds the events counted by r to the rate named.
+func (m *M) addRate(name string, r rate) {
+	m, name = m.scope(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dr, ok := m.rate[name]
+	if !ok {
+		dr = new(rate)
+		m.rate[name] = dr
+	}
+	dr.merge(r)
+}
+
+// sketches returns copies of the quantile sketches of m.
+func (m *M) sketches() map[string]sketch {
+	base, prefix := m.scope("")
+	base.mu.Lock()
+	defer base.mu.Unlock()
+	out := make(map[string]sketch)
+	for name, s := range base.sketch {
+		if strings.HasPrefix(name, prefix) {
+			cp := *s
+			cp.samples = append([]float64(nil), s.samples...)
+			out[strings.TrimPrefix(name, prefix)] = cp
+		}
+	}
+	return out
+}
+
+// addSketch adds the values summarized by s to the quantile sketch named.
+func (m *M) addSketch(name string, s sketch) {
+	m, name = m.scope(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ds, ok := m.sketch[name]
+	if !ok {
+		ds = new(sketch)
+		m.sketch[name] = ds
+	}
+	ds.merge(s)
+}
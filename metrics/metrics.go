@@ -3,61 +3,287 @@
 // A *metrics.M value exports methods to track integer counters and maximum
 // values. A metric has a caller-assigned string name that is not interpreted
 // by the collector except to locate its stored value.
+//
+// A keyed counter is a family of counters sharing a name, distinguished by a
+// second string key, for example a count of requests keyed by method name.
+// Since keys often come from outside the program, the number of distinct keys
+// per name is limited (see SetKeyLimit); once the limit is reached, counts for
+// new keys are added to the key OtherKey instead.
+//
+// A gauge is a value that may go up and down, for example the number of
+// requests in flight. A gauge is either set explicitly (see SetGauge), or
+// computed by a function that the collector calls each time it takes a
+// snapshot (see RegisterGaugeFunc).
+//
+// A rate tracks how often events occur, for example requests per second,
+// averaged over the last 1, 10, and 60 seconds (see Mark).
+//
+// A quantile sketch estimates the quantiles of a distribution of values, for
+// example the 95th percentile of request latencies, in a bounded amount of
+// memory (see ObserveQuantile and SketchSize).
+//
+// Several collectors can be combined with Merge, and a single collector can
+// be shared by several users that each see only their own metrics, through
+// views created by WithPrefix. An exporter that reports changes rather than
+// totals can use DeltaSnapshot, and Reset clears a collector, for example
+// between tests.
 package metrics
 
-import "sync"
+import (
+	"expvar"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 // An M collects counters and maximum value trackers.  A nil *M is valid, and
 // discards all metrics. The methods of an *M are safe for concurrent use by
 // multiple goroutines.
 type M struct {
+	// Counters are updated atomically, without holding mu, so that updates to
+	// counters already defined do not contend for the lock.
+	counter sync.Map // counter name → *int64
+
 	mu      sync.Mutex
-	counter map[string]int64
 	maxVal  map[string]int64
 	label   map[string]interface{}
+	keyed   map[string]map[string]int64
+	gauge   map[string]int64
+	gaugeFn map[string]func() int64
+	level   map[string]bool // gauges maintained by AddGauge (see Reset)
+	rate    map[string]*rate
+	sketch  map[string]*sketch
+	dcount  map[string]int64            // counter values at the last DeltaSnapshot
+	dkeyed  map[string]map[string]int64 // keyed counter values at the last DeltaSnapshot
+	quants  []float64                   // the quantiles reported for sketches
+	maxKeys int
+	now     func() time.Time
+	sink    Sink // if non-nil, receives each update (see NewWithSink)
+
+	// If base != nil, this M is a view of base (see WithPrefix), and the
+	// fields above are unused.
+	base   *M
+	prefix string
 }
 
+// DefaultKeyLimit is the default limit on the number of distinct keys of each
+// keyed counter. See SetKeyLimit.
+const DefaultKeyLimit = 256
+
+// OtherKey is the key of a keyed counter that accumulates the counts for keys
+// beyond the limit.
+const OtherKey = "other"
+
 // New creates a new, empty metrics collector.
 func New() *M {
 	return &M{
-		counter: make(map[string]int64),
 		maxVal:  make(map[string]int64),
 		label:   make(map[string]interface{}),
+		keyed:   make(map[string]map[string]int64),
+		gauge:   make(map[string]int64),
+		gaugeFn: make(map[string]func() int64),
+		level:   make(map[string]bool),
+		rate:    make(map[string]*rate),
+		sketch:  make(map[string]*sketch),
+		dcount:  make(map[string]int64),
+		dkeyed:  make(map[string]map[string]int64),
+		quants:  DefaultQuantiles,
+		maxKeys: DefaultKeyLimit,
+		now:     time.Now,
 	}
 }
 
+// WithPrefix returns a view of m that records its metrics in m, with prefix
+// added to the beginning of each name. Metrics written through the view are
+// also visible through m, and through any other view of m. If m is nil,
+// WithPrefix returns nil.
+//
+// Snapshots of the view report only the metrics of m whose names begin with
+// prefix, with the prefix removed. The settings of the view, such as its key
+// limit and clock, are those of m, and setting them through the view changes
+// them for m. A view of a view adds both prefixes.
+func (m *M) WithPrefix(prefix string) *M {
+	if m == nil {
+		return nil
+	}
+	base, prefix := m.scope(prefix)
+	return &M{base: base, prefix: prefix}
+}
+
+// scope returns the collector that stores the metrics of m, and the name
+// under which it stores the metric of m named.
+func (m *M) scope(name string) (*M, string) {
+	if m.base != nil {
+		return m.base, m.prefix + name
+	}
+	return m, name
+}
+
+// SetKeyLimit sets the maximum number of distinct keys of each keyed counter,
+// not counting OtherKey. Keys already defined are not affected. If n <= 0,
+// the number of keys is not limited.
+func (m *M) SetKeyLimit(n int) {
+	if m != nil {
+		m, _ = m.scope("")
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.maxKeys = n
+	}
+}
+
+// SetClock sets the function m uses to read the current time, for computing
+// rates (see Mark). If now == nil, time.Now is used. This is mainly useful for
+// testing.
+func (m *M) SetClock(now func() time.Time) {
+	if m != nil {
+		m, _ = m.scope("")
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if now == nil {
+			now = time.Now
+		}
+		m.now = now
+	}
+}
+
+// Mark records n events for the rate named, defining the rate if it does not
+// already exist. The rates of events over recent intervals are reported by
+// Snapshot.
+func (m *M) Mark(name string, n int64) {
+	if m != nil {
+		m, name = m.scope(name)
+		m.mu.Lock()
+		r, ok := m.rate[name]
+		if !ok {
+			r = new(rate)
+			m.rate[name] = r
+		}
+		r.mark(m.now(), n)
+		m.mu.Unlock()
+	}
+}
+
+// ObserveQuantile adds v to the values summarized by the quantile sketch
+// named, defining the sketch if it does not already exist. Snapshot reports
+// the estimated value of each of the quantiles set by SetQuantiles.
+//
+// A sketch keeps a uniform random sample of at most SketchSize of the values
+// observed, so its memory use is bounded however many values are observed.
+// Until more than SketchSize values are observed, the quantiles are exact.
+func (m *M) ObserveQuantile(name string, v float64) {
+	if m != nil {
+		m, name = m.scope(name)
+		m.mu.Lock()
+		s, ok := m.sketch[name]
+		if !ok {
+			s = new(sketch)
+			m.sketch[name] = s
+		}
+		s.observe(v)
+		m.mu.Unlock()
+		if m.sink != nil {
+			m.sink.Observe(name, v)
+		}
+	}
+}
+
+// SetQuantiles sets the quantiles reported for the quantile sketches of m
+// (see ObserveQuantile), replacing DefaultQuantiles. Each of qs must be
+// between 0 and 1 inclusive, or SetQuantiles panics. The quantiles apply to
+// sketches already defined, as well as to new ones.
+func (m *M) SetQuantiles(qs ...float64) {
+	if m != nil {
+		qs = checkQuantiles(qs)
+		m, _ = m.scope("")
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.quants = qs
+	}
+}
+
+// CountBy adds n to the current value of the counter named with the given key,
+// defining the counter if it does not already exist. If the counter named
+// already has the maximum number of keys, and key is not one of them, n is
+// added to the key OtherKey instead.
+func (m *M) CountBy(name, key string, n int64) {
+	if m != nil {
+		m, name = m.scope(name)
+		key = m.countKey(name, key, n)
+		if m.sink != nil {
+			m.sink.CountDelta(name+"."+key, n)
+		}
+	}
+}
+
+// countKey adds n to the counter named with the given key, as CountBy does,
+// and returns the key to which n was added.
+func (m *M) countKey(name, key string, n int64) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vals, ok := m.keyed[name]
+	if !ok {
+		vals = make(map[string]int64)
+		m.keyed[name] = vals
+	}
+	if _, ok := vals[key]; !ok && m.maxKeys > 0 {
+		nk := len(vals)
+		if _, ok := vals[OtherKey]; ok {
+			nk--
+		}
+		if nk >= m.maxKeys {
+			key = OtherKey
+		}
+	}
+	vals[key] += n
+	return key
+}
+
 // Count adds n to the current value of the counter named, defining the counter
 // if it does not already exist.
 func (m *M) Count(name string, n int64) {
 	if m != nil {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		m.counter[name] += n
+		m, name = m.scope(name)
+		atomic.AddInt64(m.counterFor(name), n)
+		if m.sink != nil {
+			m.sink.CountDelta(name, n)
+		}
+	}
+}
+
+// counterFor returns the location of the value of the counter named, defining
+// the counter if it does not already exist.
+func (m *M) counterFor(name string) *int64 {
+	if v, ok := m.counter.Load(name); ok {
+		return v.(*int64)
 	}
+	v, _ := m.counter.LoadOrStore(name, new(int64))
+	return v.(*int64)
 }
 
 // SetMaxValue sets the maximum value metric named to the greater of n and its
 // current value, defining the value if it does not already exist.
 func (m *M) SetMaxValue(name string, n int64) {
 	if m != nil {
+		m, name = m.scope(name)
 		m.mu.Lock()
-		defer m.mu.Unlock()
 		if old, ok := m.maxVal[name]; !ok || n > old {
 			m.maxVal[name] = n
 		}
+		m.mu.Unlock()
+		if m.sink != nil {
+			m.sink.SetMax(name, n)
+		}
 	}
 }
 
 // CountAndSetMax adds n to the current value of the counter named, and also
-// updates a max value tracker with the same name in a single step.
+// updates a max value tracker with the same name.
 func (m *M) CountAndSetMax(name string, n int64) {
 	if m != nil {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		if old, ok := m.maxVal[name]; !ok || n > old {
-			m.maxVal[name] = n
-		}
-		m.counter[name] += n
+		m.Count(name, n)
+		m.SetMaxValue(name, n)
 	}
 }
 
@@ -65,6 +291,7 @@ func (m *M) CountAndSetMax(name string, n int64) {
 // removed from the set.
 func (m *M) SetLabel(name string, value interface{}) {
 	if m != nil {
+		m, name = m.scope(name)
 		m.mu.Lock()
 		defer m.mu.Unlock()
 		if value == nil {
@@ -75,35 +302,332 @@ func (m *M) SetLabel(name string, value interface{}) {
 	}
 }
 
+// SetGauge sets the gauge named to v, defining the gauge if it does not
+// already exist. It replaces any function registered for the gauge by
+// RegisterGaugeFunc.
+func (m *M) SetGauge(name string, v int64) {
+	if m != nil {
+		m, name = m.scope(name)
+		m.mu.Lock()
+		delete(m.gaugeFn, name)
+		delete(m.level, name)
+		m.gauge[name] = v
+		m.mu.Unlock()
+		if m.sink != nil {
+			m.sink.Observe(name, float64(v))
+		}
+	}
+}
+
+// AddGauge adds n, which may be negative, to the gauge named, defining the
+// gauge with value n if it does not already exist. It replaces any function
+// registered for the gauge by RegisterGaugeFunc.
+//
+// AddGauge suits a gauge that tracks a level shared by several users of the
+// collector, such as the number of requests in flight on all the servers
+// that share it: each adds the changes it makes to the level. For the same
+// reason, Reset does not remove a gauge maintained by AddGauge, until it is
+// set by SetGauge or RegisterGaugeFunc.
+func (m *M) AddGauge(name string, n int64) {
+	if m != nil {
+		m, name = m.scope(name)
+		m.mu.Lock()
+		delete(m.gaugeFn, name)
+		m.level[name] = true
+		m.gauge[name] += n
+		v := m.gauge[name]
+		m.mu.Unlock()
+		if m.sink != nil {
+			m.sink.Observe(name, float64(v))
+		}
+	}
+}
+
+// RegisterGaugeFunc registers f to compute the value of the gauge named,
+// replacing any value set by SetGauge or function previously registered for
+// the gauge. If f == nil the gauge is removed.
+//
+// The collector calls f each time it takes a snapshot (see Snapshot), without
+// holding its own lock, so f may update other metrics of m. However, f must
+// not take a snapshot of m, since that would call f again; and f must not
+// wait for a lock held by a caller of Snapshot or Values, since that would
+// deadlock.
+func (m *M) RegisterGaugeFunc(name string, f func() int64) {
+	if m != nil {
+		m, name = m.scope(name)
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.gauge, name)
+		delete(m.level, name)
+		if f == nil {
+			delete(m.gaugeFn, name)
+		} else {
+			m.gaugeFn[name] = f
+		}
+	}
+}
+
 // Snapshot copies an atomic snapshot of the collected metrics into the non-nil
 // fields of the provided snapshot value. Only the fields of snap that are not
 // nil are snapshotted.
+//
+// Counters are updated without holding the lock that makes the snapshot
+// atomic, so a snapshot taken while counters are being updated may include
+// some of the concurrent updates and not others; each counter value is exact
+// as of some moment during the snapshot. Likewise, the values of gauges
+// computed by functions (see RegisterGaugeFunc) are sampled after the other
+// metrics are copied, so they are not part of the atomic snapshot.
 func (m *M) Snapshot(snap Snapshot) {
-	if m != nil {
-		m.mu.Lock()
-		defer m.mu.Unlock()
-		if c := snap.Counter; c != nil {
-			for name, val := range m.counter {
-				c[name] = val
-			}
+	if m == nil {
+		return
+	} else if m.base != nil {
+		m.snapshotView(snap)
+		return
+	}
+	for name, f := range m.copyValues(snap) {
+		snap.Gauge[name] = f()
+	}
+}
+
+// copyValues copies the current values of the metrics of m into the non-nil
+// fields of snap. If snap has gauges, it returns the registered gauge
+// functions, to be called once the lock is released.
+func (m *M) copyValues(snap Snapshot) map[string]func() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.copyLocked(snap)
+}
+
+// copyLocked copies values as copyValues does. The caller must hold m.mu.
+func (m *M) copyLocked(snap Snapshot) map[string]func() int64 {
+	if c := snap.Counter; c != nil {
+		m.counter.Range(func(name, val interface{}) bool {
+			c[name.(string)] = atomic.LoadInt64(val.(*int64))
+			return true
+		})
+	}
+	if v := snap.MaxValue; v != nil {
+		for name, val := range m.maxVal {
+			v[name] = val
+		}
+	}
+	if v := snap.Label; v != nil {
+		for name, val := range m.label {
+			v[name] = val
 		}
-		if v := snap.MaxValue; v != nil {
-			for name, val := range m.maxVal {
-				v[name] = val
+	}
+	if v := snap.KeyedCounter; v != nil {
+		for name, vals := range m.keyed {
+			cp := make(map[string]int64, len(vals))
+			for key, val := range vals {
+				cp[key] = val
 			}
+			v[name] = cp
+		}
+	}
+	if v := snap.Rate; v != nil {
+		now := m.now()
+		for name, r := range m.rate {
+			v[name] = r.rates(now)
+		}
+	}
+	if v := snap.Quantile; v != nil {
+		for name, s := range m.sketch {
+			v[name] = s.quantiles(m.quants)
+		}
+	}
+	if g := snap.Gauge; g != nil {
+		for name, val := range m.gauge {
+			g[name] = val
+		}
+		fns := make(map[string]func() int64, len(m.gaugeFn))
+		for name, f := range m.gaugeFn {
+			fns[name] = f
+		}
+		return fns
+	}
+	return nil
+}
+
+// snapshotView copies the metrics of the view m into snap, as Snapshot does.
+func (m *M) snapshotView(snap Snapshot) {
+	all := m.base.Values()
+	copyScoped(snap.Counter, all.Counter, m.prefix)
+	copyScoped(snap.MaxValue, all.MaxValue, m.prefix)
+	copyScoped(snap.Label, all.Label, m.prefix)
+	copyScoped(snap.KeyedCounter, all.KeyedCounter, m.prefix)
+	copyScoped(snap.Gauge, all.Gauge, m.prefix)
+	copyScoped(snap.Rate, all.Rate, m.prefix)
+	copyScoped(snap.Quantile, all.Quantile, m.prefix)
+}
+
+// copyScoped copies the values of src whose names begin with prefix into dst,
+// with the prefix removed. If dst == nil, copyScoped does nothing.
+func copyScoped[V any](dst, src map[string]V, prefix string) {
+	if dst == nil {
+		return
+	}
+	for name, val := range src {
+		if strings.HasPrefix(name, prefix) {
+			dst[strings.TrimPrefix(name, prefix)] = val
+		}
+	}
+}
+
+// Values returns a snapshot of all the metrics collected by m, as Snapshot
+// does. The maps of the result are new, and are not affected by later changes
+// to m; however, label values are not copied. All the maps of the result are
+// non-nil, even if m is nil.
+func (m *M) Values() Snapshot {
+	snap := newSnapshot()
+	m.Snapshot(snap)
+	return snap
+}
+
+// newSnapshot returns a Snapshot whose maps are all empty and non-nil.
+func newSnapshot() Snapshot {
+	return Snapshot{
+		Counter:      make(map[string]int64),
+		MaxValue:     make(map[string]int64),
+		Label:        make(map[string]interface{}),
+		KeyedCounter: make(map[string]map[string]int64),
+		Gauge:        make(map[string]int64),
+		Rate:         make(map[string]Rates),
+		Quantile:     make(map[string]Quantiles),
+	}
+}
+
+// Publish exports the metrics collected by m as the expvar variable name, so
+// that they are served by the expvar handler along with the variables of the
+// process. The value of the variable is the result of m.Values at the time it
+// is read. Like expvar.Publish, Publish panics if name is already in use.
+func Publish(name string, m *M) {
+	expvar.Publish(name, expvar.Func(func() interface{} { return m.Values() }))
+}
+
+// Keys returns the names of all the metrics currently defined in m, in
+// sorted order. A name is listed once, even if it is used by more than one
+// kind of metric (for example, by CountAndSetMax).
+func (m *M) Keys() []string {
+	var keys []string
+	for _, key := range m.TypedKeys() {
+		if n := len(keys); n == 0 || keys[n-1] != key.Name {
+			keys = append(keys, key.Name)
 		}
-		if v := snap.Label; v != nil {
-			for name, val := range m.label {
-				v[name] = val
+	}
+	return keys
+}
+
+// A Kind identifies the kind of a metric.
+type Kind int
+
+// The kinds of metric tracked by an *M.
+const (
+	Counter      Kind = iota + 1 // a counter, see Count
+	MaxValue                     // a maximum value tracker, see SetMaxValue
+	Label                        // a label, see SetLabel
+	KeyedCounter                 // a keyed counter, see CountBy
+	Gauge                        // a gauge, see SetGauge and RegisterGaugeFunc
+	Rate                         // a rate, see Mark
+	Quantile                     // a quantile sketch, see ObserveQuantile
+)
+
+var kindName = map[Kind]string{
+	Counter:      "counter",
+	MaxValue:     "maxValue",
+	Label:        "label",
+	KeyedCounter: "keyedCounter",
+	Gauge:        "gauge",
+	Rate:         "rate",
+	Quantile:     "quantile",
+}
+
+func (k Kind) String() string {
+	if s, ok := kindName[k]; ok {
+		return s
+	}
+	return "unknown"
+}
+
+// A Key is the name and kind of a metric.
+type Key struct {
+	Name string
+	Kind Kind
+}
+
+// TypedKeys returns the names and kinds of all the metrics currently defined
+// in m, ordered by name and then by kind. A name used by more than one kind of
+// metric appears once for each kind.
+func (m *M) TypedKeys() []Key {
+	if m == nil {
+		return nil
+	} else if m.base != nil {
+		var keys []Key
+		for _, key := range m.base.TypedKeys() {
+			if strings.HasPrefix(key.Name, m.prefix) {
+				keys = append(keys, Key{Name: strings.TrimPrefix(key.Name, m.prefix), Kind: key.Kind})
 			}
 		}
+		return keys
+	}
+	m.mu.Lock()
+	var keys []Key
+	m.counter.Range(func(name, _ interface{}) bool {
+		keys = append(keys, Key{Name: name.(string), Kind: Counter})
+		return true
+	})
+	for name := range m.maxVal {
+		keys = append(keys, Key{Name: name, Kind: MaxValue})
+	}
+	for name := range m.label {
+		keys = append(keys, Key{Name: name, Kind: Label})
+	}
+	for name := range m.keyed {
+		keys = append(keys, Key{Name: name, Kind: KeyedCounter})
+	}
+	for name := range m.gauge {
+		keys = append(keys, Key{Name: name, Kind: Gauge})
 	}
+	for name := range m.gaugeFn {
+		keys = append(keys, Key{Name: name, Kind: Gauge})
+	}
+	for name := range m.rate {
+		keys = append(keys, Key{Name: name, Kind: Rate})
+	}
+	for name := range m.sketch {
+		keys = append(keys, Key{Name: name, Kind: Quantile})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Name == keys[j].Name {
+			return keys[i].Kind < keys[j].Kind
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	return keys
 }
 
 // A Snapshot represents a point-in-time snapshot of a metrics collector.  The
 // fields of this type are filled in by the Snapshot method of *M.
+//
+// The JSON encoding of a Snapshot is stable, and matches the names used for
+// metrics by jrpc2.ServerInfo.
 type Snapshot struct {
-	Counter  map[string]int64
-	MaxValue map[string]int64
-	Label    map[string]interface{}
+	Counter  map[string]int64       `json:"counters,omitempty"`
+	MaxValue map[string]int64       `json:"maxValue,omitempty"`
+	Label    map[string]interface{} `json:"labels,omitempty"`
+
+	// Keyed counters, by name and then by key.
+	KeyedCounter map[string]map[string]int64 `json:"keyed,omitempty"`
+
+	// Gauges, including those computed by registered functions.
+	Gauge map[string]int64 `json:"gauges,omitempty"`
+
+	// Rates, averaged over recent intervals.
+	Rate map[string]Rates `json:"rates,omitempty"`
+
+	// Quantile sketches, with the estimated values of the quantiles set by
+	// SetQuantiles.
+	Quantile map[string]Quantiles `json:"quantiles,omitempty"`
 }
@@ -0,0 +1,551 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRates(t *testing.T) {
+	now := time.Unix(1000, 0)
+	m := New()
+	m.SetClock(func() time.Time { return now })
+	at := func(sec float64) { now = time.Unix(0, int64(sec*1e9)) }
+
+	tests := []struct {
+		at   float64 // the time of the step
+		mark int64   // if nonzero, the number of events to mark
+		want Rates
+	}{
+		{1000, 10, Rates{}}, // the current second is not complete
+		{1001, 0, Rates{Last1s: 10, Last10s: 1, Last60s: 10.0 / 60}},
+		{1001.5, 30, Rates{Last1s: 10, Last10s: 1, Last60s: 10.0 / 60}},
+		{1002, 0, Rates{Last1s: 30, Last10s: 4, Last60s: 40.0 / 60}},
+		{1010, 0, Rates{Last1s: 0, Last10s: 4, Last60s: 40.0 / 60}},
+		{1011, 0, Rates{Last1s: 0, Last10s: 3, Last60s: 40.0 / 60}},
+		{1012, 0, Rates{Last60s: 40.0 / 60}},
+		{1061, 0, Rates{Last60s: 30.0 / 60}},
+		{1062, 0, Rates{}},
+		{5000, 1, Rates{}},
+		{5001, 0, Rates{Last1s: 1, Last10s: 0.1, Last60s: 1.0 / 60}},
+	}
+	for _, test := range tests {
+		at(test.at)
+		if test.mark != 0 {
+			m.Mark("events", test.mark)
+		}
+		if got := m.Values().Rate["events"]; got != test.want {
+			t.Errorf("At %v: got rates %+v, want %+v", test.at, got, test.want)
+		}
+	}
+	if diff := cmp.Diff([]Key{{Name: "events", Kind: Rate}}, m.TypedKeys()); diff != "" {
+		t.Errorf("TypedKeys (-want, +got):\n%s", diff)
+	}
+}
+
+func TestGauges(t *testing.T) {
+	m := New()
+	m.SetGauge("depth", 3)
+	m.SetGauge("depth", 2)
+	m.SetGauge("fixed", 5)
+	var calls int64
+	m.RegisterGaugeFunc("sampled", func() int64 {
+		// A gauge function may update other metrics without deadlock.
+		m.Count("samples", 1)
+		m.SetGauge("fixed", 6)
+		calls++
+		return calls * 10
+	})
+
+	if got, want := m.Values().Gauge, map[string]int64{"depth": 2, "fixed": 5, "sampled": 10}; !cmp.Equal(got, want) {
+		t.Errorf("Gauges: got %v, want %v", got, want)
+	}
+	snap := m.Values()
+	if got, want := snap.Gauge, map[string]int64{"depth": 2, "fixed": 6, "sampled": 20}; !cmp.Equal(got, want) {
+		t.Errorf("Gauges (resampled): got %v, want %v", got, want)
+	}
+	if got := snap.Counter["samples"]; got != 1 {
+		t.Errorf("Counter samples: got %d, want 1", got)
+	}
+
+	// Gauges are distinguished from counters.
+	if diff := cmp.Diff([]Key{
+		{Name: "depth", Kind: Gauge},
+		{Name: "fixed", Kind: Gauge},
+		{Name: "sampled", Kind: Gauge},
+		{Name: "samples", Kind: Counter},
+	}, m.TypedKeys()); diff != "" {
+		t.Errorf("TypedKeys (-want, +got):\n%s", diff)
+	}
+
+	// Setting a value replaces a function, and vice versa; a nil function
+	// removes the gauge.
+	m.SetGauge("sampled", 1)
+	m.RegisterGaugeFunc("depth", func() int64 { return -1 })
+	m.RegisterGaugeFunc("fixed", nil)
+	if got, want := m.Values().Gauge, map[string]int64{"depth": -1, "sampled": 1}; !cmp.Equal(got, want) {
+		t.Errorf("Gauges (replaced): got %v, want %v", got, want)
+	}
+
+	// AddGauge adjusts the current value, and the adjusted gauge survives a
+	// reset, unless it is set by SetGauge.
+	m.AddGauge("level", 2)
+	m.AddGauge("level", -1)
+	m.AddGauge("sampled", 1)
+	m.Reset()
+	if got, want := m.Values().Gauge, map[string]int64{"depth": -1, "level": 1, "sampled": 2}; !cmp.Equal(got, want) {
+		t.Errorf("Gauges (after reset): got %v, want %v", got, want)
+	}
+	m.SetGauge("level", 5)
+	m.Reset()
+	if got, want := m.Values().Gauge, map[string]int64{"depth": -1, "sampled": 2}; !cmp.Equal(got, want) {
+		t.Errorf("Gauges (set, then reset): got %v, want %v", got, want)
+	}
+}
+
+// testSink is a Sink that records the calls made to it.
+type testSink struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (s *testSink) record(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, fmt.Sprintf(format, args...))
+}
+
+func (s *testSink) CountDelta(name string, n int64) { s.record("count %s %d", name, n) }
+func (s *testSink) SetMax(name string, v int64)     { s.record("max %s %d", name, v) }
+func (s *testSink) Observe(name string, v float64)  { s.record("observe %s %v", name, v) }
+
+// take returns the calls recorded by s, and clears the record.
+func (s *testSink) take() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := s.calls
+	s.calls = nil
+	return calls
+}
+
+func TestMetricsSink(t *testing.T) {
+	sink := new(testSink)
+	m := NewWithSink(sink)
+	m.SetKeyLimit(1)
+	m.Count("c", 2)
+	m.SetMaxValue("max", 5)
+	m.SetMaxValue("max", 3)
+	m.CountAndSetMax("both", 7)
+	m.CountBy("keyed", "a", 1)
+	m.CountBy("keyed", "b", 1) // over the key limit
+	m.Mark("rate", 4)          // not reported
+	m.SetGauge("gauge", -2)
+	m.SetLabel("label", "not reported")
+	m.RegisterGaugeFunc("sampled", func() int64 { return 1 })
+
+	if diff := cmp.Diff([]string{
+		"count c 2",
+		"max max 5",
+		"max max 3",
+		"count both 7",
+		"max both 7",
+		"count keyed.a 1",
+		"count keyed.other 1",
+		"observe gauge -2",
+	}, sink.take()); diff != "" {
+		t.Errorf("Sink calls (-want, +got):\n%s", diff)
+	}
+
+	// Updates are also recorded locally.
+	if got := m.Values().Counter["c"]; got != 2 {
+		t.Errorf("Counter c: got %d, want 2", got)
+	}
+}
+
+func TestBatchSink(t *testing.T) {
+	sink := new(testSink)
+	b := NewBatchSink(sink, &BatchOptions{
+		MaxPending: 3,
+		Interval:   time.Hour, // flush only explicitly or when full
+	})
+	defer b.Close()
+
+	// Deltas and maxima for the same name are combined.
+	b.CountDelta("x", 1)
+	b.CountDelta("x", 2)
+	b.SetMax("y", 4)
+	b.SetMax("y", 2)
+	if got := sink.take(); len(got) != 0 {
+		t.Errorf("Before flush: got calls %q, want none", got)
+	}
+	b.Flush()
+	if diff := cmp.Diff([]string{"count x 3", "max y 4"}, sink.take()); diff != "" {
+		t.Errorf("Flush (-want, +got):\n%s", diff)
+	}
+
+	// Reaching the limit of pending updates flushes them.
+	b.CountDelta("b", 1)
+	b.CountDelta("a", 1)
+	b.Observe("z", 1.5)
+	if diff := cmp.Diff([]string{"count a 1", "count b 1", "observe z 1.5"}, sink.take()); diff != "" {
+		t.Errorf("Flush when full (-want, +got):\n%s", diff)
+	}
+
+	// Updates are flushed periodically, and when the sink is closed.
+	p := NewBatchSink(sink, &BatchOptions{Interval: time.Millisecond})
+	p.CountDelta("tick", 1)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if got := sink.take(); len(got) != 0 {
+			if diff := cmp.Diff([]string{"count tick 1"}, got); diff != "" {
+				t.Errorf("Periodic flush (-want, +got):\n%s", diff)
+			}
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for a periodic flush")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.Close()
+	b.Observe("last", 2)
+	b.Close()
+	b.Close() // closing again is harmless
+	if diff := cmp.Diff([]string{"observe last 2"}, sink.take()); diff != "" {
+		t.Errorf("Close (-want, +got):\n%s", diff)
+	}
+}
+
+func TestMetricsPrefix(t *testing.T) {
+	m := New()
+	a := m.WithPrefix("a.")
+	b := m.WithPrefix("b.")
+	a.Count("calls", 2)
+	b.Count("calls", 3)
+	a.SetMaxValue("size", 10)
+	b.CountBy("method", "X", 1)
+	ab := a.WithPrefix("sub.")
+	ab.SetGauge("depth", 4)
+
+	// Writes through the views share the storage of m.
+	if diff := cmp.Diff(map[string]int64{"a.calls": 2, "b.calls": 3}, m.Values().Counter); diff != "" {
+		t.Errorf("Base counters (-want, +got):\n%s", diff)
+	}
+
+	// Each view reports only its own metrics, without the prefix.
+	if diff := cmp.Diff(Snapshot{
+		Counter:      map[string]int64{"calls": 2},
+		MaxValue:     map[string]int64{"size": 10},
+		Label:        map[string]interface{}{},
+		KeyedCounter: map[string]map[string]int64{},
+		Gauge:        map[string]int64{"sub.depth": 4},
+		Rate:         map[string]Rates{},
+		Quantile:     map[string]Quantiles{},
+	}, a.Values()); diff != "" {
+		t.Errorf("View a (-want, +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"calls", "method"}, b.Keys()); diff != "" {
+		t.Errorf("View b keys (-want, +got):\n%s", diff)
+	}
+	if got := ab.Values().Gauge; !cmp.Equal(got, map[string]int64{"depth": 4}) {
+		t.Errorf("View a.sub gauges: got %v, want depth=4", got)
+	}
+
+	var nilM *M
+	if v := nilM.WithPrefix("x."); v != nil {
+		t.Errorf("WithPrefix(nil): got %v, want nil", v)
+	}
+}
+
+func TestMetricsMerge(t *testing.T) {
+	now := time.Unix(1000, 0)
+	clock := func() time.Time { return now }
+
+	m1, m2 := New(), New()
+	m1.SetClock(clock)
+	m2.SetClock(clock)
+	m1.Count("calls", 2)
+	m2.Count("calls", 3)
+	m1.SetMaxValue("size", 10)
+	m2.SetMaxValue("size", 7)
+	m1.CountBy("method", "X", 1)
+	m2.CountBy("method", "X", 2)
+	m2.CountBy("method", "Y", 1)
+	m1.SetGauge("inflight", 1)
+	m2.RegisterGaugeFunc("inflight", func() int64 { return 2 })
+	m1.Mark("requests", 5)
+	m2.Mark("requests", 15)
+	m1.ObserveQuantile("latency", 1)
+	m1.ObserveQuantile("latency", 2)
+	m2.ObserveQuantile("latency", 3)
+
+	// Labels defined by more than one source take the value from the last.
+	m1.SetLabel("version", "1")
+	m1.SetLabel("only1", true)
+	m2.SetLabel("version", "2")
+
+	now = now.Add(time.Second)
+	total := New()
+	total.SetClock(clock)
+	total.SetLabel("version", "0")
+	Merge(total, m1, nil, m2)
+
+	if diff := cmp.Diff(Snapshot{
+		Counter:      map[string]int64{"calls": 5},
+		MaxValue:     map[string]int64{"size": 10},
+		Label:        map[string]interface{}{"version": "2", "only1": true},
+		KeyedCounter: map[string]map[string]int64{"method": {"X": 3, "Y": 1}},
+		Gauge:        map[string]int64{"inflight": 3},
+		Rate:         map[string]Rates{"requests": {Last1s: 20, Last10s: 2, Last60s: 20.0 / 60}},
+		Quantile: map[string]Quantiles{"latency": {
+			Count: 3, Sum: 6, Min: 1, Max: 3,
+			Values: []QuantileValue{{Q: 0.5, V: 2}, {Q: 0.95, V: 3}, {Q: 0.99, V: 3}},
+		}},
+	}, total.Values()); diff != "" {
+		t.Errorf("Merged (-want, +got):\n%s", diff)
+	}
+	Merge(nil, m1) // does nothing
+
+	// Merge views of a shared collector while they are being written.
+	const numWriters = 8
+	const numWrites = 500
+	shared := New()
+	var wg sync.WaitGroup
+	var views []*M
+	for i := 0; i < numWriters; i++ {
+		v := shared.WithPrefix(fmt.Sprintf("conn%d.", i))
+		views = append(views, v)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numWrites; j++ {
+				v.Count("requests", 1)
+				v.CountAndSetMax("bytes", int64(j))
+				v.SetLabel("state", j)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		partial := New()
+		Merge(partial, views...)
+		if n := partial.Values().Counter["requests"]; n > numWriters*numWrites {
+			t.Fatalf("Partial merge: got %d requests, more than %d", n, numWriters*numWrites)
+		}
+	}
+
+	final := New()
+	Merge(final, views...)
+	snap := final.Values()
+	if got, want := snap.Counter["requests"], int64(numWriters*numWrites); got != want {
+		t.Errorf("Final requests: got %d, want %d", got, want)
+	}
+	if got, want := snap.MaxValue["bytes"], int64(numWrites-1); got != want {
+		t.Errorf("Final max bytes: got %d, want %d", got, want)
+	}
+	if got, want := snap.Label["state"], numWrites-1; got != want {
+		t.Errorf("Final state label: got %v, want %v", got, want)
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	m := New()
+	for i := 100; i > 0; i-- {
+		m.ObserveQuantile("exact", float64(i))
+	}
+	want := Quantiles{
+		Count: 100, Sum: 5050, Min: 1, Max: 100,
+		Values: []QuantileValue{{Q: 0.5, V: 50}, {Q: 0.95, V: 95}, {Q: 0.99, V: 99}},
+	}
+	if diff := cmp.Diff(want, m.Values().Quantile["exact"]); diff != "" {
+		t.Errorf("Exact quantiles (-want, +got):\n%s", diff)
+	}
+
+	// The configured quantiles are reported in increasing order.
+	m.SetQuantiles(0.9, 0, 1)
+	want.Values = []QuantileValue{{Q: 0, V: 1}, {Q: 0.9, V: 90}, {Q: 1, V: 100}}
+	if diff := cmp.Diff(want, m.Values().Quantile["exact"]); diff != "" {
+		t.Errorf("Configured quantiles (-want, +got):\n%s", diff)
+	}
+
+	// Beyond the size of the sketch, the quantiles are estimated, but the
+	// count, sum, and extremes remain exact.
+	const n = 100 * SketchSize
+	m.SetQuantiles(0.5, 0.95)
+	for i := 0; i < n; i++ {
+		m.ObserveQuantile("approx", float64(i))
+	}
+	got := m.Values().Quantile["approx"]
+	if got.Count != n || got.Sum != n*(n-1)/2 || got.Min != 0 || got.Max != n-1 {
+		t.Errorf("Approximate sketch: got count=%d sum=%v min=%v max=%v, want %d, %v, 0, %d",
+			got.Count, got.Sum, got.Min, got.Max, n, n*(n-1)/2, n-1)
+	}
+	for _, v := range got.Values {
+		if want := v.Q * n; math.Abs(v.V-want) > 0.05*n {
+			t.Errorf("Quantile %v: got %v, want about %v", v.Q, v.V, want)
+		}
+	}
+	if diff := cmp.Diff([]Key{
+		{Name: "approx", Kind: Quantile},
+		{Name: "exact", Kind: Quantile},
+	}, m.TypedKeys()); diff != "" {
+		t.Errorf("TypedKeys (-want, +got):\n%s", diff)
+	}
+
+	// Merging sketches that are not exact resamples them.
+	total := New()
+	Merge(total, m, m)
+	if got := total.Values().Quantile["approx"]; got.Count != 2*n || got.Max != n-1 {
+		t.Errorf("Merged sketch: got count=%d max=%v, want %d, %d", got.Count, got.Max, 2*n, n-1)
+	} else if med := got.Values[0].V; math.Abs(med-n/2) > 0.05*n {
+		t.Errorf("Merged median: got %v, want about %v", med, n/2)
+	}
+
+	func() {
+		defer func() {
+			if x := recover(); x == nil {
+				t.Error("SetQuantiles(1.5) did not panic")
+			}
+		}()
+		m.SetQuantiles(0.5, 1.5)
+	}()
+}
+
+func TestMetricsReset(t *testing.T) {
+	m := New()
+	m.SetKeyLimit(1)
+	m.Count("a.calls", 1)
+	m.CountAndSetMax("b.size", 5)
+	m.SetLabel("a.state", "ok")
+	m.CountBy("a.method", "X", 1)
+	m.SetGauge("a.depth", 2)
+	m.RegisterGaugeFunc("b.live", func() int64 { return 7 })
+	m.Mark("a.requests", 1)
+	m.ObserveQuantile("b.latency", 1)
+
+	// Resetting a view removes only its metrics.
+	m.WithPrefix("a.").Reset()
+	if diff := cmp.Diff([]string{"b.latency", "b.live", "b.size"}, m.Keys()); diff != "" {
+		t.Errorf("Keys after view reset (-want, +got):\n%s", diff)
+	}
+
+	// Registered gauge functions and settings survive a reset.
+	m.Reset()
+	if diff := cmp.Diff([]string{"b.live"}, m.Keys()); diff != "" {
+		t.Errorf("Keys after reset (-want, +got):\n%s", diff)
+	}
+	m.CountBy("a.method", "X", 1)
+	m.CountBy("a.method", "Y", 1)
+	if got := m.Values().KeyedCounter["a.method"]; !cmp.Equal(got, map[string]int64{"X": 1, OtherKey: 1}) {
+		t.Errorf("Keyed counter after reset: got %v, want the key limit kept", got)
+	}
+
+	var nilM *M
+	nilM.Reset() // does nothing
+}
+
+func TestDeltaSnapshot(t *testing.T) {
+	m := New()
+	m.Count("calls", 3)
+	m.CountAndSetMax("size", 10)
+	m.CountBy("method", "X", 2)
+	m.SetLabel("state", "ok")
+
+	d := m.DeltaSnapshot()
+	if diff := cmp.Diff(Snapshot{
+		Counter:      map[string]int64{"calls": 3, "size": 10},
+		MaxValue:     map[string]int64{"size": 10},
+		Label:        map[string]interface{}{"state": "ok"},
+		KeyedCounter: map[string]map[string]int64{"method": {"X": 2}},
+		Gauge:        map[string]int64{},
+		Rate:         map[string]Rates{},
+		Quantile:     map[string]Quantiles{},
+	}, d); diff != "" {
+		t.Errorf("First delta (-want, +got):\n%s", diff)
+	}
+
+	// Later deltas report only the changes to counters, while maxima and
+	// labels remain absolute, and the totals are not affected.
+	m.Count("calls", 2)
+	m.CountAndSetMax("size", 4)
+	m.CountBy("method", "Y", 1)
+	d = m.DeltaSnapshot()
+	if diff := cmp.Diff(map[string]int64{"calls": 2, "size": 4}, d.Counter); diff != "" {
+		t.Errorf("Delta counters (-want, +got):\n%s", diff)
+	}
+	if got := d.MaxValue["size"]; got != 10 {
+		t.Errorf("Delta max value: got %d, want 10", got)
+	}
+	if diff := cmp.Diff(map[string]map[string]int64{"method": {"X": 0, "Y": 1}}, d.KeyedCounter); diff != "" {
+		t.Errorf("Delta keyed counters (-want, +got):\n%s", diff)
+	}
+	if got := m.Values().Counter; !cmp.Equal(got, map[string]int64{"calls": 5, "size": 14}) {
+		t.Errorf("Totals: got %v, want calls=5, size=14", got)
+	}
+
+	// After a reset, the delta is the value since the reset.
+	m.Reset()
+	m.Count("calls", 1)
+	if got := m.DeltaSnapshot().Counter; !cmp.Equal(got, map[string]int64{"calls": 1}) {
+		t.Errorf("Delta after reset: got %v, want calls=1", got)
+	}
+
+	// Deltas taken through a view share the tracking of the collector.
+	v := m.WithPrefix("v.")
+	v.Count("n", 4)
+	m.Count("calls", 1)
+	if got := v.DeltaSnapshot().Counter; !cmp.Equal(got, map[string]int64{"n": 4}) {
+		t.Errorf("View delta: got %v, want n=4", got)
+	}
+	if got := m.DeltaSnapshot().Counter; !cmp.Equal(got, map[string]int64{"calls": 1, "v.n": 0}) {
+		t.Errorf("Delta after view delta: got %v, want calls=1, v.n=0", got)
+	}
+
+	// Concurrent updates are each reported by exactly one delta.
+	const numWriters = 8
+	const numWrites = 2000
+	c := New()
+	var wg sync.WaitGroup
+	for i := 0; i < numWriters; i++ {
+		wg.Add(1)
+		key := fmt.Sprint("k", i%2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numWrites; j++ {
+				c.Count("n", 1)
+				c.CountBy("keyed", key, 1)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() { wg.Wait(); close(done) }()
+	var sum, keyedSum int64
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		d := c.DeltaSnapshot()
+		sum += d.Counter["n"]
+		for _, n := range d.KeyedCounter["keyed"] {
+			keyedSum += n
+		}
+	}
+	const want = numWriters * numWrites
+	if sum != want || keyedSum != want {
+		t.Errorf("Sum of deltas: got %d, keyed %d; want %d", sum, keyedSum, want)
+	}
+	if got := c.Values().Counter["n"]; got != want {
+		t.Errorf("Total: got %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,26 @@
+package prom_test
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/handler"
+	"github.com/yinfei8/jrpc2/metrics"
+	"github.com/yinfei8/jrpc2/metrics/prom"
+)
+
+func Example() {
+	// Collect metrics from a server.
+	m := metrics.New()
+	srv := jrpc2.NewServer(handler.Map{}, &jrpc2.ServerOptions{Metrics: m})
+	_ = srv // ... start the server on a channel
+
+	// Serve the metrics to Prometheus over HTTP.
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(prom.NewCollector(m, &prom.Options{Namespace: "jrpc2"}))
+	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	log.Fatal(http.ListenAndServe("localhost:9090", nil))
+}
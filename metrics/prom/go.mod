@@ -0,0 +1,25 @@
+module github.com/yinfei8/jrpc2/metrics/prom
+
+go 1.18
+
+require (
+	github.com/prometheus/client_golang v1.15.1
+	github.com/yinfei8/jrpc2 v0.0.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/prometheus/client_model v0.3.0 // indirect
+	github.com/prometheus/common v0.42.0 // indirect
+	github.com/prometheus/procfs v0.9.0 // indirect
+	golang.org/x/sync v0.3.0 // indirect
+	golang.org/x/sys v0.7.0 // indirect
+	google.golang.org/protobuf v1.30.0 // indirect
+)
+
+// The collector is developed together with the metrics package.
+replace github.com/yinfei8/jrpc2 => ../..
@@ -0,0 +1,185 @@
+// Package prom exports the metrics collected by a *metrics.M to Prometheus.
+//
+// This package is a separate module, so that programs that use jrpc2 without
+// Prometheus do not depend on the Prometheus client library.
+//
+// A Collector reports each kind of metric as follows, where the metric names
+// are converted to valid Prometheus names by replacing each character that is
+// not permitted with an underscore, and adding the configured namespace:
+//
+//    counter "rpc.requests"          ⇒ counter "rpc_requests"
+//    max value "rpc.bytesRead"       ⇒ gauge "rpc_bytesRead_max"
+//    label "rpc.lastCancelReason"    ⇒ gauge "rpc_lastCancelReason_info" = 1, with label value="..."
+//    keyed counter "rpc.methodCalls" ⇒ counter "rpc_methodCalls", with label key="..."
+//    gauge "rpc.inflight"            ⇒ gauge "rpc_inflight"
+//    rate "rpc.requests"             ⇒ gauge "rpc_requests_rate", with label window="1s", "10s", or "60s"
+//    quantile sketch "rpc.latency"   ⇒ summary "rpc_latency", with label quantile="..."
+//
+// For example, to serve the metrics of a server over HTTP:
+//
+//    m := metrics.New()
+//    srv := jrpc2.NewServer(assigner, &jrpc2.ServerOptions{Metrics: m})
+//
+//    reg := prometheus.NewRegistry()
+//    reg.MustRegister(prom.NewCollector(m, &prom.Options{Namespace: "jrpc2"}))
+//    http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+package prom
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/yinfei8/jrpc2/metrics"
+)
+
+// Options control the metrics reported by a Collector. A nil *Options provides
+// default values as described.
+type Options struct {
+	// If set, this namespace is added to the name of each metric, joined to
+	// it with an underscore.
+	Namespace string
+
+	// Labels with constant values, added to each metric.
+	ConstLabels prometheus.Labels
+
+	// The name of the label that carries the key of a keyed counter.
+	// If empty, "key" is used.
+	KeyLabel string
+}
+
+func (o *Options) namespace() string {
+	if o == nil {
+		return ""
+	}
+	return o.Namespace
+}
+
+func (o *Options) constLabels() prometheus.Labels {
+	if o == nil {
+		return nil
+	}
+	return o.ConstLabels
+}
+
+func (o *Options) keyLabel() string {
+	if o == nil || o.KeyLabel == "" {
+		return "key"
+	}
+	return o.KeyLabel
+}
+
+// A Collector implements the prometheus.Collector interface for the metrics
+// collected by a *metrics.M.
+//
+// Since the metrics of an M are not known in advance, a Collector is an
+// "unchecked" collector: Its Describe method reports no descriptors.
+type Collector struct {
+	m    *metrics.M
+	opts *Options
+}
+
+// NewCollector returns a Collector that reports the metrics collected by m.
+func NewCollector(m *metrics.M, opts *Options) *Collector {
+	return &Collector{m: m, opts: opts}
+}
+
+// Describe implements part of the prometheus.Collector interface. It reports
+// no descriptors.
+func (c *Collector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect implements part of the prometheus.Collector interface. It takes a
+// snapshot of the metrics, so that the collector is locked only while they are
+// copied, and then reports the values of the snapshot.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	snap := c.m.Values()
+	for _, name := range sortedKeys(snap.Counter) {
+		c.emit(ch, name, "", prometheus.CounterValue, float64(snap.Counter[name]), nil)
+	}
+	for _, name := range sortedKeys(snap.MaxValue) {
+		c.emit(ch, name, "_max", prometheus.GaugeValue, float64(snap.MaxValue[name]), nil)
+	}
+	for _, name := range sortedKeys(snap.Gauge) {
+		c.emit(ch, name, "", prometheus.GaugeValue, float64(snap.Gauge[name]), nil)
+	}
+	for _, name := range sortedKeys(snap.Rate) {
+		r := snap.Rate[name]
+		for _, w := range []struct {
+			window string
+			value  float64
+		}{{"1s", r.Last1s}, {"10s", r.Last10s}, {"60s", r.Last60s}} {
+			c.emit(ch, name, "_rate", prometheus.GaugeValue, w.value, prometheus.Labels{"window": w.window})
+		}
+	}
+	for _, name := range sortedKeys(snap.Quantile) {
+		c.emitSummary(ch, name, snap.Quantile[name])
+	}
+	for _, name := range sortedKeys(snap.Label) {
+		c.emit(ch, name, "_info", prometheus.GaugeValue, 1, prometheus.Labels{
+			"value": fmt.Sprint(snap.Label[name]),
+		})
+	}
+	for _, name := range sortedKeys(snap.KeyedCounter) {
+		vals := snap.KeyedCounter[name]
+		for _, key := range sortedKeys(vals) {
+			c.emit(ch, name, "", prometheus.CounterValue, float64(vals[key]), prometheus.Labels{
+				c.opts.keyLabel(): key,
+			})
+		}
+	}
+}
+
+// emit reports the value of the metric with the given name and suffix.
+func (c *Collector) emit(ch chan<- prometheus.Metric, name, suffix string, vt prometheus.ValueType, v float64, labels prometheus.Labels) {
+	var names, values []string
+	for _, key := range sortedKeys(labels) {
+		names = append(names, key)
+		values = append(values, labels[key])
+	}
+	fq := prometheus.BuildFQName(c.opts.namespace(), "", metricName(name)+suffix)
+	desc := prometheus.NewDesc(fq, fmt.Sprintf("The jrpc2 metric %q.", name), names, c.opts.constLabels())
+	m, err := prometheus.NewConstMetric(desc, vt, v, values...)
+	if err != nil {
+		m = prometheus.NewInvalidMetric(desc, err)
+	}
+	ch <- m
+}
+
+// emitSummary reports the quantile sketch with the given name as a summary.
+func (c *Collector) emitSummary(ch chan<- prometheus.Metric, name string, q metrics.Quantiles) {
+	fq := prometheus.BuildFQName(c.opts.namespace(), "", metricName(name))
+	desc := prometheus.NewDesc(fq, fmt.Sprintf("The jrpc2 metric %q.", name), nil, c.opts.constLabels())
+	vals := make(map[float64]float64, len(q.Values))
+	for _, v := range q.Values {
+		vals[v.Q] = v.V
+	}
+	m, err := prometheus.NewConstSummary(desc, uint64(q.Count), q.Sum, vals)
+	if err != nil {
+		m = prometheus.NewInvalidMetric(desc, err)
+	}
+	ch <- m
+}
+
+// metricName converts name to a valid Prometheus metric name.
+func metricName(name string) string {
+	s := strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "_" + s
+	}
+	return s
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,93 @@
+package prom_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/yinfei8/jrpc2/metrics"
+	"github.com/yinfei8/jrpc2/metrics/prom"
+)
+
+func TestCollector(t *testing.T) {
+	m := metrics.New()
+	m.Count("rpc.requests", 5)
+	m.CountAndSetMax("rpc.bytesRead", 120)
+	m.CountAndSetMax("rpc.bytesRead", 80)
+	m.SetLabel("rpc.lastMethod", "Math.Add")
+	m.CountBy("rpc.methodCalls", "Math.Add", 3)
+	m.CountBy("rpc.methodCalls", "Math.Mul", 1)
+	m.RegisterGaugeFunc("rpc.inflight", func() int64 { return 2 })
+	for _, v := range []float64{4, 1, 3, 2} {
+		m.ObserveQuantile("rpc.latency", v)
+	}
+	now := time.Unix(1000, 0)
+	m.SetClock(func() time.Time { return now })
+	m.Mark("rpc.requests", 20)
+	now = now.Add(time.Second)
+
+	c := prom.NewCollector(m, &prom.Options{
+		Namespace:   "test",
+		ConstLabels: prometheus.Labels{"server": "a"},
+		KeyLabel:    "method",
+	})
+	const want = `
+# HELP test_rpc_bytesRead The jrpc2 metric "rpc.bytesRead".
+# TYPE test_rpc_bytesRead counter
+test_rpc_bytesRead{server="a"} 200
+# HELP test_rpc_bytesRead_max The jrpc2 metric "rpc.bytesRead".
+# TYPE test_rpc_bytesRead_max gauge
+test_rpc_bytesRead_max{server="a"} 120
+# HELP test_rpc_inflight The jrpc2 metric "rpc.inflight".
+# TYPE test_rpc_inflight gauge
+test_rpc_inflight{server="a"} 2
+# HELP test_rpc_lastMethod_info The jrpc2 metric "rpc.lastMethod".
+# TYPE test_rpc_lastMethod_info gauge
+test_rpc_lastMethod_info{server="a",value="Math.Add"} 1
+# HELP test_rpc_latency The jrpc2 metric "rpc.latency".
+# TYPE test_rpc_latency summary
+test_rpc_latency{server="a",quantile="0.5"} 2
+test_rpc_latency{server="a",quantile="0.95"} 4
+test_rpc_latency{server="a",quantile="0.99"} 4
+test_rpc_latency_sum{server="a"} 10
+test_rpc_latency_count{server="a"} 4
+# HELP test_rpc_methodCalls The jrpc2 metric "rpc.methodCalls".
+# TYPE test_rpc_methodCalls counter
+test_rpc_methodCalls{method="Math.Add",server="a"} 3
+test_rpc_methodCalls{method="Math.Mul",server="a"} 1
+# HELP test_rpc_requests_rate The jrpc2 metric "rpc.requests".
+# TYPE test_rpc_requests_rate gauge
+test_rpc_requests_rate{server="a",window="10s"} 2
+test_rpc_requests_rate{server="a",window="1s"} 20
+test_rpc_requests_rate{server="a",window="60s"} 0.3333333333333333
+# HELP test_rpc_requests The jrpc2 metric "rpc.requests".
+# TYPE test_rpc_requests counter
+test_rpc_requests{server="a"} 5
+`
+	if err := testutil.CollectAndCompare(c, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// A nil *M and nil options report no metrics.
+	if n := testutil.CollectAndCount(prom.NewCollector(nil, nil)); n != 0 {
+		t.Errorf("Empty collector: got %d metrics, want 0", n)
+	}
+
+	// Names are sanitized, and the key label defaults to "key".
+	m2 := metrics.New()
+	m2.Count("rpc.errors.-32601", 2)
+	m2.CountBy("calls", "x", 1)
+	const want2 = `
+# HELP calls The jrpc2 metric "calls".
+# TYPE calls counter
+calls{key="x"} 1
+# HELP rpc_errors__32601 The jrpc2 metric "rpc.errors.-32601".
+# TYPE rpc_errors__32601 counter
+rpc_errors__32601 2
+`
+	if err := testutil.CollectAndCompare(prom.NewCollector(m2, nil), strings.NewReader(want2)); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// SketchSize is the maximum number of samples kept by a quantile sketch (see
+// ObserveQuantile). Each sketch uses at most SketchSize 8-byte samples, plus
+// a few words of bookkeeping, about 8 KiB in all, however many values are
+// observed.
+const SketchSize = 1024
+
+// DefaultQuantiles are the quantiles reported for quantile sketches, unless
+// changed by SetQuantiles.
+var DefaultQuantiles = []float64{0.5, 0.95, 0.99}
+
+// A sketch estimates the quantiles of a stream of values from a uniform
+// random sample of at most SketchSize of them (a reservoir). Until more than
+// SketchSize values are observed, the sample includes every value, and the
+// quantiles are exact.
+type sketch struct {
+	samples  []float64
+	count    int64
+	sum      float64
+	min, max float64
+	rng      uint64 // state of the sampling generator (see next)
+}
+
+// next returns a pseudo-random value from the xorshift64* generator of s.
+// The generator is deterministic, so that sketches are reproducible; it is
+// used instead of math/rand to keep the sketch small.
+func (s *sketch) next() uint64 {
+	if s.rng == 0 {
+		s.rng = 0x9e3779b97f4a7c15
+	}
+	s.rng ^= s.rng >> 12
+	s.rng ^= s.rng << 25
+	s.rng ^= s.rng >> 27
+	return s.rng * 0x2545f4914f6cdd1d
+}
+
+// observe adds v to the values summarized by s.
+func (s *sketch) observe(v float64) {
+	s.count++
+	s.sum += v
+	if s.count == 1 || v < s.min {
+		s.min = v
+	}
+	if s.count == 1 || v > s.max {
+		s.max = v
+	}
+	if len(s.samples) < SketchSize {
+		s.samples = append(s.samples, v)
+	} else if j := s.next() % uint64(s.count); j < SketchSize {
+		s.samples[j] = v
+	}
+}
+
+// merge adds the values summarized by o to s. If the samples of both
+// sketches include all their values, and together fit in a sketch, the
+// result is exact. Otherwise, the samples of the result are drawn from those
+// of s and o in proportion to the number of values each summarizes.
+func (s *sketch) merge(o sketch) {
+	if o.count == 0 {
+		return
+	} else if s.count == 0 {
+		rng := s.rng
+		*s = o
+		s.samples = append([]float64(nil), o.samples...)
+		s.rng = rng
+		return
+	}
+	exact := s.count == int64(len(s.samples)) && o.count == int64(len(o.samples))
+	if exact && len(s.samples)+len(o.samples) <= SketchSize {
+		s.samples = append(s.samples, o.samples...)
+	} else {
+		n := len(s.samples) + len(o.samples)
+		if n > SketchSize {
+			n = SketchSize
+		}
+		total := uint64(s.count + o.count)
+		merged := make([]float64, n)
+		for i := range merged {
+			if s.next()%total < uint64(s.count) {
+				merged[i] = s.samples[s.next()%uint64(len(s.samples))]
+			} else {
+				merged[i] = o.samples[s.next()%uint64(len(o.samples))]
+			}
+		}
+		s.samples = merged
+	}
+	s.count += o.count
+	s.sum += o.sum
+	s.min = math.Min(s.min, o.min)
+	s.max = math.Max(s.max, o.max)
+}
+
+// quantiles reports the values of s at each of qs, which must be sorted.
+func (s *sketch) quantiles(qs []float64) Quantiles {
+	out := Quantiles{Count: s.count, Sum: s.sum, Min: s.min, Max: s.max}
+	if len(s.samples) == 0 {
+		return out
+	}
+	sorted := append([]float64(nil), s.samples...)
+	sort.Float64s(sorted)
+	for _, q := range qs {
+		// Use the nearest-rank method: The value of rank ⌈q⋅n⌉.
+		i := int(math.Ceil(q*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		out.Values = append(out.Values, QuantileValue{Q: q, V: sorted[i]})
+	}
+	return out
+}
+
+// Quantiles summarizes the values observed for a quantile sketch (see
+// ObserveQuantile). The count, sum, minimum, and maximum are exact; the
+// quantile values are estimated from a sample of the observed values.
+type Quantiles struct {
+	Count  int64           `json:"count"`
+	Sum    float64         `json:"sum"`
+	Min    float64         `json:"min"`
+	Max    float64         `json:"max"`
+	Values []QuantileValue `json:"values,omitempty"` // in increasing order of Q
+}
+
+// A QuantileValue is the estimated value V of quantile Q, for 0 ≤ Q ≤ 1.
+// For example, if Q is 0.95, then about 95% of the values observed are less
+// than or equal to V.
+type QuantileValue struct {
+	Q float64 `json:"q"`
+	V float64 `json:"value"`
+}
+
+// checkQuantiles returns a sorted copy of qs, or panics if any of qs is not
+// between 0 and 1 inclusive.
+func checkQuantiles(qs []float64) []float64 {
+	out := append([]float64(nil), qs...)
+	for _, q := range out {
+		if !(q >= 0 && q <= 1) {
+			panic(fmt.Sprintf("quantile %v out of range", q))
+		}
+	}
+	sort.Float64s(out)
+	return out
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import "time"
+
+// rateWindow is the number of complete seconds of history kept for a rate.
+const rateWindow = 60
+
+// A rate counts the events marked during each of the most recent seconds.
+// The buckets are advanced lazily, when the rate is marked or read, so an
+// idle rate costs nothing.
+type rate struct {
+	// The bucket for second s is buckets[s%len(buckets)]. One extra bucket
+	// holds the current, incomplete second.
+	buckets [rateWindow + 1]int64
+	last    int64 // the second of the most recent bucket
+}
+
+// advance moves the newest bucket of r to the second now, clearing the
+// buckets for the seconds skipped. If the clock moved backward, r is not
+// changed, and events are counted in the newest bucket.
+func (r *rate) advance(now time.Time) {
+	sec := now.Unix()
+	if sec <= r.last {
+		return
+	}
+	if d := sec - r.last; d >= int64(len(r.buckets)) {
+		r.buckets = [len(r.buckets)]int64{}
+	} else {
+		for s := r.last + 1; s <= sec; s++ {
+			r.buckets[s%int64(len(r.buckets))] = 0
+		}
+	}
+	r.last = sec
+}
+
+// mark adds n events at time now.
+func (r *rate) mark(now time.Time, n int64) {
+	r.advance(now)
+	r.buckets[r.last%int64(len(r.buckets))] += n
+}
+
+// rates reports the rates of r as of time now.
+func (r *rate) rates(now time.Time) Rates {
+	r.advance(now)
+	return Rates{
+		Last1s:  r.average(1),
+		Last10s: r.average(10),
+		Last60s: r.average(60),
+	}
+}
+
+// average returns the average number of events per second during the n
+// complete seconds before the newest bucket.
+func (r *rate) average(n int64) float64 {
+	var sum int64
+	for s := r.last - n; s < r.last; s++ {
+		sum += r.buckets[s%int64(len(r.buckets))]
+	}
+	return float64(sum) / float64(n)
+}
+
+// Rates reports the average number of events per second marked for a rate
+// metric (see Mark) over recent intervals. Only complete seconds are counted,
+// so events marked during the current second are not yet reflected.
+type Rates struct {
+	Last1s  float64 `json:"1s"`  // during the previous second
+	Last10s float64 `json:"10s"` // during the previous 10 seconds
+	Last60s float64 `json:"60s"` // during the previous 60 seconds
+}
+
+// merge adds the events counted by o to r.
+func (r *rate) merge(o rate) {
+	if o.last > r.last {
+		r.advance(time.Unix(o.last, 0))
+	} else {
+		o.advance(time.Unix(r.last, 0))
+	}
+	for i, n := range o.buckets {
+		r.buckets[i] += n
+	}
+}
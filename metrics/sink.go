@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Sink receives the updates made to the metrics of a collector as they
+// happen, for export to an external system such as statsd. See NewWithSink.
+// The methods of a Sink must be safe for concurrent use by multiple
+// goroutines, and should not block.
+type Sink interface {
+	// CountDelta reports that n was added to the counter named.
+	CountDelta(name string, n int64)
+
+	// SetMax reports that v was recorded for the maximum value named.
+	SetMax(name string, v int64)
+
+	// Observe reports that the value named was set to v.
+	Observe(name string, v float64)
+}
+
+// NewWithSink creates a new, empty metrics collector that reports each update
+// of its metrics to sink, in addition to recording it. If sink == nil, the
+// result is the same as New.
+//
+// Updates are reported as follows:
+//
+//    Count(name, n)            CountDelta(name, n)
+//    CountBy(name, key, n)     CountDelta(name+"."+key, n), where key may be OtherKey
+//    SetMaxValue(name, n)      SetMax(name, n)
+//    CountAndSetMax            both CountDelta and SetMax
+//    SetGauge(name, v)         Observe(name, v)
+//    ObserveQuantile(name, v)  Observe(name, v)
+//
+// Labels, rates, and gauges computed by registered functions, are not
+// reported. The events measured by a rate are usually also counted, as the
+// server does for "rpc.requests", so reporting marks as counter deltas would
+// count each event twice; the sink can compute rates from the counter deltas.
+//
+// The sink is called after the update is recorded, without holding the lock
+// of the collector, so it may read the metrics of the collector.
+func NewWithSink(sink Sink) *M {
+	m := New()
+	m.sink = sink
+	return m
+}
+
+// BatchOptions control the behaviour of a BatchSink. A nil *BatchOptions
+// provides default values as described.
+type BatchOptions struct {
+	// The maximum number of pending updates to buffer before flushing them.
+	// Counter deltas and maximum values with the same name are combined, so
+	// each name counts once. If zero or negative, a limit of 256 is used.
+	MaxPending int
+
+	// The interval between periodic flushes. If zero or negative, an interval
+	// of one second is used.
+	Interval time.Duration
+}
+
+func (o *BatchOptions) maxPending() int {
+	if o == nil || o.MaxPending <= 0 {
+		return 256
+	}
+	return o.MaxPending
+}
+
+func (o *BatchOptions) interval() time.Duration {
+	if o == nil || o.Interval <= 0 {
+		return time.Second
+	}
+	return o.Interval
+}
+
+// A BatchSink is a Sink that buffers updates, and forwards them to another
+// sink in batches, so that an exporter that sends a message for each update
+// does not send one for every request. Deltas for the same counter are added
+// together, and maximum values with the same name are combined, before they
+// are forwarded. Observations are forwarded in order.
+//
+// A BatchSink flushes its buffered updates when the number pending reaches
+// the limit set by its options, periodically at the interval set by its
+// options, and when it is closed. The caller must call Close when the sink is
+// no longer needed, to stop the periodic flushes.
+type BatchSink struct {
+	sink Sink
+	max  int
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once // for closing stop
+
+	// Flushes are serialized, so that the updates buffered are forwarded in
+	// the order the batches were taken.
+	fmu sync.Mutex
+
+	mu    sync.Mutex
+	delta map[string]int64
+	maxv  map[string]int64
+	obs   []observation
+}
+
+type observation struct {
+	name  string
+	value float64
+}
+
+// NewBatchSink returns a BatchSink that forwards batches of updates to sink.
+func NewBatchSink(sink Sink, opts *BatchOptions) *BatchSink {
+	b := &BatchSink{
+		sink:  sink,
+		max:   opts.maxPending(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+		delta: make(map[string]int64),
+		maxv:  make(map[string]int64),
+	}
+	go b.flushEvery(opts.interval())
+	return b
+}
+
+func (b *BatchSink) flushEvery(d time.Duration) {
+	defer close(b.done)
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-t.C:
+			b.Flush()
+		}
+	}
+}
+
+// CountDelta implements part of the Sink interface.
+func (b *BatchSink) CountDelta(name string, n int64) {
+	b.mu.Lock()
+	b.delta[name] += n
+	b.unlockAndCheck()
+}
+
+// SetMax implements part of the Sink interface.
+func (b *BatchSink) SetMax(name string, v int64) {
+	b.mu.Lock()
+	if old, ok := b.maxv[name]; !ok || v > old {
+		b.maxv[name] = v
+	}
+	b.unlockAndCheck()
+}
+
+// Observe implements part of the Sink interface.
+func (b *BatchSink) Observe(name string, v float64) {
+	b.mu.Lock()
+	b.obs = append(b.obs, observation{name: name, value: v})
+	b.unlockAndCheck()
+}
+
+// unlockAndCheck releases the lock on the pending updates of b, and flushes
+// them if the limit is reached. The caller must hold b.mu.
+func (b *BatchSink) unlockAndCheck() {
+	full := len(b.delta)+len(b.maxv)+len(b.obs) >= b.max
+	b.mu.Unlock()
+	if full {
+		b.Flush()
+	}
+}
+
+// Flush forwards the pending updates of b to the underlying sink. Counter
+// deltas and maximum values are forwarded in order of name, followed by the
+// observations in the order they were made.
+func (b *BatchSink) Flush() {
+	b.fmu.Lock()
+	defer b.fmu.Unlock()
+
+	b.mu.Lock()
+	delta, maxv, obs := b.delta, b.maxv, b.obs
+	b.delta = make(map[string]int64)
+	b.maxv = make(map[string]int64)
+	b.obs = nil
+	b.mu.Unlock()
+
+	for _, name := range sortedNames(delta) {
+		b.sink.CountDelta(name, delta[name])
+	}
+	for _, name := range sortedNames(maxv) {
+		b.sink.SetMax(name, maxv[name])
+	}
+	for _, o := range obs {
+		b.sink.Observe(o.name, o.value)
+	}
+}
+
+// Close stops the periodic flushes of b, and flushes any pending updates.
+// Updates made after Close are forwarded only by an explicit Flush, or when
+// the limit on pending updates is reached.
+func (b *BatchSink) Close() {
+	b.once.Do(func() { close(b.stop) })
+	<-b.done
+	b.Flush()
+}
+
+func sortedNames(m map[string]int64) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
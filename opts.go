@@ -3,6 +3,7 @@ package jrpc2
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"runtime"
@@ -18,6 +19,13 @@ type ServerOptions struct {
 	// If not nil, send debug logs here.
 	Logger *log.Logger
 
+	// If positive, the server writes at most this many debug log messages per
+	// second to Logger, and discards the rest, so that a burst of requests
+	// does not flood the log. Messages that report an error are always
+	// written, and do not count against the limit. When messages have been
+	// discarded, the next message written is preceded by a count of them.
+	LogLimit int
+
 	// If not nil, the methods of this value are called to log each request
 	// received and each response or error returned.
 	RPCLog RPCLogger
@@ -31,6 +39,20 @@ type ServerOptions struct {
 	// the Notify and Callback methods of the server report errors if called.
 	AllowPush bool
 
+	// If positive, server notifications posted by Notify (and PushNotify) are
+	// buffered in a queue of this capacity, and sent to the client by a
+	// separate goroutine, so that the caller does not wait for a slow client.
+	// Notify then reports success once the notification is queued. Server
+	// callbacks are not queued. Notifications still queued when the server
+	// stops are discarded.
+	PushQueue int
+
+	// The action taken when a notification is posted while the push queue is
+	// full. Each such event is counted by the server metric
+	// "rpc.pushOverflow". The default is PushBlock. This option has no effect
+	// unless PushQueue is positive.
+	PushOverflow PushPolicy
+
 	// Instructs the server to disable the built-in rpc.* handler methods.
 	//
 	// By default, a server reserves all rpc.* methods, even if the given
@@ -38,26 +60,152 @@ type ServerOptions struct {
 	// along to the given assigner.
 	DisableBuiltin bool
 
+	// If set, the server uses this prefix for its built-in methods in place of
+	// "rpc.", so that for example the prefix "sys." gives the methods
+	// sys.serverInfo and sys.cancel. The server reserves all methods having
+	// this prefix (unless DisableBuiltin is set), and passes rpc.* methods
+	// along to the given assigner. Clients of such a server should set the
+	// same prefix in their options.
+	BuiltinPrefix string
+
 	// Allows up to the specified number of goroutines to execute concurrently
 	// in request handlers. A value less than 1 uses runtime.NumCPU().  Note
-	// that this setting does not constrain order of issue.
+	// that this setting does not constrain order of issue. Calls to built-in
+	// methods do not count against this limit, so that a client can cancel
+	// requests while the server is busy.
 	Concurrency int
 
+	// The maximum number of request batches the server buffers while it is
+	// paused (see Server.Pause). Once this many are waiting, the server
+	// rejects further requests with code.Overloaded until it is resumed,
+	// except for calls to the built-in methods that bypass the pause. A value
+	// less than 1 uses a limit of 256.
+	PauseLimit int
+
+	// If positive, the server executes handlers on a fixed pool of this many
+	// long-lived goroutines fed from a queue, rather than starting a new
+	// goroutine for each request. This reduces goroutine churn under heavy
+	// load. A value less than the effective Concurrency is raised to match it,
+	// so that the pool does not further limit concurrency.
+	WorkerPool int
+
+	// If positive, the maximum total size in bytes of the parameters of the
+	// requests in flight on the server. A request that would exceed this
+	// budget is rejected with code.Overloaded without calling its handler.
+	// The size of a request counts against the budget from when it is
+	// received until its handler returns. Calls to built-in methods are not
+	// counted. Rejected requests are counted by the server metric
+	// "rpc.budgetExceeded".
+	MemoryBudget int
+
+	// Selects how the server records the time taken by the handler of each
+	// request, from when the handler is called until it returns, in the
+	// metric "rpc.latency": as a histogram, or as a quantile sketch. The
+	// default is LatencyNone. Calls to built-in methods are not recorded.
+	Latency LatencyMetric
+
 	// If set, this function is called with the method name and encoded request
 	// parameters received from the client, before they are delivered to the
 	// handler. Its return value replaces the context and argument values. This
 	// allows the server to decode context metadata sent by the client.
 	// If unset, ctx and params are used as given.
+	//
+	// If DecodeContext reports an error of concrete type *Error, the request
+	// fails with that error. Otherwise, the request fails with an error whose
+	// code is code.InternalError.
+	//
+	// The server calls DecodeContext before CheckRequest and before the
+	// methods of the RPCLogger, so the contexts passed to those hooks include
+	// the values it attaches, such as the metadata decoded by jctx.Decode.
 	DecodeContext func(context.Context, string, json.RawMessage) (context.Context, json.RawMessage, error)
 
 	// If set, this function is called with the context and the client request
 	// to be delivered to the handler. If CheckRequest reports a non-nil error,
-	// the request fails with that error without invoking the handler.
+	// the request fails with that error without invoking the handler. The
+	// context includes the values attached by DecodeContext, and the request
+	// can also be recovered from it using InboundRequest.
 	CheckRequest func(ctx context.Context, req *Request) error
 
+	// If set, this function is called with the context of each notification
+	// for a known method, after CheckRequest, to report whether the client
+	// expected a reply. If it reports true, the notification is treated as a
+	// malformed call that is missing its ID: Its handler is not called, and
+	// the server replies with an error whose code is code.InvalidRequest and
+	// whose ID is null. Such requests are counted by the server metric
+	// "rpc.missingID".
+	//
+	// This allows a server to detect clients that omit the ID from calls, for
+	// example by reporting true for methods that are never used as
+	// notifications. If unset, all notifications are handled normally.
+	ExpectsReply func(ctx context.Context, req *Request) bool
+
+	// If set, this function is called when the server receives a message that
+	// is not a valid JSON request or batch, with a copy of the message and the
+	// error reported to the client. The hook is called by the goroutine that
+	// reads from the channel, so it should not block. The message is never
+	// delivered to a handler.
+	OnParseError func(raw []byte, err error)
+
+	// If true, request parameters decoded by the UnmarshalParams method of
+	// the request, including those decoded by handlers constructed with
+	// handler.New, must not have object keys that do not correspond to a field
+	// of the target value. A request with such keys fails with the error code
+	// code.InvalidParams. Otherwise unknown keys are ignored, unless the
+	// target requests otherwise (see jrpc2.StrictFields).
+	StrictParams bool
+
+	// If true, an error returned by a handler whose code is in the range
+	// reserved by the JSON-RPC specification (see code.IsReserved), but is not
+	// one of the codes defined by the code package, is reported to the client
+	// as code.InternalError. Otherwise such errors are reported unchanged. In
+	// either case the server logs a warning.
+	StrictErrorCodes bool
+
+	// If true, the error data of each error response sent by the server
+	// include the string name of the error code (as given by its String
+	// method) under the key "codeName". If the error has no data, the data
+	// become an object with only that key. If the data are an object without
+	// a "codeName" key, the key is added. Other data are sent unchanged.
+	// The numeric code is always reported as the specification requires.
+	ErrorCodeNames bool
+
+	// If set, this function is called for each request to obtain its
+	// idempotency key, for example from the request context metadata. If it
+	// returns a non-empty key, and the server has a retained result for an
+	// earlier request to the same method with the same key, the server replies
+	// with that result without calling the handler. If the earlier request is
+	// still in progress, the server waits for it to finish.
+	//
+	// A result is retained only if the handler returned before the request
+	// was cancelled. Duplicate requests answered this way are counted by the
+	// server metric "rpc.deduplicated".
+	IdempotencyKey func(ctx context.Context, req *Request) string
+
+	// How long the server retains the result of a request having an
+	// idempotency key. If zero, results are retained for 5 minutes. This is
+	// ignored if IdempotencyStore is set.
+	IdempotencyTTL time.Duration
+
+	// If set, the server retains the results of requests having an
+	// idempotency key in this store, which may be shared with other servers,
+	// so that a request retried on another connection is recognized. Each
+	// result is retained for the duration given to NewDedupStore. If nil, a
+	// new store is created for each server. This is ignored unless
+	// IdempotencyKey is set.
+	IdempotencyStore *DedupStore
+
 	// If set, use this value to record server metrics. All servers created
 	// from the same options will share the same metrics collector.  If none is
 	// set, an empty collector will be created for each new server.
+	//
+	// Among others, the server counts the error responses it sends by code,
+	// in counters named "rpc.errors.<code>", for example "rpc.errors.-32601"
+	// for code.MethodNotFound. It also counts the calls to each method, and the
+	// calls that failed, in the keyed counters "rpc.methodCalls" and
+	// "rpc.methodErrors" (see metrics.M.CountBy), and reports the number of
+	// requests awaiting a reply in the gauge "rpc.inflight" (see
+	// metrics.M.AddGauge). Servers sharing a collector report the total for
+	// all of them.
 	Metrics *metrics.M
 
 	// If nonzero this value as the server start time; otherwise, use the
@@ -65,17 +213,52 @@ type ServerOptions struct {
 	StartTime time.Time
 }
 
-func (s *ServerOptions) logger() logger {
+// logger returns the debug logging function for a server with options s, and
+// the output function it writes to, or nil if s has no Logger. Both share the
+// rate limit set by LogLimit.
+func (s *ServerOptions) logger() (logger, logOutput) {
 	if s == nil || s.Logger == nil {
-		return func(string, ...interface{}) {}
+		return func(string, ...interface{}) {}, nil
 	}
 	logger := s.Logger
-	return func(msg string, args ...interface{}) { logger.Output(2, fmt.Sprintf(msg, args...)) }
+	out := func(depth int, msg string, _ bool) { logger.Output(depth+1, msg) }
+	if s.LogLimit > 0 {
+		lim := &logLimiter{max: s.LogLimit, now: time.Now}
+		out = func(depth int, msg string, force bool) {
+			n, ok := lim.allow(force)
+			if !ok {
+				return
+			} else if n > 0 {
+				logger.Output(depth+1, fmt.Sprintf("[%d log messages discarded]", n))
+			}
+			logger.Output(depth+1, msg)
+		}
+	}
+	return func(msg string, args ...interface{}) {
+		out(2, fmt.Sprintf(msg, args...), reportsError(args))
+	}, out
 }
 
 func (s *ServerOptions) allowV1() bool      { return s != nil && s.AllowV1 }
 func (s *ServerOptions) allowPush() bool    { return s != nil && s.AllowPush }
 func (s *ServerOptions) allowBuiltin() bool { return s == nil || !s.DisableBuiltin }
+func (s *ServerOptions) strictCodes() bool  { return s != nil && s.StrictErrorCodes }
+func (s *ServerOptions) codeNames() bool    { return s != nil && s.ErrorCodeNames }
+func (s *ServerOptions) strictParams() bool { return s != nil && s.StrictParams }
+
+func (s *ServerOptions) pushQueue() (int, PushPolicy) {
+	if s == nil || s.PushQueue <= 0 {
+		return 0, PushBlock
+	}
+	return s.PushQueue, s.PushOverflow
+}
+
+func (s *ServerOptions) builtinPrefix() string {
+	if s == nil || s.BuiltinPrefix == "" {
+		return defaultBuiltinPrefix
+	}
+	return s.BuiltinPrefix
+}
 
 func (s *ServerOptions) concurrency() int64 {
 	if s == nil || s.Concurrency < 1 {
@@ -84,6 +267,47 @@ func (s *ServerOptions) concurrency() int64 {
 	return int64(s.Concurrency)
 }
 
+func (s *ServerOptions) pauseLimit() int {
+	if s == nil || s.PauseLimit < 1 {
+		return 256
+	}
+	return s.PauseLimit
+}
+
+func (s *ServerOptions) workerPool() int {
+	if s == nil || s.WorkerPool < 1 {
+		return 0
+	} else if c := int(s.concurrency()); s.WorkerPool < c {
+		return c
+	}
+	return s.WorkerPool
+}
+
+func (s *ServerOptions) memoryBudget() int {
+	if s == nil {
+		return 0
+	}
+	return s.MemoryBudget
+}
+
+func (s *ServerOptions) latency() LatencyMetric {
+	if s == nil {
+		return LatencyNone
+	}
+	return s.Latency
+}
+
+func (s *ServerOptions) dedup(m *metrics.M) *dedup {
+	if s == nil || s.IdempotencyKey == nil {
+		return nil
+	}
+	store := s.IdempotencyStore
+	if store == nil {
+		store = NewDedupStore(s.IdempotencyTTL)
+	}
+	return newDedup(s.IdempotencyKey, store, m)
+}
+
 func (s *ServerOptions) startTime() time.Time {
 	if s == nil {
 		return time.Time{}
@@ -111,6 +335,23 @@ func (s *ServerOptions) checkRequest() verifier {
 	return s.CheckRequest
 }
 
+type replyCheck = func(context.Context, *Request) bool
+
+func (s *ServerOptions) expectsReply() replyCheck {
+	if s == nil || s.ExpectsReply == nil {
+		return func(context.Context, *Request) bool { return false }
+	}
+	return s.ExpectsReply
+}
+
+func (s *ServerOptions) onParseError() func([]byte, error) {
+	if s == nil || s.OnParseError == nil {
+		return nil
+	}
+	h := s.OnParseError
+	return func(raw []byte, err error) { h(append([]byte(nil), raw...), err) }
+}
+
 func (s *ServerOptions) metrics() *metrics.M {
 	if s == nil || s.Metrics == nil {
 		return metrics.New()
@@ -132,13 +373,42 @@ type ClientOptions struct {
 	Logger *log.Logger
 
 	// Instructs the client to tolerate responses that do not include the
-	// required "jsonrpc" version marker.
+	// required "jsonrpc" version marker. A response that includes a marker
+	// other than "2.0" is always reported as an error.
 	AllowV1 bool
 
 	// Instructs the client not to send rpc.cancel notifications to the server
 	// when the context for an in-flight request terminates.
 	DisableCancel bool
 
+	// If set, the client uses this prefix for the built-in methods of the
+	// server in place of "rpc.", for example when sending cancellation
+	// notifications. It should match the BuiltinPrefix of the server.
+	BuiltinPrefix string
+
+	// If true, the client requires the parameters of each request to be a
+	// JSON object (or absent), for use with servers that do not accept
+	// positional parameters. A call, notification, or batch whose parameters
+	// encode as an array fails with code.InvalidRequest without sending
+	// anything to the server.
+	ForceObjectParams bool
+
+	// If positive, limits the number of requests that may be awaiting a reply
+	// from the server at once. A call or batch that would exceed the limit
+	// fails with ErrTooManyPending without sending anything to the server.
+	// Notifications do not count toward this limit.
+	MaxPending int
+
+	// If set, this function is called to obtain the ID for each request the
+	// client sends, in place of the client's internal counter. It must return
+	// a JSON string or number; otherwise the call fails without sending.
+	//
+	// An ID may be reused only after the response to the earlier request that
+	// used it has been delivered. A call or batch whose ID matches a request
+	// that is still pending, or another request in the same batch, fails with
+	// ErrDuplicateID without sending anything to the server.
+	NewID func() json.RawMessage
+
 	// If set, this function is called with the context, method name, and
 	// encoded request parameters before the request is sent to the server.
 	// Its return value replaces the request parameters. This allows the client
@@ -161,6 +431,14 @@ type ClientOptions struct {
 	// report a system error back to the server describing the error.
 	OnCallback func(context.Context, *Request) (interface{}, error)
 
+	// If set, this function is called if a response is received from the
+	// server whose ID does not match any pending request, for example because
+	// the server is confused about which requests it has received. If unset,
+	// such responses are logged and discarded. The hook is not called while
+	// the client holds its lock, so it may use the client, for example to
+	// issue a request or to close the client.
+	OnOrphanResponse func(*Response)
+
 	// If set, this function is called when the context for a request terminates.
 	// The function receives the client and the response that was cancelled.
 	// The hook can obtain the ID and error value from rsp.
@@ -179,8 +457,30 @@ func (c *ClientOptions) logger() logger {
 	return func(msg string, args ...interface{}) { logger.Output(2, fmt.Sprintf(msg, args...)) }
 }
 
-func (c *ClientOptions) allowV1() bool     { return c != nil && c.AllowV1 }
-func (c *ClientOptions) allowCancel() bool { return c == nil || !c.DisableCancel }
+func (c *ClientOptions) allowV1() bool      { return c != nil && c.AllowV1 }
+func (c *ClientOptions) allowCancel() bool  { return c == nil || !c.DisableCancel }
+func (c *ClientOptions) objectParams() bool { return c != nil && c.ForceObjectParams }
+
+func (c *ClientOptions) builtinPrefix() string {
+	if c == nil || c.BuiltinPrefix == "" {
+		return defaultBuiltinPrefix
+	}
+	return c.BuiltinPrefix
+}
+
+func (c *ClientOptions) maxPending() int {
+	if c == nil || c.MaxPending < 0 {
+		return 0
+	}
+	return c.MaxPending
+}
+
+func (c *ClientOptions) newID() func() json.RawMessage {
+	if c == nil {
+		return nil
+	}
+	return c.NewID
+}
 
 type encoder = func(context.Context, string, json.RawMessage) (json.RawMessage, error)
 
@@ -201,6 +501,16 @@ func (c *ClientOptions) handleNotification() func(*jmessage) {
 	return func(req *jmessage) { h(&Request{method: req.M, params: req.P}) }
 }
 
+func (c *ClientOptions) handleOrphan() func(*jmessage) {
+	if c == nil || c.OnOrphanResponse == nil {
+		return nil
+	}
+	h := c.OnOrphanResponse
+	return func(rsp *jmessage) {
+		h(&Response{id: string(fixID(rsp.ID)), err: rsp.E, result: rsp.R})
+	}
+}
+
 func (c *ClientOptions) handleCancel() func(*Client, *Response) {
 	if c == nil {
 		return nil
@@ -239,9 +549,7 @@ func (c *ClientOptions) handleCallback() func(*jmessage) []byte {
 		}
 		if err != nil {
 			rsp.R = nil
-			if e, ok := err.(*Error); ok {
-				rsp.E = e
-			} else {
+			if !errors.As(err, &rsp.E) {
 				rsp.E = &Error{code: code.FromError(err), message: err.Error()}
 			}
 		}
@@ -261,7 +569,8 @@ func panicToError(f func() (interface{}, error)) (v interface{}, err error) {
 
 // An RPCLogger receives callbacks from a server to record the receipt of
 // requests and the delivery of responses. These callbacks are invoked
-// synchronously with the processing of the request.
+// synchronously with the processing of the request. Their contexts include
+// the values attached by the DecodeContext hook of the server, if any.
 type RPCLogger interface {
 	// Called for each request received prior to invoking its handler.
 	LogRequest(ctx context.Context, req *Request)
@@ -269,6 +578,11 @@ type RPCLogger interface {
 	// Called for each response produced by a handler, immediately prior to
 	// sending it back to the client. The inbound request can be recovered from
 	// the context using jrpc2.InboundRequest.
+	//
+	// This is also called for the error response to a request rejected by
+	// the CheckRequest hook of the server, with the context passed to that
+	// hook. For requests that fail before their context is decoded, such as
+	// invalid requests, the context is nil.
 	LogResponse(ctx context.Context, rsp *Response)
 }
 
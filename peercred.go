@@ -0,0 +1,51 @@
+package jrpc2
+
+import (
+	"context"
+	"net"
+
+	"github.com/yinfei8/jrpc2/channel"
+)
+
+// Ucred describes the credentials of the process at the other end of a Unix
+// domain socket, as reported by the operating system when the connection was
+// established.
+type Ucred struct {
+	PID int // the process ID of the peer
+	UID int // the effective user ID of the peer
+	GID int // the effective group ID of the peer
+}
+
+// PeerCred returns the credentials of the client process for the server
+// associated with ctx, and reports whether they are known. The credentials
+// are known only if the server was started by StartConn with a connection on
+// a Unix domain socket, on a platform that supports reporting them (currently
+// Linux). The context passed to a handler and to the CheckRequest hook of the
+// server includes this value.
+func PeerCred(ctx context.Context) (*Ucred, bool) {
+	cred, ok := ctx.Value(peerCredKey{}).(*Ucred)
+	return cred, ok
+}
+
+type peerCredKey struct{}
+
+// StartConn enables processing of requests from conn, using framing to
+// construct a channel from it, as Start does. If conn is a Unix domain socket,
+// the credentials of the peer process are obtained from it and made available
+// to handlers via PeerCred. This function will panic if the server is already
+// running.
+func (s *Server) StartConn(conn net.Conn, framing channel.Framing) *Server {
+	var cred *Ucred
+	if uc, ok := conn.(*net.UnixConn); ok {
+		c, err := peerCred(uc)
+		if err != nil {
+			s.log("Reading peer credentials: %v", err)
+		}
+		cred = c
+	}
+	var rclose func() error
+	if rc, ok := conn.(interface{ CloseRead() error }); ok {
+		rclose = rc.CloseRead
+	}
+	return s.startWith(framing(conn, conn), cred, rclose)
+}
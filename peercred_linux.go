@@ -0,0 +1,25 @@
+package jrpc2
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCred reports the credentials of the peer of conn via SO_PEERCRED.
+func peerCred(conn *net.UnixConn) (*Ucred, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var serr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, serr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	} else if serr != nil {
+		return nil, serr
+	}
+	return &Ucred{PID: int(cred.Pid), UID: int(cred.Uid), GID: int(cred.Gid)}, nil
+}
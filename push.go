@@ -0,0 +1,147 @@
+package jrpc2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// A PushPolicy determines what a server does when a notification is posted
+// while its push queue is full. See ServerOptions.PushQueue.
+type PushPolicy int
+
+const (
+	// PushBlock makes Notify wait until there is space in the queue, or until
+	// its context ends.
+	PushBlock PushPolicy = iota
+
+	// PushDropOldest discards the oldest notification in the queue to make
+	// room for the new one.
+	PushDropOldest
+
+	// PushDropNewest discards the new notification, and Notify reports
+	// ErrPushOverflow.
+	PushDropNewest
+)
+
+// String returns a short name for the policy.
+func (p PushPolicy) String() string {
+	switch p {
+	case PushBlock:
+		return "block"
+	case PushDropOldest:
+		return "dropOldest"
+	case PushDropNewest:
+		return "dropNewest"
+	}
+	return "unknown"
+}
+
+// ErrPushOverflow is returned by Notify when a notification is discarded
+// because the push queue of the server is full.
+var ErrPushOverflow = errors.New("server push queue is full")
+
+// A pushQueue buffers server notifications for delivery to the client by a
+// separate goroutine, so that callers of Notify do not wait for a slow client.
+type pushQueue struct {
+	q      chan *jmessage
+	done   chan struct{} // closed when the server stops
+	policy PushPolicy
+}
+
+func newPushQueue(size int, policy PushPolicy) *pushQueue {
+	return &pushQueue{
+		q:      make(chan *jmessage, size),
+		done:   make(chan struct{}),
+		policy: policy,
+	}
+}
+
+// push adds msg to the queue according to the overflow policy of q. The
+// overflow function is called each time the queue is found to be full.
+func (q *pushQueue) push(ctx context.Context, msg *jmessage, overflow func()) error {
+	select {
+	case q.q <- msg:
+		return nil
+	case <-q.done:
+		return ErrConnClosed
+	default:
+	}
+	overflow()
+
+	switch q.policy {
+	case PushDropNewest:
+		return ErrPushOverflow
+
+	case PushDropOldest:
+		for {
+			select {
+			case q.q <- msg:
+				return nil
+			case <-q.done:
+				return ErrConnClosed
+			default:
+			}
+			select {
+			case <-q.q: // discard the oldest
+			default: // the sender got there first
+			}
+		}
+	}
+
+	// PushBlock: Wait for space.
+	select {
+	case q.q <- msg:
+		return nil
+	case <-q.done:
+		return ErrConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop signals the sender and any blocked callers that the server stopped.
+func (q *pushQueue) stop() { close(q.done) }
+
+// queueNotify encodes a notification and adds it to the push queue of s.
+func (s *Server) queueNotify(ctx context.Context, q *pushQueue, method string, params interface{}) error {
+	var bits []byte
+	if params != nil {
+		v, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		bits = v
+	}
+	s.log("Queueing server notification %q %s", method, string(bits))
+	return q.push(ctx, &jmessage{V: Version, M: method, P: bits}, func() {
+		s.metrics.Count("rpc.pushOverflow", 1)
+	})
+}
+
+// sendPushes delivers notifications from q to the client until the server
+// stops. Notifications remaining in the queue at that point are discarded.
+func (s *Server) sendPushes(q *pushQueue) {
+	for {
+		select {
+		case <-q.done:
+			return
+		case msg := <-q.q:
+			s.mu.Lock()
+			ch := s.ch
+			s.mu.Unlock()
+			if ch == nil {
+				continue // the server stopped
+			}
+
+			// Write outside s.mu, so that a client that is slow to read the
+			// notification does not block the handlers.
+			nw, err := s.send(ch, jmessages{msg})
+			s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
+			s.metrics.Count("rpc.notifications", 1)
+			if err != nil {
+				s.log("Sending notification %q: %v", msg.M, err)
+			}
+		}
+	}
+}
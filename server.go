@@ -4,7 +4,9 @@ import (
 	"container/list"
 	"context"
 	"encoding/json"
+	"errors"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -18,6 +20,13 @@ import (
 
 type logger = func(string, ...interface{})
 
+// A logOutput writes msg to the debug log of a server. As for the calldepth
+// argument of log.Logger.Output, depth is the number of stack frames to skip
+// to find the location reported for the message, where 1 is the caller of
+// the logOutput. If force is true, msg is written even if the log is limited
+// by the LogLimit option.
+type logOutput = func(depth int, msg string, force bool)
+
 // A Server is a JSON-RPC 2.0 server. The server receives requests and sends
 // responses on a channel.Channel provided by the caller, and dispatches
 // requests to user-defined Handlers.
@@ -28,30 +37,69 @@ type Server struct {
 	allow1  bool                // allow v1 requests with no version marker
 	allowP  bool                // allow server notifications to the client
 	log     logger              // write debug logs here
+	logOut  logOutput           // the output of log (nil if there is no logger)
 	rpcLog  RPCLogger           // log RPC requests and responses here
 	dectx   decoder             // decode context from request
 	ckreq   verifier            // request checking hook
+	exprep  replyCheck          // missing request ID hook
+	onParse func([]byte, error) // parse error hook (may be nil)
 	expctx  bool                // whether to expect request context
 	metrics *metrics.M          // metrics collected during execution
 	start   time.Time           // when Start was called
 	builtin bool                // whether built-in rpc.* methods are enabled
+	prefix  string              // the prefix of built-in method names
+	strictC bool                // whether to replace reserved error codes
+	strictP bool                // whether to reject unknown fields in params
+	cnames  bool                // whether to add code names to error data
+	nwork   int                 // size of the worker pool (0 means no pool)
+	plimit  int                 // maximum batches to buffer while paused
+	psize   int                 // capacity of the push queue (0 means no queue)
+	ppolicy PushPolicy          // push queue overflow policy
+	dedup   *dedup              // idempotent request results (nil if disabled)
+	budget  *memBudget          // limit on the size of requests in flight (nil if disabled)
+	latency LatencyMetric       // how to record handler latency
+
+	// The push queue is guarded separately from mu, so that Notify does not
+	// wait for mu to find it.
+	pmu   sync.Mutex // protects pushq
+	pushq *pushQueue // queued notifications, if enabled
+
+	// Writes to the channel are serialized by smu rather than mu, so that a
+	// client that is slow to read does not block the rest of the server.
+	// A goroutine holding smu must not acquire mu.
+	smu sync.Mutex
 
 	mu *sync.Mutex // protects the fields below
 
-	nbar sync.WaitGroup  // notification barrier (see the dispatch method)
-	err  error           // error from a previous operation
-	work *sync.Cond      // for signaling message availability
-	inq  *list.List      // inbound requests awaiting processing
-	ch   channel.Channel // the channel to the client
+	nbar  sync.WaitGroup  // notification barrier (see the dispatch method)
+	err   error           // error from a previous operation
+	work  *sync.Cond      // for signaling message availability
+	inq   *list.List      // inbound requests awaiting processing
+	ch    channel.Channel // the channel to the client
+	peer  *Ucred          // credentials of the client process, if known
+	pool  chan func()     // tasks for the worker pool, if enabled
+	stall bool            // whether dispatch is paused
 
 	// For each request ID currently in-flight, this map carries a cancel
-	// function attached to the context that was sent to the handler.
-	used map[string]context.CancelFunc
+	// function attached to the context that was sent to the handler, and
+	// the method and start time reported by Inflight.
+	used map[string]*activeCall
 
 	// For each push-call ID currently in flight, this map carries the response
 	// waiting for its reply.
 	call   map[string]*Response
 	callID int64
+
+	// Records the names of deprecated methods that have been called, so that
+	// the server logs a warning for each only once.
+	deprec map[string]bool
+
+	// The number of batches taken from the queue whose responses have not yet
+	// been delivered, and the state of a graceful stop (see Drain).
+	nbatch   int
+	draining bool
+	rclose   func() error // closes the read side of the connection, or nil
+	rdone    bool         // whether the reader stopped for Drain
 }
 
 // NewServer returns a new unstarted server that will dispatch incoming
@@ -66,32 +114,53 @@ func NewServer(mux Assigner, opts *ServerOptions) *Server {
 		panic("nil assigner")
 	}
 	dc, exp := opts.decodeContext()
+	log, logOut := opts.logger()
 	s := &Server{
 		mux:     mux,
 		sem:     semaphore.NewWeighted(opts.concurrency()),
 		allow1:  opts.allowV1(),
 		allowP:  opts.allowPush(),
-		log:     opts.logger(),
+		log:     log,
+		logOut:  logOut,
 		rpcLog:  opts.rpcLog(),
 		dectx:   dc,
 		ckreq:   opts.checkRequest(),
+		exprep:  opts.expectsReply(),
+		onParse: opts.onParseError(),
 		expctx:  exp,
 		mu:      new(sync.Mutex),
 		metrics: opts.metrics(),
 		start:   opts.startTime(),
 		builtin: opts.allowBuiltin(),
+		prefix:  opts.builtinPrefix(),
+		strictC: opts.strictCodes(),
+		strictP: opts.strictParams(),
+		cnames:  opts.codeNames(),
+		nwork:   opts.workerPool(),
+		plimit:  opts.pauseLimit(),
+		budget:  newMemBudget(opts.memoryBudget()),
+		latency: opts.latency(),
 		inq:     list.New(),
-		used:    make(map[string]context.CancelFunc),
+		used:    make(map[string]*activeCall),
 		call:    make(map[string]*Response),
 		callID:  1,
+		deprec:  make(map[string]bool),
 	}
+	s.dedup = opts.dedup(s.metrics)
+	s.psize, s.ppolicy = opts.pushQueue()
 	s.work = sync.NewCond(s.mu)
+	s.metrics.AddGauge("rpc.inflight", 0)
 	return s
 }
 
 // Start enables processing of requests from c. This function will panic if the
 // server is already running.
-func (s *Server) Start(c channel.Channel) *Server {
+func (s *Server) Start(c channel.Channel) *Server { return s.startWith(c, nil, nil) }
+
+// startWith implements Start and StartConn. If cred != nil, it is attached to the
+// context of each request as the credentials of the peer. If rclose != nil, it
+// closes the read side of the connection underlying c (see Drain).
+func (s *Server) startWith(c channel.Channel, cred *Ucred, rclose func() error) *Server {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.ch != nil {
@@ -100,12 +169,14 @@ func (s *Server) Start(c channel.Channel) *Server {
 
 	// Set up the queues and condition variable used by the workers.
 	s.ch = c
+	s.peer = cred
 	if s.start.IsZero() {
 		s.start = time.Now().In(time.UTC)
 	}
 
 	// Reset all the I/O structures and start up the workers.
 	s.err = nil
+	s.draining, s.rclose, s.rdone = false, rclose, false
 
 	// s.wg waits for the maintenance goroutines for receiving input and
 	// processing the request queue. In addition, each request in flight adds a
@@ -116,8 +187,33 @@ func (s *Server) Start(c channel.Channel) *Server {
 	// Accept requests from the client and enqueue them for processing.
 	go func() { defer s.wg.Done(); s.read(c) }()
 
+	// If a worker pool is enabled, start the workers. Each worker adds itself
+	// to s.wg, and exits once serve has closed the pool at shutdown.
+	if s.nwork > 0 {
+		s.pool = make(chan func())
+		s.wg.Add(s.nwork)
+		for i := 0; i < s.nwork; i++ {
+			go func(pool <-chan func()) {
+				defer s.wg.Done()
+				for run := range pool {
+					run()
+				}
+			}(s.pool)
+		}
+	}
+
+	// If push notifications are queued, start the goroutine that sends them.
+	if s.psize > 0 {
+		q := newPushQueue(s.psize, s.ppolicy)
+		s.pmu.Lock()
+		s.pushq = q
+		s.pmu.Unlock()
+		s.wg.Add(1)
+		go func() { defer s.wg.Done(); s.sendPushes(q) }()
+	}
+
 	// Remove requests from the queue and dispatch them to handlers.
-	go func() { defer s.wg.Done(); s.serve() }()
+	go func() { defer s.wg.Done(); s.serve(s.pool) }()
 
 	return s
 }
@@ -138,7 +234,16 @@ func (s *Server) Start(c channel.Channel) *Server {
 //       |   ...
 //       * deliver     -- send responses to the client
 //
-func (s *Server) serve() {
+func (s *Server) serve(pool chan func()) {
+	// Track the batches in flight, so that the worker pool (if any) can be
+	// closed once no batch can send it more work.
+	var batches sync.WaitGroup
+	defer func() {
+		if pool != nil {
+			batches.Wait()
+			close(pool)
+		}
+	}()
 	for {
 		next, err := s.nextRequest()
 		if err != nil {
@@ -146,13 +251,27 @@ func (s *Server) serve() {
 			return
 		}
 		s.wg.Add(1)
+		batches.Add(1)
 		go func() {
 			defer s.wg.Done()
+			defer batches.Done()
 			next()
+			s.batchDone()
 		}()
 	}
 }
 
+// batchDone records that a batch taken from the queue by nextRequest has
+// been completed, and wakes a caller of Drain waiting for it.
+func (s *Server) batchDone() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nbatch--
+	if s.draining {
+		s.work.Broadcast()
+	}
+}
+
 // nextRequest blocks until a request batch is available and returns a function
 // that dispatches it to the appropriate handlers. The result is only an error
 // if the connection failed; errors reported by the handler are reported to the
@@ -162,19 +281,103 @@ func (s *Server) serve() {
 func (s *Server) nextRequest() (func() error, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for s.ch != nil && s.inq.Len() == 0 {
+	var elt *list.Element
+	for s.ch != nil {
+		if elt = s.nextReady(); elt != nil {
+			break
+		}
 		s.work.Wait()
 	}
-	if s.ch == nil && s.inq.Len() == 0 {
-		return nil, s.err
+	if s.ch == nil {
+		if s.inq.Len() == 0 {
+			return nil, s.err
+		}
+		elt = s.inq.Front() // drain the queue at shutdown, even if paused
 	}
 	ch := s.ch // capture
 
-	next := s.inq.Remove(s.inq.Front()).(jmessages)
+	next := s.inq.Remove(elt).(jmessages)
+	s.nbatch++
 	s.log("Processing %d requests", len(next))
 
 	// Construct a dispatcher to run the handlers outside the lock.
-	return s.dispatch(next, ch), nil
+	return s.dispatch(next, ch, s.pool), nil
+}
+
+// nextReady returns the queue element for the next batch that is ready to be
+// dispatched, or nil if there is none. While the server is paused, only a
+// batch that runs no handlers (see pauseExempt) is ready.
+// The caller must hold s.mu.
+func (s *Server) nextReady() *list.Element {
+	if !s.stall {
+		return s.inq.Front()
+	}
+	for elt := s.inq.Front(); elt != nil; elt = elt.Next() {
+		if s.pauseExempt(elt.Value.(jmessages)) {
+			return elt
+		}
+	}
+	return nil
+}
+
+// pauseExempt reports whether every request in msgs either calls a built-in
+// method that bypasses the pause, or has already failed, so that msgs may be
+// dispatched while the server is paused.
+func (s *Server) pauseExempt(msgs jmessages) bool {
+	for _, req := range msgs {
+		if req.err != nil {
+			continue
+		}
+		switch strings.TrimPrefix(req.M, s.prefix) {
+		case serverInfoMethod, cancelMethod:
+			if s.builtin && strings.HasPrefix(req.M, s.prefix) {
+				continue
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// numPaused reports the number of batches held in the queue while the server
+// is paused. The caller must hold s.mu.
+func (s *Server) numPaused() int {
+	var n int
+	for elt := s.inq.Front(); elt != nil; elt = elt.Next() {
+		if !s.pauseExempt(elt.Value.(jmessages)) {
+			n++
+		}
+	}
+	return n
+}
+
+// Pause suspends the dispatch of requests to handlers, without closing the
+// connection. While paused, the server continues to read requests from the
+// client and buffers them, up to the PauseLimit set in its options; beyond
+// that it rejects them with code.Overloaded until resumed. Requests already
+// dispatched are not affected. Calls to the built-in rpc.serverInfo and
+// rpc.cancel methods are still dispatched while the server is paused, even
+// if the buffer is full. Pause has no effect if the server is already paused,
+// or if it is draining (see Drain).
+func (s *Server) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stall && !s.draining {
+		s.log("Pausing request dispatch")
+		s.stall = true
+	}
+}
+
+// Resume resumes the dispatch of requests suspended by Pause, in the order
+// they were received. Resume has no effect if the server is not paused.
+func (s *Server) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stall {
+		s.log("Resuming request dispatch (%d batches waiting)", s.inq.Len())
+		s.stall = false
+		s.work.Broadcast()
+	}
 }
 
 // waitForBarrier blocks until all notification handlers that have been issued
@@ -194,12 +397,14 @@ func (s *Server) waitForBarrier(n int) {
 // dispatch constructs a function that invokes each of the specified tasks.
 // The caller must hold s.mu when calling dispatch, but the returned function
 // should be executed outside the lock to wait for the handlers to return.
+// If pool != nil, the handlers are executed by the worker pool; otherwise
+// each handler runs in its own goroutine.
 //
 // dispatch blocks until any notification received prior to this batch has
 // completed, to ensure that notifications are processed in a partial order
 // that respects order of receipt. Notifications within a batch are handled
 // concurrently.
-func (s *Server) dispatch(next jmessages, ch channel.Sender) func() error {
+func (s *Server) dispatch(next jmessages, ch channel.Sender, pool chan<- func()) func() error {
 	// Resolve all the task handlers or record errors.
 	start := time.Now()
 	tasks := s.checkAndAssign(next)
@@ -226,10 +431,25 @@ func (s *Server) dispatch(next jmessages, ch channel.Sender) func() error {
 				}
 
 				before <- true
-				t.val, t.err = s.invoke(t.ctx, t.m, t.hreq)
+				began := time.Now()
+				t.val, t.err = s.invoke(t.ctx, t.m, t.hreq, t.builtin)
+				if !t.builtin {
+					s.latency.record(s.metrics, time.Since(began))
+				}
+				s.budget.release(t.mem)
+				s.metrics.CountBy("rpc.methodCalls", t.hreq.Method(), 1)
+				if t.err != nil {
+					s.metrics.CountBy("rpc.methodErrors", t.hreq.Method(), 1)
+				}
 			}
 
-			go run()
+			// Built-in methods do not wait for a worker, so that rpc.cancel
+			// works even when all the workers are busy.
+			if pool != nil && !t.builtin {
+				pool <- run
+			} else {
+				go run()
+			}
 
 			<- before
 			close(before)
@@ -237,28 +457,55 @@ func (s *Server) dispatch(next jmessages, ch channel.Sender) func() error {
 
 		// Wait for all the handlers to return, then deliver any responses.
 		wg.Wait()
-		return s.deliver(tasks.responses(s.rpcLog), ch, time.Since(start))
+		rsps := tasks.responses(s.rpcLog)
+		for _, rsp := range rsps {
+			if rsp.E == nil {
+				continue
+			}
+			s.countError(rsp.E.code)
+			if s.cnames {
+				rsp.E = rsp.E.withCodeName()
+			}
+		}
+		return s.deliver(rsps, ch, time.Since(start))
 	}
 }
 
 // deliver cleans up completed responses and arranges their replies (if any) to
-// be sent back to the client.
+// be sent back to the client. If the replies cannot be sent, the server stops
+// with the error from the channel, since the client cannot be told the outcome
+// of its requests.
 func (s *Server) deliver(rsps jmessages, ch channel.Sender, elapsed time.Duration) error {
 	if len(rsps) == 0 {
 		return nil
 	}
 	s.log("Completed %d requests [%v elapsed]", len(rsps), elapsed)
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
 	// Ensure all the inflight requests get their contexts cancelled.
 	for _, rsp := range rsps {
-		s.cancel(string(rsp.ID))
+		s.cancel(string(rsp.ID), nil)
 	}
+	s.mu.Unlock()
 
-	nw, err := encode(ch, rsps)
+	nw, err := s.send(ch, rsps)
+	if err != nil {
+		s.log("Sending %d responses: %v", len(rsps), err)
+		s.mu.Lock()
+		s.stop(err)
+		s.mu.Unlock()
+		return err
+	}
 	s.metrics.CountAndSetMax("rpc.bytesWritten", int64(nw))
-	return err
+	return nil
+}
+
+// send encodes msgs and writes them to ch, holding the send lock so that the
+// writes of concurrent goroutines are not interleaved. The caller must not
+// hold s.mu.
+func (s *Server) send(ch channel.Sender, msgs jmessages) (int, error) {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	return encode(ch, msgs)
 }
 
 // checkAndAssign resolves all the task handlers for the given batch, or
@@ -269,8 +516,9 @@ func (s *Server) checkAndAssign(next jmessages) tasks {
 		s.log("Checking request for %q: %s", req.M, string(req.P))
 		fid := fixID(req.ID)
 		t := &task{
-			hreq:  &Request{id: fid, method: req.M, params: req.P},
+			hreq:  &Request{id: fid, method: req.M, params: req.P, strict: s.strictP},
 			batch: req.batch,
+			raw:   req.raw,
 		}
 		id := string(fid)
 		if req.err != nil {
@@ -292,8 +540,16 @@ func (s *Server) checkAndAssign(next jmessages) tasks {
 			t.err = Errorf(code.InvalidRequest, "empty method name")
 		} else if s.setContext(t, id) {
 			t.m = s.assign(t.ctx, req.M)
+			t.builtin = t.m != nil && s.isBuiltin(req.M)
 			if t.m == nil {
 				t.err = Errorf(code.MethodNotFound, "no such method %q", req.M)
+			} else if id == "" && !t.builtin && s.exprep(t.ctx, t.hreq) {
+				s.metrics.Count("rpc.missingID", 1)
+				t.err = Errorf(code.InvalidRequest, "missing request id for method %q", req.M)
+			} else if err := s.reserve(t, len(req.P)); err != nil {
+				t.err = err
+			} else {
+				s.checkDeprecated(req.M, t.m)
 			}
 		}
 
@@ -306,70 +562,180 @@ func (s *Server) checkAndAssign(next jmessages) tasks {
 	return ts
 }
 
+// reserve reserves n bytes of the memory budget of s for t, unless t is a call
+// to a built-in method. Built-in methods are exempt, so that a client can
+// cancel requests while the budget is exhausted.
+func (s *Server) reserve(t *task, n int) error {
+	if t.builtin {
+		return nil
+	} else if err := s.budget.acquire(n); err != nil {
+		s.metrics.Count("rpc.budgetExceeded", 1)
+		return err
+	}
+	t.mem = n
+	return nil
+}
+
+// A deprecator is an optional interface that a Handler may implement to mark
+// its method as deprecated. The Deprecated method returns a message describing
+// the deprecation, for example what to use instead.
+//
+// Deprecated methods work normally, and the responses are unchanged; but the
+// first time a server handles a request for a deprecated method, it logs a
+// warning with the message. Each call is also counted by the server metric
+// "rpc.deprecatedCalls".
+type deprecator interface {
+	Deprecated() string
+}
+
+// checkDeprecated records a call to method, if h is marked as deprecated.
+// The caller must hold s.mu.
+func (s *Server) checkDeprecated(method string, h Handler) {
+	d, ok := h.(deprecator)
+	if !ok {
+		return
+	}
+	s.metrics.Count("rpc.deprecatedCalls", 1)
+	if !s.deprec[method] {
+		s.deprec[method] = true
+		s.log("WARNING: Method %q is deprecated: %s", method, d.Deprecated())
+	}
+}
+
 // setContext constructs and attaches a request context to t, and reports
 // whether this succeeded.
 func (s *Server) setContext(t *task, id string) bool {
 	base, params, err := s.dectx(context.Background(), t.hreq.method, t.hreq.params)
 	t.hreq.params = params
-	if err != nil {
+	if e, ok := err.(*Error); ok {
+		t.err = e
+		return false
+	} else if err != nil {
 		t.err = Errorf(code.InternalError, "invalid request context: %v", err)
 		return false
 	}
+	base = context.WithValue(base, rawRequestKey{}, t.raw)
+	if s.peer != nil {
+		base = context.WithValue(base, peerCredKey{}, s.peer)
+	}
 
-	// Check request.
-	if err := s.ckreq(base, t.hreq); err != nil {
+	// Check request. If the request is rejected, its context is still
+	// reported to the RPC logger with the response.
+	t.ctx = context.WithValue(base, inboundRequestKey{}, t.hreq)
+	if err := s.ckreq(t.ctx, t.hreq); err != nil {
 		t.err = err
 		return false
 	}
 
-	t.ctx = context.WithValue(base, inboundRequestKey{}, t.hreq)
-
 	// Store the cancellation for a request that needs a reply, so that we can
 	// respond to rpc.cancel requests.
 	if id != "" {
-		ctx, cancel := context.WithCancel(t.ctx)
-		s.used[id] = cancel
+		ctx, cancel := withCancelCause(t.ctx)
+		s.used[id] = &activeCall{cancel: cancel, method: t.hreq.method, start: time.Now()}
+		s.metrics.AddGauge("rpc.inflight", 1)
 		t.ctx = ctx
 	}
 	return true
 }
 
 // invoke invokes the handler m for the specified request type, and marshals
-// the return value into JSON if there is one.
-func (s *Server) invoke(base context.Context, h Handler, req *Request) (json.RawMessage, error) {
+// the return value into JSON if there is one. Unless builtin is true, the
+// call counts against the concurrency limit of the server.
+func (s *Server) invoke(base context.Context, h Handler, req *Request, builtin bool) (json.RawMessage, error) {
 	ctx := context.WithValue(base, serverKey{}, s)
-	if err := s.sem.Acquire(ctx, 1); err != nil {
-		return nil, err
-	}
-	defer s.sem.Release(1)
 
-	s.rpcLog.LogRequest(ctx, req)
-	v, err := h.Handle(ctx, req)
-	if err != nil {
-		if req.IsNotification() {
-			s.log("Discarding error from notification to %q: %v", req.Method(), err)
-			return nil, nil // a notification
+	// N.B. Check for a duplicate before acquiring the semaphore, so that a
+	// duplicate waiting for the original does not block its execution.
+	return s.dedup.do(ctx, req, func() (json.RawMessage, error) {
+		if !builtin {
+			// N.B. Acquire succeeds without checking ctx if there is capacity,
+			// so check ctx first, and again once the wait is over, so that a
+			// request whose context has ended does not start its handler.
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			} else if err := s.sem.Acquire(ctx, 1); err != nil {
+				return nil, err
+			}
+			defer s.sem.Release(1)
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
+
+		s.rpcLog.LogRequest(ctx, req)
+		v, err := h.Handle(ctx, req)
+		if err != nil {
+			if req.IsNotification() {
+				s.log("Discarding error from notification to %q: %v", req.Method(), err)
+				return nil, nil // a notification
+			}
+			return nil, s.checkCode(req, err) // a call reporting an error
 		}
-		return nil, err // a call reporting an error
+		return encodeResult(req, v)
+	})
+}
+
+// encodeResult encodes the result v reported by the handler for req.  The
+// result of a notification is discarded without encoding it, and a result
+// that is already encoded as a json.RawMessage is used as-is.
+func encodeResult(req *Request, v interface{}) (json.RawMessage, error) {
+	if req.IsNotification() {
+		return nil, nil
+	}
+	switch t := v.(type) {
+	case nil:
+		return json.RawMessage("null"), nil
+	case json.RawMessage:
+		if len(t) == 0 {
+			return json.RawMessage("null"), nil
+		} else if !json.Valid(t) {
+			return nil, errors.New("result is not valid JSON")
+		}
+		return t, nil
 	}
 	return json.Marshal(v)
 }
 
+// checkCode checks whether err, returned by the handler for req, has an error
+// code that is reserved but not pre-defined. If so, it logs a warning, and if
+// the server has strict error codes, returns an error with code.InternalError.
+// Otherwise it returns err unchanged.
+func (s *Server) checkCode(req *Request, err error) error {
+	c := code.FromError(err)
+	if !code.IsReserved(c) || code.IsPredefined(c) {
+		return err
+	}
+	s.log("WARNING: Handler for %q returned reserved error code %d", req.Method(), c)
+	if s.strictC {
+		return &Error{code: code.InternalError, message: err.Error(), cause: err}
+	}
+	return err
+}
+
 // ServerInfo returns an atomic snapshot of the current server info for s.
 func (s *Server) ServerInfo() *ServerInfo {
+	names := s.mux.Names()
+	snap := s.metrics.Values()
 	info := &ServerInfo{
-		Methods:     s.mux.Names(),
+		Methods:     names,
 		UsesContext: s.expctx,
 		StartTime:   s.start,
-		Counter:     make(map[string]int64),
-		MaxValue:    make(map[string]int64),
-		Label:       make(map[string]interface{}),
-	}
-	s.metrics.Snapshot(metrics.Snapshot{
-		Counter:  info.Counter,
-		MaxValue: info.MaxValue,
-		Label:    info.Label,
-	})
+		Counter:     snap.Counter,
+		Keyed:       snap.KeyedCounter,
+		MaxValue:    snap.MaxValue,
+		Label:       snap.Label,
+		Gauge:       snap.Gauge,
+		Rate:        snap.Rate,
+		Quantile:    snap.Quantile,
+	}
+	d, _ := s.mux.(methodDescriber)
+	for _, name := range names {
+		desc := MethodDesc{Name: name}
+		if d != nil {
+			desc.MethodInfo, _ = d.Describe(name)
+		}
+		info.MethodInfo = append(info.MethodInfo, desc)
+	}
 	return info
 }
 
@@ -380,14 +746,121 @@ func (s *Server) ServerInfo() *ServerInfo {
 // this method will always report an error (ErrPushUnsupported) without sending
 // anything.  If Notify is called after the client connection is closed, it
 // returns ErrConnClosed.
+//
+// If the server has a push queue (see ServerOptions.PushQueue), Notify returns
+// once the notification is queued, subject to the overflow policy.
 func (s *Server) Notify(ctx context.Context, method string, params interface{}) error {
 	if !s.allowP {
 		return ErrPushUnsupported
 	}
+	s.pmu.Lock()
+	q := s.pushq
+	s.pmu.Unlock()
+	if q != nil {
+		return s.queueNotify(ctx, q, method, params)
+	}
 	_, err := s.pushReq(ctx, false /* no ID */, method, params)
 	return err
 }
 
+// Broadcast posts a single server-side notification to the client, as Notify
+// does, but the notification is sent immediately even if the server has a push
+// queue, so that it is not discarded if the server stops. Unless s was
+// constructed with the AllowPush option set true, Broadcast reports
+// ErrPushUnsupported without sending anything.
+func (s *Server) Broadcast(method string, params interface{}) error {
+	if !s.allowP {
+		return ErrPushUnsupported
+	}
+	_, err := s.pushReq(context.Background(), false /* no ID */, method, params)
+	return err
+}
+
+// Shutdown stops the server gracefully. If push is enabled, it first sends
+// the client an "rpc.shutdown" notification (using the builtin prefix of the
+// server) without parameters, so that the client can arrange to reconnect
+// elsewhere. Shutdown then drains the server as Drain does: The server stops
+// reading requests from the client, finishes the requests it has already
+// received, and then stops, whether or not the client closes the connection.
+//
+// If ctx ends before the server has finished, Shutdown stops it at once,
+// cancelling the requests still pending, and returns the error from ctx.
+// Otherwise Shutdown returns nil. In either case, the server has stopped when
+// Shutdown returns; call Wait or WaitStatus for its exit status.
+//
+// A client can recognize the notification via the OnNotify option.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if err := s.Broadcast(s.prefix+shutdownMethod, nil); err != nil && err != ErrPushUnsupported {
+		s.log("Sending shutdown notification: %v", err)
+	}
+	return s.Drain(ctx)
+}
+
+// Drain stops the server gracefully, without notifying the client, for use
+// when push notifications are not enabled (compare Shutdown). The server
+// stops reading requests from the client, finishes the requests it has
+// already received, including those still waiting in its queue, and then
+// stops. If the server is paused (see Pause), Drain resumes it, so that the
+// requests waiting in its queue can finish.
+//
+// To stop reading, Drain closes the read side of the connection, which is
+// possible if the server was started by StartConn with a connection that has
+// a CloseRead method, such as a TCP or Unix domain socket. Otherwise, the
+// server goes on reading until the requests already received are finished,
+// and a request that arrives just as it stops may not be answered. If the
+// client closes the connection while the server is draining, the requests
+// already received are still finished, though their replies may be lost.
+//
+// If ctx ends before the server has finished, Drain stops it at once,
+// cancelling the requests still pending, and returns the error from ctx.
+// Otherwise Drain returns nil. In either case, the server has stopped when
+// Drain returns; call Wait or WaitStatus for its exit status.
+func (s *Server) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.work.Broadcast() // wake the waiter below
+			s.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ch == nil {
+		return nil // nothing is running
+	}
+	s.draining = true
+	if s.stall {
+		s.log("Resuming request dispatch to drain")
+		s.stall = false
+		s.work.Broadcast()
+	}
+	if s.rclose != nil {
+		if err := s.rclose(); err != nil {
+			s.log("Closing connection for reading: %v", err)
+			s.rclose = nil
+		}
+	}
+	for s.ch != nil && ctx.Err() == nil && !s.drained() {
+		s.work.Wait()
+	}
+	s.stop(errServerStopped)
+	if !s.drained() {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// drained reports whether the server has finished all the requests it has
+// received, and will not read any more. The caller must hold s.mu.
+func (s *Server) drained() bool {
+	return s.inq.Len() == 0 && s.nbatch == 0 && (s.rclose == nil || s.rdone)
+}
+
 // Callback posts a single server-side call to the client. It blocks until a
 // reply is received or the client connection terminates.  A successful
 // callback reports a nil error and a non-nil response. Errors returned by the
@@ -423,10 +896,11 @@ func (s *Server) pushReq(ctx context.Context, wantID bool, method string, params
 		bits = v
 	}
 	s.mu.Lock()
-	defer s.mu.Unlock()
 	if s.ch == nil {
+		s.mu.Unlock()
 		return nil, ErrConnClosed
 	}
+	ch := s.ch // capture
 
 	kind := "notification"
 	var jid json.RawMessage
@@ -444,8 +918,10 @@ func (s *Server) pushReq(ctx context.Context, wantID bool, method string, params
 		s.call[id] = rsp
 	}
 
+	s.mu.Unlock()
+
 	s.log("Posting server %s %q %s", kind, method, string(bits))
-	nw, err := encode(s.ch, jmessages{{
+	nw, err := s.send(ch, jmessages{{
 		V:  Version,
 		ID: jid,
 		M:  method,
@@ -464,6 +940,38 @@ func (s *Server) Stop() {
 	s.stop(errServerStopped)
 }
 
+// An InflightRequest describes a request in flight on a server.
+// See Server.Inflight.
+type InflightRequest struct {
+	ID     string    `json:"id"`     // the request ID, as encoded in JSON
+	Method string    `json:"method"` // the method name of the request
+	Start  time.Time `json:"start"`  // when the server received the request
+}
+
+// Inflight returns a snapshot of the requests currently in flight on s, that
+// is, the requests that have been received and not yet replied to, ordered
+// from oldest to newest. Notifications are not included, since they have no
+// ID. This is meant for diagnosing handlers that fail to return.
+//
+// A request is included as soon as it is received, even if its handler is
+// waiting for the server to have capacity to run it.
+func (s *Server) Inflight() []InflightRequest {
+	s.mu.Lock()
+	reqs := make([]InflightRequest, 0, len(s.used))
+	for id, a := range s.used {
+		reqs = append(reqs, InflightRequest{ID: id, Method: a.method, Start: a.start})
+	}
+	s.mu.Unlock()
+
+	sort.Slice(reqs, func(i, j int) bool {
+		if reqs[i].Start.Equal(reqs[j].Start) {
+			return reqs[i].ID < reqs[j].ID
+		}
+		return reqs[i].Start.Before(reqs[j].Start)
+	})
+	return reqs
+}
+
 // ServerStatus describes the status of a stopped server.
 type ServerStatus struct {
 	Err error // the error that caused the server to stop (nil on success)
@@ -522,7 +1030,7 @@ func (s *Server) stop(err error) {
 				keep = append(keep, req)
 				s.log("Retaining notification %p", req)
 			} else {
-				s.cancel(string(req.ID))
+				s.cancel(string(req.ID), nil)
 			}
 		}
 		s.inq.Remove(cur)
@@ -541,10 +1049,17 @@ func (s *Server) stop(err error) {
 		}
 		delete(s.call, id)
 	}
-	for id, cancel := range s.used {
-		cancel()
+	for id, a := range s.used {
+		a.cancel(nil)
 		delete(s.used, id)
+		s.metrics.AddGauge("rpc.inflight", -1)
+	}
+	s.pmu.Lock()
+	if s.pushq != nil {
+		s.pushq.stop()
+		s.pushq = nil
 	}
+	s.pmu.Unlock()
 
 	// Postcondition check.
 	if len(s.used) != 0 {
@@ -571,17 +1086,43 @@ func (s *Server) read(ch channel.Receiver) {
 			err = nil
 			derr = in.parseJSON(bits)
 			s.metrics.Count("rpc.requests", int64(len(in)))
+			s.metrics.Mark("rpc.requests", int64(len(in)))
+			if derr != nil && s.onParse != nil {
+				s.onParse(bits, derr)
+			}
 		}
 		s.mu.Lock()
-		if err != nil { // receive failure; shut down
+		if err != nil && s.draining {
+			// Drain closed the connection for reading, or the client closed
+			// it; the requests already queued are still to be answered.
+			s.rdone = true
+			s.work.Broadcast()
+			s.mu.Unlock()
+			return
+		} else if err != nil { // receive failure; shut down
 			s.stop(err)
 			s.mu.Unlock()
 			return
 		} else if derr != nil { // parse failure; report and continue
+			s.mu.Unlock()
 			s.pushError(derr)
+			continue
 		} else if len(in) == 0 {
+			s.mu.Unlock()
 			s.pushError(Errorf(code.InvalidRequest, "empty request batch"))
+			continue
 		} else {
+			// While paused, reject a batch that would have to wait once the
+			// buffer is full, rather than stop reading, so that calls to the
+			// built-in methods that bypass the pause are still read.
+			if s.stall && !s.pauseExempt(in) && s.numPaused() >= s.plimit {
+				s.log("Rejecting %d requests while paused", len(in))
+				for _, req := range in {
+					if req.err == nil {
+						req.err = Errorf(code.Overloaded, "server is paused")
+					}
+				}
+			}
 			s.log("Received %d new requests", len(in))
 			s.inq.PushBack(in)
 			s.work.Broadcast()
@@ -595,6 +1136,15 @@ type ServerInfo struct {
 	// The list of method names exported by this server.
 	Methods []string `json:"methods,omitempty"`
 
+	// Descriptions of the methods exported by this server, in the same order
+	// as Methods. If the assigner of the server has a method
+	//
+	//    Describe(method string) (jrpc2.MethodInfo, bool)
+	//
+	// as handler.Map and handler.SyncMap do, the metadata it reports for each
+	// method are included; otherwise only the names are set.
+	MethodInfo []MethodDesc `json:"methodInfo,omitempty"`
+
 	// Whether this server understands context wrappers.
 	UsesContext bool `json:"usesContext"`
 
@@ -603,19 +1153,72 @@ type ServerInfo struct {
 	MaxValue map[string]int64       `json:"maxValue,omitempty"`
 	Label    map[string]interface{} `json:"labels,omitempty"`
 
+	// Keyed counters, by name and then by key. The server counts the calls
+	// to each method in "rpc.methodCalls", and the calls that failed in
+	// "rpc.methodErrors", keyed by method name.
+	Keyed map[string]map[string]int64 `json:"keyed,omitempty"`
+
+	// Gauge values. The server reports the number of requests awaiting a
+	// reply in "rpc.inflight", summed over all the servers that share its
+	// metrics collector.
+	Gauge map[string]int64 `json:"gauges,omitempty"`
+
+	// Rates per second over recent intervals. The server reports the rate of
+	// requests received in "rpc.requests".
+	Rate map[string]metrics.Rates `json:"rates,omitempty"`
+
+	// Quantile sketches. If the server was created with the option
+	// LatencyQuantiles, it reports the latency of requests in milliseconds
+	// in "rpc.latency".
+	Quantile map[string]metrics.Quantiles `json:"quantiles,omitempty"`
+
 	// When the server started.
 	StartTime time.Time `json:"startTime,omitempty"`
 }
 
+// MethodInfo describes a method for discovery and documentation. See also
+// handler.Info, which is an alias for this type.
+type MethodInfo struct {
+	// A short human-readable description of the method.
+	Summary string `json:"summary,omitempty"`
+
+	// JSON Schema documents describing the parameters and the result of the
+	// method, if known.
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+
+	// If the method is deprecated, a message describing the deprecation.
+	// This is filled in automatically for handlers wrapped by
+	// handler.Deprecated.
+	Deprecated string `json:"deprecated,omitempty"`
+}
+
+// A MethodDesc is the description of a method reported in ServerInfo.
+type MethodDesc struct {
+	Name string `json:"name"`
+	MethodInfo
+}
+
+// methodDescriber is an optional interface for an Assigner that can describe
+// its methods.
+type methodDescriber interface {
+	Describe(method string) (MethodInfo, bool)
+}
+
 // assign returns a Handler to handle the specified name, or nil.
 // The caller must hold s.mu.
 func (s *Server) assign(ctx context.Context, name string) Handler {
-	if s.builtin && strings.HasPrefix(name, "rpc.") {
-		switch name {
-		case rpcServerInfo:
+	if s.isBuiltin(name) {
+		switch strings.TrimPrefix(name, s.prefix) {
+		case serverInfoMethod:
 			return methodFunc(s.handleRPCServerInfo)
-		case rpcCancel:
+		case cancelMethod:
 			return methodFunc(s.handleRPCCancel)
+		case modulesMethod:
+			if _, ok := s.mux.(moduler); ok {
+				return methodFunc(s.handleRPCModules)
+			}
+			return nil
 		default:
 			return nil // reserved
 		}
@@ -623,19 +1226,32 @@ func (s *Server) assign(ctx context.Context, name string) Handler {
 	return s.mux.Assign(ctx, name)
 }
 
+// isBuiltin reports whether name is reserved for built-in methods.
+func (s *Server) isBuiltin(name string) bool {
+	return s.builtin && strings.HasPrefix(name, s.prefix)
+}
+
 // pushError reports an error for the given request ID directly back to the
 // client, bypassing the normal request handling mechanism.  The caller must
-// hold s.mu when calling this method.
+// not hold s.mu when calling this method.
 func (s *Server) pushError(err error) {
 	s.log("Invalid request: %v", err)
 	var jerr *Error
-	if e, ok := err.(*Error); ok {
-		jerr = e
-	} else {
-		jerr = &Error{code: code.FromError(err), message: err.Error()}
+	if !errors.As(err, &jerr) {
+		jerr = &Error{code: code.FromError(err), message: err.Error(), cause: err}
 	}
+	if s.cnames {
+		jerr = jerr.withCodeName()
+	}
+	s.countError(jerr.code)
 
-	nw, err := encode(s.ch, jmessages{{
+	s.mu.Lock()
+	ch := s.ch
+	s.mu.Unlock()
+	if ch == nil {
+		return // the server stopped
+	}
+	nw, err := s.send(ch, jmessages{{
 		V:  Version,
 		ID: json.RawMessage("null"),
 		E:  jerr,
@@ -647,18 +1263,32 @@ func (s *Server) pushError(err error) {
 	}
 }
 
+// countError records an error response with code c in the server metrics, as
+// the counter "rpc.errors.<c>", for example "rpc.errors.-32601".
+func (s *Server) countError(c code.Code) {
+	s.metrics.Count("rpc.errors."+strconv.Itoa(int(c)), 1)
+}
+
 // cancel reports whether id is an active call.  If so, it also calls the
-// cancellation function associated with id and removes it from the
-// reservations. The caller must hold s.mu.
-func (s *Server) cancel(id string) bool {
-	cancel, ok := s.used[id]
+// cancellation function associated with id with the given cause, and removes
+// it from the reservations. The caller must hold s.mu.
+func (s *Server) cancel(id string, cause error) bool {
+	a, ok := s.used[id]
 	if ok {
-		cancel()
+		a.cancel(cause)
 		delete(s.used, id)
+		s.metrics.AddGauge("rpc.inflight", -1)
 	}
 	return ok
 }
 
+// An activeCall records a request in flight on the server.
+type activeCall struct {
+	cancel func(cause error) // cancels the context of the handler
+	method string            // the method name of the request
+	start  time.Time         // when the request was received
+}
+
 func (s *Server) versionOK(v string) bool {
 	if v == "" {
 		return s.allow1 // an empty version is OK if the server allows it
@@ -673,6 +1303,10 @@ type task struct {
 	ctx   context.Context // the context passed to the handler
 	hreq  *Request        // the request passed to the handler
 	batch bool            // whether the request was part of a batch
+	raw   json.RawMessage // the request message as received
+
+	builtin bool // the handler is a built-in method
+	mem     int  // bytes of the memory budget reserved for the request
 
 	val json.RawMessage // the result value (when complete)
 	err error           // the error value (when complete)
@@ -700,14 +1334,15 @@ func (ts tasks) responses(rpcLog RPCLogger) jmessages {
 		if rsp.ID == nil {
 			rsp.ID = json.RawMessage("null")
 		}
+		var e *Error
 		if task.err == nil {
 			rsp.R = task.val
-		} else if e, ok := task.err.(*Error); ok {
+		} else if errors.As(task.err, &e) {
 			rsp.E = e
 		} else if c := code.FromError(task.err); c != code.NoError {
-			rsp.E = &Error{code: c, message: task.err.Error()}
+			rsp.E = &Error{code: c, message: task.err.Error(), cause: task.err}
 		} else {
-			rsp.E = &Error{code: code.InternalError, message: task.err.Error()}
+			rsp.E = &Error{code: code.InternalError, message: task.err.Error(), cause: task.err}
 		}
 		rpcLog.LogResponse(task.ctx, &Response{
 			id:     string(rsp.ID),
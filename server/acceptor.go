@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/channel"
+)
+
+// An Acceptor serves connections from a listener, as Loop does, and supports
+// shutting down gracefully: Shutdown stops accepting new connections, and
+// lets the servers for the active connections finish their work.
+type Acceptor struct {
+	lst        net.Listener
+	newService func() Service
+	opts       *LoopOptions
+	wg         sync.WaitGroup // active connections
+
+	mu      sync.Mutex
+	active  map[*jrpc2.Server]bool
+	closing bool // whether Shutdown has been called
+}
+
+// NewAcceptor constructs an Acceptor that obtains connections from lst and
+// starts a server for each with the given service constructor and options.
+// To begin serving, call Serve.
+func NewAcceptor(lst net.Listener, newService func() Service, opts *LoopOptions) *Acceptor {
+	return &Acceptor{
+		lst:        lst,
+		newService: newService,
+		opts:       opts,
+		active:     make(map[*jrpc2.Server]bool),
+	}
+}
+
+// Serve accepts connections from the listener and starts a server for each,
+// running in a new goroutine, until accept reports an error. It then waits
+// for all the servers currently active to return, and reports the error, or
+// nil if the listener was closed, as it is by Shutdown.
+func (a *Acceptor) Serve() error {
+	newChannel := a.opts.framing()
+	serverOpts := a.opts.serverOpts()
+	log := a.logger()
+
+	for {
+		conn, err := a.lst.Accept()
+		if err != nil {
+			if channel.IsErrClosing(err) {
+				err = nil
+			} else {
+				log("Error accepting new connection: %v", err)
+			}
+			a.wg.Wait()
+			return err
+		}
+		a.wg.Add(1)
+		go func() {
+			defer a.wg.Done()
+			svc := a.newService()
+			assigner, err := svc.Assigner()
+			if err != nil {
+				log("Service initialization failed: %v", err)
+				conn.Close()
+				return
+			}
+			srv := a.start(jrpc2.NewServer(assigner, serverOpts), conn, newChannel)
+			if srv == nil {
+				return // shutting down
+			}
+			stat := srv.WaitStatus()
+			a.mu.Lock()
+			delete(a.active, srv)
+			a.mu.Unlock()
+			svc.Finish(stat)
+			if stat.Err != nil {
+				log("Server exit: %v", stat.Err)
+			}
+		}()
+	}
+}
+
+// start starts srv on conn and records it as active, unless a is shutting
+// down, in which case it closes conn and returns nil.
+func (a *Acceptor) start(srv *jrpc2.Server, conn net.Conn, newChannel channel.Framing) *jrpc2.Server {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closing {
+		conn.Close()
+		return nil
+	}
+	a.active[srv] = true
+	return srv.StartConn(conn, newChannel)
+}
+
+// Shutdown stops a from accepting new connections by closing its listener,
+// and asks the server for each active connection to finish its work:
+//
+// Shutdown calls the Drain method of each server, which stops reading
+// requests from the client, and stops the server once it has answered the
+// requests already received. If the servers allow push notifications, it
+// calls their Shutdown method instead, which also notifies the client before
+// draining the server.
+//
+// If ctx ends before a server has finished, Shutdown stops it, cancelling any
+// requests still in flight. Shutdown then waits for all the connections to
+// be cleaned up, and returns the number of servers that were stopped because
+// ctx ended; if this is not zero, it also returns the error from ctx.
+func (a *Acceptor) Shutdown(ctx context.Context) (int, error) {
+	a.mu.Lock()
+	a.closing = true
+	srvs := make([]*jrpc2.Server, 0, len(a.active))
+	for srv := range a.active {
+		srvs = append(srvs, srv)
+	}
+	a.mu.Unlock()
+	if err := a.lst.Close(); err != nil && !channel.IsErrClosing(err) {
+		a.logger()("Closing listener: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var forced int
+	for _, srv := range srvs {
+		srv := srv
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if a.drain(ctx, srv) {
+				mu.Lock()
+				forced++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	a.wg.Wait()
+	if forced != 0 {
+		return forced, ctx.Err()
+	}
+	return 0, nil
+}
+
+// drain asks srv to finish its work, as described for Shutdown, and reports
+// whether it had to be stopped because ctx ended.
+func (a *Acceptor) drain(ctx context.Context, srv *jrpc2.Server) bool {
+	if opts := a.opts.serverOpts(); opts != nil && opts.AllowPush {
+		return srv.Shutdown(ctx) != nil
+	}
+	return srv.Drain(ctx) != nil
+}
+
+func (a *Acceptor) logger() func(string, ...interface{}) {
+	if opts := a.opts.serverOpts(); opts != nil && opts.Logger != nil {
+		return opts.Logger.Printf
+	}
+	return func(string, ...interface{}) {}
+}
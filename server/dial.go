@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/channel"
+)
+
+// Dial connects to the specified address and returns a channel that uses the
+// given framing to communicate over the connection. The network type is
+// chosen by jrpc2.Network, so addr may be a host:port pair or the path of a
+// Unix-domain socket. If framing == nil, channel.RawJSON is used.
+//
+// If config != nil, the connection is secured with TLS using config, and the
+// TLS handshake is completed before Dial returns. If config does not specify
+// a ServerName, the host portion of addr is used. Other settings such as the
+// application protocols (NextProtos) are used as given. If config == nil, the
+// connection is not encrypted.
+//
+// If ctx has a deadline, it bounds both the connection and the handshake.
+func Dial(ctx context.Context, addr string, config *tls.Config, framing channel.Framing) (channel.Channel, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, jrpc2.Network(addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		if dl, ok := ctx.Deadline(); ok {
+			conn.SetDeadline(dl)
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				config.ServerName = host
+			}
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		conn = tc
+	}
+	if framing == nil {
+		framing = channel.RawJSON
+	}
+	return framing(conn, conn), nil
+}
+
+// ListenTLS listens for connections at the specified address, with the
+// network type chosen by jrpc2.Network. If config != nil, connections
+// accepted by the listener are secured with TLS using config. The result is
+// suitable for use with the Loop function.
+func ListenTLS(addr string, config *tls.Config) (net.Listener, error) {
+	lst, err := net.Listen(jrpc2.Network(addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		return tls.NewListener(lst, config), nil
+	}
+	return lst, nil
+}
+
+// A Listener accepts connections from a net.Listener and returns a channel
+// for each, using a fixed framing.
+type Listener struct {
+	lst     net.Listener
+	framing channel.Framing
+}
+
+// Listen listens for connections at the specified address as ListenTLS does,
+// and returns a Listener that wraps each accepted connection in a channel
+// with the given framing. If framing == nil, channel.RawJSON is used.
+//
+// If config != nil, the TLS handshake for each connection is performed when
+// it is first read or written, so a slow client does not block Accept.
+func Listen(addr string, config *tls.Config, framing channel.Framing) (*Listener, error) {
+	lst, err := ListenTLS(addr, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(lst, framing), nil
+}
+
+// NewListener returns a Listener that accepts connections from lst and wraps
+// them with the given framing. If framing == nil, channel.RawJSON is used.
+func NewListener(lst net.Listener, framing channel.Framing) *Listener {
+	if framing == nil {
+		framing = channel.RawJSON
+	}
+	return &Listener{lst: lst, framing: framing}
+}
+
+// Accept blocks until the next connection is available, and returns a
+// channel that communicates over it.
+func (l *Listener) Accept() (channel.Channel, error) {
+	conn, err := l.lst.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.framing(conn, conn), nil
+}
+
+// Addr returns the network address of the underlying listener.
+func (l *Listener) Addr() net.Addr { return l.lst.Addr() }
+
+// Close closes the underlying listener. Channels already returned by Accept
+// are not affected.
+func (l *Listener) Close() error { return l.lst.Close() }
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yinfei8/jrpc2"
+	"github.com/yinfei8/jrpc2/channel"
+	"github.com/yinfei8/jrpc2/handler"
+)
+
+// newTestTLS generates a self-signed certificate for 127.0.0.1, and returns
+// a server configuration using it and a client configuration trusting it.
+func newTestTLS(t *testing.T) (server, client *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "jrpc2 test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Creating certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Parsing certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client = &tls.Config{RootCAs: pool}
+	return
+}
+
+func TestDialTLS(t *testing.T) {
+	serverConfig, clientConfig := newTestTLS(t)
+	lst, err := ListenTLS("127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("ListenTLS: %v", err)
+	}
+	sc := mustServe(t, lst, testService)
+	addr := lst.Addr().String()
+	ctx := context.Background()
+
+	// A client that trusts the server certificate can call the service.
+	ch, err := Dial(ctx, addr, clientConfig, newChan)
+	if err != nil {
+		t.Fatalf("Dial %q: %v", addr, err)
+	}
+	cli := jrpc2.NewClient(ch, nil)
+	var rsp string
+	if err := cli.CallResult(ctx, "Test", nil, &rsp); err != nil {
+		t.Errorf("Test call: unexpected error: %v", err)
+	} else if rsp != "OK" {
+		t.Errorf("Test call: got %q, want OK", rsp)
+	}
+	cli.Close()
+
+	// A client that does not trust the certificate fails the handshake.
+	if ch, err := Dial(ctx, addr, &tls.Config{}, newChan); err == nil {
+		ch.Close()
+		t.Error("Dial with untrusted certificate: got nil, wanted error")
+	} else {
+		t.Logf("Dial with untrusted certificate: got expected error: %v", err)
+	}
+
+	lst.Close()
+	<-sc
+}
+
+func TestDialPlain(t *testing.T) {
+	lst, err := ListenTLS("127.0.0.1:0", nil)
+	if err != nil {
+		t.Fatalf("ListenTLS: %v", err)
+	}
+	sc := make(chan error, 1)
+	go func() { sc <- Loop(lst, testService, nil) }()
+
+	// With no framing specified, both sides default to RawJSON.
+	ctx := context.Background()
+	ch, err := Dial(ctx, lst.Addr().String(), nil, nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	cli := jrpc2.NewClient(ch, nil)
+	var rsp string
+	if err := cli.CallResult(ctx, "Test", nil, &rsp); err != nil {
+		t.Errorf("Test call: unexpected error: %v", err)
+	} else if rsp != "OK" {
+		t.Errorf("Test call: got %q, want OK", rsp)
+	}
+	cli.Close()
+	lst.Close()
+	if err := <-sc; err != nil {
+		t.Errorf("Loop: unexpected error: %v", err)
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jrpc2-test")
+	if err != nil {
+		t.Fatalf("Creating temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "socket")
+	if nw := jrpc2.Network(addr); nw != "unix" {
+		t.Fatalf("Network(%q): got %q, want unix", addr, nw)
+	}
+
+	lst, err := Listen(addr, nil, channel.Line)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer lst.Close()
+
+	// Serve a single connection from the listener.
+	done := make(chan error, 1)
+	go func() {
+		ch, err := lst.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- jrpc2.NewServer(handler.Map{
+			"Test": handler.New(func(context.Context) (string, error) {
+				return "OK", nil
+			}),
+		}, nil).Start(ch).Wait()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ch, err := Dial(ctx, addr, nil, channel.Line)
+	if err != nil {
+		t.Fatalf("Dial %q: %v", addr, err)
+	}
+	cli := jrpc2.NewClient(ch, nil)
+	var rsp string
+	if err := cli.CallResult(ctx, "Test", nil, &rsp); err != nil {
+		t.Errorf("Test call: unexpected error: %v", err)
+	} else if rsp != "OK" {
+		t.Errorf("Test call: got %q, want OK", rsp)
+	}
+	cli.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Server: unexpected error: %v", err)
+	}
+}
+
+func TestListenALPN(t *testing.T) {
+	serverConfig, clientConfig := newTestTLS(t)
+	serverConfig.NextProtos = []string{"jrpc2"}
+	lst, err := Listen("127.0.0.1:0", serverConfig, newChan)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	defer lst.Close()
+	go func() {
+		for {
+			ch, err := lst.Accept()
+			if err != nil {
+				return
+			}
+			// Force the handshake to occur, and discard the result.
+			go func() { ch.Recv(); ch.Close() }()
+		}
+	}()
+	addr := lst.Addr().String()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A client offering a matching protocol completes the handshake.
+	good := clientConfig.Clone()
+	good.NextProtos = []string{"other", "jrpc2"}
+	if ch, err := Dial(ctx, addr, good, newChan); err != nil {
+		t.Errorf("Dial with matching protocol: unexpected error: %v", err)
+	} else {
+		ch.Close()
+	}
+
+	// A client offering no matching protocol is rejected.
+	bad := clientConfig.Clone()
+	bad.NextProtos = []string{"other"}
+	if ch, err := Dial(ctx, addr, bad, newChan); err == nil {
+		ch.Close()
+		t.Error("Dial with mismatched protocol: got nil, wanted error")
+	} else {
+		t.Logf("Dial with mismatched protocol: got expected error: %v", err)
+	}
+}
@@ -3,7 +3,6 @@ package server
 
 import (
 	"net"
-	"sync"
 
 	"github.com/yinfei8/jrpc2"
 	"github.com/yinfei8/jrpc2/channel"
@@ -35,49 +34,16 @@ func NewStatic(assigner jrpc2.Assigner) func() Service {
 // reports an error, the loop will terminate and the error will be reported
 // once all the servers currently active have returned.
 //
+// Loop is equivalent to NewAcceptor(lst, newService, opts).Serve(). To stop
+// serving without abandoning the active connections, use an Acceptor.
+//
 // TODO: Add options to support sensible rate-limitation.
 func Loop(lst net.Listener, newService func() Service, opts *LoopOptions) error {
-	newChannel := opts.framing()
-	serverOpts := opts.serverOpts()
-	log := func(string, ...interface{}) {}
-	if serverOpts != nil && serverOpts.Logger != nil {
-		log = serverOpts.Logger.Printf
-	}
-
-	var wg sync.WaitGroup
-	for {
-		conn, err := lst.Accept()
-		if err != nil {
-			if channel.IsErrClosing(err) {
-				err = nil
-			} else {
-				log("Error accepting new connection: %v", err)
-			}
-			wg.Wait()
-			return err
-		}
-		ch := newChannel(conn, conn)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			svc := newService()
-			assigner, err := svc.Assigner()
-			if err != nil {
-				log("Service initialization failed: %v", err)
-				return
-			}
-			srv := jrpc2.NewServer(assigner, serverOpts).Start(ch)
-			stat := srv.WaitStatus()
-			svc.Finish(stat)
-			if stat.Err != nil {
-				log("Server exit: %v", stat.Err)
-			}
-		}()
-	}
+	return NewAcceptor(lst, newService, opts).Serve()
 }
 
-// LoopOptions control the behaviour of the Loop function.  A nil *LoopOptions
-// provides default values as described.
+// LoopOptions control the behaviour of the Loop function and of an Acceptor.
+// A nil *LoopOptions provides default values as described.
 type LoopOptions struct {
 	// If non-nil, this function is used to convert a stream connection to an
 	// RPC channel. If this field is nil, channel.RawJSON is used.
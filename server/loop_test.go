@@ -167,3 +167,191 @@ func TestLoop(t *testing.T) {
 		})
 	}
 }
+
+// Test that an Acceptor lets active requests finish when it shuts down, and
+// stops the servers that do not finish in time.
+func TestAcceptorShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	svc := NewStatic(handler.Map{
+		"Slow": handler.New(func(ctx context.Context) (string, error) {
+			started <- struct{}{}
+			select {
+			case <-release:
+				return "done", nil
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}),
+		"Quick": handler.New(func(context.Context) (string, error) {
+			return "quick", nil
+		}),
+	})
+	for _, allowPush := range []bool{false, true} {
+		name := map[bool]string{false: "Idle", true: "Push"}[allowPush]
+		t.Run(name, func(t *testing.T) {
+			lst := mustListen(t)
+			acc := NewAcceptor(lst, svc, &LoopOptions{
+				Framing:       newChan,
+				ServerOptions: &jrpc2.ServerOptions{AllowPush: allowPush},
+			})
+			served := make(chan error, 1)
+			go func() { served <- acc.Serve() }()
+
+			conn, err := net.Dial("tcp", lst.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			notified := make(chan struct{}, 1)
+			cli := jrpc2.NewClient(newChan(conn, conn), &jrpc2.ClientOptions{
+				OnNotify: func(req *jrpc2.Request) {
+					if req.Method() == "rpc.shutdown" {
+						notified <- struct{}{}
+					}
+				},
+			})
+			defer cli.Close()
+
+			result := make(chan string, 1)
+			go func() {
+				var rsp string
+				if err := cli.CallResult(context.Background(), "Slow", nil, &rsp); err != nil {
+					t.Errorf("Call(Slow): unexpected error: %v", err)
+				}
+				result <- rsp
+			}()
+			<-started
+
+			type shutdown struct {
+				n   int
+				err error
+			}
+			done := make(chan shutdown, 1)
+			go func() {
+				n, err := acc.Shutdown(context.Background())
+				done <- shutdown{n, err}
+			}()
+
+			// While the call is active, Shutdown waits, but stops accepting.
+			select {
+			case <-done:
+				t.Fatal("Shutdown returned while a call was in flight")
+			case <-time.After(50 * time.Millisecond):
+			}
+			if c, err := net.Dial("tcp", lst.Addr().String()); err == nil {
+				c.Close()
+				t.Error("Dial after Shutdown: unexpectedly succeeded")
+			}
+
+			release <- struct{}{}
+			if got := <-result; got != "done" {
+				t.Errorf("Call(Slow): got %q, want done", got)
+			}
+			if allowPush {
+				// The client is notified, but need not disconnect.
+				<-notified
+			}
+			if got := <-done; got.n != 0 || got.err != nil {
+				t.Errorf("Shutdown: got %d, %v; want 0, nil", got.n, got.err)
+			}
+			if err := <-served; err != nil {
+				t.Errorf("Serve: unexpected error: %v", err)
+			}
+		})
+	}
+
+	for _, allowPush := range []bool{false, true} {
+		name := map[bool]string{false: "Queued", true: "QueuedPush"}[allowPush]
+		t.Run(name, func(t *testing.T) {
+			// Requests received before Shutdown are answered, even if they
+			// are still waiting to run; a request sent after Shutdown begins
+			// is not read, and fails when the connection closes.
+			lst := mustListen(t)
+			acc := NewAcceptor(lst, svc, &LoopOptions{
+				Framing:       newChan,
+				ServerOptions: &jrpc2.ServerOptions{Concurrency: 1, AllowPush: allowPush},
+			})
+			served := make(chan error, 1)
+			go func() { served <- acc.Serve() }()
+
+			cli := mustDial(t, lst.Addr().String())
+			defer cli.Close()
+			ctx := context.Background()
+			slow := cli.CallAsync(ctx, "Slow", nil)
+			<-started
+			queued := cli.CallAsync(ctx, "Quick", nil)
+
+			// Wait for the server to receive the queued request.
+			var srv *jrpc2.Server
+			for srv == nil || len(srv.Inflight()) != 2 {
+				time.Sleep(time.Millisecond)
+				acc.mu.Lock()
+				for s := range acc.active {
+					srv = s
+				}
+				acc.mu.Unlock()
+			}
+
+			done := make(chan error, 1)
+			go func() { _, err := acc.Shutdown(ctx); done <- err }()
+			select {
+			case <-done:
+				t.Fatal("Shutdown returned while a call was in flight")
+			case <-time.After(50 * time.Millisecond):
+			}
+			late := cli.CallAsync(ctx, "Quick", nil)
+
+			release <- struct{}{}
+			if _, err := slow.Await(ctx); err != nil {
+				t.Errorf("Call(Slow): unexpected error: %v", err)
+			}
+			if _, err := queued.Await(ctx); err != nil {
+				t.Errorf("Call(Quick) before Shutdown: unexpected error: %v", err)
+			}
+			if _, err := late.Await(ctx); err == nil {
+				t.Error("Call(Quick) after Shutdown: got nil error, want the call to fail")
+			}
+			if err := <-done; err != nil {
+				t.Errorf("Shutdown: unexpected error: %v", err)
+			}
+			if err := <-served; err != nil {
+				t.Errorf("Serve: unexpected error: %v", err)
+			}
+		})
+	}
+
+	t.Run("Forced", func(t *testing.T) {
+		lst := mustListen(t)
+		acc := NewAcceptor(lst, svc, &LoopOptions{Framing: newChan})
+		served := make(chan error, 1)
+		go func() { served <- acc.Serve() }()
+
+		var clients []*jrpc2.Client
+		errs := make(chan error, 2)
+		for i := 0; i < 2; i++ {
+			cli := mustDial(t, lst.Addr().String())
+			defer cli.Close()
+			clients = append(clients, cli)
+			go func() {
+				_, err := cli.Call(context.Background(), "Slow", nil)
+				errs <- err
+			}()
+			<-started
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		n, err := acc.Shutdown(ctx)
+		if n != 2 || err != context.DeadlineExceeded {
+			t.Errorf("Shutdown: got %d, %v; want 2, %v", n, err, context.DeadlineExceeded)
+		}
+		for range clients {
+			if err := <-errs; err == nil {
+				t.Error("Call(Slow): got nil error, want the call to fail")
+			}
+		}
+		if err := <-served; err != nil {
+			t.Errorf("Serve: unexpected error: %v", err)
+		}
+	})
+}
@@ -3,13 +3,26 @@ package jrpc2
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"time"
 
 	"github.com/yinfei8/jrpc2/code"
 )
 
+// The names of the built-in methods, relative to the builtin prefix.
 const (
-	rpcServerInfo = "rpc.serverInfo"
-	rpcCancel     = "rpc.cancel"
+	serverInfoMethod = "serverInfo"
+	cancelMethod     = "cancel"
+	modulesMethod    = "modules"
+	shutdownMethod   = "shutdown" // pushed by the server, see Server.Shutdown
+)
+
+// defaultBuiltinPrefix is the builtin prefix used when none is configured.
+const defaultBuiltinPrefix = "rpc."
+
+const (
+	rpcServerInfo = defaultBuiltinPrefix + serverInfoMethod
+	rpcCancel     = defaultBuiltinPrefix + cancelMethod
 )
 
 // Handle the special rpc.cancel notification, that requests cancellation of a
@@ -18,29 +31,55 @@ func (s *Server) handleRPCCancel(ctx context.Context, req *Request) (interface{}
 	if !InboundRequest(ctx).IsNotification() {
 		return nil, code.MethodNotFound.Err()
 	}
-	var ids []json.RawMessage
-	if err := req.UnmarshalParams(&ids); err != nil {
+	var params []json.RawMessage
+	if err := req.UnmarshalParams(&params); err != nil {
 		return nil, err
 	}
-	s.cancelRequests(ids)
+
+	// An object among the IDs gives the reason for the cancellation.
+	var ids []json.RawMessage
+	var reason string
+	for _, p := range params {
+		var info cancelInfo
+		if len(p) != 0 && p[0] == '{' {
+			if json.Unmarshal(p, &info) == nil {
+				reason = info.Reason
+			}
+			continue
+		}
+		ids = append(ids, p)
+	}
+	s.cancelRequests(ids, reason)
 	return nil, nil
 }
 
-func (s *Server) cancelRequests(ids []json.RawMessage) {
+// cancelRequests cancels the requests with the specified IDs. If reason != "",
+// the cause of each cancellation is a *CancelError with that reason.
+func (s *Server) cancelRequests(ids []json.RawMessage, reason string) {
+	var cause error
+	if reason != "" {
+		cause = &CancelError{Reason: reason}
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	for _, raw := range ids {
 		id := string(raw)
-		if s.cancel(id) {
+		if !s.cancel(id, cause) {
+			continue
+		} else if reason != "" {
+			s.log("Cancelled request %s by client order: %s", id, reason)
+			s.metrics.SetLabel("rpc.lastCancelReason", reason)
+		} else {
 			s.log("Cancelled request %s by client order", id)
 		}
+		s.metrics.Count("rpc.cancelledByClient", 1)
 	}
 }
 
 // CancelRequest instructs s to cancel the pending or in-flight request with
 // the specified ID. If no request exists with that ID, this is a no-op.
 func (s *Server) CancelRequest(id string) {
-	s.cancelRequests([]json.RawMessage{json.RawMessage(id)})
+	s.cancelRequests([]json.RawMessage{json.RawMessage(id)}, "")
 }
 
 // methodFunc is a replication of handler.Func redeclared to avert a cycle.
@@ -55,9 +94,72 @@ func (s *Server) handleRPCServerInfo(context.Context, *Request) (interface{}, er
 	return s.ServerInfo(), nil
 }
 
-// RPCServerInfo calls the built-in rpc.serverInfo method exported by servers.
-// It is a convenience wrapper for an invocation of cli.CallResult.
+// A moduler is an optional interface for an Assigner whose methods are grouped
+// into namespaces, such as handler.ServiceMap. Modules returns the names of
+// the methods in each namespace, keyed by the namespace name.
+type moduler interface {
+	Modules() map[string][]string
+}
+
+// Handle the special rpc.modules method, that reports the methods of the
+// server grouped by namespace.
+func (s *Server) handleRPCModules(context.Context, *Request) (interface{}, error) {
+	return s.mux.(moduler).Modules(), nil
+}
+
+// RPCModules calls the built-in rpc.modules method (under the BuiltinPrefix
+// of cli) exported by servers whose assigner groups its methods into
+// namespaces. It reports the names of the methods in each namespace, keyed by
+// the namespace name. It is a convenience wrapper for an invocation of
+// cli.CallResult.
+func RPCModules(ctx context.Context, cli *Client) (result map[string][]string, err error) {
+	err = cli.CallResult(ctx, cli.mods, nil, &result)
+	return
+}
+
+// RPCServerInfo calls the built-in rpc.serverInfo method (under the
+// BuiltinPrefix of cli) exported by servers. It is a convenience wrapper for
+// an invocation of cli.CallResult.
 func RPCServerInfo(ctx context.Context, cli *Client) (result *ServerInfo, err error) {
-	err = cli.CallResult(ctx, rpcServerInfo, nil, &result)
+	err = cli.CallResult(ctx, cli.info, nil, &result)
 	return
 }
+
+// WaitReady waits until the server is ready to handle requests, by calling its
+// built-in rpc.serverInfo method (under the BuiltinPrefix of cli) until the
+// server answers. If the server reports an error with code.SystemError or
+// code.Overloaded, for example because its CheckRequest hook rejects requests
+// until it has finished starting up, WaitReady tries again after a delay,
+// which doubles after each attempt from 10ms up to 1s. Any other reply from
+// the server, including an error such as code.MethodNotFound from a server
+// whose built-in methods are disabled, shows that the server is ready. If the
+// call fails for another reason, for example because the client is closed,
+// WaitReady reports that error without trying again. If ctx ends before the
+// server is ready, WaitReady returns ctx.Err().
+func WaitReady(ctx context.Context, cli *Client) error {
+	const minDelay, maxDelay = 10 * time.Millisecond, time.Second
+	delay := minDelay
+	for {
+		_, err := cli.Call(ctx, cli.info, nil)
+		var e *Error
+		if err == nil {
+			return nil
+		} else if ctx.Err() != nil {
+			return ctx.Err()
+		} else if !errors.As(err, &e) {
+			return err
+		} else if c := e.Code(); c != code.SystemError && c != code.Overloaded {
+			return nil // the server answered
+		}
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		if delay *= 2; delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+}